@@ -10,7 +10,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	// IMPORTANT: import docs as a named package so we can override fields at runtime
 	_ "abasithdev.github.io/internal-cs-center-backend/docs"
@@ -19,6 +26,10 @@ import (
 	"github.com/joho/godotenv"
 )
 
+// shutdownTimeout is how long requests in flight and queued background work
+// get to finish once the server is asked to stop
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	_ = godotenv.Load() // loads .env if present
 
@@ -27,8 +38,25 @@ func main() {
 
 	log.Println("Starting server :" + appConfig.Port)
 
-	r := router.NewRouter()
-	if err := r.Run(":" + appConfig.Port); err != nil {
-		log.Fatal(err)
+	r, shutdown := router.NewRouter()
+	server := &http.Server{Addr: ":" + appConfig.Port, Handler: r}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	if err := shutdown(ctx); err != nil {
+		log.Printf("shutdown: background work left unfinished: %v", err)
 	}
 }
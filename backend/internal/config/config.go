@@ -3,15 +3,80 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"abasithdev.github.io/internal-cs-center-backend/internal/jwtkeys"
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	Port           string
-	JwtSecret      string
+	Port string
+	// JwtSecret signs tokens with HS256 unless JwtPrivateKeyFile is set
+	JwtSecret string
+	// JwtSecretID names JwtSecret in the kid header of its tokens
+	JwtSecretID string
+	// JwtPrivateKeyFile is a PEM RSA (RS256) or Ed25519 (EdDSA) private key
+	// that signs tokens in place of JwtSecret
+	JwtPrivateKeyFile string
+	// keys of earlier rotations, still accepted until their tokens expire.
+	// Key files may hold public keys.
+	JwtPreviousKeyFiles []string
+	JwtPreviousSecret   string
+	JwtPreviousSecretID string
+
 	AllowedOrigins []string
+	StorageDriver  string
+	SQLitePath     string
+
+	// MemoryDataDir turns on snapshot + log durability for the memory driver
+	MemoryDataDir          string
+	MemorySnapshotEvery    int
+	MemorySnapshotInterval time.Duration
+
+	// SeedEnabled loads SeedFixture, or the built-in demo fixture when it is
+	// empty, on boot. Turn it off in production.
+	SeedEnabled bool
+	SeedFixture string
+
+	// lifetimes of access and refresh tokens, zero keeps the AuthService defaults
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// PolicyFile maps roles to permissions, the built-in policy when empty
+	PolicyFile string
+
+	// TrustedProxies may set X-Forwarded-For, nobody when empty
+	TrustedProxies []string
+	// failed logins before an account is locked and for how long, zero keeps the defaults
+	LoginLockoutThreshold int
+	LoginLockoutDuration  time.Duration
+
+	// OpenID Connect single sign-on, off while OIDCIssuer is empty
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	// OIDCRedirectURL is the callback registered with the IdP
+	OIDCRedirectURL string
+	OIDCScopes      []string
+	OIDCGroupsClaim string
+	// OIDCRoleMapping maps IdP groups to roles, "group=role,group=role"
+	OIDCRoleMapping string
+	// OIDCFrontendURL is where the browser lands with its session after an SSO login
+	OIDCFrontendURL string
+	// PasswordLogin keeps /auth/login open, turn it off to allow SSO only
+	PasswordLogin bool
+
+	// OutboxDir receives notifications such as password reset links as files,
+	// password resets are off while it is empty
+	OutboxDir string
+	// PasswordResetURL is the frontend page reset links point to
+	PasswordResetURL string
+	// PasswordResetTTL is how long a reset link works, zero keeps the default
+	PasswordResetTTL time.Duration
+	// PasswordMinLength of new passwords, zero keeps the default
+	PasswordMinLength int
 }
 
 func Load() *Config {
@@ -36,15 +101,177 @@ func Load() *Config {
 		log.Println("⚠️  ALLOWED_ORIGINS not set, allowing all (*)")
 	}
 
+	privateKeyFile := os.Getenv("JWT_PRIVATE_KEY_FILE")
 	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		log.Println("⚠️  JWT_SECRET not set, using default")
-		secret = "changeme"
+	if secret == "" && privateKeyFile == "" {
+		log.Fatal("JWT_SECRET or JWT_PRIVATE_KEY_FILE must be set")
+	}
+
+	// a rotated secret needs an ID of its own, the key manager refuses two
+	// keys of the same ID
+	secretID := os.Getenv("JWT_SECRET_ID")
+	if secretID == "" {
+		secretID = jwtkeys.DefaultHMACKeyID
+	}
+	previousSecretID := os.Getenv("JWT_PREVIOUS_SECRET_ID")
+	if previousSecretID == "" {
+		previousSecretID = jwtkeys.DefaultHMACKeyID
+	}
+
+	storageDriver := strings.ToLower(strings.TrimSpace(os.Getenv("STORAGE_DRIVER")))
+	switch storageDriver {
+	case "":
+		storageDriver = "memory"
+	case "memory", "sqlite":
+	default:
+		log.Printf("⚠️  unknown STORAGE_DRIVER %q, using memory\n", storageDriver)
+		storageDriver = "memory"
+	}
+
+	sqlitePath := os.Getenv("SQLITE_PATH")
+	if sqlitePath == "" {
+		sqlitePath = "data/cs-center.db"
+	}
+
+	snapshotEvery := 0
+	if raw := os.Getenv("MEMORY_SNAPSHOT_EVERY"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			snapshotEvery = n
+		} else {
+			log.Printf("⚠️  invalid MEMORY_SNAPSHOT_EVERY %q, using default\n", raw)
+		}
+	}
+
+	var snapshotInterval time.Duration
+	if raw := os.Getenv("MEMORY_SNAPSHOT_INTERVAL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			snapshotInterval = d
+		} else {
+			log.Printf("⚠️  invalid MEMORY_SNAPSHOT_INTERVAL %q, periodic snapshots disabled\n", raw)
+		}
+	}
+
+	seedEnabled := true
+	if raw := os.Getenv("SEED_ENABLED"); raw != "" {
+		if enabled, err := strconv.ParseBool(raw); err == nil {
+			seedEnabled = enabled
+		} else {
+			log.Printf("⚠️  invalid SEED_ENABLED %q, seeding stays enabled\n", raw)
+		}
+	}
+
+	var previousKeyFiles []string
+	for _, path := range strings.Split(os.Getenv("JWT_PREVIOUS_KEY_FILES"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			previousKeyFiles = append(previousKeyFiles, path)
+		}
+	}
+
+	var trustedProxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+
+	lockoutThreshold := 0
+	if raw := os.Getenv("LOGIN_LOCKOUT_THRESHOLD"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			lockoutThreshold = n
+		} else {
+			log.Printf("⚠️  invalid LOGIN_LOCKOUT_THRESHOLD %q, using default\n", raw)
+		}
+	}
+
+	passwordLogin := true
+	if raw := os.Getenv("PASSWORD_LOGIN"); raw != "" {
+		if enabled, err := strconv.ParseBool(raw); err == nil {
+			passwordLogin = enabled
+		} else {
+			log.Printf("⚠️  invalid PASSWORD_LOGIN %q, password login stays enabled\n", raw)
+		}
+	}
+
+	passwordMinLength := 0
+	if raw := os.Getenv("PASSWORD_MIN_LENGTH"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			passwordMinLength = n
+		} else {
+			log.Printf("⚠️  invalid PASSWORD_MIN_LENGTH %q, using default\n", raw)
+		}
+	}
+
+	passwordResetURL := os.Getenv("PASSWORD_RESET_URL")
+	if passwordResetURL == "" {
+		passwordResetURL = "http://localhost:5173/reset-password"
+	}
+
+	oidcFrontendURL := os.Getenv("OIDC_FRONTEND_URL")
+	if oidcFrontendURL == "" {
+		oidcFrontendURL = "http://localhost:5173/sso"
 	}
 
+	accessTokenTTL := parseDuration("ACCESS_TOKEN_TTL")
+	refreshTokenTTL := parseDuration("REFRESH_TOKEN_TTL")
+
 	return &Config{
-		Port:           port,
-		JwtSecret:      secret,
-		AllowedOrigins: origins,
+		Port:                port,
+		JwtSecret:           secret,
+		JwtPrivateKeyFile:   privateKeyFile,
+		JwtPreviousKeyFiles: previousKeyFiles,
+		JwtSecretID:         secretID,
+		JwtPreviousSecret:   os.Getenv("JWT_PREVIOUS_SECRET"),
+		JwtPreviousSecretID: previousSecretID,
+		AllowedOrigins:      origins,
+		StorageDriver:       storageDriver,
+		SQLitePath:          sqlitePath,
+
+		MemoryDataDir:          os.Getenv("MEMORY_DATA_DIR"),
+		MemorySnapshotEvery:    snapshotEvery,
+		MemorySnapshotInterval: snapshotInterval,
+
+		SeedEnabled: seedEnabled,
+		SeedFixture: os.Getenv("SEED_FIXTURE"),
+
+		AccessTokenTTL:  accessTokenTTL,
+		RefreshTokenTTL: refreshTokenTTL,
+
+		PolicyFile: os.Getenv("POLICY_FILE"),
+
+		TrustedProxies:        trustedProxies,
+		LoginLockoutThreshold: lockoutThreshold,
+		LoginLockoutDuration:  parseDuration("LOGIN_LOCKOUT_DURATION"),
+
+		OIDCIssuer:       os.Getenv("OIDC_ISSUER"),
+		OIDCClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		OIDCClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		OIDCRedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		OIDCScopes: strings.FieldsFunc(os.Getenv("OIDC_SCOPES"), func(r rune) bool {
+			return r == ',' || r == ' '
+		}),
+		OIDCGroupsClaim: os.Getenv("OIDC_GROUPS_CLAIM"),
+		OIDCRoleMapping: os.Getenv("OIDC_ROLE_MAPPING"),
+		OIDCFrontendURL: oidcFrontendURL,
+		PasswordLogin:   passwordLogin,
+
+		OutboxDir:         os.Getenv("OUTBOX_DIR"),
+		PasswordResetURL:  passwordResetURL,
+		PasswordResetTTL:  parseDuration("PASSWORD_RESET_TTL"),
+		PasswordMinLength: passwordMinLength,
+	}
+}
+
+// parseDuration reads a positive duration such as "15m" from the environment
+func parseDuration(name string) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Printf("⚠️  invalid %s %q, using default\n", name, raw)
+		return 0
 	}
+	return d
 }
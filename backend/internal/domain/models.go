@@ -1,11 +1,141 @@
 package domain
 
-import "time"
+import (
+	"slices"
+	"time"
+)
 
 type User struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Role     string `json:"role"`
+	Email string `json:"email"`
+	// PasswordHash is a password.Hash value, or the plaintext of a legacy
+	// user until their next login. It is never serialised.
+	PasswordHash string `json:"-"`
+	Role         string `json:"role"`
+	// Disabled users can neither log in nor use tokens issued before
+	Disabled bool `json:"disabled"`
+	// MFAEnabled is set once a TOTP enrolment is confirmed, logins then
+	// need a code as well
+	MFAEnabled bool `json:"mfa_enabled"`
+	// TOTPSecret is the base32 TOTP secret, pending until MFAEnabled is set
+	TOTPSecret string `json:"-"`
+	// TOTPLastStep is the time step of the last accepted code, a code is
+	// only accepted once
+	TOTPLastStep int64 `json:"-"`
+	// RecoveryCodes are the SHA-256 hashes of the unused recovery codes
+	RecoveryCodes []string `json:"-"`
+	// MustChangePassword is set by an admin, the next password login has to
+	// choose a new password before it gets tokens
+	MustChangePassword bool `json:"must_change_password"`
+	// Merchants and MerchantGroups limit the payments the user sees to those
+	// of these merchants, groups are defined in the policy. Users with
+	// neither see no payments unless AllMerchants is set.
+	Merchants      []string `json:"merchants,omitempty"`
+	MerchantGroups []string `json:"merchant_groups,omitempty"`
+	// AllMerchants lets the user see every merchant, admins always do
+	AllMerchants bool `json:"all_merchants"`
+}
+
+const (
+	RoleCS          = "cs"
+	RoleOperational = "operational"
+	RoleAdmin       = "admin"
+)
+
+// Roles lists every known user role
+var Roles = []string{RoleCS, RoleOperational, RoleAdmin}
+
+func IsRole(role string) bool {
+	return slices.Contains(Roles, role)
+}
+
+// ServiceAccount is a non-human principal, such as a reconciliation job.
+// It authenticates with API keys only and acts with its role.
+type ServiceAccount struct {
+	// Name identifies the account in place of an email, it never contains "@"
+	Name        string    `json:"name"`
+	Role        string    `json:"role"`
+	Description string    `json:"description"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// APIKey is a credential of a service account. Like refresh tokens only the
+// SHA-256 of the key is kept, the key itself is handed out once.
+type APIKey struct {
+	// ID is the public part of the key, shown in listings to tell keys apart
+	ID      string `json:"id"`
+	Account string `json:"account"`
+	Hash    string `json:"-"`
+	// Scopes are the permissions the key may use, on top of the account role
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the key can still be used at now
+func (key *APIKey) Active(now time.Time) bool {
+	if key.RevokedAt != nil {
+		return false
+	}
+	return key.ExpiresAt == nil || now.Before(*key.ExpiresAt)
+}
+
+// RefreshToken is a stored refresh token. Only the SHA-256 of the opaque
+// token is kept, the token itself is handed to the client once.
+type RefreshToken struct {
+	Hash string `json:"hash"`
+	// Family is shared by every token rotated from the same login
+	Family    string    `json:"family"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// AMR are the authentication methods of the login, carried over to
+	// every access token of the session
+	AMR []string `json:"amr,omitempty"`
+	// Rotated is set once the token was exchanged, presenting it again is reuse
+	Rotated bool `json:"rotated"`
+	Revoked bool `json:"revoked"`
+}
+
+// Session is one login of a user on one device. Its ID is the family of its
+// refresh tokens and the sid claim of its access tokens.
+type Session struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	// UserAgent and IP are those of the client at its last login or refresh
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// ExpiresAt is the expiry of the latest refresh token
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PasswordReset is the pending password reset of a user. A user has at most
+// one, requesting another replaces it.
+type PasswordReset struct {
+	Email string `json:"email"`
+	// Hash is the SHA-256 of the token sent to the user
+	Hash      string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RevokedToken is a denylisted access token, kept until it expires anyway
+type RevokedToken struct {
+	JTI       string    `json:"jti"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LoginAttempts counts recent failed logins of one key, an account or a
+// client address
+type LoginAttempts struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	// LockedUntil is set once Failures reaches the lockout threshold
+	LockedUntil time.Time `json:"locked_until"`
 }
 
 type Payment struct {
@@ -15,4 +145,155 @@ type Payment struct {
 	Amount       float64   `json:"amount"`
 	Status       string    `json:"status"`
 	Reviewed     bool      `json:"reviewed"`
+	// Review is the conclusion of the last review, nil when unreviewed or
+	// reviewed before reviews were recorded
+	Review *PaymentReview `json:"review,omitempty"`
+	// Version is bumped by the store on every write, updates carrying an older one are rejected
+	Version int64 `json:"version"`
+}
+
+const (
+	PaymentStatusCompleted         = "completed"
+	PaymentStatusProcessing        = "processing"
+	PaymentStatusFailed            = "failed"
+	PaymentStatusRefunded          = "refunded"
+	PaymentStatusPartiallyRefunded = "partially_refunded"
+	PaymentStatusDisputed          = "disputed"
+)
+
+// PaymentStatuses lists every known payment status
+var PaymentStatuses = []string{
+	PaymentStatusCompleted, PaymentStatusProcessing, PaymentStatusFailed,
+	PaymentStatusRefunded, PaymentStatusPartiallyRefunded, PaymentStatusDisputed,
+}
+
+func IsPaymentStatus(status string) bool {
+	return slices.Contains(PaymentStatuses, status)
+}
+
+// PaymentReview is who reviewed a payment, when and what they concluded
+type PaymentReview struct {
+	Reviewer string    `json:"reviewer"`
+	At       time.Time `json:"at"`
+	Outcome  string    `json:"outcome"`
+	Reason   string    `json:"reason,omitempty"`
+	Note     string    `json:"note,omitempty"`
+}
+
+const (
+	ReviewOutcomeApproved      = "approved"
+	ReviewOutcomeFlagged       = "flagged"
+	ReviewOutcomeNeedsFollowUp = "needs_follow_up"
+)
+
+// ReviewOutcomes lists every known review outcome
+var ReviewOutcomes = []string{ReviewOutcomeApproved, ReviewOutcomeFlagged, ReviewOutcomeNeedsFollowUp}
+
+func IsReviewOutcome(outcome string) bool {
+	return slices.Contains(ReviewOutcomes, outcome)
+}
+
+// PaymentEvent is an entry of the activity timeline of a payment
+type PaymentEvent struct {
+	ID        string `json:"id"`
+	PaymentID string `json:"payment_id"`
+	Type      string `json:"type"`
+	// Actor is the user or service account behind the event, empty for the system
+	Actor string    `json:"actor,omitempty"`
+	At    time.Time `json:"at"`
+	// From and To are the statuses of a status change
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Outcome is the outcome of a review, or of the review a revert undid
+	Outcome string `json:"outcome,omitempty"`
+	// Reason is the reason code of a status change or review
+	Reason string `json:"reason,omitempty"`
+	Note   string `json:"note,omitempty"`
+	// RefundID and Amount are the refund of a refund event, From and To its
+	// statuses
+	RefundID string  `json:"refund_id,omitempty"`
+	Amount   float64 `json:"amount,omitempty"`
+}
+
+const (
+	PaymentEventCreated        = "created"
+	PaymentEventStatusChanged  = "status_changed"
+	PaymentEventReviewed       = "reviewed"
+	PaymentEventReviewReverted = "review_reverted"
+	PaymentEventNote           = "note"
+	PaymentEventRefund         = "refund"
+)
+
+// Refund is money returned on a payment, in full or in part
+type Refund struct {
+	ID          string    `json:"id"`
+	PaymentID   string    `json:"payment_id"`
+	Amount      float64   `json:"amount"`
+	Status      string    `json:"status"`
+	Reason      string    `json:"reason"`
+	Note        string    `json:"note,omitempty"`
+	RequestedBy string    `json:"requested_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	// DecidedBy approved or rejected the refund
+	DecidedBy string     `json:"decided_by,omitempty"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+const (
+	RefundStatusRequested = "requested"
+	RefundStatusApproved  = "approved"
+	RefundStatusRejected  = "rejected"
+	RefundStatusProcessed = "processed"
+	RefundStatusFailed    = "failed"
+)
+
+// Pending reports whether the refund counts against the refundable amount of
+// its payment: it has not been rejected or failed
+func (refund *Refund) Pending() bool {
+	return refund.Status != RefundStatusRejected && refund.Status != RefundStatusFailed
+}
+
+const (
+	PaymentSortDate   = "date"
+	PaymentSortAmount = "amount"
+
+	SortAsc  = "asc"
+	SortDesc = "desc"
+)
+
+// PaymentQuery is a single list request answered by the store: filters, sort and page
+type PaymentQuery struct {
+	Status   string
+	Search   string // substring of the payment ID
+	Reviewed *bool
+	// ReviewOutcome and Reviewer match the last review, "" for any
+	ReviewOutcome string
+	Reviewer      string
+	SortBy        string // PaymentSortDate (default) or PaymentSortAmount, ties are broken by ID
+	Order         string // SortAsc or SortDesc (default)
+	Offset        int
+	Limit         int // items to return, <= 0 only counts
+	// Merchants limits the result to payments of these merchants, nil is
+	// every merchant and an empty list none
+	Merchants []string
+	// Cursor switches to keyset paging: Offset is ignored and the page starts
+	// right after (or, when Backward, ends right before) the cursor position
+	Cursor *PaymentCursor
+}
+
+// PaymentCursor is a position in a sort order: the sort key of a payment plus
+// its ID as tie-breaker. Only the key of the active sort field is used.
+type PaymentCursor struct {
+	Date     time.Time
+	Amount   float64
+	ID       string
+	Backward bool
+}
+
+type PaymentPage struct {
+	Total int // matches before paging
+	Items []*Payment
+	// HasMore is set in cursor mode when more matches lie beyond the page in the direction of travel
+	HasMore bool
 }
@@ -0,0 +1,150 @@
+package domain
+
+import "time"
+
+// PaymentRepository is the storage contract PaymentService depends on.
+// Payments handed out are copies, changing one has no effect until it is
+// written back.
+type PaymentRepository interface {
+	GetPaymentList() []*Payment
+	GetPaymentById(id string) (*Payment, bool)
+	CreatePayment(payment *Payment) error
+	// UpdatePayment upserts the payment. An existing payment is only replaced
+	// when payment.Version matches the stored one, otherwise a ConflictError is
+	// returned. On success payment.Version is set to the new version.
+	UpdatePayment(payment *Payment) error
+	DeletePayment(id string) error
+	QueryPayments(query PaymentQuery) PaymentPage
+	// CountPaymentsByStatus counts the payments of merchants, nil counts
+	// every merchant like in PaymentQuery
+	CountPaymentsByStatus(merchants []string) map[string]int
+	// ListPaymentEvents returns the timeline of a payment, oldest first.
+	// Events are written through Tx and go away with their payment.
+	ListPaymentEvents(paymentID string) []*PaymentEvent
+	// ListRefunds returns the refunds of a payment, oldest first. Refunds
+	// are written through Tx and go away with their payment.
+	ListRefunds(paymentID string) []*Refund
+	Transactor
+}
+
+// UserRepository is the storage contract of users.
+type UserRepository interface {
+	// ListUsers returns every user ordered by email
+	ListUsers() []*User
+	GetUserByEmail(email string) (*User, bool)
+	CreateUser(user *User) error
+	// UpdateUser replaces an existing user, a missing one is a NotFoundError
+	UpdateUser(user *User) error
+	DeleteUser(email string) error
+	Transactor
+}
+
+// TokenRepository is the storage contract of refresh tokens and the access
+// token denylist. Tokens are written through Tx.
+type TokenRepository interface {
+	IsTokenRevoked(jti string) bool
+	// PurgeExpiredTokens drops refresh tokens, sessions, password resets and
+	// denylist entries that expired before now, they can no longer be
+	// presented anyway
+	PurgeExpiredTokens(now time.Time) error
+	GetSession(id string) (*Session, bool)
+	// ListSessions returns the sessions of a user, most recently seen first
+	ListSessions(email string) []*Session
+	Transactor
+}
+
+// LoginAttemptRepository is the storage contract of failed login tracking.
+// Attempts are written through Tx.
+type LoginAttemptRepository interface {
+	// PurgeLoginAttempts drops attempts whose last failure and lockout both
+	// ended before the given time
+	PurgeLoginAttempts(before time.Time) error
+	Transactor
+}
+
+// ServiceAccountRepository is the storage contract of service accounts and
+// their API keys. Writes go through Tx.
+type ServiceAccountRepository interface {
+	// ListServiceAccounts returns every account ordered by name
+	ListServiceAccounts() []*ServiceAccount
+	GetServiceAccount(name string) (*ServiceAccount, bool)
+	// ListAPIKeys returns the keys of the account, oldest first
+	ListAPIKeys(account string) []*APIKey
+	GetAPIKey(id string) (*APIKey, bool)
+	Transactor
+}
+
+// AuthRepository is the storage contract AuthService depends on.
+type AuthRepository interface {
+	UserRepository
+	TokenRepository
+	LoginAttemptRepository
+	ServiceAccountRepository
+}
+
+// Transactor runs read-modify-write sequences atomically.
+type Transactor interface {
+	// Update runs fn against a consistent view of the store. Writes made
+	// through tx become visible together when fn returns nil and are
+	// discarded when it returns an error, which Update then returns.
+	Update(fn func(tx Tx) error) error
+}
+
+// Tx is the view of the store inside Update. It follows the same rules as
+// the repositories: values are copies and UpdatePayment checks the version.
+type Tx interface {
+	GetPaymentById(id string) (*Payment, bool)
+	CreatePayment(payment *Payment) error
+	UpdatePayment(payment *Payment) error
+	DeletePayment(id string) error
+	// AddPaymentEvent appends to the timeline of event.PaymentID, which has
+	// to exist
+	AddPaymentEvent(event *PaymentEvent) error
+	GetRefund(id string) (*Refund, bool)
+	ListRefunds(paymentID string) []*Refund
+	// PutRefund creates or replaces the refund stored under refund.ID, its
+	// payment has to exist
+	PutRefund(refund *Refund) error
+
+	GetUserByEmail(email string) (*User, bool)
+	CreateUser(user *User) error
+	UpdateUser(user *User) error
+	DeleteUser(email string) error
+
+	GetRefreshToken(hash string) (*RefreshToken, bool)
+	// PutRefreshToken creates or replaces the token stored under token.Hash
+	PutRefreshToken(token *RefreshToken) error
+	// RevokeRefreshTokens revokes every token of the family
+	RevokeRefreshTokens(family string) error
+	// RevokeUserRefreshTokens revokes every token of the user, whatever its
+	// family
+	RevokeUserRefreshTokens(email string) error
+	RevokeToken(token *RevokedToken) error
+
+	GetSession(id string) (*Session, bool)
+	// PutSession creates or replaces the session stored under session.ID
+	PutSession(session *Session) error
+	// DeleteSession forgets the session, a missing one is not an error
+	DeleteSession(id string) error
+	// DeleteUserSessions forgets every session of the user
+	DeleteUserSessions(email string) error
+
+	GetPasswordReset(email string) (*PasswordReset, bool)
+	// PutPasswordReset creates or replaces the reset of reset.Email
+	PutPasswordReset(reset *PasswordReset) error
+	// DeletePasswordReset forgets the reset, a missing one is not an error
+	DeletePasswordReset(email string) error
+
+	GetLoginAttempts(key string) (*LoginAttempts, bool)
+	PutLoginAttempts(attempts *LoginAttempts) error
+	// DeleteLoginAttempts forgets the key, a missing one is not an error
+	DeleteLoginAttempts(key string) error
+
+	GetServiceAccount(name string) (*ServiceAccount, bool)
+	CreateServiceAccount(account *ServiceAccount) error
+	// DeleteServiceAccount removes the account together with its keys
+	DeleteServiceAccount(name string) error
+	GetAPIKey(id string) (*APIKey, bool)
+	// PutAPIKey creates or replaces the key stored under key.ID
+	PutAPIKey(key *APIKey) error
+}
@@ -0,0 +1,16 @@
+package errors
+
+type AlreadyExistsError struct {
+	Msg string
+}
+
+func NewAlreadyExistsError(msg string) *AlreadyExistsError {
+	return &AlreadyExistsError{Msg: msg}
+}
+
+func (existsErr *AlreadyExistsError) Error() string {
+	if existsErr.Msg != "" {
+		return "Data already exists" + existsErr.Msg
+	}
+	return "Data already exists"
+}
@@ -0,0 +1,33 @@
+package errors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlreadyExistsError(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		wantErr string
+	}{
+		{
+			name:    "empty message",
+			msg:     "",
+			wantErr: "Data already exists",
+		},
+		{
+			name:    "with message",
+			msg:     ": paymentId: 123",
+			wantErr: "Data already exists: paymentId: 123",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewAlreadyExistsError(tt.msg)
+			require.Equal(t, tt.wantErr, err.Error())
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package errors
+
+type ConflictError struct {
+	Msg string
+}
+
+func NewConflictError(msg string) *ConflictError {
+	return &ConflictError{Msg: msg}
+}
+
+func (conflictErr *ConflictError) Error() string {
+	if conflictErr.Msg != "" {
+		return "Data was modified concurrently" + conflictErr.Msg
+	}
+	return "Data was modified concurrently"
+}
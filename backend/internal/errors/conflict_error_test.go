@@ -0,0 +1,33 @@
+package errors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflictError(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		wantErr string
+	}{
+		{
+			name:    "empty message",
+			msg:     "",
+			wantErr: "Data was modified concurrently",
+		},
+		{
+			name:    "with message",
+			msg:     ": paymentId: 123",
+			wantErr: "Data was modified concurrently: paymentId: 123",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewConflictError(tt.msg)
+			require.Equal(t, tt.wantErr, err.Error())
+		})
+	}
+}
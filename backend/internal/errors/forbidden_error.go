@@ -0,0 +1,16 @@
+package errors
+
+type ForbiddenError struct {
+	Msg string
+}
+
+func NewForbiddenError(msg string) *ForbiddenError {
+	return &ForbiddenError{Msg: msg}
+}
+
+func (forbiddenErr *ForbiddenError) Error() string {
+	if forbiddenErr.Msg != "" {
+		return "Not allowed" + forbiddenErr.Msg
+	}
+	return "Not allowed"
+}
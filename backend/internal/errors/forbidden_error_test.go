@@ -0,0 +1,33 @@
+package errors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForbiddenError(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		wantErr string
+	}{
+		{
+			name:    "empty message",
+			msg:     "",
+			wantErr: "Not allowed",
+		},
+		{
+			name:    "with message",
+			msg:     ": role cs",
+			wantErr: "Not allowed: role cs",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewForbiddenError(tt.msg)
+			require.Equal(t, tt.wantErr, err.Error())
+		})
+	}
+}
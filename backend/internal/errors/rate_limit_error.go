@@ -0,0 +1,20 @@
+package errors
+
+import "time"
+
+type RateLimitError struct {
+	Msg string
+	// RetryAfter is how long the caller has to wait before trying again
+	RetryAfter time.Duration
+}
+
+func NewRateLimitError(msg string, retryAfter time.Duration) *RateLimitError {
+	return &RateLimitError{Msg: msg, RetryAfter: retryAfter}
+}
+
+func (rateLimitErr *RateLimitError) Error() string {
+	if rateLimitErr.Msg != "" {
+		return "Too many attempts" + rateLimitErr.Msg
+	}
+	return "Too many attempts"
+}
@@ -0,0 +1,35 @@
+package errors
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitError(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		wantErr string
+	}{
+		{
+			name:    "empty message",
+			msg:     "",
+			wantErr: "Too many attempts",
+		},
+		{
+			name:    "with message",
+			msg:     ", try again later",
+			wantErr: "Too many attempts, try again later",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewRateLimitError(tt.msg, time.Minute)
+			require.Equal(t, tt.wantErr, err.Error())
+			require.Equal(t, time.Minute, err.RetryAfter)
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package errors
+
+type TransitionError struct {
+	Msg string
+}
+
+func NewTransitionError(msg string) *TransitionError {
+	return &TransitionError{Msg: msg}
+}
+
+func (transitionErr *TransitionError) Error() string {
+	if transitionErr.Msg != "" {
+		return "Status transition not allowed" + transitionErr.Msg
+	}
+	return "Status transition not allowed"
+}
@@ -0,0 +1,33 @@
+package errors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransitionError(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		wantErr string
+	}{
+		{
+			name:    "empty message",
+			msg:     "",
+			wantErr: "Status transition not allowed",
+		},
+		{
+			name:    "with message",
+			msg:     ": completed -> processing",
+			wantErr: "Status transition not allowed: completed -> processing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewTransitionError(tt.msg)
+			require.Equal(t, tt.wantErr, err.Error())
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package errors
+
+type ValidationError struct {
+	Msg string
+}
+
+func NewValidationError(msg string) *ValidationError {
+	return &ValidationError{Msg: msg}
+}
+
+func (validationErr *ValidationError) Error() string {
+	if validationErr.Msg != "" {
+		return "Invalid data" + validationErr.Msg
+	}
+	return "Invalid data"
+}
@@ -0,0 +1,33 @@
+package errors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidationError(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		wantErr string
+	}{
+		{
+			name:    "empty message",
+			msg:     "",
+			wantErr: "Invalid data",
+		},
+		{
+			name:    "with message",
+			msg:     ": cursor is malformed",
+			wantErr: "Invalid data: cursor is malformed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewValidationError(tt.msg)
+			require.Equal(t, tt.wantErr, err.Error())
+		})
+	}
+}
@@ -1,10 +1,17 @@
 package handler
 
 import (
+	common_errors "errors"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
 
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
 	"abasithdev.github.io/internal-cs-center-backend/internal/service"
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 type AuthHandler struct {
@@ -21,13 +28,55 @@ type loginRequest struct {
 }
 
 type loginResponse struct {
-	Token string `json:"token"`
-	Role  string `json:"role"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	// ExpiresIn is the lifetime of Token in seconds
+	ExpiresIn int    `json:"expires_in"`
+	Role      string `json:"role"`
+}
+
+// mfaChallengeResponse is the login response of users with MFA enabled
+type mfaChallengeResponse struct {
+	MFARequired bool `json:"mfa_required"`
+	// MFAToken is exchanged for the session at /auth/mfa/verify
+	MFAToken string `json:"mfa_token"`
+	// ExpiresIn is the lifetime of MFAToken in seconds
+	ExpiresIn int `json:"expires_in"`
+}
+
+// passwordChangeResponse is the login response of users who have to change
+// their password
+type passwordChangeResponse struct {
+	PasswordChangeRequired bool `json:"password_change_required"`
+	// PasswordChangeToken is exchanged for the session at /auth/password/change
+	PasswordChangeToken string `json:"password_change_token"`
+	// ExpiresIn is the lifetime of PasswordChangeToken in seconds
+	ExpiresIn int `json:"expires_in"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type logoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func newLoginResponse(pair *service.TokenPair, role string) loginResponse {
+	return loginResponse{
+		Token:        pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		ExpiresIn:    int(pair.ExpiresIn.Seconds()),
+		Role:         role,
+	}
 }
 
 // Login godoc
 // @Summary Login
-// @Description Authenticate and return JWT token
+// @Description Authenticate and return a short-lived JWT access token plus a refresh token.
+// @Description Repeated failures slow down and then lock the account and the client address for a while.
+// @Description Users with MFA enabled get an mfaChallengeResponse instead, to be completed at /auth/mfa/verify.
+// @Description Users who have to change their password get a passwordChangeResponse, to be completed at /auth/password/change.
 // @Tags auth
 // @Accept json
 // @Produce json
@@ -35,6 +84,7 @@ type loginResponse struct {
 // @Success 200 {object} loginResponse
 // @Failure 400 {object} map[string]string
 // @Failure 401 {object} map[string]string
+// @Failure 429 {object} map[string]string
 // @Router /auth/login [post]
 func (auth *AuthHandler) Login(context *gin.Context) {
 	var request loginRequest
@@ -44,18 +94,148 @@ func (auth *AuthHandler) Login(context *gin.Context) {
 		return
 	}
 
-	user, err := auth.auth.Authenticate(request.Email, request.Password)
+	user, err := auth.auth.Login(request.Email, request.Password, context.ClientIP())
+	if writeRateLimitError(context, err, "login attempts") {
+		return
+	}
 	if err != nil {
 		context.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credential"})
 		return
 	}
 
-	token, err := auth.auth.GenerateToken(user)
+	if user.MFAEnabled {
+		challenge, err := auth.auth.NewMFAChallenge(user)
+		if err != nil {
+			context.JSON(http.StatusUnauthorized, gin.H{"error": "Failed generate token"})
+			return
+		}
 
+		context.JSON(http.StatusOK, mfaChallengeResponse{
+			MFARequired: true,
+			MFAToken:    challenge.Token,
+			ExpiresIn:   int(challenge.ExpiresIn.Seconds()),
+		})
+		return
+	}
+
+	auth.completeLogin(context, user, []string{service.AMRPassword})
+}
+
+// completeLogin answers a login that passed every factor with its session.
+// Users who have to change their password get a passwordChangeResponse
+// instead, to be completed at /auth/password/change.
+func (auth *AuthHandler) completeLogin(context *gin.Context, user *domain.User, amr []string) {
+	if user.MustChangePassword {
+		challenge, err := auth.auth.NewPasswordChangeChallenge(user, amr)
+		if err != nil {
+			context.JSON(http.StatusUnauthorized, gin.H{"error": "Failed generate token"})
+			return
+		}
+
+		context.JSON(http.StatusOK, passwordChangeResponse{
+			PasswordChangeRequired: true,
+			PasswordChangeToken:    challenge.Token,
+			ExpiresIn:              int(challenge.ExpiresIn.Seconds()),
+		})
+		return
+	}
+
+	pair, err := auth.auth.IssueTokens(user, amr, clientInfo(context))
 	if err != nil {
 		context.JSON(http.StatusUnauthorized, gin.H{"error": "Failed generate token"})
 		return
 	}
 
-	context.JSON(http.StatusOK, loginResponse{Token: token, Role: user.Role})
+	context.JSON(http.StatusOK, newLoginResponse(pair, user.Role))
+}
+
+// Refresh godoc
+// @Summary Refresh tokens
+// @Description Exchange a refresh token for a new access and refresh token. Each refresh token works once, reusing one ends the session.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param body body refreshRequest true "refresh token"
+// @Success 200 {object} loginResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Router /auth/refresh [post]
+func (auth *AuthHandler) Refresh(context *gin.Context) {
+	var request refreshRequest
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	pair, user, err := auth.auth.Refresh(request.RefreshToken, clientInfo(context))
+	if err != nil {
+		context.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	context.JSON(http.StatusOK, newLoginResponse(pair, user.Role))
+}
+
+// Logout godoc
+// @Summary Logout
+// @Description Revoke the access token of the request and, when given, the session of the refresh token
+// @Tags auth
+// @Accept json
+// @Param Authorization header string true "Bearer token"
+// @Param body body logoutRequest false "refresh token"
+// @Success 204
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Router /auth/logout [post]
+func (auth *AuthHandler) Logout(context *gin.Context) {
+	var request logoutRequest
+
+	// the body is optional
+	if err := context.ShouldBindJSON(&request); err != nil && !common_errors.Is(err, io.EOF) {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, _ := context.Get("claims")
+	mapClaims, ok := claims.(jwt.MapClaims)
+	if !ok {
+		context.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+
+	if err := auth.auth.Logout(mapClaims, request.RefreshToken); err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to logout"})
+		return
+	}
+
+	context.Status(http.StatusNoContent)
+}
+
+// JWKS godoc
+// @Summary Token signing keys
+// @Description Public keys access tokens are verified with, as a JWK Set (RFC 7517), the current key first.
+// @Description Served at /.well-known/jwks.json outside the API base path. Empty while tokens are signed with HMAC.
+// @Tags auth
+// @Produce json
+// @Success 200 {object} jwtkeys.JWKS
+// @Router /.well-known/jwks.json [get]
+func (auth *AuthHandler) JWKS(context *gin.Context) {
+	// verifiers refetch on an unknown kid, so a short cache is enough
+	context.Header("Cache-Control", "public, max-age=300")
+	context.JSON(http.StatusOK, auth.auth.JWKS())
+}
+
+// writeRateLimitError answers a throttled login, MFA attempt or password reset
+// request with 429, naming what there were too many of, and reports whether
+// err was one. The answer is the same for every account, existing or not.
+func writeRateLimitError(context *gin.Context, err error, what string) bool {
+	var rateLimitErr *errors.RateLimitError
+	if !common_errors.As(err, &rateLimitErr) {
+		return false
+	}
+
+	context.Header("Retry-After", strconv.Itoa(int(math.Ceil(rateLimitErr.RetryAfter.Seconds()))))
+	context.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many " + what + ", try again later"})
+	return true
 }
@@ -2,25 +2,50 @@ package handler
 
 import (
 	"bytes"
+	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"abasithdev.github.io/internal-cs-center-backend/internal/jwtkeys"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
 	"abasithdev.github.io/internal-cs-center-backend/internal/service"
 	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
 )
 
 func setupAuthTest(t *testing.T) (*AuthHandler, *gin.Engine) {
 	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
 	authService := service.NewAuthService(store, []byte("donttellanyone"))
 	handler := NewAuthHandler(authService)
 
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
 	r.POST("/login", handler.Login)
+	r.POST("/refresh", handler.Refresh)
+	r.POST("/mfa/verify", handler.VerifyMFA)
+	// stands in for middleware.AuthMiddleware
+	authenticate := func(context *gin.Context) {
+		token := strings.TrimPrefix(context.GetHeader("Authorization"), "Bearer ")
+		claims, err := authService.ParseToken(token)
+		if err != nil {
+			context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		context.Set("claims", claims)
+		context.Set("email", claims["email"])
+	}
+	r.POST("/logout", authenticate, handler.Logout)
+	r.POST("/mfa/enroll", authenticate, handler.EnrollMFA)
+	r.POST("/mfa/confirm", authenticate, handler.ConfirmMFA)
+	r.POST("/mfa/disable", authenticate, handler.DisableMFA)
 
 	return handler, r
 }
@@ -114,6 +139,8 @@ func TestAuthHandler_Login(t *testing.T) {
 			require.NoError(t, err)
 			if tt.wantToken {
 				require.NotEmpty(t, resp.Token)
+				require.NotEmpty(t, resp.RefreshToken)
+				require.Equal(t, 900, resp.ExpiresIn)
 			}
 			if tt.wantRole != "" {
 				require.Equal(t, tt.wantRole, resp.Role)
@@ -121,3 +148,167 @@ func TestAuthHandler_Login(t *testing.T) {
 		})
 	}
 }
+
+func postJSON(r *gin.Engine, path, accessToken string, body any) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		b, _ := json.Marshal(body)
+		reader = bytes.NewReader(b)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func login(t *testing.T, r *gin.Engine) loginResponse {
+	w := postJSON(r, "/login", "", loginRequest{Email: "john-cs@durianpay.id", Password: "admin123"})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp loginResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestAuthHandler_Refresh(t *testing.T) {
+	_, r := setupAuthTest(t)
+	session := login(t, r)
+
+	w := postJSON(r, "/refresh", "", refreshRequest{RefreshToken: session.RefreshToken})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var refreshed loginResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refreshed))
+	require.NotEmpty(t, refreshed.Token)
+	require.NotEqual(t, session.RefreshToken, refreshed.RefreshToken)
+	require.Equal(t, "cs", refreshed.Role)
+	require.Equal(t, 900, refreshed.ExpiresIn)
+
+	tests := []struct {
+		name     string
+		body     any
+		wantCode int
+		errorMsg string
+	}{
+		{name: "reused token", body: refreshRequest{RefreshToken: session.RefreshToken}, wantCode: http.StatusUnauthorized, errorMsg: "Invalid refresh token"},
+		{name: "token of the revoked session", body: refreshRequest{RefreshToken: refreshed.RefreshToken}, wantCode: http.StatusUnauthorized, errorMsg: "Invalid refresh token"},
+		{name: "missing token", body: map[string]string{}, wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postJSON(r, "/refresh", "", tt.body)
+			require.Equal(t, tt.wantCode, w.Code)
+
+			var resp map[string]string
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			require.Contains(t, resp, "error")
+			if tt.errorMsg != "" {
+				require.Equal(t, tt.errorMsg, resp["error"])
+			}
+		})
+	}
+}
+
+func TestAuthHandler_Logout(t *testing.T) {
+	_, r := setupAuthTest(t)
+
+	// without a body only the access token is revoked
+	session := login(t, r)
+	w := postJSON(r, "/logout", session.Token, nil)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, http.StatusUnauthorized, postJSON(r, "/logout", session.Token, nil).Code)
+	require.Equal(t, http.StatusOK, postJSON(r, "/refresh", "", refreshRequest{RefreshToken: session.RefreshToken}).Code)
+
+	// with the refresh token the session ends as well
+	session = login(t, r)
+	w = postJSON(r, "/logout", session.Token, logoutRequest{RefreshToken: session.RefreshToken})
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, http.StatusUnauthorized, postJSON(r, "/refresh", "", refreshRequest{RefreshToken: session.RefreshToken}).Code)
+
+	// a malformed body is rejected before anything is revoked
+	session = login(t, r)
+	req := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader("{"))
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, http.StatusNoContent, postJSON(r, "/logout", session.Token, nil).Code)
+}
+
+func TestAuthHandler_LoginThrottled(t *testing.T) {
+	// a known and an unknown account get the same answers
+	for _, email := range []string{"john-cs@durianpay.id", "nobody@durianpay.id"} {
+		_, r := setupAuthTest(t)
+		for i := 0; i < 3; i++ {
+			w := postJSON(r, "/login", "", loginRequest{Email: email, Password: "wrong"})
+			require.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+
+		w := postJSON(r, "/login", "", loginRequest{Email: email, Password: "admin123"})
+		require.Equal(t, http.StatusTooManyRequests, w.Code, email)
+		require.Equal(t, "1", w.Header().Get("Retry-After"))
+		require.JSONEq(t, `{"error": "Too many login attempts, try again later"}`, w.Body.String())
+	}
+}
+
+func TestAuthHandler_JWKS(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	current, err := jwtkeys.Generate(jwtkeys.RS256)
+	require.NoError(t, err)
+	keys, err := jwtkeys.NewManager(current, jwtkeys.HMACKey(jwtkeys.DefaultHMACKeyID, []byte("donttellanyone")))
+	require.NoError(t, err)
+	authService := service.NewAuthServiceWithKeys(store, keys)
+	handler := NewAuthHandler(authService)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/login", handler.Login)
+	r.GET("/.well-known/jwks.json", handler.JWKS)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Header().Get("Cache-Control"), "max-age")
+
+	// the HMAC secret is never published
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &set))
+	require.Len(t, set.Keys, 1)
+	jwk := set.Keys[0]
+	require.Equal(t, "RSA", jwk["kty"])
+	require.Equal(t, "RS256", jwk["alg"])
+	require.Equal(t, current.ID, jwk["kid"])
+	require.NotContains(t, w.Body.String(), `"k"`)
+
+	// another service can verify a login token with nothing but the JWK Set
+	raw, _ := json.Marshal(loginRequest{Email: "john-cs@durianpay.id", Password: "admin123"})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(raw)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var login loginResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+
+	modulus, err := base64.RawURLEncoding.DecodeString(jwk["n"])
+	require.NoError(t, err)
+	exponent, err := base64.RawURLEncoding.DecodeString(jwk["e"])
+	require.NoError(t, err)
+	public := &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(new(big.Int).SetBytes(exponent).Int64())}
+
+	token, err := jwt.Parse(login.Token, func(token *jwt.Token) (any, error) {
+		require.Equal(t, jwk["kid"], token.Header["kid"])
+		return public, nil
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	require.NoError(t, err)
+	require.Equal(t, "john-cs@durianpay.id", token.Claims.(jwt.MapClaims)["email"])
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	common_errors "errors"
+	"net/http"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"github.com/gin-gonic/gin"
+)
+
+type verifyMFARequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	// Code is a TOTP code or a recovery code
+	Code string `json:"code" binding:"required"`
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type mfaEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	// ProvisioningURI is the otpauth:// URI to show as a QR code
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// VerifyMFA godoc
+// @Summary Verify MFA
+// @Description Complete a login of a user with MFA enabled: exchange the challenge token and a TOTP or recovery code for the session.
+// @Description Each challenge works once, repeated wrong codes lock the account for a while.
+// @Description Users who have to change their password get a passwordChangeResponse instead.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param body body verifyMFARequest true "challenge and code"
+// @Success 200 {object} loginResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 429 {object} map[string]string
+// @Router /auth/mfa/verify [post]
+func (auth *AuthHandler) VerifyMFA(context *gin.Context) {
+	var request verifyMFARequest
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, amr, err := auth.auth.VerifyMFA(request.MFAToken, request.Code)
+	if writeRateLimitError(context, err, "login attempts") {
+		return
+	}
+	if err != nil {
+		context.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid MFA code"})
+		return
+	}
+
+	auth.completeLogin(context, user, amr)
+}
+
+// EnrollMFA godoc
+// @Summary Enrol in MFA
+// @Description Start a TOTP enrolment of the current user. MFA is only enabled once a code of the new secret is confirmed.
+// @Tags auth
+// @Produce json
+// @Success 200 {object} mfaEnrollmentResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /auth/mfa/enroll [post]
+func (auth *AuthHandler) EnrollMFA(context *gin.Context) {
+	enrollment, err := auth.auth.EnrollMFA(context.GetString("email"))
+	if err != nil {
+		writeMFAError(context, err)
+		return
+	}
+
+	context.JSON(http.StatusOK, mfaEnrollmentResponse{Secret: enrollment.Secret, ProvisioningURI: enrollment.URI})
+}
+
+// ConfirmMFA godoc
+// @Summary Confirm MFA enrolment
+// @Description Enable MFA with a code of the enrolled secret. Returns recovery codes, they are shown this once.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param body body mfaCodeRequest true "TOTP code"
+// @Success 200 {object} recoveryCodesResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /auth/mfa/confirm [post]
+func (auth *AuthHandler) ConfirmMFA(context *gin.Context) {
+	var request mfaCodeRequest
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := auth.auth.ConfirmMFA(context.GetString("email"), request.Code)
+	if err != nil {
+		writeMFAError(context, err)
+		return
+	}
+
+	context.JSON(http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableMFA godoc
+// @Summary Disable MFA
+// @Description Turn MFA off for the current user, which takes a TOTP or recovery code
+// @Tags auth
+// @Accept json
+// @Param body body mfaCodeRequest true "TOTP or recovery code"
+// @Success 204
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 429 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /auth/mfa/disable [post]
+func (auth *AuthHandler) DisableMFA(context *gin.Context) {
+	var request mfaCodeRequest
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := auth.auth.DisableMFA(context.GetString("email"), request.Code); err != nil {
+		writeMFAError(context, err)
+		return
+	}
+
+	context.Status(http.StatusNoContent)
+}
+
+// writeMFAError maps service errors of MFA management to responses
+func writeMFAError(context *gin.Context, err error) {
+	if writeRateLimitError(context, err, "login attempts") {
+		return
+	}
+
+	var validationErr *errors.ValidationError
+	if common_errors.As(err, &validationErr) {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the user of a valid token was deleted in the meantime
+	var notFoundErr *errors.NotFoundError
+	if common_errors.As(err, &notFoundErr) {
+		context.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+
+	context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/totp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthHandler_MFA(t *testing.T) {
+	_, r := setupAuthTest(t)
+	session := login(t, r)
+
+	// enrol
+	w := postJSON(r, "/mfa/enroll", session.Token, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var enrollment mfaEnrollmentResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &enrollment))
+	require.NotEmpty(t, enrollment.Secret)
+	require.Contains(t, enrollment.ProvisioningURI, "otpauth://totp/")
+
+	w = postJSON(r, "/mfa/confirm", session.Token, mfaCodeRequest{Code: "000000"})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.JSONEq(t, `{"error": "Invalid data: invalid code"}`, w.Body.String())
+
+	code, err := totp.Code(enrollment.Secret, totp.Step(time.Now())-1)
+	require.NoError(t, err)
+	w = postJSON(r, "/mfa/confirm", session.Token, mfaCodeRequest{Code: code})
+	require.Equal(t, http.StatusOK, w.Code)
+	var recovery recoveryCodesResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &recovery))
+	require.Len(t, recovery.RecoveryCodes, 10)
+
+	// the password now only gets a challenge
+	w = postJSON(r, "/login", "", loginRequest{Email: "john-cs@durianpay.id", Password: "admin123"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var challenge mfaChallengeResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &challenge))
+	require.True(t, challenge.MFARequired)
+	require.Equal(t, 300, challenge.ExpiresIn)
+	require.NotContains(t, w.Body.String(), `"token"`)
+
+	// which is not an access token
+	require.Equal(t, http.StatusUnauthorized, postJSON(r, "/logout", challenge.MFAToken, nil).Code)
+
+	w = postJSON(r, "/mfa/verify", "", verifyMFARequest{MFAToken: challenge.MFAToken, Code: "000000"})
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.JSONEq(t, `{"error": "Invalid MFA code"}`, w.Body.String())
+
+	w = postJSON(r, "/mfa/verify", "", verifyMFARequest{MFAToken: challenge.MFAToken, Code: recovery.RecoveryCodes[0]})
+	require.Equal(t, http.StatusOK, w.Code)
+	var verified loginResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &verified))
+	require.NotEmpty(t, verified.Token)
+	require.NotEmpty(t, verified.RefreshToken)
+	require.Equal(t, "cs", verified.Role)
+
+	w = postJSON(r, "/mfa/verify", "", verifyMFARequest{MFAToken: challenge.MFAToken, Code: recovery.RecoveryCodes[1]})
+	require.Equal(t, http.StatusUnauthorized, w.Code, "challenges work once")
+
+	// enrolling twice or disabling without a code is refused
+	require.Equal(t, http.StatusBadRequest, postJSON(r, "/mfa/enroll", verified.Token, nil).Code)
+	require.Equal(t, http.StatusBadRequest, postJSON(r, "/mfa/disable", verified.Token, map[string]string{}).Code)
+
+	w = postJSON(r, "/mfa/disable", verified.Token, mfaCodeRequest{Code: recovery.RecoveryCodes[1]})
+	require.Equal(t, http.StatusNoContent, w.Code)
+	login(t, r)
+}
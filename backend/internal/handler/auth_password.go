@@ -0,0 +1,123 @@
+package handler
+
+import (
+	common_errors "errors"
+	"log"
+	"net/http"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"github.com/gin-gonic/gin"
+)
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type resetPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	// Token is the token of the reset link
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+type changePasswordRequest struct {
+	PasswordChangeToken string `json:"password_change_token" binding:"required"`
+	NewPassword         string `json:"new_password" binding:"required"`
+}
+
+// ForgotPassword godoc
+// @Summary Request password reset
+// @Description Send a single-use password reset link to the user. The answer is the same whether the account exists or not.
+// @Tags auth
+// @Accept json
+// @Param body body forgotPasswordRequest true "email"
+// @Success 202
+// @Failure 400 {object} map[string]string
+// @Failure 429 {object} map[string]string
+// @Router /auth/password/forgot [post]
+func (auth *AuthHandler) ForgotPassword(context *gin.Context) {
+	var request forgotPasswordRequest
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// throttling goes by the client address, it tells no accounts apart
+	err := auth.auth.RequestPasswordReset(context.Request.Context(), request.Email, context.ClientIP())
+	if writeRateLimitError(context, err, "password reset requests") {
+		return
+	}
+	// other failures are not reported, they would tell accounts apart
+	if err != nil {
+		log.Printf("auth: password reset of %s: %v", request.Email, err)
+	}
+
+	context.Status(http.StatusAccepted)
+}
+
+// ResetPassword godoc
+// @Summary Reset password
+// @Description Set a new password with the token of a reset link. Ends every session of the user and lifts a login lockout.
+// @Tags auth
+// @Accept json
+// @Param body body resetPasswordRequest true "reset token and new password"
+// @Success 204
+// @Failure 400 {object} map[string]string
+// @Router /auth/password/reset [post]
+func (auth *AuthHandler) ResetPassword(context *gin.Context) {
+	var request resetPasswordRequest
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := auth.auth.ResetPassword(request.Email, request.Token, request.NewPassword); err != nil {
+		writePasswordError(context, err, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	context.Status(http.StatusNoContent)
+}
+
+// ChangePassword godoc
+// @Summary Change required password
+// @Description Complete a login of a user who has to change their password: exchange the challenge token and a new password for the session.
+// @Description The new password has to differ from the current one. Each challenge works once.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param body body changePasswordRequest true "challenge and new password"
+// @Success 200 {object} loginResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Router /auth/password/change [post]
+func (auth *AuthHandler) ChangePassword(context *gin.Context) {
+	var request changePasswordRequest
+
+	if err := context.ShouldBindJSON(&request); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, amr, err := auth.auth.ChangeRequiredPassword(request.PasswordChangeToken, request.NewPassword)
+	if err != nil {
+		writePasswordError(context, err, http.StatusUnauthorized, "Invalid password change token")
+		return
+	}
+
+	auth.completeLogin(context, user, amr)
+}
+
+// writePasswordError answers a rejected new password with 400 and its
+// reason, any other err with status and message
+func writePasswordError(context *gin.Context, err error, status int, message string) {
+	var validationErr *errors.ValidationError
+	if common_errors.As(err, &validationErr) {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	context.JSON(status, gin.H{"error": message})
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/notify"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func setupPasswordTest(t *testing.T) (*gin.Engine, *service.UserService, *notify.Outbox) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	outbox, err := notify.NewOutbox(t.TempDir())
+	require.NoError(t, err)
+
+	authService := service.NewAuthService(store, []byte("donttellanyone"))
+	authService.SetPasswordReset(outbox, service.PasswordResetOptions{URL: "http://localhost:5173/reset-password"})
+	handler := NewAuthHandler(authService)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/login", handler.Login)
+	r.POST("/password/forgot", handler.ForgotPassword)
+	r.POST("/password/reset", handler.ResetPassword)
+	r.POST("/password/change", handler.ChangePassword)
+
+	return r, service.NewUserService(store), outbox
+}
+
+func TestAuthHandler_ResetPassword(t *testing.T) {
+	r, _, outbox := setupPasswordTest(t)
+
+	// unknown accounts get the same answer
+	require.Equal(t, http.StatusAccepted, postJSON(r, "/password/forgot", "", forgotPasswordRequest{Email: "nobody@durianpay.id"}).Code)
+	require.Equal(t, http.StatusAccepted, postJSON(r, "/password/forgot", "", forgotPasswordRequest{Email: "john-cs@durianpay.id"}).Code)
+	require.Equal(t, http.StatusBadRequest, postJSON(r, "/password/forgot", "", map[string]string{"email": "john"}).Code)
+
+	// the address is throttled after a few requests, for any account
+	require.Equal(t, http.StatusAccepted, postJSON(r, "/password/forgot", "", forgotPasswordRequest{Email: "nobody@durianpay.id"}).Code)
+	w := postJSON(r, "/password/forgot", "", forgotPasswordRequest{Email: "jane-operational@durianpay.id"})
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "1", w.Header().Get("Retry-After"))
+	require.JSONEq(t, `{"error": "Too many password reset requests, try again later"}`, w.Body.String())
+
+	// the link is sent in the background
+	var messages []notify.Message
+	require.Eventually(t, func() bool {
+		messages, _ = outbox.Messages()
+		return len(messages) == 1
+	}, time.Second, 10*time.Millisecond)
+	link, err := url.Parse(regexp.MustCompile(`https?://\S+`).FindString(messages[0].Body))
+	require.NoError(t, err)
+	token := link.Query().Get("token")
+
+	w = postJSON(r, "/password/reset", "", resetPasswordRequest{Email: "john-cs@durianpay.id", Token: token, NewPassword: "short"})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.JSONEq(t, `{"error": "Invalid data: password must be at least 10 characters"}`, w.Body.String())
+
+	w = postJSON(r, "/password/reset", "", resetPasswordRequest{Email: "john-cs@durianpay.id", Token: "wrong", NewPassword: "a-new-password"})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.JSONEq(t, `{"error": "Invalid data: invalid or expired password reset token"}`, w.Body.String())
+
+	w = postJSON(r, "/password/reset", "", resetPasswordRequest{Email: "john-cs@durianpay.id", Token: token, NewPassword: "a-new-password"})
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	require.Equal(t, http.StatusUnauthorized, postJSON(r, "/login", "", loginRequest{Email: "john-cs@durianpay.id", Password: "admin123"}).Code)
+	require.Equal(t, http.StatusOK, postJSON(r, "/login", "", loginRequest{Email: "john-cs@durianpay.id", Password: "a-new-password"}).Code)
+}
+
+func TestAuthHandler_ChangeRequiredPassword(t *testing.T) {
+	r, users, _ := setupPasswordTest(t)
+	flag := true
+	_, err := users.UpdateUser("admin@durianpay.id", "john-cs@durianpay.id", service.UpdateUserRequest{MustChangePassword: &flag})
+	require.NoError(t, err)
+
+	// the password only gets a challenge
+	w := postJSON(r, "/login", "", loginRequest{Email: "john-cs@durianpay.id", Password: "admin123"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var challenge passwordChangeResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &challenge))
+	require.True(t, challenge.PasswordChangeRequired)
+	require.Equal(t, 600, challenge.ExpiresIn)
+	require.NotContains(t, w.Body.String(), `"token"`)
+
+	w = postJSON(r, "/password/change", "", changePasswordRequest{PasswordChangeToken: challenge.PasswordChangeToken, NewPassword: "admin123"})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.JSONEq(t, `{"error": "Invalid data: the new password must differ from the current one"}`, w.Body.String())
+
+	w = postJSON(r, "/password/change", "", changePasswordRequest{PasswordChangeToken: "invalid", NewPassword: "a-new-password"})
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.JSONEq(t, `{"error": "Invalid password change token"}`, w.Body.String())
+
+	w = postJSON(r, "/password/change", "", changePasswordRequest{PasswordChangeToken: challenge.PasswordChangeToken, NewPassword: "a-new-password"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var session loginResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	require.NotEmpty(t, session.Token)
+	require.NotEmpty(t, session.RefreshToken)
+	require.Equal(t, "cs", session.Role)
+
+	w = postJSON(r, "/password/change", "", changePasswordRequest{PasswordChangeToken: challenge.PasswordChangeToken, NewPassword: "another-password"})
+	require.Equal(t, http.StatusUnauthorized, w.Code, "challenges work once")
+
+	// the next login is an ordinary one
+	w = postJSON(r, "/login", "", loginRequest{Email: "john-cs@durianpay.id", Password: "a-new-password"})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"token"`)
+}
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"github.com/gin-gonic/gin"
+)
+
+// paymentETag is the strong entity tag of a payment, derived from its version
+func paymentETag(payment *domain.Payment) string {
+	return strconv.Quote(strconv.FormatInt(payment.Version, 10))
+}
+
+func setPaymentETag(ctx *gin.Context, payment *domain.Payment) {
+	ctx.Header("ETag", paymentETag(payment))
+}
+
+// ifMatchVersion reads the If-Match precondition of a payment mutation.
+// It returns 0 when the header is absent or "*", meaning no precondition.
+func ifMatchVersion(ctx *gin.Context) (int64, error) {
+	raw := strings.TrimSpace(ctx.GetHeader("If-Match"))
+	if raw == "" || raw == "*" {
+		return 0, nil
+	}
+
+	if strings.Contains(raw, ",") {
+		return 0, errors.NewValidationError(": If-Match must hold a single ETag")
+	}
+
+	// weak tags carry the same version, the W/ prefix is tolerated
+	raw = strings.TrimPrefix(raw, "W/")
+	unquoted, err := strconv.Unquote(raw)
+	if err != nil {
+		return 0, errors.NewValidationError(fmt.Sprintf(": If-Match %s is not an ETag", raw))
+	}
+
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, errors.NewValidationError(fmt.Sprintf(": If-Match %s is not a payment ETag", raw))
+	}
+	return version, nil
+}
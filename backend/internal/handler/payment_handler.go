@@ -4,6 +4,7 @@ import (
 	common_errors "errors"
 	"net/http"
 
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
 	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
 	"abasithdev.github.io/internal-cs-center-backend/internal/service"
 	"abasithdev.github.io/internal-cs-center-backend/internal/utils"
@@ -14,20 +15,48 @@ type PaymentHandler struct {
 	paymentService *service.PaymentService
 }
 
+type paymentNoteRequest struct {
+	Note string `json:"note" binding:"required"`
+}
+
+type paymentReviewRequest struct {
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason"`
+	Note    string `json:"note"`
+}
+
+type paymentRevertReviewRequest struct {
+	Note string `json:"note" binding:"required"`
+}
+
+type paymentStatusRequest struct {
+	Status string `json:"status" binding:"required"`
+	Reason string `json:"reason" binding:"required"`
+	Note   string `json:"note"`
+}
+
 func NewPaymentHandler(payment *service.PaymentService) *PaymentHandler {
 	return &PaymentHandler{paymentService: payment}
 }
 
 // ListPayments godoc
 // @Summary List payments
-// @Description Get list of payments with filters
+// @Description Get list of payments with filters. Passing cursor (empty for the first page)
+// @Description switches to keyset pagination, follow meta.next_cursor / meta.prev_cursor from there.
+// @Description Users limited to some merchants only get, and count, the payments of those.
 // @Tags payments
 // @Accept json
 // @Produce json
 // @Param page query int false "page number" default(1)
+// @Param cursor query string false "opaque cursor from a previous page"
 // @Param size query int false "page size" default(10)
 // @Param status query string false "filter by status"
 // @Param search query string false "search term"
+// @Param reviewed query bool false "filter by reviewed state"
+// @Param outcome query string false "filter by the outcome of the last review"
+// @Param reviewer query string false "filter by the email of the last reviewer"
+// @Param sortBy query string false "date or amount" default(date)
+// @Param orderBy query string false "asc or desc" default(desc)
 // @Success 200 {object} map[string]interface{}
 // @Failure 400 {object} map[string]string
 // @Security ApiKeyAuth
@@ -39,67 +68,290 @@ func (paymentHandler *PaymentHandler) ListPayments(context *gin.Context) {
 	search := context.Query("search")
 	sortBy := context.DefaultQuery("sortBy", "date")
 	orderBy := context.DefaultQuery("orderBy", "desc")
+	reviewed, err := utils.QueryBool(context, "reviewed")
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "reviewed must be true or false"})
+		return
+	}
 
 	params := service.ListRequest{
-		Page:    page,
-		Size:    size,
-		Status:  status,
-		Search:  search,
-		SortBy:  sortBy,
-		OrderBy: orderBy,
+		Page:          page,
+		Size:          size,
+		Status:        status,
+		Search:        search,
+		Reviewed:      reviewed,
+		ReviewOutcome: context.Query("outcome"),
+		Reviewer:      context.Query("reviewer"),
+		SortBy:        sortBy,
+		OrderBy:       orderBy,
+		Scope:         merchantScope(context),
 	}
 
-	total := paymentHandler.paymentService.GetTotalByFilter(params)
-	result := paymentHandler.paymentService.GetList(params)
-	completed, process, failed := paymentHandler.paymentService.GetStatusSummary()
+	var result service.ListResult
+	if cursor, cursorMode := context.GetQuery("cursor"); cursorMode {
+		params.Cursor = cursor
+		result, err = paymentHandler.paymentService.GetCursorList(params)
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		result = paymentHandler.paymentService.GetList(params)
+	}
+	completed, process, failed := paymentHandler.paymentService.GetStatusSummary(params.Scope)
 
 	context.JSON(http.StatusOK, gin.H{
 		"meta": result,
 		"summary": gin.H{
-			"total":      total,
-			"completed":  completed,
-			"processing": process,
-			"failed":     failed,
+			"total":                        result.Total,
+			domain.PaymentStatusCompleted:  completed,
+			domain.PaymentStatusProcessing: process,
+			domain.PaymentStatusFailed:     failed,
 		},
 	})
 }
 
+// GetPayment godoc
+// @Summary Get payment
+// @Description Get a payment with its activity timeline, oldest event first: creation, status changes, reviews and notes
+// @Description with who and when. Payments outside the merchants of the user are not found.
+// @Tags payments
+// @Produce json
+// @Param id path string true "payment id"
+// @Success 200 {object} service.PaymentDetail
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /payments/{id} [get]
+func (paymentHandler *PaymentHandler) GetPayment(ctx *gin.Context) {
+	detail, err := paymentHandler.paymentService.GetPaymentDetail(ctx.Param("id"), merchantScope(ctx))
+	if err != nil {
+		writePaymentError(ctx, err)
+		return
+	}
+
+	setPaymentETag(ctx, detail.Payment)
+	ctx.JSON(http.StatusOK, detail)
+}
+
+// AddPaymentNote godoc
+// @Summary Add payment note
+// @Description Add a note to the timeline of a payment (payments:note permission required)
+// @Tags payments
+// @Accept json
+// @Produce json
+// @Param id path string true "payment id"
+// @Param body body paymentNoteRequest true "note"
+// @Success 201 {object} domain.PaymentEvent
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /payments/{id}/notes [post]
+func (paymentHandler *PaymentHandler) AddPaymentNote(ctx *gin.Context) {
+	var request paymentNoteRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	event, err := paymentHandler.paymentService.AddNote(ctx.Param("id"), ctx.GetString("email"), request.Note, merchantScope(ctx))
+	if err != nil {
+		writePaymentError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, event)
+}
+
 // ReviewPayment godoc
 // @Summary Review payment
-// @Description Review a payment (operational role required)
+// @Description Review a payment (payments:review permission required) with an outcome, reason code and note, all
+// @Description optional: no body approves it. Sending the conclusion it already has changes nothing. Send the payment
+// @Description ETag in If-Match to only review the version you have seen. Payments outside the merchants of the user
+// @Description are not found.
 // @Tags payments
 // @Accept json
 // @Produce json
 // @Param id path string true "payment id"
-// @Success 200 {object} map[string]string
+// @Param If-Match header string false "ETag of the payment version being reviewed"
+// @Param body body paymentReviewRequest false "outcome (approved, flagged or needs_follow_up), reason code and note"
+// @Success 200 {object} domain.Payment
 // @Failure 400 {object} map[string]string
 // @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
 // @Failure 404 {object} map[string]string
+// @Failure 412 {object} map[string]string
 // @Failure 500 {object} map[string]string
 // @Security ApiKeyAuth
 // @Router /payments/{id}/review [put]
 func (paymentHandler *PaymentHandler) ReviewPayment(ctx *gin.Context) {
-	role, _ := ctx.Get("role")
-
-	if role.(string) != "operational" {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Forbidden"})
-		return
-	}
-
 	id := ctx.Param("id")
 	if id == "" {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "id must not empty"})
 		return
 	}
 
-	if err := paymentHandler.paymentService.Review(id); err != nil {
-		var notFoundErr *errors.NotFoundError
-		if common_errors.As(err, &notFoundErr) {
-			ctx.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+	var request paymentReviewRequest
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		// for any other error, return internal server error
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+
+	ifMatch, err := ifMatchVersion(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	review := service.ReviewRequest{Outcome: request.Outcome, Reason: request.Reason, Note: request.Note}
+	payment, err := paymentHandler.paymentService.Review(id, ctx.GetString("email"), review, ifMatch, merchantScope(ctx))
+	if err != nil {
+		writePaymentError(ctx, err)
 		return
 	}
+
+	setPaymentETag(ctx, payment)
+	ctx.JSON(http.StatusOK, payment)
+}
+
+// RevertPaymentReview godoc
+// @Summary Revert payment review
+// @Description Mark a reviewed payment unreviewed again (payments:review permission required), the note saying why
+// @Description is kept on its timeline. Reverting an unreviewed payment changes nothing. If-Match is as for review.
+// @Tags payments
+// @Accept json
+// @Produce json
+// @Param id path string true "payment id"
+// @Param If-Match header string false "ETag of the payment version being reverted"
+// @Param body body paymentRevertReviewRequest true "why the review is reverted"
+// @Success 200 {object} domain.Payment
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 412 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /payments/{id}/review/revert [post]
+func (paymentHandler *PaymentHandler) RevertPaymentReview(ctx *gin.Context) {
+	var request paymentRevertReviewRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payment, err := paymentHandler.paymentService.RevertReview(ctx.Param("id"), ctx.GetString("email"), request.Note, ifMatch, merchantScope(ctx))
+	if err != nil {
+		writePaymentError(ctx, err)
+		return
+	}
+
+	setPaymentETag(ctx, payment)
+	ctx.JSON(http.StatusOK, payment)
+}
+
+// TransitionPayment godoc
+// @Summary Change payment status
+// @Description Move a payment to another status of its lifecycle with a reason code (payments:status permission
+// @Description required). The transitions the user may make, with their reason codes, are listed by GET /payments/{id}.
+// @Description Send the payment ETag in If-Match to only change the version you have seen.
+// @Tags payments
+// @Accept json
+// @Produce json
+// @Param id path string true "payment id"
+// @Param If-Match header string false "ETag of the payment version being changed"
+// @Param body body paymentStatusRequest true "new status, reason code and optional note"
+// @Success 200 {object} domain.Payment
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 412 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /payments/{id}/status [put]
+func (paymentHandler *PaymentHandler) TransitionPayment(ctx *gin.Context) {
+	var request paymentStatusRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ifMatch, err := ifMatchVersion(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	change := service.StatusChange{To: request.Status, Reason: request.Reason, Note: request.Note}
+	payment, err := paymentHandler.paymentService.Transition(ctx.Param("id"), ctx.GetString("email"), change, ifMatch, merchantScope(ctx))
+	if err != nil {
+		writePaymentError(ctx, err)
+		return
+	}
+
+	setPaymentETag(ctx, payment)
+	ctx.JSON(http.StatusOK, payment)
+}
+
+// merchantScope is the scope of the authenticated caller, service accounts
+// are set to all merchants by the auth middleware
+func merchantScope(ctx *gin.Context) service.MerchantScope {
+	return service.MerchantScope{
+		Role:           ctx.GetString("role"),
+		Merchants:      ctx.GetStringSlice("merchants"),
+		MerchantGroups: ctx.GetStringSlice("merchant_groups"),
+		AllMerchants:   ctx.GetBool("all_merchants"),
+	}
+}
+
+// writePaymentError maps service errors of payment mutations to responses
+func writePaymentError(ctx *gin.Context, err error) {
+	if common_errors.Is(err, service.ErrRefundNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Refund not found"})
+		return
+	}
+
+	var notFoundErr *errors.NotFoundError
+	if common_errors.As(err, &notFoundErr) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+
+	var conflictErr *errors.ConflictError
+	if common_errors.As(err, &conflictErr) {
+		ctx.JSON(http.StatusPreconditionFailed, gin.H{"error": "Payment was modified, reload and retry"})
+		return
+	}
+
+	var transitionErr *errors.TransitionError
+	if common_errors.As(err, &transitionErr) {
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	var forbiddenErr *errors.ForbiddenError
+	if common_errors.As(err, &forbiddenErr) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	var validationErr *errors.ValidationError
+	if common_errors.As(err, &validationErr) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// for any other error, return internal server error
+	ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 }
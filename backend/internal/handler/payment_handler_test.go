@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,13 +18,13 @@ import (
 
 func setupPaymentTest(t *testing.T) (*PaymentHandler, *gin.Engine, *storage.MemoryStore) {
 	store := storage.NewMemoryStore()
-	store.ClearPayments() // Start with clean slate
 
 	paymentService := service.NewPaymentService(store)
 	handler := NewPaymentHandler(paymentService)
 
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
+	r.Use(allMerchants)
 	r.GET("/payments", handler.ListPayments)
 	r.PUT("/payments/:id/review", handler.ReviewPayment)
 
@@ -55,6 +56,11 @@ func setupPaymentTest(t *testing.T) (*PaymentHandler, *gin.Engine, *storage.Memo
 	return handler, r, store
 }
 
+// allMerchants is what AuthMiddleware sets for a user of every merchant
+func allMerchants(ctx *gin.Context) {
+	ctx.Set("all_merchants", true)
+}
+
 func TestPaymentHandler_ListPayments(t *testing.T) {
 	_, r, _ := setupPaymentTest(t)
 
@@ -134,33 +140,82 @@ func TestPaymentHandler_ListPayments(t *testing.T) {
 	}
 }
 
+func TestPaymentHandler_ListPaymentsWithCursor(t *testing.T) {
+	_, r, _ := setupPaymentTest(t)
+
+	get := func(url string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, resp
+	}
+
+	code, resp := get("/payments?cursor=&size=1")
+	require.Equal(t, http.StatusOK, code)
+	meta := resp["meta"].(map[string]interface{})
+	require.Len(t, meta["data"], 1)
+	require.Equal(t, "payment2", meta["data"].([]interface{})[0].(map[string]interface{})["id"])
+	next, ok := meta["next_cursor"].(string)
+	require.True(t, ok)
+	require.NotContains(t, meta, "prev_cursor")
+
+	code, resp = get("/payments?size=1&cursor=" + next)
+	require.Equal(t, http.StatusOK, code)
+	meta = resp["meta"].(map[string]interface{})
+	require.Equal(t, "payment1", meta["data"].([]interface{})[0].(map[string]interface{})["id"])
+	require.NotContains(t, meta, "next_cursor")
+	require.Contains(t, meta, "prev_cursor")
+
+	code, resp = get("/payments?cursor=bogus")
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Contains(t, resp, "error")
+}
+
 func TestPaymentHandler_ReviewPayment(t *testing.T) {
 	tests := []struct {
 		name      string
 		id        string
-		role      string
+		ifMatch   string
 		wantCode  int
 		wantError bool
 		errorMsg  string
+		wantETag  string
 	}{
 		{
-			name:      "unauthorized - cs role",
-			id:        "payment1",
-			role:      "cs",
-			wantCode:  http.StatusUnauthorized,
-			wantError: true,
-			errorMsg:  "Forbidden",
+			name:     "success",
+			id:       "payment1",
+			wantCode: http.StatusOK,
+			wantETag: `"2"`,
 		},
 		{
-			name:     "success - operational role",
+			name:     "success - matching If-Match",
 			id:       "payment1",
-			role:     "operational",
+			ifMatch:  `"1"`,
 			wantCode: http.StatusOK,
+			wantETag: `"2"`,
+		},
+		{
+			name:      "stale If-Match",
+			id:        "payment1",
+			ifMatch:   `"5"`,
+			wantCode:  http.StatusPreconditionFailed,
+			wantError: true,
+			errorMsg:  "Payment was modified, reload and retry",
+		},
+		{
+			name:      "malformed If-Match",
+			id:        "payment1",
+			ifMatch:   "v1",
+			wantCode:  http.StatusBadRequest,
+			wantError: true,
+			errorMsg:  "Invalid data: If-Match v1 is not an ETag",
 		},
 		{
 			name:      "not found",
 			id:        "nonexistent",
-			role:      "operational",
 			wantCode:  http.StatusNotFound,
 			wantError: true,
 			errorMsg:  "Payment not found",
@@ -168,7 +223,6 @@ func TestPaymentHandler_ReviewPayment(t *testing.T) {
 		{
 			name:      "empty id",
 			id:        "",
-			role:      "operational",
 			wantCode:  http.StatusBadRequest,
 			wantError: true,
 			errorMsg:  "id must not empty",
@@ -181,20 +235,22 @@ func TestPaymentHandler_ReviewPayment(t *testing.T) {
 			gin.SetMode(gin.TestMode)
 			r := gin.New()
 
-			// Set up router middleware
-			r.Use(func(c *gin.Context) {
-				c.Set("role", tt.role)
-			})
-
 			handler, _, _ := setupPaymentTest(t)
+			r.Use(allMerchants)
 			r.PUT("/payments/:id/review", handler.ReviewPayment)
 
 			url := fmt.Sprintf("/payments/%s/review", tt.id)
 			w := httptest.NewRecorder()
 			req := httptest.NewRequest(http.MethodPut, url, nil)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
 			r.ServeHTTP(w, req)
 
 			require.Equal(t, tt.wantCode, w.Code)
+			if tt.wantETag != "" {
+				require.Equal(t, tt.wantETag, w.Header().Get("ETag"))
+			}
 
 			if tt.wantError {
 				var resp map[string]string
@@ -206,3 +262,234 @@ func TestPaymentHandler_ReviewPayment(t *testing.T) {
 		})
 	}
 }
+
+func TestPaymentHandler_MerchantScope(t *testing.T) {
+	handler, _, _ := setupPaymentTest(t)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// what AuthMiddleware sets for a cs user limited to Merchant A
+	r.Use(func(ctx *gin.Context) {
+		ctx.Set("role", "cs")
+		ctx.Set("merchants", []string{"Merchant A"})
+		ctx.Set("merchant_groups", []string(nil))
+	})
+	r.GET("/payments", handler.ListPayments)
+	r.PUT("/payments/:id/review", handler.ReviewPayment)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/payments", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Meta    service.ListResult `json:"meta"`
+		Summary map[string]int     `json:"summary"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Meta.Data, 1)
+	require.Equal(t, "payment1", resp.Meta.Data[0].ID)
+	require.Equal(t, map[string]int{"total": 1, "completed": 1, "processing": 0, "failed": 0}, resp.Summary)
+
+	// payments of other merchants are not found rather than forbidden
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/payments/payment2/review", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.JSONEq(t, `{"error": "Payment not found"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/payments/payment1/review", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// a user without merchants, say one provisioned by SSO, sees nothing
+	// until they are given merchants or all of them
+	unassigned := gin.New()
+	unassigned.Use(func(ctx *gin.Context) {
+		ctx.Set("role", "cs")
+		ctx.Set("merchants", []string(nil))
+		ctx.Set("merchant_groups", []string(nil))
+		ctx.Set("all_merchants", false)
+	})
+	unassigned.GET("/payments", handler.ListPayments)
+	unassigned.PUT("/payments/:id/review", handler.ReviewPayment)
+
+	w = httptest.NewRecorder()
+	unassigned.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/payments", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Empty(t, resp.Meta.Data)
+	require.Equal(t, map[string]int{"total": 0, "completed": 0, "processing": 0, "failed": 0}, resp.Summary)
+
+	w = httptest.NewRecorder()
+	unassigned.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/payments/payment1/review", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPaymentHandler_GetPayment(t *testing.T) {
+	handler, _, _ := setupPaymentTest(t)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(ctx *gin.Context) {
+		ctx.Set("role", "cs")
+		ctx.Set("email", "john-cs@durianpay.id")
+		ctx.Set("all_merchants", true)
+	})
+	r.GET("/payments/:id", handler.GetPayment)
+	r.POST("/payments/:id/notes", handler.AddPaymentNote)
+	r.PUT("/payments/:id/review", handler.ReviewPayment)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/payments/payment1/review", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = postJSON(r, "/payments/payment1/notes", "", paymentNoteRequest{Note: "refund requested by phone"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.Contains(t, w.Body.String(), `"type":"note"`)
+	require.Equal(t, http.StatusBadRequest, postJSON(r, "/payments/payment1/notes", "", paymentNoteRequest{Note: " "}).Code)
+	require.Equal(t, http.StatusBadRequest, postJSON(r, "/payments/payment1/notes", "", map[string]string{}).Code)
+	require.Equal(t, http.StatusNotFound, postJSON(r, "/payments/nonexistent/notes", "", paymentNoteRequest{Note: "note"}).Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/payments/payment1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	var detail service.PaymentDetail
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &detail))
+	require.Equal(t, "payment1", detail.Payment.ID)
+	require.True(t, detail.Payment.Reviewed)
+	types := []string{}
+	for _, event := range detail.Timeline {
+		types = append(types, event.Type)
+		if event.Type != domain.PaymentEventCreated {
+			require.Equal(t, "john-cs@durianpay.id", event.Actor)
+		}
+	}
+	require.Equal(t, []string{"created", "reviewed", "note"}, types)
+	require.Equal(t, "refund requested by phone", detail.Timeline[2].Note)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/payments/nonexistent", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.JSONEq(t, `{"error": "Payment not found"}`, w.Body.String())
+}
+
+func TestPaymentHandler_TransitionPayment(t *testing.T) {
+	handler, _, store := setupPaymentTest(t)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(ctx *gin.Context) {
+		ctx.Set("role", ctx.GetHeader("X-Role"))
+		ctx.Set("all_merchants", true)
+		ctx.Set("email", "jane-operational@durianpay.id")
+	})
+	r.PUT("/payments/:id/status", handler.TransitionPayment)
+
+	transition := func(role, ifMatch string, body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPut, "/payments/payment1/status", strings.NewReader(string(b)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Role", role)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		role     string
+		ifMatch  string
+		body     any
+		wantCode int
+	}{
+		{name: "missing reason", role: "operational", body: map[string]string{"status": "disputed"}, wantCode: http.StatusBadRequest},
+		{name: "unknown reason", role: "operational", body: paymentStatusRequest{Status: "disputed", Reason: "bored"}, wantCode: http.StatusBadRequest},
+		{name: "illegal transition", role: "operational", body: paymentStatusRequest{Status: "processing", Reason: "retried"}, wantCode: http.StatusConflict},
+		{name: "refunds only", role: "operational", body: paymentStatusRequest{Status: "refunded", Reason: "duplicate"}, wantCode: http.StatusConflict},
+		{name: "stale If-Match", role: "cs", ifMatch: `"7"`, body: paymentStatusRequest{Status: "disputed", Reason: "chargeback"}, wantCode: http.StatusPreconditionFailed},
+		{name: "dispute", role: "cs", ifMatch: `"1"`, body: paymentStatusRequest{Status: "disputed", Reason: "chargeback"}, wantCode: http.StatusOK},
+		{name: "role may not settle a dispute", role: "cs", body: paymentStatusRequest{Status: "completed", Reason: "dispute_won"}, wantCode: http.StatusForbidden},
+		{name: "dispute won", role: "operational", body: paymentStatusRequest{Status: "completed", Reason: "dispute_won"}, wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := transition(tt.role, tt.ifMatch, tt.body)
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+		})
+	}
+
+	payment, _ := store.GetPaymentById("payment1")
+	require.Equal(t, domain.PaymentStatusCompleted, payment.Status)
+	events := store.ListPaymentEvents("payment1")
+	require.Len(t, events, 2)
+	require.Equal(t, "chargeback", events[0].Reason)
+	require.Equal(t, "dispute_won", events[1].Reason)
+}
+
+func TestPaymentHandler_ReviewOutcome(t *testing.T) {
+	handler, _, store := setupPaymentTest(t)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(ctx *gin.Context) {
+		ctx.Set("role", "operational")
+		ctx.Set("all_merchants", true)
+		ctx.Set("email", "jane-operational@durianpay.id")
+	})
+	r.GET("/payments", handler.ListPayments)
+	r.PUT("/payments/:id/review", handler.ReviewPayment)
+	r.POST("/payments/:id/review/revert", handler.RevertPaymentReview)
+
+	send := func(method, path string, body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, strings.NewReader(string(b)))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	flag := paymentReviewRequest{Outcome: "flagged", Reason: "suspected_fraud", Note: "card used in two countries"}
+	w := send(http.MethodPut, "/payments/payment1/review", flag)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	var reviewed domain.Payment
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &reviewed))
+	require.Equal(t, "jane-operational@durianpay.id", reviewed.Review.Reviewer)
+	require.Equal(t, "flagged", reviewed.Review.Outcome)
+
+	// idempotent
+	w = send(http.MethodPut, "/payments/payment1/review", flag)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPut, "/payments/payment2/review", paymentReviewRequest{Outcome: "flagged"}).Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/payments?outcome=flagged&reviewer=jane-operational@durianpay.id", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Meta service.ListResult `json:"meta"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Meta.Data, 1)
+	require.Equal(t, "payment1", list.Meta.Data[0].ID)
+
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/payments/payment1/review/revert", map[string]string{}).Code)
+	w = send(http.MethodPost, "/payments/payment1/review/revert", paymentRevertReviewRequest{Note: "cardholder confirmed both purchases"})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `"3"`, w.Header().Get("ETag"))
+
+	payment, _ := store.GetPaymentById("payment1")
+	require.False(t, payment.Reviewed)
+	require.Nil(t, payment.Review)
+	events := store.ListPaymentEvents("payment1")
+	require.Len(t, events, 2)
+	require.Equal(t, domain.PaymentEventReviewReverted, events[1].Type)
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	common_errors "errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"abasithdev.github.io/internal-cs-center-backend/internal/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// largest upload accepted by ImportPayments
+const maxImportBytes = 64 << 20
+
+// ImportPayments godoc
+// @Summary Import payments
+// @Description Upsert payments from a CSV or NDJSON file (payments:import permission required). The file is
+// @Description sent as the request body or as the "file" field of a multipart form. Valid rows are
+// @Description written, invalid ones are listed in the report. CSV files need a header row with
+// @Description id, merchant_name, date, amount, status and optionally reviewed.
+// @Tags payments
+// @Accept text/csv
+// @Accept application/x-ndjson
+// @Accept multipart/form-data
+// @Produce json
+// @Param format query string false "csv or ndjson, taken from the Content-Type or file name when omitted"
+// @Param dry_run query bool false "validate and report without writing"
+// @Param file formData file false "file to import when sending multipart/form-data"
+// @Success 200 {object} service.ImportReport
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 413 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /payments/import [post]
+func (paymentHandler *PaymentHandler) ImportPayments(ctx *gin.Context) {
+	dryRun, err := utils.QueryBool(ctx, "dry_run")
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "dry_run must be true or false"})
+		return
+	}
+
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxImportBytes)
+	body, contentType, filename, err := importUpload(ctx.Request)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	format := importFormat(ctx.Query("format"), contentType, filename)
+	if format == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Unknown file format, pass format=csv or format=ndjson"})
+		return
+	}
+
+	report, err := paymentHandler.paymentService.Import(service.ImportRequest{
+		Format: format,
+		Body:   body,
+		DryRun: dryRun != nil && *dryRun,
+		Actor:  ctx.GetString("email"),
+		Scope:  merchantScope(ctx),
+	})
+	if err != nil {
+		// rows before the limit may already be written, the client has to retry with a smaller file
+		var tooLargeErr *http.MaxBytesError
+		if common_errors.As(err, &tooLargeErr) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Import file is too large"})
+			return
+		}
+
+		writePaymentError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, report)
+}
+
+// importUpload returns the uploaded file without buffering it: the "file" part
+// of a multipart form, or else the request body itself
+func importUpload(request *http.Request) (io.Reader, string, string, error) {
+	contentType := request.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "multipart/form-data" {
+		return request.Body, contentType, "", nil
+	}
+
+	reader, err := request.MultipartReader()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, "", "", common_errors.New("multipart form has no file field")
+		}
+		if err != nil {
+			return nil, "", "", err
+		}
+		if part.FormName() == "file" {
+			return part, part.Header.Get("Content-Type"), part.FileName(), nil
+		}
+	}
+}
+
+// importFormat picks the file format from, in order, the format query
+// parameter, the content type and the file extension
+func importFormat(explicit string, contentType string, filename string) string {
+	if explicit != "" {
+		return strings.ToLower(explicit)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv", "application/csv":
+		return service.ImportFormatCSV
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return service.ImportFormatNDJSON
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return service.ImportFormatCSV
+	case ".ndjson", ".jsonl":
+		return service.ImportFormatNDJSON
+	}
+	return ""
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func multipartUpload(t *testing.T, filename string, content string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	require.NoError(t, writer.WriteField("note", "gateway batch"))
+	part, err := writer.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	_, err = part.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return body, writer.FormDataContentType()
+}
+
+func TestPaymentHandler_ImportPayments(t *testing.T) {
+	csv := "id,merchant_name,date,amount,status\n" +
+		"payment1,Merchant A,2024-05-01,120,completed\n" +
+		"payment9,Merchant Z,2024-05-01,80,completed\n" +
+		"payment10,Merchant Z,2024-05-01,0,completed\n"
+	ndjson := `{"id":"payment9","merchant_name":"Merchant Z","date":"2024-05-01","amount":80,"status":"completed"}` + "\n"
+	upload, uploadType := multipartUpload(t, "batch.ndjson", ndjson)
+
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		wantCode    int
+		wantError   string
+		wantReport  service.ImportReport
+		wantWritten bool
+	}{
+		{
+			name:        "csv body",
+			contentType: "text/csv",
+			body:        csv,
+			wantCode:    http.StatusOK,
+			wantReport:  service.ImportReport{Rows: 3, Created: 1, Updated: 1, Failed: 1},
+			wantWritten: true,
+		},
+		{
+			name:        "dry run",
+			query:       "?dry_run=true",
+			contentType: "text/csv",
+			body:        csv,
+			wantCode:    http.StatusOK,
+			wantReport:  service.ImportReport{DryRun: true, Rows: 3, Created: 1, Updated: 1, Failed: 1},
+		},
+		{
+			name:        "multipart ndjson",
+			contentType: uploadType,
+			body:        upload.String(),
+			wantCode:    http.StatusOK,
+			wantReport:  service.ImportReport{Rows: 1, Created: 1},
+			wantWritten: true,
+		},
+		{
+			name:        "format query wins",
+			query:       "?format=csv",
+			contentType: "application/octet-stream",
+			body:        csv,
+			wantCode:    http.StatusOK,
+			wantReport:  service.ImportReport{Rows: 3, Created: 1, Updated: 1, Failed: 1},
+			wantWritten: true,
+		},
+		{
+			name:        "unknown format",
+			contentType: "application/octet-stream",
+			body:        csv,
+			wantCode:    http.StatusBadRequest,
+			wantError:   "Unknown file format, pass format=csv or format=ndjson",
+		},
+		{
+			name:        "missing columns",
+			contentType: "text/csv",
+			body:        "id,amount\n",
+			wantCode:    http.StatusBadRequest,
+			wantError:   "Invalid data: CSV header is missing merchant_name, date, status",
+		},
+		{
+			name:        "bad dry_run",
+			query:       "?dry_run=maybe",
+			contentType: "text/csv",
+			body:        csv,
+			wantCode:    http.StatusBadRequest,
+			wantError:   "dry_run must be true or false",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+
+			handler, _, store := setupPaymentTest(t)
+			r.Use(func(ctx *gin.Context) {
+				ctx.Set("role", "operational")
+				ctx.Set("all_merchants", true)
+			})
+			r.POST("/payments/import", handler.ImportPayments)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/payments/import"+tt.query, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+
+			if tt.wantError != "" {
+				var resp map[string]string
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				require.Equal(t, tt.wantError, resp["error"])
+				return
+			}
+
+			var report service.ImportReport
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+			require.Equal(t, tt.wantReport.DryRun, report.DryRun)
+			require.Equal(t, tt.wantReport.Rows, report.Rows)
+			require.Equal(t, tt.wantReport.Created, report.Created)
+			require.Equal(t, tt.wantReport.Updated, report.Updated)
+			require.Equal(t, tt.wantReport.Failed, report.Failed)
+			require.Len(t, report.Errors, tt.wantReport.Failed)
+
+			_, written := store.GetPaymentById("payment9")
+			require.Equal(t, tt.wantWritten, written)
+		})
+	}
+}
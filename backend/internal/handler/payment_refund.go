@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"net/http"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+type refundRequest struct {
+	Amount float64 `json:"amount" binding:"required"`
+	Reason string  `json:"reason" binding:"required"`
+	Note   string  `json:"note"`
+}
+
+type refundStatusRequest struct {
+	Status string `json:"status" binding:"required"`
+	Note   string `json:"note"`
+}
+
+// ListRefunds godoc
+// @Summary List payment refunds
+// @Description List the refunds of a payment, oldest first (payments:read permission required)
+// @Tags refunds
+// @Produce json
+// @Param id path string true "payment id"
+// @Success 200 {array} domain.Refund
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /payments/{id}/refunds [get]
+func (paymentHandler *PaymentHandler) ListRefunds(ctx *gin.Context) {
+	refunds, err := paymentHandler.paymentService.ListRefunds(ctx.Param("id"), merchantScope(ctx))
+	if err != nil {
+		writePaymentError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, refunds)
+}
+
+// RequestRefund godoc
+// @Summary Request refund
+// @Description Request a full or partial refund of a completed payment (refunds:request permission required).
+// @Description Requested, approved and processed refunds together may not exceed the payment amount.
+// @Tags refunds
+// @Accept json
+// @Produce json
+// @Param id path string true "payment id"
+// @Param body body refundRequest true "amount, reason code and optional note"
+// @Success 201 {object} domain.Refund
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /payments/{id}/refunds [post]
+func (paymentHandler *PaymentHandler) RequestRefund(ctx *gin.Context) {
+	var request refundRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	refund, err := paymentHandler.paymentService.RequestRefund(ctx.Param("id"), ctx.GetString("email"),
+		service.RefundRequest{Amount: request.Amount, Reason: request.Reason, Note: request.Note}, merchantScope(ctx))
+	if err != nil {
+		writePaymentError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, refund)
+}
+
+// UpdateRefund godoc
+// @Summary Change refund status
+// @Description Approve or reject a requested refund, or report an approved one processed or failed (refunds:manage
+// @Description permission required). A refund cannot be approved or rejected by its requester. Processing a refund
+// @Description moves the payment to partially_refunded, or refunded once nothing is left.
+// @Tags refunds
+// @Accept json
+// @Produce json
+// @Param id path string true "payment id"
+// @Param refundId path string true "refund id"
+// @Param body body refundStatusRequest true "new status and optional note"
+// @Success 200 {object} domain.Refund
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /payments/{id}/refunds/{refundId}/status [put]
+func (paymentHandler *PaymentHandler) UpdateRefund(ctx *gin.Context) {
+	var request refundStatusRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	refund, err := paymentHandler.paymentService.UpdateRefund(ctx.Param("id"), ctx.Param("refundId"), ctx.GetString("email"),
+		request.Status, request.Note, merchantScope(ctx))
+	if err != nil {
+		writePaymentError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, refund)
+}
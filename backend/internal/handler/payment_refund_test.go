@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentHandler_Refunds(t *testing.T) {
+	handler, _, store := setupPaymentTest(t)
+
+	role, email := "cs", "john-cs@durianpay.id"
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(ctx *gin.Context) {
+		ctx.Set("role", role)
+		ctx.Set("all_merchants", true)
+		ctx.Set("email", email)
+	})
+	r.GET("/payments/:id/refunds", handler.ListRefunds)
+	r.POST("/payments/:id/refunds", handler.RequestRefund)
+	r.PUT("/payments/:id/refunds/:refundId/status", handler.UpdateRefund)
+
+	send := func(method, path string, body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, strings.NewReader(string(b)))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodPost, "/payments/payment1/refunds", refundRequest{Amount: 40, Reason: "customer_request", Note: "item returned"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	var refund domain.Refund
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refund))
+	require.Equal(t, domain.RefundStatusRequested, refund.Status)
+	require.Equal(t, "john-cs@durianpay.id", refund.RequestedBy)
+
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/payments/payment1/refunds", map[string]any{"reason": "duplicate"}).Code)
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/payments/payment1/refunds", refundRequest{Amount: 60.01, Reason: "duplicate"}).Code)
+	require.Equal(t, http.StatusConflict, send(http.MethodPost, "/payments/payment2/refunds", refundRequest{Amount: 10, Reason: "duplicate"}).Code)
+	require.Equal(t, http.StatusNotFound, send(http.MethodPost, "/payments/unknown/refunds", refundRequest{Amount: 10, Reason: "duplicate"}).Code)
+
+	// the requester may not approve, even with the role for it
+	role = "operational"
+	path := "/payments/payment1/refunds/" + refund.ID + "/status"
+	require.Equal(t, http.StatusForbidden, send(http.MethodPut, path, refundStatusRequest{Status: "approved"}).Code)
+
+	email = "jane-operational@durianpay.id"
+	require.Equal(t, http.StatusConflict, send(http.MethodPut, path, refundStatusRequest{Status: "processed"}).Code)
+	require.Equal(t, http.StatusOK, send(http.MethodPut, path, refundStatusRequest{Status: "approved"}).Code)
+	w = send(http.MethodPut, path, refundStatusRequest{Status: "processed", Note: "acquirer ref 123"})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refund))
+	require.Equal(t, domain.RefundStatusProcessed, refund.Status)
+	require.Equal(t, "jane-operational@durianpay.id", refund.DecidedBy)
+
+	w = send(http.MethodPut, "/payments/payment1/refunds/unknown/status", refundStatusRequest{Status: "approved"})
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Contains(t, w.Body.String(), "Refund not found")
+	w = send(http.MethodPut, "/payments/unknown/refunds/"+refund.ID+"/status", refundStatusRequest{Status: "approved"})
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Contains(t, w.Body.String(), "Payment not found")
+
+	payment, _ := store.GetPaymentById("payment1")
+	require.Equal(t, domain.PaymentStatusPartiallyRefunded, payment.Status)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/payments/payment1/refunds", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var refunds []*domain.Refund
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refunds))
+	require.Len(t, refunds, 1)
+	require.Equal(t, 40.0, refunds[0].Amount)
+}
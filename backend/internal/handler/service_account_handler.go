@@ -0,0 +1,279 @@
+package handler
+
+import (
+	common_errors "errors"
+	"net/http"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+type ServiceAccountHandler struct {
+	accounts *service.ServiceAccountService
+}
+
+func NewServiceAccountHandler(accounts *service.ServiceAccountService) *ServiceAccountHandler {
+	return &ServiceAccountHandler{accounts: accounts}
+}
+
+type createServiceAccountRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Role        string `json:"role" binding:"required"`
+	Description string `json:"description"`
+}
+
+type createAPIKeyRequest struct {
+	Scopes []string `json:"scopes" binding:"required"`
+	// ExpiresAt is RFC 3339, keys without one work until they are revoked
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type rotateAPIKeyRequest struct {
+	// GracePeriodSeconds keeps the old key working for a while, 0 revokes it at once
+	GracePeriodSeconds int64 `json:"grace_period_seconds"`
+}
+
+// apiKeyResponse is a new key. Key is only ever shown here.
+type apiKeyResponse struct {
+	*domain.APIKey
+	Key string `json:"key"`
+}
+
+// ListServiceAccounts godoc
+// @Summary List service accounts
+// @Description List every service account ordered by name (users:manage permission required)
+// @Tags service-accounts
+// @Produce json
+// @Success 200 {array} domain.ServiceAccount
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /service-accounts [get]
+func (accountHandler *ServiceAccountHandler) ListServiceAccounts(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, accountHandler.accounts.ListServiceAccounts())
+}
+
+// GetServiceAccount godoc
+// @Summary Get service account
+// @Description Get a single service account (users:manage permission required)
+// @Tags service-accounts
+// @Produce json
+// @Param name path string true "account name"
+// @Success 200 {object} domain.ServiceAccount
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /service-accounts/{name} [get]
+func (accountHandler *ServiceAccountHandler) GetServiceAccount(ctx *gin.Context) {
+	account, err := accountHandler.accounts.GetServiceAccount(ctx.Param("name"))
+	if err != nil {
+		writeServiceAccountError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, account)
+}
+
+// CreateServiceAccount godoc
+// @Summary Create service account
+// @Description Create a principal for a machine client, it authenticates with API keys only
+// @Description (users:manage permission required). Names are 2 to 63 lowercase letters, digits or dashes.
+// @Tags service-accounts
+// @Accept json
+// @Produce json
+// @Param body body createServiceAccountRequest true "service account"
+// @Success 201 {object} domain.ServiceAccount
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /service-accounts [post]
+func (accountHandler *ServiceAccountHandler) CreateServiceAccount(ctx *gin.Context) {
+	var request createServiceAccountRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := accountHandler.accounts.CreateServiceAccount(ctx.GetString("email"), service.CreateServiceAccountRequest{
+		Name:        request.Name,
+		Role:        request.Role,
+		Description: request.Description,
+	})
+	if err != nil {
+		writeServiceAccountError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, account)
+}
+
+// DeleteServiceAccount godoc
+// @Summary Delete service account
+// @Description Delete a service account, its API keys stop working at once (users:manage permission required)
+// @Tags service-accounts
+// @Param name path string true "account name"
+// @Success 204
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /service-accounts/{name} [delete]
+func (accountHandler *ServiceAccountHandler) DeleteServiceAccount(ctx *gin.Context) {
+	if err := accountHandler.accounts.DeleteServiceAccount(ctx.Param("name")); err != nil {
+		writeServiceAccountError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// ListAPIKeys godoc
+// @Summary List API keys
+// @Description List the keys of a service account oldest first, including revoked and expired ones
+// @Description (users:manage permission required). The keys themselves cannot be shown again.
+// @Tags service-accounts
+// @Produce json
+// @Param name path string true "account name"
+// @Success 200 {array} domain.APIKey
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /service-accounts/{name}/keys [get]
+func (accountHandler *ServiceAccountHandler) ListAPIKeys(ctx *gin.Context) {
+	keys, err := accountHandler.accounts.ListAPIKeys(ctx.Param("name"))
+	if err != nil {
+		writeServiceAccountError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, keys)
+}
+
+// CreateAPIKey godoc
+// @Summary Create API key
+// @Description Issue a key limited to scopes the account role grants (users:manage permission required).
+// @Description The key is in the response once, only its id is kept visible.
+// @Tags service-accounts
+// @Accept json
+// @Produce json
+// @Param name path string true "account name"
+// @Param body body createAPIKeyRequest true "scopes and expiry"
+// @Success 201 {object} apiKeyResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /service-accounts/{name}/keys [post]
+func (accountHandler *ServiceAccountHandler) CreateAPIKey(ctx *gin.Context) {
+	var request createAPIKeyRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	issued, err := accountHandler.accounts.CreateAPIKey(ctx.Param("name"), service.CreateAPIKeyRequest{
+		Scopes:    request.Scopes,
+		ExpiresAt: request.ExpiresAt,
+	})
+	if err != nil {
+		writeServiceAccountError(ctx, err)
+		return
+	}
+
+	writeNewAPIKey(ctx, issued)
+}
+
+// RotateAPIKey godoc
+// @Summary Rotate API key
+// @Description Replace a key by a new one with the same scopes and lifetime (users:manage permission required).
+// @Description The old key keeps working for the grace period, at most 7 days, or stops at once without one.
+// @Tags service-accounts
+// @Accept json
+// @Produce json
+// @Param name path string true "account name"
+// @Param id path string true "key id"
+// @Param body body rotateAPIKeyRequest false "grace period"
+// @Success 201 {object} apiKeyResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /service-accounts/{name}/keys/{id}/rotate [post]
+func (accountHandler *ServiceAccountHandler) RotateAPIKey(ctx *gin.Context) {
+	var request rotateAPIKeyRequest
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	grace := time.Duration(request.GracePeriodSeconds) * time.Second
+	issued, err := accountHandler.accounts.RotateAPIKey(ctx.Param("name"), ctx.Param("id"), grace)
+	if err != nil {
+		writeServiceAccountError(ctx, err)
+		return
+	}
+
+	writeNewAPIKey(ctx, issued)
+}
+
+// RevokeAPIKey godoc
+// @Summary Revoke API key
+// @Description Stop a key at once, it stays listed as revoked (users:manage permission required)
+// @Tags service-accounts
+// @Param name path string true "account name"
+// @Param id path string true "key id"
+// @Success 204
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /service-accounts/{name}/keys/{id} [delete]
+func (accountHandler *ServiceAccountHandler) RevokeAPIKey(ctx *gin.Context) {
+	if err := accountHandler.accounts.RevokeAPIKey(ctx.Param("name"), ctx.Param("id")); err != nil {
+		writeServiceAccountError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func writeNewAPIKey(ctx *gin.Context, issued *service.NewAPIKey) {
+	// the key cannot be looked up again, keep it out of caches
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusCreated, apiKeyResponse{APIKey: issued.APIKey, Key: issued.Secret})
+}
+
+// writeServiceAccountError maps service errors of service account
+// administration to responses
+func writeServiceAccountError(ctx *gin.Context, err error) {
+	var notFoundErr *errors.NotFoundError
+	if common_errors.As(err, &notFoundErr) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	var existsErr *errors.AlreadyExistsError
+	if common_errors.As(err, &existsErr) {
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Service account already exists"})
+		return
+	}
+
+	var validationErr *errors.ValidationError
+	if common_errors.As(err, &validationErr) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/policy"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func setupServiceAccountTest(t *testing.T) (*gin.Engine, *service.AuthService) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	handler := NewServiceAccountHandler(service.NewServiceAccountService(store, policy.Default()))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("email", "admin@durianpay.id")
+	})
+	r.GET("/service-accounts", handler.ListServiceAccounts)
+	r.POST("/service-accounts", handler.CreateServiceAccount)
+	r.GET("/service-accounts/:name", handler.GetServiceAccount)
+	r.DELETE("/service-accounts/:name", handler.DeleteServiceAccount)
+	r.GET("/service-accounts/:name/keys", handler.ListAPIKeys)
+	r.POST("/service-accounts/:name/keys", handler.CreateAPIKey)
+	r.POST("/service-accounts/:name/keys/:id/rotate", handler.RotateAPIKey)
+	r.DELETE("/service-accounts/:name/keys/:id", handler.RevokeAPIKey)
+
+	return r, service.NewAuthService(store, []byte("test-secret-key"))
+}
+
+func TestServiceAccountHandler(t *testing.T) {
+	r, auth := setupServiceAccountTest(t)
+
+	w := serveUserRequest(r, http.MethodPost, "/service-accounts", createServiceAccountRequest{Name: "recon", Role: "operational", Description: "settlement reconciliation"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	var account map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &account))
+	require.Equal(t, "recon", account["name"])
+	require.Equal(t, "admin@durianpay.id", account["created_by"])
+
+	w = serveUserRequest(r, http.MethodGet, "/service-accounts", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var accounts []map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &accounts))
+	require.Len(t, accounts, 1)
+
+	w = serveUserRequest(r, http.MethodGet, "/service-accounts/recon", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the key is in the create response and nowhere else
+	w = serveUserRequest(r, http.MethodPost, "/service-accounts/recon/keys", map[string]any{
+		"scopes": []string{"payments:read"}, "expires_at": time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	var created struct {
+		ID        string     `json:"id"`
+		Key       string     `json:"key"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.True(t, strings.HasPrefix(created.Key, service.APIKeyPrefix+created.ID+"_"))
+	require.Equal(t, []string{"payments:read"}, created.Scopes)
+	require.NotNil(t, created.ExpiresAt)
+
+	_, _, err := auth.AuthorizeAPIKey(created.Key)
+	require.NoError(t, err)
+
+	w = serveUserRequest(r, http.MethodGet, "/service-accounts/recon/keys", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotContains(t, w.Body.String(), created.Key)
+	require.NotContains(t, w.Body.String(), "hash")
+	require.Contains(t, w.Body.String(), created.ID)
+
+	// rotating without a body revokes the old key at once
+	w = serveUserRequest(r, http.MethodPost, "/service-accounts/recon/keys/"+created.ID+"/rotate", nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var rotated struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rotated))
+	_, _, err = auth.AuthorizeAPIKey(created.Key)
+	require.Error(t, err)
+	_, _, err = auth.AuthorizeAPIKey(rotated.Key)
+	require.NoError(t, err)
+
+	w = serveUserRequest(r, http.MethodPost, "/service-accounts/recon/keys/"+rotated.ID+"/rotate", rotateAPIKeyRequest{GracePeriodSeconds: 3600})
+	require.Equal(t, http.StatusCreated, w.Code)
+	_, _, err = auth.AuthorizeAPIKey(rotated.Key)
+	require.NoError(t, err)
+
+	w = serveUserRequest(r, http.MethodDelete, "/service-accounts/recon/keys/"+rotated.ID, nil)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	_, _, err = auth.AuthorizeAPIKey(rotated.Key)
+	require.Error(t, err)
+
+	w = serveUserRequest(r, http.MethodDelete, "/service-accounts/recon", nil)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	w = serveUserRequest(r, http.MethodGet, "/service-accounts/recon", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServiceAccountHandler_Errors(t *testing.T) {
+	r, _ := setupServiceAccountTest(t)
+	w := serveUserRequest(r, http.MethodPost, "/service-accounts", createServiceAccountRequest{Name: "recon", Role: "cs"})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     any
+		wantCode int
+	}{
+		{name: "existing account", method: http.MethodPost, path: "/service-accounts", body: createServiceAccountRequest{Name: "recon", Role: "cs"}, wantCode: http.StatusConflict},
+		{name: "invalid name", method: http.MethodPost, path: "/service-accounts", body: createServiceAccountRequest{Name: "bot@durianpay.id", Role: "cs"}, wantCode: http.StatusBadRequest},
+		{name: "missing role", method: http.MethodPost, path: "/service-accounts", body: map[string]any{"name": "exporter"}, wantCode: http.StatusBadRequest},
+		{name: "unknown account", method: http.MethodGet, path: "/service-accounts/missing", wantCode: http.StatusNotFound},
+		{name: "delete unknown account", method: http.MethodDelete, path: "/service-accounts/missing", wantCode: http.StatusNotFound},
+		{name: "keys of unknown account", method: http.MethodGet, path: "/service-accounts/missing/keys", wantCode: http.StatusNotFound},
+		{name: "missing scopes", method: http.MethodPost, path: "/service-accounts/recon/keys", body: map[string]any{}, wantCode: http.StatusBadRequest},
+		{name: "scope beyond role", method: http.MethodPost, path: "/service-accounts/recon/keys", body: map[string]any{"scopes": []string{"payments:review"}}, wantCode: http.StatusBadRequest},
+		{name: "rotate unknown key", method: http.MethodPost, path: "/service-accounts/recon/keys/missing/rotate", wantCode: http.StatusNotFound},
+		{name: "negative grace", method: http.MethodPost, path: "/service-accounts/recon/keys/missing/rotate", body: rotateAPIKeyRequest{GracePeriodSeconds: -1}, wantCode: http.StatusBadRequest},
+		{name: "revoke unknown key", method: http.MethodDelete, path: "/service-accounts/recon/keys/missing", wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveUserRequest(r, tt.method, tt.path, tt.body)
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package handler
+
+import (
+	common_errors "errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/policy"
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SessionHandler serves the current user and their sessions
+type SessionHandler struct {
+	auth  *service.AuthService
+	users *service.UserService
+	rules *policy.Policy
+}
+
+func NewSessionHandler(auth *service.AuthService, users *service.UserService, rules *policy.Policy) *SessionHandler {
+	return &SessionHandler{auth: auth, users: users, rules: rules}
+}
+
+type meResponse struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+	// Permissions are those the presented token can use
+	Permissions []string `json:"permissions"`
+	// MFARequired are permissions of the role that need a multi-factor login
+	// the token lacks
+	MFARequired []string `json:"mfa_required"`
+	MFAEnabled  bool     `json:"mfa_enabled"`
+	// AMR lists how the user logged in, empty for API keys
+	AMR []string `json:"amr"`
+	// SessionID is empty for API keys
+	SessionID string `json:"session_id,omitempty"`
+	// ExpiresAt is the expiry of the access token
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type sessionResponse struct {
+	*domain.Session
+	// Current is the session of the presented token
+	Current bool `json:"current"`
+}
+
+// Me godoc
+// @Summary Current user
+// @Description Who the token belongs to: role, the permissions the token can use, MFA state, session and token expiry.
+// @Description For API keys, the service account and the permissions of the key's scopes.
+// @Tags auth
+// @Produce json
+// @Success 200 {object} meResponse
+// @Failure 401 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /auth/me [get]
+func (sessionHandler *SessionHandler) Me(ctx *gin.Context) {
+	role := ctx.GetString("role")
+	claims, _ := ctx.Get("claims")
+	mapClaims, _ := claims.(jwt.MapClaims)
+
+	response := meResponse{
+		Email:       ctx.GetString("email"),
+		Role:        role,
+		Permissions: []string{},
+		MFARequired: []string{},
+		AMR:         []string{},
+	}
+
+	// the same checks as middleware.RequirePermission
+	scopes, scoped := ctx.Get("scopes")
+	for _, permission := range sessionHandler.rules.Granted(role) {
+		if scoped && !slices.Contains(scopes.([]string), permission) {
+			continue
+		}
+		if sessionHandler.rules.RequiresMFA(role, permission) && !service.HasMFA(mapClaims) {
+			response.MFARequired = append(response.MFARequired, permission)
+			continue
+		}
+		response.Permissions = append(response.Permissions, permission)
+	}
+
+	if mapClaims != nil {
+		user, err := sessionHandler.users.GetUser(response.Email)
+		if err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		response.MFAEnabled = user.MFAEnabled
+
+		amr, _ := mapClaims["amr"].([]any)
+		for _, method := range amr {
+			if method, ok := method.(string); ok {
+				response.AMR = append(response.AMR, method)
+			}
+		}
+		response.SessionID, _ = mapClaims["sid"].(string)
+		if expiresAt, err := mapClaims.GetExpirationTime(); err == nil && expiresAt != nil {
+			response.ExpiresAt = &expiresAt.Time
+		}
+	}
+
+	ctx.JSON(http.StatusOK, response)
+}
+
+// ListSessions godoc
+// @Summary List sessions
+// @Description The active sessions of the current user, most recently seen first. Current marks the session of the presented token.
+// @Tags auth
+// @Produce json
+// @Success 200 {array} sessionResponse
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /auth/sessions [get]
+func (sessionHandler *SessionHandler) ListSessions(ctx *gin.Context) {
+	current, ok := currentSession(ctx)
+	if !ok {
+		return
+	}
+
+	sessions := []sessionResponse{}
+	for _, session := range sessionHandler.auth.ListSessions(ctx.GetString("email")) {
+		sessions = append(sessions, sessionResponse{Session: session, Current: session.ID == current})
+	}
+
+	ctx.JSON(http.StatusOK, sessions)
+}
+
+// TerminateSession godoc
+// @Summary Terminate session
+// @Description End a session of the current user, its refresh and access tokens stop working at once.
+// @Description Terminating the current session logs out.
+// @Tags auth
+// @Param id path string true "session id"
+// @Success 204
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /auth/sessions/{id} [delete]
+func (sessionHandler *SessionHandler) TerminateSession(ctx *gin.Context) {
+	if _, ok := currentSession(ctx); !ok {
+		return
+	}
+
+	if err := sessionHandler.auth.TerminateSession(ctx.GetString("email"), ctx.Param("id")); err != nil {
+		var notFoundErr *errors.NotFoundError
+		if common_errors.As(err, &notFoundErr) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// TerminateOtherSessions godoc
+// @Summary Terminate other sessions
+// @Description End every session of the current user except the one of the presented token
+// @Tags auth
+// @Success 204
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /auth/sessions [delete]
+func (sessionHandler *SessionHandler) TerminateOtherSessions(ctx *gin.Context) {
+	current, ok := currentSession(ctx)
+	if !ok {
+		return
+	}
+
+	if _, err := sessionHandler.auth.TerminateOtherSessions(ctx.GetString("email"), current); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// currentSession returns the session ID of the presented token. API keys
+// have no sessions and are answered with 403.
+func currentSession(ctx *gin.Context) (string, bool) {
+	claims, _ := ctx.Get("claims")
+	mapClaims, ok := claims.(jwt.MapClaims)
+	if !ok {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return "", false
+	}
+
+	sid, _ := mapClaims["sid"].(string)
+	return sid, true
+}
+
+// clientInfo describes the client of a login or refresh for its session
+func clientInfo(ctx *gin.Context) service.ClientInfo {
+	return service.ClientInfo{UserAgent: ctx.Request.UserAgent(), IP: ctx.ClientIP()}
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/policy"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func setupSessionTest(t *testing.T) *gin.Engine {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	authService := service.NewAuthService(store, []byte("donttellanyone"))
+	authHandler := NewAuthHandler(authService)
+	handler := NewSessionHandler(authService, service.NewUserService(store), policy.Default())
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/login", authHandler.Login)
+	r.POST("/refresh", authHandler.Refresh)
+	// stands in for middleware.AuthMiddleware
+	authenticate := func(context *gin.Context) {
+		token := strings.TrimPrefix(context.GetHeader("Authorization"), "Bearer ")
+		if token == "service-account" {
+			context.Set("role", "operational")
+			context.Set("email", "recon")
+			context.Set("scopes", []string{"payments:read"})
+			return
+		}
+
+		user, claims, err := authService.Authorize(token)
+		if err != nil {
+			context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		context.Set("role", user.Role)
+		context.Set("email", user.Email)
+		context.Set("claims", claims)
+	}
+	r.GET("/me", authenticate, handler.Me)
+	r.GET("/sessions", authenticate, handler.ListSessions)
+	r.DELETE("/sessions", authenticate, handler.TerminateOtherSessions)
+	r.DELETE("/sessions/:id", authenticate, handler.TerminateSession)
+
+	return r
+}
+
+func sessionRequest(r *gin.Engine, method, path, accessToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "session-test")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSessionHandler_Me(t *testing.T) {
+	r := setupSessionTest(t)
+	session := login(t, r)
+
+	w := sessionRequest(r, http.MethodGet, "/me", session.Token)
+	require.Equal(t, http.StatusOK, w.Code)
+	var me meResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &me))
+	require.Equal(t, "john-cs@durianpay.id", me.Email)
+	require.Equal(t, "cs", me.Role)
+	require.Equal(t, policy.Default().Granted("cs"), me.Permissions)
+	require.Empty(t, me.MFARequired)
+	require.False(t, me.MFAEnabled)
+	require.Equal(t, []string{service.AMRPassword}, me.AMR)
+	require.NotEmpty(t, me.SessionID)
+	require.NotNil(t, me.ExpiresAt)
+
+	// API keys are limited to their scopes and have no session
+	w = sessionRequest(r, http.MethodGet, "/me", "service-account")
+	require.Equal(t, http.StatusOK, w.Code)
+	me = meResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &me))
+	require.Equal(t, "recon", me.Email)
+	require.Equal(t, []string{"payments:read"}, me.Permissions)
+	require.Empty(t, me.SessionID)
+	require.Nil(t, me.ExpiresAt)
+
+	require.Equal(t, http.StatusUnauthorized, sessionRequest(r, http.MethodGet, "/me", "invalid").Code)
+}
+
+func TestSessionHandler_Sessions(t *testing.T) {
+	r := setupSessionTest(t)
+	first, second, third := login(t, r), login(t, r), login(t, r)
+
+	w := sessionRequest(r, http.MethodGet, "/sessions", first.Token)
+	require.Equal(t, http.StatusOK, w.Code)
+	var sessions []struct {
+		ID        string `json:"id"`
+		UserAgent string `json:"user_agent"`
+		IP        string `json:"ip"`
+		Current   bool   `json:"current"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 3)
+
+	var me meResponse
+	require.NoError(t, json.Unmarshal(sessionRequest(r, http.MethodGet, "/me", first.Token).Body.Bytes(), &me))
+	var current, other string
+	for _, session := range sessions {
+		require.NotEmpty(t, session.IP)
+		if session.Current {
+			current = session.ID
+		} else {
+			other = session.ID
+		}
+	}
+	require.Equal(t, me.SessionID, current)
+
+	// ending one session
+	require.Equal(t, http.StatusNotFound, sessionRequest(r, http.MethodDelete, "/sessions/missing", first.Token).Code)
+	require.Equal(t, http.StatusNoContent, sessionRequest(r, http.MethodDelete, "/sessions/"+other, first.Token).Code)
+	require.Equal(t, http.StatusNotFound, sessionRequest(r, http.MethodDelete, "/sessions/"+other, first.Token).Code)
+
+	// and the others
+	require.Equal(t, http.StatusNoContent, sessionRequest(r, http.MethodDelete, "/sessions", first.Token).Code)
+	require.Equal(t, http.StatusUnauthorized, sessionRequest(r, http.MethodGet, "/sessions", second.Token).Code)
+	require.Equal(t, http.StatusUnauthorized, sessionRequest(r, http.MethodGet, "/sessions", third.Token).Code)
+	require.Equal(t, http.StatusUnauthorized, postJSON(r, "/refresh", "", refreshRequest{RefreshToken: third.RefreshToken}).Code)
+
+	w = sessionRequest(r, http.MethodGet, "/sessions", first.Token)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 1)
+	require.True(t, sessions[0].Current)
+
+	// API keys have no sessions
+	require.Equal(t, http.StatusForbidden, sessionRequest(r, http.MethodGet, "/sessions", "service-account").Code)
+}
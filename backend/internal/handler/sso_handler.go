@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+// ssoStateCookie holds the state token of an SSO login until the IdP calls back
+const ssoStateCookie = "oidc_state"
+
+type SSOHandler struct {
+	sso  *service.SSOService
+	auth *service.AuthService
+	// frontendURL receives the session in its fragment, or #error=sso_failed
+	frontendURL string
+}
+
+func NewSSOHandler(sso *service.SSOService, auth *service.AuthService, frontendURL string) *SSOHandler {
+	return &SSOHandler{sso: sso, auth: auth, frontendURL: frontendURL}
+}
+
+// Login godoc
+// @Summary SSO login
+// @Description Start a single sign-on login: redirects the browser to the OpenID Connect provider
+// @Tags auth
+// @Success 302
+// @Failure 502 {object} map[string]string
+// @Router /auth/oidc/login [get]
+func (ssoHandler *SSOHandler) Login(context *gin.Context) {
+	authURL, stateToken, err := ssoHandler.sso.BeginLogin(context.Request.Context())
+	if err != nil {
+		log.Printf("sso: begin login: %v", err)
+		context.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+
+	ssoHandler.setStateCookie(context, stateToken, 600)
+	context.Redirect(http.StatusFound, authURL)
+}
+
+// Callback godoc
+// @Summary SSO callback
+// @Description Redirect target of the OpenID Connect provider. Sends the browser on to the dashboard with
+// @Description token, refresh_token, expires_in and role in the URL fragment, or with error=sso_failed.
+// @Tags auth
+// @Param code query string false "authorization code"
+// @Param state query string false "state of the login"
+// @Success 302
+// @Router /auth/oidc/callback [get]
+func (ssoHandler *SSOHandler) Callback(context *gin.Context) {
+	stateToken, _ := context.Cookie(ssoStateCookie)
+	// the state works once, whatever the outcome
+	ssoHandler.setStateCookie(context, "", -1)
+
+	if idpError := context.Query("error"); idpError != "" {
+		log.Printf("sso: identity provider returned %s: %s", idpError, context.Query("error_description"))
+		ssoHandler.redirect(context, url.Values{"error": {"sso_failed"}})
+		return
+	}
+
+	user, amr, err := ssoHandler.sso.CompleteLogin(context.Request.Context(), stateToken, context.Query("state"), context.Query("code"))
+	if err != nil {
+		ssoHandler.redirect(context, url.Values{"error": {"sso_failed"}})
+		return
+	}
+
+	pair, err := ssoHandler.auth.IssueTokens(user, amr, clientInfo(context))
+	if err != nil {
+		log.Printf("sso: issue tokens of %s: %v", user.Email, err)
+		ssoHandler.redirect(context, url.Values{"error": {"sso_failed"}})
+		return
+	}
+
+	ssoHandler.redirect(context, url.Values{
+		"token":         {pair.AccessToken},
+		"refresh_token": {pair.RefreshToken},
+		"expires_in":    {strconv.Itoa(int(pair.ExpiresIn.Seconds()))},
+		"role":          {user.Role},
+		"email":         {user.Email},
+	})
+}
+
+// redirect sends the browser to the frontend with values in the fragment,
+// which browsers neither send to servers nor keep in Referer headers
+func (ssoHandler *SSOHandler) redirect(context *gin.Context, values url.Values) {
+	context.Header("Cache-Control", "no-store")
+	context.Redirect(http.StatusFound, ssoHandler.frontendURL+"#"+values.Encode())
+}
+
+// setStateCookie scopes the cookie to the SSO routes. SameSite=Lax still
+// sends it along with the IdP's top-level redirect back to us.
+func (ssoHandler *SSOHandler) setStateCookie(context *gin.Context, value string, maxAge int) {
+	path := context.Request.URL.Path
+	path = path[:strings.LastIndex(path, "/")+1]
+
+	http.SetCookie(context.Writer, &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   context.Request.TLS != nil || context.GetHeader("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/oidc"
+	"abasithdev.github.io/internal-cs-center-backend/internal/oidc/oidctest"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+const ssoFrontendURL = "http://localhost:5173/sso"
+
+func setupSSOTest(t *testing.T) (*gin.Engine, *oidctest.IdP, *service.AuthService) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	authService := service.NewAuthService(store, []byte("donttellanyone"))
+
+	idp := oidctest.NewIdP(t)
+	idp.SetClaims(jwt.MapClaims{"sub": "u-1", "email": "sso@durianpay.id", "groups": []string{"cs-ops"}})
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:       idp.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "http://localhost:8080/auth/oidc/callback",
+	})
+	sso, err := service.NewSSOService(provider, authService, store, []service.GroupRole{{Group: "cs-ops", Role: "operational"}})
+	require.NoError(t, err)
+	handler := NewSSOHandler(sso, authService, ssoFrontendURL)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/auth/oidc/login", handler.Login)
+	r.GET("/auth/oidc/callback", handler.Callback)
+	return r, idp, authService
+}
+
+func serveSSO(r *gin.Engine, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// fragment parses the fragment of the redirect to the frontend
+func fragment(t *testing.T, w *httptest.ResponseRecorder) url.Values {
+	require.Equal(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, ssoFrontendURL, location.Scheme+"://"+location.Host+location.Path)
+
+	values, err := url.ParseQuery(location.Fragment)
+	require.NoError(t, err)
+	return values
+}
+
+func TestSSOHandler(t *testing.T) {
+	r, idp, authService := setupSSOTest(t)
+
+	w := serveSSO(r, "/auth/oidc/login")
+	require.Equal(t, http.StatusFound, w.Code)
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.Equal(t, "oidc_state", cookies[0].Name)
+	require.Equal(t, "/auth/oidc/", cookies[0].Path)
+	require.True(t, cookies[0].HttpOnly)
+	require.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+
+	callback := idp.Authorize(t, w.Header().Get("Location"))
+	require.Equal(t, "/auth/oidc/callback", callback.Path)
+
+	// without the cookie of the browser that started the login
+	values := fragment(t, serveSSO(r, callback.RequestURI()))
+	require.Equal(t, "sso_failed", values.Get("error"))
+
+	w = serveSSO(r, "/auth/oidc/login")
+	state := w.Result().Cookies()[0]
+	callback = idp.Authorize(t, w.Header().Get("Location"))
+	w = serveSSO(r, callback.RequestURI(), state)
+	values = fragment(t, w)
+	require.Empty(t, values.Get("error"))
+	require.Equal(t, "operational", values.Get("role"))
+	require.Equal(t, "sso@durianpay.id", values.Get("email"))
+	require.Equal(t, "900", values.Get("expires_in"))
+	require.NotEmpty(t, values.Get("refresh_token"))
+	require.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	claims, err := authService.ParseToken(values.Get("token"))
+	require.NoError(t, err)
+	require.Equal(t, "sso@durianpay.id", claims["email"])
+	require.Equal(t, []any{"fed"}, claims["amr"])
+
+	// the state cookie is cleared
+	cleared := w.Result().Cookies()
+	require.Len(t, cleared, 1)
+	require.Equal(t, -1, cleared[0].MaxAge)
+
+	// the IdP turned the user down
+	values = fragment(t, serveSSO(r, "/auth/oidc/callback?error=access_denied&state=x", state))
+	require.Equal(t, "sso_failed", values.Get("error"))
+}
+
+func TestSSOHandler_IdPUnavailable(t *testing.T) {
+	r, idp, _ := setupSSOTest(t)
+	idp.Server.Close()
+
+	w := serveSSO(r, "/auth/oidc/login")
+	require.Equal(t, http.StatusBadGateway, w.Code)
+	require.JSONEq(t, `{"error": "Identity provider unavailable"}`, w.Body.String())
+}
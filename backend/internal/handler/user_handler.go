@@ -0,0 +1,244 @@
+package handler
+
+import (
+	common_errors "errors"
+	"net/http"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+type UserHandler struct {
+	userService *service.UserService
+}
+
+func NewUserHandler(users *service.UserService) *UserHandler {
+	return &UserHandler{userService: users}
+}
+
+type createUserRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+	Role     string `json:"role" binding:"required"`
+	// MustChangePassword makes the user replace the password on first login
+	MustChangePassword bool `json:"must_change_password"`
+	// Merchants and MerchantGroups limit the payments the user sees,
+	// AllMerchants lets them see every merchant
+	Merchants      []string `json:"merchants"`
+	MerchantGroups []string `json:"merchant_groups"`
+	AllMerchants   bool     `json:"all_merchants"`
+}
+
+type updateUserRequest struct {
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+	// MustChangePassword makes the user choose a new password at their next login
+	MustChangePassword *bool `json:"must_change_password"`
+	// Merchants and MerchantGroups replace the lists of the user, without
+	// either the user sees no payments unless AllMerchants is set
+	Merchants      *[]string `json:"merchants"`
+	MerchantGroups *[]string `json:"merchant_groups"`
+	AllMerchants   *bool     `json:"all_merchants"`
+}
+
+// ListUsers godoc
+// @Summary List users
+// @Description List every user ordered by email (users:manage permission required)
+// @Tags users
+// @Produce json
+// @Success 200 {array} domain.User
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /users [get]
+func (userHandler *UserHandler) ListUsers(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, userHandler.userService.ListUsers())
+}
+
+// GetUser godoc
+// @Summary Get user
+// @Description Get a single user (users:manage permission required)
+// @Tags users
+// @Produce json
+// @Param email path string true "user email"
+// @Success 200 {object} domain.User
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /users/{email} [get]
+func (userHandler *UserHandler) GetUser(ctx *gin.Context) {
+	user, err := userHandler.userService.GetUser(ctx.Param("email"))
+	if err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, user)
+}
+
+// CreateUser godoc
+// @Summary Create user
+// @Description Create a user with a password satisfying the password policy (users:manage permission required).
+// @Description Merchants and merchant groups limit the payments a non-admin user sees.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param body body createUserRequest true "user"
+// @Success 201 {object} domain.User
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /users [post]
+func (userHandler *UserHandler) CreateUser(ctx *gin.Context) {
+	var request createUserRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := userHandler.userService.CreateUser(service.CreateUserRequest{
+		Email:    request.Email,
+		Password: request.Password,
+		Role:     request.Role,
+
+		MustChangePassword: request.MustChangePassword,
+		Merchants:          request.Merchants,
+		MerchantGroups:     request.MerchantGroups,
+		AllMerchants:       request.AllMerchants,
+	})
+	if err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, user)
+}
+
+// UpdateUser godoc
+// @Summary Update user
+// @Description Change the role of a user, disable / enable them, make them change their password at the next login
+// @Description or limit the merchants whose payments they see,
+// @Description fields left out stay as they are (users:manage permission required). Admins cannot demote or disable themselves.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param email path string true "user email"
+// @Param body body updateUserRequest true "changes"
+// @Success 200 {object} domain.User
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /users/{email} [patch]
+func (userHandler *UserHandler) UpdateUser(ctx *gin.Context) {
+	var request updateUserRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := userHandler.userService.UpdateUser(ctx.GetString("email"), ctx.Param("email"), service.UpdateUserRequest{
+		Role:     request.Role,
+		Disabled: request.Disabled,
+
+		MustChangePassword: request.MustChangePassword,
+		Merchants:          request.Merchants,
+		MerchantGroups:     request.MerchantGroups,
+		AllMerchants:       request.AllMerchants,
+	})
+	if err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, user)
+}
+
+// DeleteUser godoc
+// @Summary Delete user
+// @Description Delete a user (users:manage permission required). Admins cannot delete themselves.
+// @Tags users
+// @Param email path string true "user email"
+// @Success 204
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /users/{email} [delete]
+func (userHandler *UserHandler) DeleteUser(ctx *gin.Context) {
+	if err := userHandler.userService.DeleteUser(ctx.GetString("email"), ctx.Param("email")); err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// UnlockUser godoc
+// @Summary Unlock user
+// @Description Lift the login lockout of an account before its cooldown ends (users:manage permission required)
+// @Tags users
+// @Param email path string true "user email"
+// @Success 204
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /users/{email}/unlock [post]
+func (userHandler *UserHandler) UnlockUser(ctx *gin.Context) {
+	if err := userHandler.userService.UnlockUser(ctx.Param("email")); err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// ResetMFA godoc
+// @Summary Reset MFA
+// @Description Turn off MFA of a user who lost their authenticator and recovery codes (users:manage permission required)
+// @Tags users
+// @Param email path string true "user email"
+// @Success 204
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Security ApiKeyAuth
+// @Router /users/{email}/mfa [delete]
+func (userHandler *UserHandler) ResetMFA(ctx *gin.Context) {
+	if err := userHandler.userService.ResetMFA(ctx.Param("email")); err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// writeUserError maps service errors of user administration to responses
+func writeUserError(ctx *gin.Context, err error) {
+	var notFoundErr *errors.NotFoundError
+	if common_errors.As(err, &notFoundErr) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var existsErr *errors.AlreadyExistsError
+	if common_errors.As(err, &existsErr) {
+		ctx.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+		return
+	}
+
+	var validationErr *errors.ValidationError
+	if common_errors.As(err, &validationErr) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
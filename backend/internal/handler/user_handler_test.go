@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/service"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func setupUserTest(t *testing.T) (*gin.Engine, *storage.MemoryStore) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	handler := NewUserHandler(service.NewUserService(store))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("email", "admin@durianpay.id")
+	})
+	r.GET("/users", handler.ListUsers)
+	r.POST("/users", handler.CreateUser)
+	r.GET("/users/:email", handler.GetUser)
+	r.PATCH("/users/:email", handler.UpdateUser)
+	r.DELETE("/users/:email", handler.DeleteUser)
+	r.POST("/users/:email/unlock", handler.UnlockUser)
+	r.DELETE("/users/:email/mfa", handler.ResetMFA)
+
+	return r, store
+}
+
+func serveUserRequest(r *gin.Engine, method, path string, body any) *httptest.ResponseRecorder {
+	var raw []byte
+	if body != nil {
+		raw, _ = json.Marshal(body)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(raw))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUserHandler(t *testing.T) {
+	r, store := setupUserTest(t)
+
+	w := serveUserRequest(r, http.MethodGet, "/users", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var users []map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &users))
+	require.Len(t, users, 3)
+	require.NotContains(t, w.Body.String(), "argon2id")
+
+	w = serveUserRequest(r, http.MethodPost, "/users", createUserRequest{Email: "new@durianpay.id", Password: "long-enough", Role: "cs"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.JSONEq(t, `{"email": "new@durianpay.id", "role": "cs", "disabled": false, "mfa_enabled": false, "must_change_password": false, "all_merchants": false}`, w.Body.String())
+
+	w = serveUserRequest(r, http.MethodPatch, "/users/new@durianpay.id", map[string]any{"disabled": true, "must_change_password": true})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"email": "new@durianpay.id", "role": "cs", "disabled": true, "mfa_enabled": false, "must_change_password": true, "all_merchants": false}`, w.Body.String())
+
+	w = serveUserRequest(r, http.MethodPatch, "/users/new@durianpay.id", map[string]any{"role": "operational"})
+	require.Equal(t, http.StatusOK, w.Code)
+	stored, _ := store.GetUserByEmail("new@durianpay.id")
+	require.Equal(t, domain.User{Email: "new@durianpay.id", PasswordHash: stored.PasswordHash, Role: "operational", Disabled: true, MustChangePassword: true}, *stored)
+
+	w = serveUserRequest(r, http.MethodGet, "/users/new@durianpay.id", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = serveUserRequest(r, http.MethodPost, "/users/new@durianpay.id/unlock", nil)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = serveUserRequest(r, http.MethodDelete, "/users/new@durianpay.id/mfa", nil)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = serveUserRequest(r, http.MethodDelete, "/users/new@durianpay.id", nil)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	_, exists := store.GetUserByEmail("new@durianpay.id")
+	require.False(t, exists)
+}
+
+func TestUserHandler_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     any
+		wantCode int
+		errorMsg string
+	}{
+		{name: "unknown user", method: http.MethodGet, path: "/users/ghost@durianpay.id", wantCode: http.StatusNotFound, errorMsg: "User not found"},
+		{name: "delete unknown user", method: http.MethodDelete, path: "/users/ghost@durianpay.id", wantCode: http.StatusNotFound, errorMsg: "User not found"},
+		{name: "unlock unknown user", method: http.MethodPost, path: "/users/ghost@durianpay.id/unlock", wantCode: http.StatusNotFound, errorMsg: "User not found"},
+		{name: "reset MFA of unknown user", method: http.MethodDelete, path: "/users/ghost@durianpay.id/mfa", wantCode: http.StatusNotFound, errorMsg: "User not found"},
+		{
+			name: "existing user", method: http.MethodPost, path: "/users",
+			body:     createUserRequest{Email: "john-cs@durianpay.id", Password: "long-enough", Role: "cs"},
+			wantCode: http.StatusConflict, errorMsg: "User already exists",
+		},
+		{
+			name: "unknown role", method: http.MethodPost, path: "/users",
+			body:     createUserRequest{Email: "new@durianpay.id", Password: "long-enough", Role: "root"},
+			wantCode: http.StatusBadRequest, errorMsg: "Invalid data: role must be one of cs, operational, admin",
+		},
+		{
+			name: "weak password", method: http.MethodPost, path: "/users",
+			body:     createUserRequest{Email: "new@durianpay.id", Password: "password123", Role: "cs"},
+			wantCode: http.StatusBadRequest, errorMsg: "Invalid data: password is too common",
+		},
+		{name: "missing fields", method: http.MethodPost, path: "/users", body: map[string]string{"email": "new@durianpay.id"}, wantCode: http.StatusBadRequest},
+		{
+			name: "disable yourself", method: http.MethodPatch, path: "/users/admin@durianpay.id",
+			body:     map[string]any{"disabled": true},
+			wantCode: http.StatusBadRequest, errorMsg: "Invalid data: you cannot disable your own account",
+		},
+		{
+			name: "delete yourself", method: http.MethodDelete, path: "/users/admin@durianpay.id",
+			wantCode: http.StatusBadRequest, errorMsg: "Invalid data: you cannot delete your own account",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := setupUserTest(t)
+			w := serveUserRequest(r, tt.method, tt.path, tt.body)
+			require.Equal(t, tt.wantCode, w.Code)
+
+			var resp map[string]string
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			require.Contains(t, resp, "error")
+			if tt.errorMsg != "" {
+				require.Equal(t, tt.errorMsg, resp["error"])
+			}
+		})
+	}
+}
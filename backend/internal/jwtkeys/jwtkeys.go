@@ -0,0 +1,227 @@
+// Package jwtkeys holds the keys tokens are signed and verified with. One key
+// signs; keys it replaced keep verifying the tokens they signed until those
+// expire, so keys can be rotated without ending every session. Public halves
+// of asymmetric keys are published as a JWK Set for other services.
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms, named as in the JWT alg header
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+// minRSABits is the smallest RSA modulus accepted, RFC 7518 section 3.3
+const minRSABits = 2048
+
+// Key is a signing or verification key. Its ID goes in the kid header of the
+// tokens it signs.
+type Key struct {
+	ID        string
+	Algorithm string
+
+	// signing is nil for a verify-only key, loaded from a public key
+	signing   crypto.PrivateKey
+	verifying crypto.PublicKey
+}
+
+// DefaultHMACKeyID names an HMAC key whose ID is not configured
+const DefaultHMACKeyID = "hs256"
+
+// HMACKey returns an HS256 key named id. The ID is configured rather than
+// derived from the secret, a derived ID would let anyone holding a token test
+// guessed secrets offline.
+func HMACKey(id string, secret []byte) *Key {
+	return &Key{ID: id, Algorithm: HS256, signing: secret, verifying: secret}
+}
+
+// Generate returns a new random key of algorithm, for tests and throwaway
+// deployments
+func Generate(algorithm string) (*Key, error) {
+	switch algorithm {
+	case HS256:
+		secret, id := make([]byte, 32), make([]byte, 16)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		return HMACKey(encode(id), secret), nil
+	case RS256:
+		private, err := rsa.GenerateKey(rand.Reader, minRSABits)
+		if err != nil {
+			return nil, err
+		}
+		return newAsymmetricKey(private, &private.PublicKey)
+	case EdDSA:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return newAsymmetricKey(private, public)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+}
+
+// ParsePEM reads an RSA or Ed25519 key. Private keys can sign (PKCS #1 or
+// PKCS #8), public keys (PKIX) only verify. The algorithm follows from the
+// key type, RS256 or EdDSA.
+func ParsePEM(raw []byte) (*Key, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newAsymmetricKey(private, &private.PublicKey)
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch private := parsed.(type) {
+		case *rsa.PrivateKey:
+			return newAsymmetricKey(private, &private.PublicKey)
+		case ed25519.PrivateKey:
+			return newAsymmetricKey(private, private.Public())
+		default:
+			return nil, fmt.Errorf("unsupported private key type %T", parsed)
+		}
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newAsymmetricKey(nil, parsed)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+// LoadFile reads a key with ParsePEM
+func LoadFile(path string) (*Key, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ParsePEM(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+func newAsymmetricKey(private crypto.PrivateKey, public crypto.PublicKey) (*Key, error) {
+	key := &Key{signing: private, verifying: public}
+
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA key has %d bits, at least %d are required", public.N.BitLen(), minRSABits)
+		}
+		key.Algorithm = RS256
+	case ed25519.PublicKey:
+		key.Algorithm = EdDSA
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", public)
+	}
+
+	jwk, _ := key.JWK()
+	key.ID = thumbprint(jwk.members())
+	return key, nil
+}
+
+// CanSign reports whether the key has its private half
+func (key *Key) CanSign() bool {
+	return key.signing != nil
+}
+
+func (key *Key) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(key.Algorithm)
+}
+
+// JWK is a public key in JSON Web Key form, RFC 7517
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA modulus and exponent
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP curve and public key, RFC 8037
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public half of the key, false for HMAC keys which have none
+func (key *Key) JWK() (JWK, bool) {
+	jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm}
+
+	switch public := key.verifying.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = encode(public.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = encode(public)
+	default:
+		return JWK{}, false
+	}
+
+	return jwk, true
+}
+
+// members are the required members of the JWK, the input of its thumbprint
+func (jwk JWK) members() map[string]string {
+	switch jwk.KeyType {
+	case "RSA":
+		return map[string]string{"kty": jwk.KeyType, "n": jwk.N, "e": jwk.E}
+	default:
+		return map[string]string{"kty": jwk.KeyType, "crv": jwk.Curve, "x": jwk.X}
+	}
+}
+
+// thumbprint is the RFC 7638 SHA-256 thumbprint of the required JWK members.
+// encoding/json sorts map keys and adds no whitespace, as the RFC asks.
+func thumbprint(members map[string]string) string {
+	raw, _ := json.Marshal(members)
+	sum := sha256.Sum256(raw)
+	return encode(sum[:])
+}
+
+func encode(raw []byte) string {
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
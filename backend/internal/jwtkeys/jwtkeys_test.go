@@ -0,0 +1,248 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func generate(t *testing.T, algorithm string) *Key {
+	key, err := Generate(algorithm)
+	require.NoError(t, err)
+	return key
+}
+
+func claims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": "someone", "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func parse(manager *Manager, token string) error {
+	_, err := jwt.Parse(token, manager.Keyfunc, jwt.WithValidMethods(manager.Algorithms()))
+	return err
+}
+
+func TestManager_SignAndVerify(t *testing.T) {
+	for _, algorithm := range []string{HS256, RS256, EdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			key := generate(t, algorithm)
+			manager, err := NewManager(key)
+			require.NoError(t, err)
+
+			signed, err := manager.Sign(claims())
+			require.NoError(t, err)
+
+			token, _, err := jwt.NewParser().ParseUnverified(signed, jwt.MapClaims{})
+			require.NoError(t, err)
+			require.Equal(t, key.ID, token.Header["kid"])
+			require.Equal(t, algorithm, token.Header["alg"])
+
+			require.NoError(t, parse(manager, signed))
+
+			// another key of the same algorithm does not verify it
+			other, err := NewManager(generate(t, algorithm))
+			require.NoError(t, err)
+			require.Error(t, parse(other, signed))
+		})
+	}
+}
+
+func TestManager_Rotation(t *testing.T) {
+	old := generate(t, HS256)
+	oldManager, err := NewManager(old)
+	require.NoError(t, err)
+	oldToken, err := oldManager.Sign(claims())
+	require.NoError(t, err)
+
+	// moving from HMAC to EdDSA keeps the HMAC key for verification
+	current := generate(t, EdDSA)
+	manager, err := NewManager(current, old)
+	require.NoError(t, err)
+	require.Equal(t, current, manager.Current())
+	require.ElementsMatch(t, []string{EdDSA, HS256}, manager.Algorithms())
+
+	newToken, err := manager.Sign(claims())
+	require.NoError(t, err)
+	require.NoError(t, parse(manager, newToken))
+	require.NoError(t, parse(manager, oldToken))
+
+	// once the old key is dropped its tokens stop working
+	retired, err := NewManager(current)
+	require.NoError(t, err)
+	require.Error(t, parse(retired, oldToken))
+	require.NoError(t, parse(retired, newToken))
+}
+
+func TestManager_LegacyTokensWithoutKid(t *testing.T) {
+	secret := []byte("legacy-secret")
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims()).SignedString(secret)
+	require.NoError(t, err)
+
+	manager, err := NewManager(generate(t, RS256), generate(t, HS256), HMACKey("legacy", secret))
+	require.NoError(t, err)
+	require.NoError(t, parse(manager, legacy))
+
+	manager, err = NewManager(generate(t, RS256))
+	require.NoError(t, err)
+	require.Error(t, parse(manager, legacy))
+}
+
+func TestManager_RejectsAlgorithmConfusion(t *testing.T) {
+	rsaKey := generate(t, RS256)
+	manager, err := NewManager(rsaKey)
+	require.NoError(t, err)
+
+	// an HS256 token keyed with the published public key, naming the RSA key
+	public, err := x509.MarshalPKIXPublicKey(rsaKey.verifying)
+	require.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	forged.Header["kid"] = rsaKey.ID
+	signed, err := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}))
+	require.NoError(t, err)
+	require.Error(t, parse(manager, signed))
+
+	// and one naming a key of the right algorithm that is not configured
+	unknown := jwt.NewWithClaims(jwt.SigningMethodRS256, claims())
+	unknown.Header["kid"] = "unknown"
+	other := generate(t, RS256)
+	signed, err = unknown.SignedString(other.signing)
+	require.NoError(t, err)
+	require.Error(t, parse(manager, signed))
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	require.Error(t, parse(manager, unsigned))
+}
+
+func TestNewManager(t *testing.T) {
+	key := generate(t, EdDSA)
+	public, err := newAsymmetricKey(nil, key.verifying)
+	require.NoError(t, err)
+	require.Equal(t, key.ID, public.ID)
+
+	_, err = NewManager(public)
+	require.Error(t, err, "verify-only keys cannot sign")
+	_, err = NewManager(nil)
+	require.Error(t, err)
+	_, err = NewManager(key, public)
+	require.Error(t, err, "duplicate kid")
+
+	manager, err := NewManager(generate(t, HS256), public)
+	require.NoError(t, err)
+	require.Len(t, manager.JWKS().Keys, 1)
+}
+
+func TestManager_JWKS(t *testing.T) {
+	rsaKey, edKey := generate(t, RS256), generate(t, EdDSA)
+	manager, err := NewManager(rsaKey, generate(t, HS256), edKey)
+	require.NoError(t, err)
+
+	set := manager.JWKS()
+	require.Len(t, set.Keys, 2)
+
+	rsaJWK := set.Keys[0]
+	require.Equal(t, JWK{KeyType: "RSA", KeyID: rsaKey.ID, Use: "sig", Algorithm: RS256, N: rsaJWK.N, E: "AQAB"}, rsaJWK)
+	modulus, err := base64.RawURLEncoding.DecodeString(rsaJWK.N)
+	require.NoError(t, err)
+	require.Equal(t, rsaKey.verifying.(*rsa.PublicKey).N.Bytes(), modulus)
+
+	edJWK := set.Keys[1]
+	require.Equal(t, "OKP", edJWK.KeyType)
+	require.Equal(t, "Ed25519", edJWK.Curve)
+	require.Equal(t, EdDSA, edJWK.Algorithm)
+	require.Equal(t, base64.RawURLEncoding.EncodeToString(edKey.verifying.(ed25519.PublicKey)), edJWK.X)
+
+	manager, err = NewManager(generate(t, HS256))
+	require.NoError(t, err)
+	require.Empty(t, manager.JWKS().Keys)
+}
+
+func TestKeyIDIsThumbprint(t *testing.T) {
+	// RFC 8037 appendix A.3
+	x, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	require.NoError(t, err)
+	key, err := newAsymmetricKey(nil, ed25519.PublicKey(x))
+	require.NoError(t, err)
+	require.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", key.ID)
+
+	// HMAC key IDs say nothing about the secret
+	require.Equal(t, "primary", HMACKey("primary", []byte("secret")).ID)
+	require.NotEqual(t, generate(t, HS256).ID, generate(t, HS256).ID)
+}
+
+func TestParsePEM(t *testing.T) {
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, minRSABits)
+	require.NoError(t, err)
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	encode := func(blockType string, raw []byte, err error) []byte {
+		require.NoError(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: raw})
+	}
+	pkcs8 := func(key any) []byte {
+		raw, err := x509.MarshalPKCS8PrivateKey(key)
+		return encode("PRIVATE KEY", raw, err)
+	}
+	pkix := func(key any) []byte {
+		raw, err := x509.MarshalPKIXPublicKey(key)
+		return encode("PUBLIC KEY", raw, err)
+	}
+
+	tests := []struct {
+		name          string
+		pem           []byte
+		wantAlgorithm string
+		wantSign      bool
+	}{
+		{name: "RSA PKCS #1", pem: encode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaPrivate), nil), wantAlgorithm: RS256, wantSign: true},
+		{name: "RSA PKCS #8", pem: pkcs8(rsaPrivate), wantAlgorithm: RS256, wantSign: true},
+		{name: "RSA public", pem: pkix(&rsaPrivate.PublicKey), wantAlgorithm: RS256},
+		{name: "Ed25519 PKCS #8", pem: pkcs8(edPrivate), wantAlgorithm: EdDSA, wantSign: true},
+		{name: "Ed25519 public", pem: pkix(edPrivate.Public()), wantAlgorithm: EdDSA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParsePEM(tt.pem)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantAlgorithm, key.Algorithm)
+			require.Equal(t, tt.wantSign, key.CanSign())
+			require.NotEmpty(t, key.ID)
+		})
+	}
+
+	// private and public halves share the ID
+	private, err := ParsePEM(pkcs8(rsaPrivate))
+	require.NoError(t, err)
+	public, err := ParsePEM(pkix(&rsaPrivate.PublicKey))
+	require.NoError(t, err)
+	require.Equal(t, private.ID, public.ID)
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	_, err = ParsePEM(pkcs8(small))
+	require.ErrorContains(t, err, "at least 2048")
+
+	_, err = ParsePEM([]byte("not a key"))
+	require.Error(t, err)
+	_, err = ParsePEM(encode("CERTIFICATE", []byte("x"), nil))
+	require.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(path, pkcs8(edPrivate), 0o600))
+	key, err := LoadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, EdDSA, key.Algorithm)
+	_, err = LoadFile(filepath.Join(t.TempDir(), "missing.pem"))
+	require.Error(t, err)
+}
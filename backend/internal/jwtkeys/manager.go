@@ -0,0 +1,105 @@
+package jwtkeys
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Manager signs with its current key and verifies with the current and the
+// previous keys
+type Manager struct {
+	// keys holds the current key first
+	keys []*Key
+}
+
+// NewManager needs a current key that can sign. previous keys may be
+// verify-only; key IDs must be unique.
+func NewManager(current *Key, previous ...*Key) (*Manager, error) {
+	if current == nil || !current.CanSign() {
+		return nil, fmt.Errorf("the current key must be able to sign")
+	}
+
+	keys := append([]*Key{current}, previous...)
+	for i, key := range keys {
+		if jwt.GetSigningMethod(key.Algorithm) == nil {
+			return nil, fmt.Errorf("key %s: unsupported algorithm %q", key.ID, key.Algorithm)
+		}
+		if slices.ContainsFunc(keys[:i], func(other *Key) bool { return other.ID == key.ID }) {
+			return nil, fmt.Errorf("key %s is configured twice", key.ID)
+		}
+	}
+
+	return &Manager{keys: keys}, nil
+}
+
+// Current is the signing key
+func (manager *Manager) Current() *Key {
+	return manager.keys[0]
+}
+
+// Sign signs claims with the current key and names it in the kid header
+func (manager *Manager) Sign(claims jwt.Claims) (string, error) {
+	current := manager.Current()
+
+	token := jwt.NewWithClaims(current.method(), claims)
+	token.Header["kid"] = current.ID
+	return token.SignedString(current.signing)
+}
+
+// Algorithms lists the algorithms of all keys, for jwt.WithValidMethods
+func (manager *Manager) Algorithms() []string {
+	var algorithms []string
+	for _, key := range manager.keys {
+		if !slices.Contains(algorithms, key.Algorithm) {
+			algorithms = append(algorithms, key.Algorithm)
+		}
+	}
+	return algorithms
+}
+
+// Keyfunc picks the verification key named by the kid header. The key's
+// algorithm must match the token's, so a public key is never used as an HMAC
+// secret. Tokens signed before kids were stamped are tried against every key
+// of their algorithm.
+func (manager *Manager) Keyfunc(token *jwt.Token) (any, error) {
+	algorithm := token.Method.Alg()
+
+	kid, hasKid := token.Header["kid"].(string)
+	if hasKid {
+		for _, key := range manager.keys {
+			if key.ID != kid {
+				continue
+			}
+			if key.Algorithm != algorithm {
+				return nil, fmt.Errorf("key %s is not an %s key", kid, algorithm)
+			}
+			return key.verifying, nil
+		}
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	var candidates []jwt.VerificationKey
+	for _, key := range manager.keys {
+		if key.Algorithm == algorithm {
+			candidates = append(candidates, key.verifying)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no %s key", algorithm)
+	}
+	return jwt.VerificationKeySet{Keys: candidates}, nil
+}
+
+// JWKS publishes the public halves of the asymmetric keys, the current one
+// first. HMAC keys are secret and left out.
+func (manager *Manager) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range manager.keys {
+		if jwk, ok := key.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
@@ -27,19 +27,42 @@ func AuthMiddleware(auth *service.AuthService) gin.HandlerFunc {
 		}
 
 		token := authPart[1]
-		claims, err := auth.ParseToken(token)
+
+		// service accounts send an API key in place of a JWT, they have no
+		// claims and may only use the scopes of the key
+		if service.IsAPIKey(token) {
+			account, key, err := auth.AuthorizeAPIKey(token)
+			if err != nil {
+				ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				return
+			}
+
+			ctx.Set("role", account.Role)
+			ctx.Set("email", account.Name)
+			// service accounts are integrations, not limited to merchants
+			ctx.Set("all_merchants", true)
+
+			ctx.Set("scopes", key.Scopes)
+
+			ctx.Next()
+			return
+		}
+
+		// Authorize also rejects tokens revoked by a logout and tokens of
+		// users that were disabled or deleted since
+		user, claims, err := auth.Authorize(token)
 		if err != nil {
 			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			return
 		}
 
-		if role, ok := claims["role"].(string); ok {
-			ctx.Set("role", role)
-		}
+		ctx.Set("role", user.Role)
+		ctx.Set("email", user.Email)
+		ctx.Set("merchants", user.Merchants)
+		ctx.Set("merchant_groups", user.MerchantGroups)
+		ctx.Set("all_merchants", user.AllMerchants)
 
-		if email, ok := claims["email"].(string); ok {
-			ctx.Set("email", email)
-		}
+		ctx.Set("claims", claims)
 
 		ctx.Next()
 	}
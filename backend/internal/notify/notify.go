@@ -0,0 +1,117 @@
+// Package notify delivers messages to users, such as password reset links.
+// Notifier is the extension point for real delivery like email; Outbox
+// writes messages to a directory instead, for development and tests.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is addressed to a single user
+type Message struct {
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, message Message) error
+}
+
+// Outbox keeps every message as a JSON file in a directory, named so they
+// sort in the order they were sent. Messages carry secrets such as reset
+// links, so the directory and the files are only readable by the owner.
+type Outbox struct {
+	dir string
+
+	mu       sync.Mutex
+	sequence int
+}
+
+func NewOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create outbox %s: %w", dir, err)
+	}
+	return &Outbox{dir: dir}, nil
+}
+
+func (outbox *Outbox) Notify(ctx context.Context, message Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if message.SentAt.IsZero() {
+		message.SentAt = time.Now()
+	}
+
+	data, err := json.MarshalIndent(message, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+
+	// the sequence orders messages sent within the same clock tick
+	outbox.sequence++
+	name := fmt.Sprintf("%020d-%06d.json", message.SentAt.UnixNano(), outbox.sequence%1_000_000)
+	return writeFile(filepath.Join(outbox.dir, name), data)
+}
+
+// Messages returns the messages in the outbox, oldest first
+func (outbox *Outbox) Messages() ([]Message, error) {
+	entries, err := os.ReadDir(outbox.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	messages := make([]Message, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(outbox.dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		var message Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			return nil, fmt.Errorf("read %s: %w", name, err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// writeFile creates path with data under a temporary name first, so a
+// reader of the outbox never sees half a message
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
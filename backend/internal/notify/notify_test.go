@@ -0,0 +1,55 @@
+package notify
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	outbox, err := NewOutbox(dir)
+	require.NoError(t, err)
+
+	messages, err := outbox.Messages()
+	require.NoError(t, err)
+	require.Empty(t, messages)
+
+	sentAt := time.Now()
+	for _, to := range []string{"a@durianpay.id", "b@durianpay.id", "c@durianpay.id"} {
+		require.NoError(t, outbox.Notify(context.Background(), Message{To: to, Subject: "Hello", Body: "body", SentAt: sentAt}))
+	}
+
+	messages, err = outbox.Messages()
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+	// sent in the same instant and still in order
+	require.Equal(t, "a@durianpay.id", messages[0].To)
+	require.Equal(t, "b@durianpay.id", messages[1].To)
+	require.Equal(t, "c@durianpay.id", messages[2].To)
+	require.Equal(t, "Hello", messages[0].Subject)
+	require.True(t, messages[0].SentAt.Equal(sentAt))
+
+	// messages carry secrets
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	info, err = entries[0].Info()
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// a cancelled request sends nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, outbox.Notify(ctx, Message{To: "d@durianpay.id"}), context.Canceled)
+	messages, err = outbox.Messages()
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+}
@@ -0,0 +1,148 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// refetchInterval limits JWKS fetches for unknown key ids, so tokens with
+// made up kids cannot make us hammer the IdP
+var refetchInterval = time.Minute
+
+// supportedAlgorithms are the ID token signatures accepted. HMAC is not
+// among them, a token signed with the client secret or a public key as
+// secret is rejected.
+var supportedAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "PS256"}
+
+// jwk is a key of a JSON Web Key Set (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type keySet struct {
+	uri   string
+	fetch func(ctx context.Context, target string, value any) error
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	lastFetched time.Time
+}
+
+func newKeySet(uri string, fetch func(ctx context.Context, target string, value any) error) *keySet {
+	return &keySet{uri: uri, fetch: fetch, keys: map[string]crypto.PublicKey{}}
+}
+
+// key returns the signing key kid, refetching the set once the IdP
+// rotated to a key we have not seen yet
+func (set *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	if key, ok := set.lookup(kid); ok {
+		return key, nil
+	}
+	if time.Since(set.lastFetched) < refetchInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var document struct {
+		Keys []jwk `json:"keys"`
+	}
+	set.lastFetched = time.Now()
+	if err := set.fetch(ctx, set.uri, &document); err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, raw := range document.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+		// keys we cannot use are skipped, the set may hold other kinds
+		if key, err := raw.publicKey(); err == nil {
+			keys[raw.Kid] = key
+		}
+	}
+	set.keys = keys
+
+	if key, ok := set.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup finds kid, a token without kid is fine while the set has one key
+func (set *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(set.keys) == 1 {
+		for _, key := range set.keys {
+			return key, true
+		}
+	}
+	key, ok := set.keys[kid]
+	return key, ok
+}
+
+func (raw jwk) publicKey() (crypto.PublicKey, error) {
+	switch raw.Kty {
+	case "RSA":
+		n, err := decodeBigInt(raw.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(raw.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, fmt.Errorf("rsa exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch raw.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", raw.Crv)
+		}
+		x, err := decodeBigInt(raw.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(raw.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", raw.Kty)
+	}
+}
+
+func decodeBigInt(encoded string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(raw) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
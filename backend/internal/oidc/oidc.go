@@ -0,0 +1,271 @@
+// Package oidc is a relying party for OpenID Connect single sign-on: the
+// authorization code flow with PKCE against any IdP that publishes a
+// discovery document, with ID tokens verified against the IdP's JWKS.
+// It only speaks the protocol, mapping identities to users is up to the
+// caller.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// leeway absorbs clock drift between us and the IdP when checking ID token times
+const leeway = time.Minute
+
+// Config describes the IdP and how we are registered with it
+type Config struct {
+	// Issuer is the IdP's issuer URL, its discovery document is looked up below it
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is our callback as registered with the IdP
+	RedirectURL string
+	// Scopes are requested besides openid, email by default
+	Scopes []string
+	// GroupsClaim names the ID token claim listing the user's groups, "groups" by default
+	GroupsClaim string
+	// HTTPClient talks to the IdP, a client with a 10 second timeout by default
+	HTTPClient *http.Client
+}
+
+// Identity is what a verified ID token says about the user
+type Identity struct {
+	Subject string
+	Email   string
+	// EmailVerified is false when the IdP says so, and true when it does not say
+	EmailVerified bool
+	Groups        []string
+	// AMR are the authentication methods the IdP reports, if any
+	AMR []string
+}
+
+// Provider is an IdP. The discovery document is fetched on first use and
+// kept, so the server starts even while the IdP is down.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *metadata
+	keys     *keySet
+}
+
+// metadata is the part of the discovery document we use
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewProvider(config Config) *Provider {
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"email"}
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &Provider{config: config, client: client}
+}
+
+// discover returns the IdP metadata, fetching it the first time
+func (provider *Provider) discover(ctx context.Context) (*metadata, *keySet, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if provider.metadata != nil {
+		return provider.metadata, provider.keys, nil
+	}
+
+	var found metadata
+	if err := provider.getJSON(ctx, provider.config.Issuer+"/.well-known/openid-configuration", &found); err != nil {
+		return nil, nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	// a document for another issuer would make us trust its tokens
+	if strings.TrimSuffix(found.Issuer, "/") != provider.config.Issuer {
+		return nil, nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", found.Issuer, provider.config.Issuer)
+	}
+	if found.AuthorizationEndpoint == "" || found.TokenEndpoint == "" || found.JWKSURI == "" {
+		return nil, nil, fmt.Errorf("oidc discovery: incomplete provider metadata")
+	}
+
+	provider.metadata = &found
+	provider.keys = newKeySet(found.JWKSURI, provider.getJSON)
+	return provider.metadata, provider.keys, nil
+}
+
+// AuthCodeURL is where to send the user to log in. state and nonce tie the
+// callback and the ID token to this attempt, challenge is the PKCE code
+// challenge of the verifier later passed to Exchange.
+func (provider *Provider) AuthCodeURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+	found, _, err := provider.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.config.ClientID)
+	query.Set("redirect_uri", provider.config.RedirectURL)
+	query.Set("scope", strings.Join(append([]string{"openid"}, provider.config.Scopes...), " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", challenge)
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(found.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return found.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// tokenResponse is the token endpoint's answer, success or error
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange redeems an authorization code with its PKCE verifier and
+// returns the identity in the verified ID token, which must carry nonce
+func (provider *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	found, keys, err := provider.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", provider.config.RedirectURL)
+	form.Set("client_id", provider.config.ClientID)
+	form.Set("code_verifier", verifier)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, found.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if provider.config.ClientSecret != "" {
+		// client_secret_basic, RFC 6749 section 2.3.1 wants both form encoded first
+		request.SetBasicAuth(url.QueryEscape(provider.config.ClientID), url.QueryEscape(provider.config.ClientSecret))
+	}
+
+	response, err := provider.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("oidc token request: %w", err)
+	}
+	defer response.Body.Close()
+
+	var tokens tokenResponse
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("oidc token response: %w", err)
+	}
+	if response.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("oidc token request: %d %s %s", response.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("oidc token response: no id_token")
+	}
+
+	return provider.verify(ctx, keys, tokens.IDToken, nonce)
+}
+
+// verify checks the ID token as OpenID Connect Core section 3.1.3.7 asks
+func (provider *Provider) verify(ctx context.Context, keys *keySet, idToken, nonce string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return keys.key(ctx, kid)
+	},
+		jwt.WithValidMethods(supportedAlgorithms),
+		jwt.WithIssuer(provider.config.Issuer),
+		jwt.WithAudience(provider.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(leeway),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("oidc id token: %w", err)
+	}
+
+	audience, _ := claims.GetAudience()
+	if azp, _ := claims["azp"].(string); len(audience) > 1 && azp != provider.config.ClientID {
+		return nil, fmt.Errorf("oidc id token: issued to %q", azp)
+	}
+	if claims["nonce"] != nonce {
+		return nil, fmt.Errorf("oidc id token: nonce mismatch")
+	}
+
+	identity := &Identity{EmailVerified: true}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	if verified, ok := claims["email_verified"].(bool); ok {
+		identity.EmailVerified = verified
+	}
+	identity.Groups = stringList(claims[provider.config.GroupsClaim])
+	identity.AMR = stringList(claims["amr"])
+
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("oidc id token: no subject")
+	}
+	return identity, nil
+}
+
+// stringList reads a claim that is a list of strings, or a single string
+func stringList(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if text, ok := item.(string); ok {
+				list = append(list, text)
+			}
+		}
+		return slices.Clip(list)
+	default:
+		return nil
+	}
+}
+
+func (provider *Provider) getJSON(ctx context.Context, target string, value any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+
+	response, err := provider.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", target, response.Status)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(value)
+}
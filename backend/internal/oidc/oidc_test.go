@@ -0,0 +1,205 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/oidc/oidctest"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+const redirectURL = "http://localhost:8080/dashboard/v1/auth/oidc/callback"
+
+func newTestProvider(idp *oidctest.IdP) *Provider {
+	return NewProvider(Config{
+		Issuer:       idp.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"email", "groups"},
+	})
+}
+
+// login runs the flow up to the callback and returns its code
+func login(t *testing.T, idp *oidctest.IdP, provider *Provider, verifier, nonce string) string {
+	authURL, err := provider.AuthCodeURL(context.Background(), "state-1", nonce, Challenge(verifier))
+	require.NoError(t, err)
+
+	callback := idp.Authorize(t, authURL)
+	require.Equal(t, "state-1", callback.Query().Get("state"))
+	return callback.Query().Get("code")
+}
+
+func TestProvider_Exchange(t *testing.T) {
+	idp := oidctest.NewIdP(t)
+	idp.SetClaims(jwt.MapClaims{
+		"sub":    "user-1",
+		"email":  "sso@durianpay.id",
+		"groups": []string{"cs-agents", "everyone"},
+		"amr":    []string{"pwd", "mfa"},
+	})
+	provider := newTestProvider(idp)
+
+	authURL, err := provider.AuthCodeURL(context.Background(), "state-1", "nonce-1", Challenge("verifier"))
+	require.NoError(t, err)
+	parsed, err := url.Parse(authURL)
+	require.NoError(t, err)
+	require.Equal(t, idp.Issuer()+"/authorize", parsed.Scheme+"://"+parsed.Host+parsed.Path)
+	require.Equal(t, "openid email groups", parsed.Query().Get("scope"))
+	require.Equal(t, redirectURL, parsed.Query().Get("redirect_uri"))
+	require.Equal(t, "S256", parsed.Query().Get("code_challenge_method"))
+
+	code := login(t, idp, provider, "verifier", "nonce-1")
+	identity, err := provider.Exchange(context.Background(), code, "verifier", "nonce-1")
+	require.NoError(t, err)
+	require.Equal(t, &Identity{
+		Subject:       "user-1",
+		Email:         "sso@durianpay.id",
+		EmailVerified: true,
+		Groups:        []string{"cs-agents", "everyone"},
+		AMR:           []string{"pwd", "mfa"},
+	}, identity)
+
+	// codes work once
+	_, err = provider.Exchange(context.Background(), code, "verifier", "nonce-1")
+	require.Error(t, err)
+
+	// and only with their verifier
+	code = login(t, idp, provider, "verifier", "nonce-1")
+	_, err = provider.Exchange(context.Background(), code, "another verifier", "nonce-1")
+	require.ErrorContains(t, err, "invalid_grant")
+}
+
+func TestProvider_RejectsIDTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(claims jwt.MapClaims)
+		nonce   string
+		wantErr string
+	}{
+		{name: "other audience", tamper: func(c jwt.MapClaims) { c["aud"] = "other-client" }, wantErr: "audience"},
+		{name: "other issuer", tamper: func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }, wantErr: "issuer"},
+		{name: "expired", tamper: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, wantErr: "expired"},
+		{name: "no expiry", tamper: func(c jwt.MapClaims) { delete(c, "exp") }, wantErr: "exp"},
+		{name: "issued in the future", tamper: func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() }, wantErr: "used before issued"},
+		{name: "other nonce", nonce: "replayed", wantErr: "nonce"},
+		{name: "no subject", tamper: func(c jwt.MapClaims) { delete(c, "sub") }, wantErr: "subject"},
+		{
+			name:    "several audiences without azp",
+			tamper:  func(c jwt.MapClaims) { c["aud"] = []string{oidctest.ClientID, "other-client"} },
+			wantErr: "issued to",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := oidctest.NewIdP(t)
+			idp.Tamper = tt.tamper
+			provider := newTestProvider(idp)
+
+			code := login(t, idp, provider, "verifier", "nonce-1")
+			nonce := "nonce-1"
+			if tt.nonce != "" {
+				nonce = tt.nonce
+			}
+			_, err := provider.Exchange(context.Background(), code, "verifier", nonce)
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestProvider_RejectsForgedSignatures(t *testing.T) {
+	idp := oidctest.NewIdP(t)
+	provider := newTestProvider(idp)
+	_, keys, err := provider.discover(context.Background())
+	require.NoError(t, err)
+
+	claims := jwt.MapClaims{
+		"iss": idp.Issuer(), "aud": oidctest.ClientID, "sub": "user-1", "nonce": "n",
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix(),
+	}
+
+	signed, err := idp.Sign(claims)
+	require.NoError(t, err)
+	_, err = provider.verify(context.Background(), keys, signed, "n")
+	require.NoError(t, err)
+
+	// HMAC with the client secret is not accepted
+	hmac, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(oidctest.ClientSecret))
+	require.NoError(t, err)
+	_, err = provider.verify(context.Background(), keys, hmac, "n")
+	require.ErrorContains(t, err, "signing method")
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = provider.verify(context.Background(), keys, unsigned, "n")
+	require.Error(t, err)
+
+	// a key the IdP does not publish
+	other := oidctest.NewIdP(t)
+	forged, err := other.Sign(claims)
+	require.NoError(t, err)
+	_, err = provider.verify(context.Background(), keys, forged, "n")
+	require.ErrorContains(t, err, "unknown signing key")
+}
+
+func TestProvider_KeyRotation(t *testing.T) {
+	idp := oidctest.NewIdP(t)
+	provider := newTestProvider(idp)
+
+	code := login(t, idp, provider, "verifier", "nonce-1")
+	_, err := provider.Exchange(context.Background(), code, "verifier", "nonce-1")
+	require.NoError(t, err)
+
+	// the new key is not fetched again right away
+	idp.RotateKey(t)
+	code = login(t, idp, provider, "verifier", "nonce-1")
+	_, err = provider.Exchange(context.Background(), code, "verifier", "nonce-1")
+	require.ErrorContains(t, err, "unknown signing key")
+
+	refetchInterval = 0
+	t.Cleanup(func() { refetchInterval = time.Minute })
+	code = login(t, idp, provider, "verifier", "nonce-1")
+	_, err = provider.Exchange(context.Background(), code, "verifier", "nonce-1")
+	require.NoError(t, err)
+}
+
+func TestProvider_Discovery(t *testing.T) {
+	// an IdP claiming to be another issuer is not trusted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"issuer": "https://idp.example", "authorization_endpoint": "https://idp.example/authorize",
+			"token_endpoint": "https://idp.example/token", "jwks_uri": "https://idp.example/jwks"}`))
+	}))
+	defer server.Close()
+
+	provider := NewProvider(Config{Issuer: server.URL, ClientID: "client"})
+	_, err := provider.AuthCodeURL(context.Background(), "s", "n", "c")
+	require.ErrorContains(t, err, "does not match")
+
+	// an IdP that is down fails the login, not the start of the server
+	server.Close()
+	_, err = provider.AuthCodeURL(context.Background(), "s", "n", "c")
+	require.ErrorContains(t, err, "oidc discovery")
+}
+
+func TestStringList(t *testing.T) {
+	require.Equal(t, []string{"a"}, stringList("a"))
+	require.Equal(t, []string{"a", "b"}, stringList([]any{"a", 1, "b"}))
+	require.Nil(t, stringList(nil))
+	require.Nil(t, stringList(42))
+}
+
+func TestChallenge(t *testing.T) {
+	// base64url of the SHA-256, without padding
+	require.Equal(t, "wJcHylfBUcuIch8JkDrHElrGPIhZda0H3UNRBfEFYuo", Challenge("dBjftJeZ4CVP-mB92K8rVSdQWYCVSZTYyoDfmEwW1ZM"))
+
+	verifier, err := RandomString()
+	require.NoError(t, err)
+	require.Len(t, verifier, 43)
+}
@@ -0,0 +1,253 @@
+// Package oidctest is an in-process OpenID Connect provider for tests. It
+// implements discovery, the authorization endpoint (approving every login
+// as the configured user), the token endpoint with PKCE and a JWKS, so the
+// whole single sign-on flow runs without an external IdP.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	ClientID     = "cs-center"
+	ClientSecret = "cs-center-secret"
+)
+
+// IdP is a running mock provider, closed when the test ends
+type IdP struct {
+	Server *httptest.Server
+
+	// Tamper, when set, may change the claims of an ID token before it is
+	// signed. Set it before starting a login.
+	Tamper func(claims jwt.MapClaims)
+
+	mu sync.Mutex
+	// claims are the user claims of the next ID tokens
+	claims jwt.MapClaims
+
+	kid   string
+	key   *rsa.PrivateKey
+	codes map[string]grant
+}
+
+// grant is an issued authorization code
+type grant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	claims      jwt.MapClaims
+}
+
+func NewIdP(t testing.TB) *IdP {
+	t.Helper()
+
+	idp := &IdP{
+		claims: jwt.MapClaims{"sub": "user-1", "email": "sso@durianpay.id", "email_verified": true},
+		codes:  map[string]grant{},
+	}
+	idp.RotateKey(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("GET /authorize", idp.authorize)
+	mux.HandleFunc("POST /token", idp.token)
+	mux.HandleFunc("GET /jwks", idp.jwks)
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Server.Close)
+	return idp
+}
+
+// Issuer is the issuer URL to configure the relying party with
+func (idp *IdP) Issuer() string {
+	return idp.Server.URL
+}
+
+// SetClaims replaces the user claims of the next ID tokens, sub, email and
+// groups for example
+func (idp *IdP) SetClaims(claims jwt.MapClaims) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.claims = claims
+}
+
+// RotateKey switches to a new signing key with a new key id
+func (idp *IdP) RotateKey(t testing.TB) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("oidctest: generate key: %v", err)
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.key = key
+	idp.kid = uuid.NewString()
+}
+
+// Authorize plays the browser at the authorization endpoint: it follows
+// authURL and returns the callback URL the IdP redirects to
+func (idp *IdP) Authorize(t testing.TB, authURL string) *url.URL {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("oidctest: authorize: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("oidctest: authorize: %s", response.Status)
+	}
+	callback, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("oidctest: authorize: %v", err)
+	}
+	return callback
+}
+
+func (idp *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                idp.Issuer(),
+		"authorization_endpoint":                idp.Issuer() + "/authorize",
+		"token_endpoint":                        idp.Issuer() + "/token",
+		"jwks_uri":                              idp.Issuer() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (idp *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" ||
+		query.Get("code_challenge") == "" || query.Get("client_id") != ClientID {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	idp.mu.Lock()
+	claims := jwt.MapClaims{}
+	for name, value := range idp.claims {
+		claims[name] = value
+	}
+	code := uuid.NewString()
+	idp.codes[code] = grant{
+		clientID:    query.Get("client_id"),
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		claims:      claims,
+	}
+	idp.mu.Unlock()
+
+	callback := redirectURI.Query()
+	callback.Set("code", code)
+	callback.Set("state", query.Get("state"))
+	redirectURI.RawQuery = callback.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (idp *IdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, _ := r.BasicAuth()
+	clientID, _ = url.QueryUnescape(clientID)
+	secret, _ = url.QueryUnescape(secret)
+	if clientID != ClientID || secret != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	idp.mu.Lock()
+	code := r.PostFormValue("code")
+	issued, ok := idp.codes[code]
+	// codes work once
+	delete(idp.codes, code)
+	idp.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || issued.clientID != clientID ||
+		issued.redirectURI != r.PostFormValue("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != issued.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   idp.Issuer(),
+		"aud":   ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": issued.nonce,
+	}
+	for name, value := range issued.claims {
+		claims[name] = value
+	}
+
+	idToken, err := idp.Sign(claims)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": uuid.NewString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+// Sign signs claims with the current key, after Tamper had its say
+func (idp *IdP) Sign(claims jwt.MapClaims) (string, error) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	if idp.Tamper != nil {
+		idp.Tamper(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.kid
+	return token.SignedString(idp.key)
+}
+
+func (idp *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": idp.kid,
+		"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
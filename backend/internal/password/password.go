@@ -0,0 +1,121 @@
+// Package password hashes and verifies user passwords. Hashes are stored in
+// PHC string format, so the algorithm and its parameters travel with the
+// value and can be raised later without breaking existing users.
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Params are the argon2id parameters new hashes are made with
+type Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultParams follow the OWASP recommendation for argon2id
+var DefaultParams = Params{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// dummyHash is verified against when there is no stored hash, so a login for
+// an unknown user costs as much as one for a known user
+var dummyHash, _ = Hash("not a password")
+
+// Hash returns the argon2id hash of plain with DefaultParams
+func Hash(plain string) (string, error) {
+	return HashWithParams(plain, DefaultParams)
+}
+
+func HashWithParams(plain string, params Params) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(plain), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify reports whether plain matches the stored value. needsRehash is set
+// on a match when the value is not an argon2id hash with at least
+// DefaultParams: a bcrypt hash, a weaker argon2id hash, or a legacy
+// plaintext password. An empty stored value never matches.
+func Verify(stored string, plain string) (match bool, needsRehash bool) {
+	switch {
+	case stored == "":
+		Verify(dummyHash, plain)
+		return false, false
+	case strings.HasPrefix(stored, "$argon2id$"):
+		params, ok := verifyArgon2id(stored, plain)
+		if !ok {
+			return false, false
+		}
+		return true, params.weakerThan(DefaultParams)
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		match := bcrypt.CompareHashAndPassword([]byte(stored), []byte(plain)) == nil
+		return match, match
+	default:
+		// legacy plaintext, still compared in constant time and hashed on first use
+		Verify(dummyHash, plain)
+		match := subtle.ConstantTimeCompare([]byte(stored), []byte(plain)) == 1
+		return match, match
+	}
+}
+
+func verifyArgon2id(stored string, plain string) (Params, bool) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return Params{}, false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Params{}, false
+	}
+
+	var params Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return Params{}, false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Params{}, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Params{}, false
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	candidate := argon2.IDKey([]byte(plain), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return params, subtle.ConstantTimeCompare(key, candidate) == 1
+}
+
+func (params Params) weakerThan(other Params) bool {
+	return params.Memory < other.Memory ||
+		params.Iterations < other.Iterations ||
+		params.Parallelism < other.Parallelism ||
+		params.SaltLength < other.SaltLength ||
+		params.KeyLength < other.KeyLength
+}
@@ -0,0 +1,64 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	hash, err := Hash("admin123")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$"), hash)
+	require.NotContains(t, hash, "admin123")
+
+	// salted, the same password never hashes the same twice
+	again, err := Hash("admin123")
+	require.NoError(t, err)
+	require.NotEqual(t, hash, again)
+
+	match, needsRehash := Verify(hash, "admin123")
+	require.True(t, match)
+	require.False(t, needsRehash)
+
+	match, _ = Verify(hash, "admin124")
+	require.False(t, match)
+}
+
+func TestVerify(t *testing.T) {
+	weaker, err := HashWithParams("secret", Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	require.NoError(t, err)
+	stronger, err := HashWithParams("secret", Params{Memory: 32 * 1024, Iterations: 3, Parallelism: 2, SaltLength: 16, KeyLength: 32})
+	require.NoError(t, err)
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		stored          string
+		plain           string
+		wantMatch       bool
+		wantNeedsRehash bool
+	}{
+		{name: "weaker argon2id", stored: weaker, plain: "secret", wantMatch: true, wantNeedsRehash: true},
+		{name: "stronger argon2id", stored: stronger, plain: "secret", wantMatch: true},
+		{name: "bcrypt", stored: string(bcryptHash), plain: "secret", wantMatch: true, wantNeedsRehash: true},
+		{name: "bcrypt mismatch", stored: string(bcryptHash), plain: "Secret"},
+		{name: "legacy plaintext", stored: "secret", plain: "secret", wantMatch: true, wantNeedsRehash: true},
+		{name: "legacy plaintext mismatch", stored: "secret", plain: "secret "},
+		{name: "empty stored value", stored: "", plain: ""},
+		{name: "malformed argon2id", stored: "$argon2id$v=19$m=abc$salt$key", plain: "secret"},
+		{name: "other argon2 version", stored: strings.Replace(stronger, "v=19", "v=16", 1), plain: "secret"},
+		{name: "tampered key", stored: stronger[:len(stronger)-4] + "AAAA", plain: "secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, needsRehash := Verify(tt.stored, tt.plain)
+			require.Equal(t, tt.wantMatch, match)
+			require.Equal(t, tt.wantNeedsRehash, needsRehash)
+		})
+	}
+}
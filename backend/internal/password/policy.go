@@ -0,0 +1,78 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Policy is what a new password has to satisfy. Existing passwords are not
+// checked again, the policy applies when one is set.
+type Policy struct {
+	MinLength int
+	// MaxLength bounds the work a single hash can cause
+	MaxLength int
+	// MinClasses is how many of lower case letters, upper case letters,
+	// digits and other characters the password has to mix
+	MinClasses int
+}
+
+// DefaultPolicy is used unless configured otherwise
+var DefaultPolicy = Policy{MinLength: 10, MaxLength: 128, MinClasses: 2}
+
+// commonPasswords are rejected whatever the policy, compared case-insensitively
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password12": true, "password123": true, "password1234": true,
+	"passw0rd": true, "p@ssw0rd": true, "p@ssword": true, "qwerty123": true, "qwertyuiop": true,
+	"1q2w3e4r5t": true, "1qaz2wsx3edc": true, "123456789": true, "1234567890": true, "0123456789": true,
+	"abc123456": true, "iloveyou1": true, "letmein123": true, "welcome1": true, "welcome123": true,
+	"admin123": true, "admin1234": true, "administrator": true, "changeme": true, "changeme123": true,
+	"durianpay": true, "durianpay1": true, "durianpay123": true,
+}
+
+// Validate checks plain against the policy. personal are values the password
+// must not contain, such as the local part of the user's email.
+func (policy Policy) Validate(plain string, personal ...string) error {
+	length := utf8.RuneCountInString(plain)
+	if length < policy.MinLength {
+		return fmt.Errorf("password must be at least %d characters", policy.MinLength)
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		return fmt.Errorf("password must be at most %d characters", policy.MaxLength)
+	}
+
+	if classes(plain) < policy.MinClasses {
+		return fmt.Errorf("password must mix at least %d of lower case letters, upper case letters, digits and symbols", policy.MinClasses)
+	}
+
+	lower := strings.ToLower(plain)
+	if commonPasswords[lower] {
+		return fmt.Errorf("password is too common")
+	}
+	for _, value := range personal {
+		// short values such as initials would reject too much
+		if value = strings.ToLower(value); utf8.RuneCountInString(value) >= 3 && strings.Contains(lower, value) {
+			return fmt.Errorf("password must not contain your name or email")
+		}
+	}
+
+	return nil
+}
+
+func classes(plain string) int {
+	var lower, upper, digit, other int
+	for _, r := range plain {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
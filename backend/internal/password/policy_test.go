@@ -0,0 +1,42 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		plain    string
+		personal []string
+		wantErr  string
+	}{
+		{name: "acceptable", policy: DefaultPolicy, plain: "long-enough"},
+		{name: "passphrase", policy: DefaultPolicy, plain: "correct horse battery staple"},
+		{name: "multibyte characters count once", policy: Policy{MinLength: 4}, plain: "ääää"},
+		{name: "too short", policy: DefaultPolicy, plain: "Short-1", wantErr: "at least 10 characters"},
+		{name: "too long", policy: DefaultPolicy, plain: strings.Repeat("a1", 65), wantErr: "at most 128 characters"},
+		{name: "one class", policy: DefaultPolicy, plain: "onlyletterswithoutmore", wantErr: "at least 2 of"},
+		{name: "three classes required", policy: Policy{MinLength: 8, MinClasses: 3}, plain: "lower-and-symbols", wantErr: "at least 3 of"},
+		{name: "three classes", policy: Policy{MinLength: 8, MinClasses: 3}, plain: "Lower-and-symbols"},
+		{name: "common", policy: DefaultPolicy, plain: "Password123", wantErr: "too common"},
+		{name: "contains email", policy: DefaultPolicy, plain: "john-cs-2024!", personal: []string{"john-cs"}, wantErr: "must not contain"},
+		{name: "contains email in other case", policy: DefaultPolicy, plain: "JOHN-CS-2024!", personal: []string{"john-cs"}, wantErr: "must not contain"},
+		{name: "short personal values are ignored", policy: DefaultPolicy, plain: "jo-is-a-fine-start", personal: []string{"jo"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate(tt.plain, tt.personal...)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
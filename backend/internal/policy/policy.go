@@ -0,0 +1,209 @@
+// Package policy decides what a role may do. Roles map to named permissions
+// in a policy file, routes require permissions rather than roles, so access
+// can be changed without touching handlers. The file also names groups of
+// merchants, which users can be limited to.
+package policy
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PaymentsRead   = "payments:read"
+	PaymentsReview = "payments:review"
+	PaymentsImport = "payments:import"
+	PaymentsNote   = "payments:note"
+	// PaymentsStatus lets a role request status transitions, the lifecycle
+	// still limits which ones each role may make
+	PaymentsStatus = "payments:status"
+	RefundsRequest = "refunds:request"
+	// RefundsManage lets a role approve, reject and settle refunds, never its
+	// own requests
+	RefundsManage = "refunds:manage"
+	UsersManage   = "users:manage"
+)
+
+// Permissions lists every permission a policy may grant
+var Permissions = []string{PaymentsRead, PaymentsReview, PaymentsImport, PaymentsNote, PaymentsStatus, RefundsRequest, RefundsManage, UsersManage}
+
+//go:embed default.yaml
+var defaultPolicy []byte
+
+// Policy is an immutable role to permissions mapping, safe for concurrent use
+type Policy struct {
+	roles map[string]map[string]bool
+	// mfa holds the permissions a role may only use after a multi-factor login
+	mfa map[string]map[string]bool
+	// merchantGroups maps a group name to the merchant names in it
+	merchantGroups map[string][]string
+}
+
+// file is the content of a policy file
+type file struct {
+	Roles          map[string][]string `json:"roles" yaml:"roles"`
+	MFA            map[string][]string `json:"mfa" yaml:"mfa"`
+	MerchantGroups map[string][]string `json:"merchant_groups" yaml:"merchant_groups"`
+}
+
+// Default is the built-in policy used when no policy file is configured
+func Default() *Policy {
+	policy, err := Parse(defaultPolicy, ".yaml")
+	if err != nil {
+		panic("policy: invalid default policy: " + err.Error())
+	}
+	return policy
+}
+
+// Load reads a policy file, the format is picked by its extension
+func Load(path string) (*Policy, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy: %w", err)
+	}
+
+	policy, err := Parse(raw, filepath.Ext(path))
+	if err != nil {
+		return nil, fmt.Errorf("policy %s: %w", path, err)
+	}
+	return policy, nil
+}
+
+// Parse decodes a policy in the format named by ext (".json", ".yaml" or
+// ".yml"). Unknown fields, roles and permissions are rejected, a typo must
+// not silently take access away or hand it out.
+func Parse(raw []byte, ext string) (*Policy, error) {
+	var content file
+
+	switch strings.ToLower(ext) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&content); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&content); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported policy format %q, use .json, .yaml or .yml", ext)
+	}
+
+	policy, err := NewWithMFA(content.Roles, content.MFA)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy.merchantGroups, err = merchantGroups(content.MerchantGroups); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// New builds a policy from role to permission names. Roles left out have no
+// permissions.
+func New(roles map[string][]string) (*Policy, error) {
+	return NewWithMFA(roles, nil)
+}
+
+// NewWithMFA is New where the permissions listed in mfa for a role are only
+// allowed once its user logged in with a second factor
+func NewWithMFA(roles, mfa map[string][]string) (*Policy, error) {
+	granted, err := permissionSets("roles", roles)
+	if err != nil {
+		return nil, err
+	}
+
+	required, err := permissionSets("mfa", mfa)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Policy{roles: granted, mfa: required}, nil
+}
+
+// permissionSets validates a role to permission names mapping, section names
+// it in errors
+func permissionSets(section string, roles map[string][]string) (map[string]map[string]bool, error) {
+	sets := map[string]map[string]bool{}
+
+	for role, permissions := range roles {
+		if !domain.IsRole(role) {
+			return nil, fmt.Errorf("%s: unknown role %q", section, role)
+		}
+
+		set := map[string]bool{}
+		for _, permission := range permissions {
+			if !slices.Contains(Permissions, permission) {
+				return nil, fmt.Errorf("%s.%s: unknown permission %q", section, role, permission)
+			}
+			set[permission] = true
+		}
+		sets[role] = set
+	}
+
+	return sets, nil
+}
+
+// merchantGroups validates the merchant groups of a policy file
+func merchantGroups(groups map[string][]string) (map[string][]string, error) {
+	validated := map[string][]string{}
+
+	for name, merchants := range groups {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("merchant_groups: empty group name")
+		}
+		for _, merchant := range merchants {
+			if strings.TrimSpace(merchant) == "" {
+				return nil, fmt.Errorf("merchant_groups.%s: empty merchant name", name)
+			}
+		}
+		validated[name] = slices.Clone(merchants)
+	}
+
+	return validated, nil
+}
+
+// Allows reports whether role has permission
+func (policy *Policy) Allows(role, permission string) bool {
+	return policy.roles[role][permission]
+}
+
+// RequiresMFA reports whether role may only use permission after a
+// multi-factor login
+func (policy *Policy) RequiresMFA(role, permission string) bool {
+	return policy.mfa[role][permission]
+}
+
+// Granted lists the permissions of role in a stable order
+func (policy *Policy) Granted(role string) []string {
+	granted := make([]string, 0, len(policy.roles[role]))
+	for permission := range policy.roles[role] {
+		granted = append(granted, permission)
+	}
+
+	sort.Strings(granted)
+	return granted
+}
+
+// MerchantGroups returns the merchant groups by name, a copy the caller may keep
+func (policy *Policy) MerchantGroups() map[string][]string {
+	groups := make(map[string][]string, len(policy.merchantGroups))
+	for name, merchants := range policy.merchantGroups {
+		groups[name] = slices.Clone(merchants)
+	}
+	return groups
+}
@@ -0,0 +1,138 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefault(t *testing.T) {
+	policy := Default()
+
+	tests := []struct {
+		role       string
+		permission string
+		want       bool
+	}{
+		{role: "cs", permission: PaymentsRead, want: true},
+		{role: "cs", permission: PaymentsReview},
+		{role: "cs", permission: UsersManage},
+		{role: "operational", permission: PaymentsRead, want: true},
+		{role: "operational", permission: PaymentsReview, want: true},
+		{role: "operational", permission: PaymentsImport, want: true},
+		{role: "operational", permission: UsersManage},
+		{role: "admin", permission: UsersManage, want: true},
+		{role: "admin", permission: PaymentsReview},
+		{role: "cs", permission: PaymentsNote, want: true},
+		{role: "admin", permission: PaymentsNote},
+		{role: "cs", permission: PaymentsStatus, want: true},
+		{role: "admin", permission: PaymentsStatus},
+		{role: "cs", permission: RefundsRequest, want: true},
+		{role: "cs", permission: RefundsManage},
+		{role: "operational", permission: RefundsManage, want: true},
+		{role: "admin", permission: RefundsRequest},
+		{role: "", permission: PaymentsRead},
+		{role: "unknown", permission: PaymentsRead},
+		{role: "cs", permission: "payments:delete"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.role+" "+tt.permission, func(t *testing.T) {
+			require.Equal(t, tt.want, policy.Allows(tt.role, tt.permission))
+		})
+	}
+
+	require.Equal(t, []string{"payments:import", "payments:note", "payments:read", "payments:review", "payments:status", "refunds:manage", "refunds:request"}, policy.Granted("operational"))
+	require.Empty(t, policy.Granted("unknown"))
+	require.False(t, policy.RequiresMFA("operational", PaymentsReview), "MFA is opt-in")
+}
+
+func TestParse(t *testing.T) {
+	yamlPolicy := `
+roles:
+  cs: [payments:read, payments:review]
+  admin: []
+`
+	jsonPolicy := `{"roles": {"cs": ["payments:read", "payments:review"], "admin": []}}`
+
+	fromYAML, err := Parse([]byte(yamlPolicy), ".yml")
+	require.NoError(t, err)
+	fromJSON, err := Parse([]byte(jsonPolicy), ".json")
+	require.NoError(t, err)
+	require.Equal(t, fromJSON, fromYAML)
+
+	require.True(t, fromYAML.Allows("cs", PaymentsReview))
+	require.False(t, fromYAML.Allows("admin", UsersManage))
+	require.False(t, fromYAML.Allows("operational", PaymentsRead), "roles left out have no permissions")
+
+	tests := []struct {
+		name    string
+		raw     string
+		ext     string
+		wantErr string
+	}{
+		{name: "unknown permission", raw: `{"roles": {"cs": ["payments:reed"]}}`, ext: ".json", wantErr: `unknown permission "payments:reed"`},
+		{name: "unknown role", raw: `{"roles": {"auditor": ["payments:read"]}}`, ext: ".json", wantErr: `unknown role "auditor"`},
+		{name: "unknown mfa permission", raw: `{"mfa": {"cs": ["payments:reed"]}}`, ext: ".json", wantErr: `mfa.cs: unknown permission "payments:reed"`},
+		{name: "unknown mfa role", raw: `{"mfa": {"auditor": ["payments:read"]}}`, ext: ".json", wantErr: `mfa: unknown role "auditor"`},
+		{name: "empty merchant", raw: `{"merchant_groups": {"retail": ["Acme", " "]}}`, ext: ".json", wantErr: "merchant_groups.retail: empty merchant name"},
+		{name: "unknown field", raw: `{"role": {}}`, ext: ".json", wantErr: "unknown field"},
+		{name: "unknown yaml field", raw: "rules: {}\n", ext: ".yaml", wantErr: "not found"},
+		{name: "unsupported format", raw: "", ext: ".toml", wantErr: "unsupported policy format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.raw), tt.ext)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestParse_MFA(t *testing.T) {
+	policy, err := Parse([]byte(`
+roles:
+  operational: [payments:read, payments:review]
+mfa:
+  operational: [payments:review]
+`), ".yaml")
+	require.NoError(t, err)
+
+	require.True(t, policy.Allows("operational", PaymentsReview))
+	require.True(t, policy.RequiresMFA("operational", PaymentsReview))
+	require.False(t, policy.RequiresMFA("operational", PaymentsRead))
+	require.False(t, policy.RequiresMFA("cs", PaymentsReview))
+}
+
+func TestParse_MerchantGroups(t *testing.T) {
+	policy, err := Parse([]byte(`
+merchant_groups:
+  retail: [Acme Store, Corner Shop]
+  travel: []
+`), ".yaml")
+	require.NoError(t, err)
+
+	groups := policy.MerchantGroups()
+	require.Equal(t, map[string][]string{"retail": {"Acme Store", "Corner Shop"}, "travel": {}}, groups)
+
+	// the policy is immutable
+	groups["retail"][0] = "changed"
+	require.Equal(t, "Acme Store", policy.MerchantGroups()["retail"][0])
+
+	require.Empty(t, Default().MerchantGroups())
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("roles:\n  cs: [payments:read]\n"), 0o644))
+
+	policy, err := Load(path)
+	require.NoError(t, err)
+	require.True(t, policy.Allows("cs", PaymentsRead))
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.Error(t, err)
+}
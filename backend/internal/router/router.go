@@ -4,32 +4,78 @@
 package router
 
 import (
+	"context"
 	"log"
 	"strings"
 	"time"
 
 	"abasithdev.github.io/internal-cs-center-backend/internal/config"
 	"abasithdev.github.io/internal-cs-center-backend/internal/handler"
+	"abasithdev.github.io/internal-cs-center-backend/internal/jwtkeys"
 	"abasithdev.github.io/internal-cs-center-backend/internal/middleware"
+	"abasithdev.github.io/internal-cs-center-backend/internal/notify"
+	"abasithdev.github.io/internal-cs-center-backend/internal/oidc"
+	"abasithdev.github.io/internal-cs-center-backend/internal/password"
+	"abasithdev.github.io/internal-cs-center-backend/internal/policy"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
 	"abasithdev.github.io/internal-cs-center-backend/internal/service"
 	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage/sqlite"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
 
-func NewRouter() *gin.Engine {
-	store := storage.NewMemoryStore()
-	authService := service.NewAuthService(store, []byte("donttellanyone"))
+// NewRouter builds the API. shutdown finishes the work it left running in the
+// background, such as reset links being sent; call it once the server stopped
+// taking requests.
+func NewRouter() (r *gin.Engine, shutdown func(context.Context) error) {
+	appConfig := config.Load()
+
+	store, err := newStore(appConfig)
+	if err != nil {
+		log.Fatalf("failed to open %s storage: %v", appConfig.StorageDriver, err)
+	}
+
+	if appConfig.SeedEnabled {
+		if err := seedStore(store, appConfig.SeedFixture); err != nil {
+			log.Fatalf("failed to seed storage: %v", err)
+		}
+	}
+
+	rules, err := loadPolicy(appConfig.PolicyFile)
+	if err != nil {
+		log.Fatalf("failed to load policy: %v", err)
+	}
+
+	keys, err := newKeyManager(appConfig)
+	if err != nil {
+		log.Fatalf("failed to load JWT keys: %v", err)
+	}
+
+	authService := service.NewAuthServiceWithKeys(store, keys)
+	authService.SetTokenTTL(appConfig.AccessTokenTTL, appConfig.RefreshTokenTTL)
+	authService.SetLoginThrottle(loginThrottle(appConfig))
+	authService.SetPasswordPolicy(passwordPolicy(appConfig))
 	paymentService := service.NewPaymentService(store)
+	paymentService.SetMerchantGroups(rules.MerchantGroups())
+	userService := service.NewUserService(store)
+	userService.SetPasswordPolicy(passwordPolicy(appConfig))
+	serviceAccountService := service.NewServiceAccountService(store, rules)
 
 	authHandler := handler.NewAuthHandler(authService)
 	paymentHandler := handler.NewPaymentHandler(paymentService)
+	userHandler := handler.NewUserHandler(userService)
+	serviceAccountHandler := handler.NewServiceAccountHandler(serviceAccountService)
+	sessionHandler := handler.NewSessionHandler(authService, userService, rules)
 
-	appConfig := config.Load()
+	r = gin.Default()
 
-	r := gin.Default()
+	// the client address drives login throttling, only take it from headers set by our own proxies
+	if err := r.SetTrustedProxies(appConfig.TrustedProxies); err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
 
 	// Normalize and validate allowed origins to avoid panics from the CORS middleware
 	var allowOrigins []string
@@ -59,30 +105,246 @@ func NewRouter() *gin.Engine {
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     allowOrigins,
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
-		AllowHeaders:     []string{"Origin", "Authorization", "Content-Type"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowHeaders:     []string{"Origin", "Authorization", "Content-Type", "If-Match"},
+		ExposeHeaders:    []string{"Content-Length", "ETag"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 
+	// for other services verifying our tokens, outside the versioned API
+	r.GET("/.well-known/jwks.json", authHandler.JWKS)
+
 	r.GET("/api", func(c *gin.Context) {
 		c.JSON(200, "")
 	})
 
 	v1 := r.Group("/dashboard/v1")
 	{
-		v1.POST("/auth/login", authHandler.Login)
+		if appConfig.PasswordLogin {
+			v1.POST("/auth/login", authHandler.Login)
+			v1.POST("/auth/mfa/verify", authHandler.VerifyMFA)
+			v1.POST("/auth/password/change", authHandler.ChangePassword)
+
+			if appConfig.OutboxDir != "" {
+				outbox, err := notify.NewOutbox(appConfig.OutboxDir)
+				if err != nil {
+					log.Fatalf("failed to set up password reset: %v", err)
+				}
+				authService.SetPasswordReset(outbox, service.PasswordResetOptions{URL: appConfig.PasswordResetURL, TTL: appConfig.PasswordResetTTL})
+				v1.POST("/auth/password/forgot", authHandler.ForgotPassword)
+				v1.POST("/auth/password/reset", authHandler.ResetPassword)
+				log.Println("Password reset links are written to " + appConfig.OutboxDir)
+			} else {
+				log.Println("Password reset disabled, set OUTBOX_DIR to enable it")
+			}
+		} else {
+			log.Println("Password login disabled")
+		}
+		v1.POST("/auth/refresh", authHandler.Refresh)
+
+		if appConfig.OIDCIssuer != "" {
+			ssoHandler, err := newSSOHandler(appConfig, authService, store)
+			if err != nil {
+				log.Fatalf("failed to set up SSO: %v", err)
+			}
+			v1.GET("/auth/oidc/login", ssoHandler.Login)
+			v1.GET("/auth/oidc/callback", ssoHandler.Callback)
+			log.Println("SSO enabled with " + appConfig.OIDCIssuer)
+		}
 
 		protected := v1.Group("/")
 		protected.Use(middleware.AuthMiddleware(authService))
 		{
-			protected.GET("/payments", paymentHandler.ListPayments)
-			protected.PUT("/payments/:id/review", paymentHandler.ReviewPayment)
+			protected.POST("/auth/logout", authHandler.Logout)
+			protected.GET("/auth/me", sessionHandler.Me)
+			protected.GET("/auth/sessions", sessionHandler.ListSessions)
+			protected.DELETE("/auth/sessions", sessionHandler.TerminateOtherSessions)
+			protected.DELETE("/auth/sessions/:id", sessionHandler.TerminateSession)
+			protected.POST("/auth/mfa/enroll", authHandler.EnrollMFA)
+			protected.POST("/auth/mfa/confirm", authHandler.ConfirmMFA)
+			protected.POST("/auth/mfa/disable", authHandler.DisableMFA)
+			protected.GET("/payments", middleware.RequirePermission(rules, policy.PaymentsRead), paymentHandler.ListPayments)
+			protected.GET("/payments/:id", middleware.RequirePermission(rules, policy.PaymentsRead), paymentHandler.GetPayment)
+			protected.PUT("/payments/:id/review", middleware.RequirePermission(rules, policy.PaymentsReview), paymentHandler.ReviewPayment)
+			protected.POST("/payments/:id/review/revert", middleware.RequirePermission(rules, policy.PaymentsReview), paymentHandler.RevertPaymentReview)
+			protected.PUT("/payments/:id/status", middleware.RequirePermission(rules, policy.PaymentsStatus), paymentHandler.TransitionPayment)
+			protected.POST("/payments/:id/notes", middleware.RequirePermission(rules, policy.PaymentsNote), paymentHandler.AddPaymentNote)
+			protected.GET("/payments/:id/refunds", middleware.RequirePermission(rules, policy.PaymentsRead), paymentHandler.ListRefunds)
+			protected.POST("/payments/:id/refunds", middleware.RequirePermission(rules, policy.RefundsRequest), paymentHandler.RequestRefund)
+			protected.PUT("/payments/:id/refunds/:refundId/status", middleware.RequirePermission(rules, policy.RefundsManage), paymentHandler.UpdateRefund)
+			protected.POST("/payments/import", middleware.RequirePermission(rules, policy.PaymentsImport), paymentHandler.ImportPayments)
+
+			users := protected.Group("/users")
+			users.Use(middleware.RequirePermission(rules, policy.UsersManage))
+			{
+				users.GET("", userHandler.ListUsers)
+				users.POST("", userHandler.CreateUser)
+				users.GET("/:email", userHandler.GetUser)
+				users.PATCH("/:email", userHandler.UpdateUser)
+				users.DELETE("/:email", userHandler.DeleteUser)
+				users.POST("/:email/unlock", userHandler.UnlockUser)
+				users.DELETE("/:email/mfa", userHandler.ResetMFA)
+			}
+
+			serviceAccounts := protected.Group("/service-accounts")
+			serviceAccounts.Use(middleware.RequirePermission(rules, policy.UsersManage))
+			{
+				serviceAccounts.GET("", serviceAccountHandler.ListServiceAccounts)
+				serviceAccounts.POST("", serviceAccountHandler.CreateServiceAccount)
+				serviceAccounts.GET("/:name", serviceAccountHandler.GetServiceAccount)
+				serviceAccounts.DELETE("/:name", serviceAccountHandler.DeleteServiceAccount)
+				serviceAccounts.GET("/:name/keys", serviceAccountHandler.ListAPIKeys)
+				serviceAccounts.POST("/:name/keys", serviceAccountHandler.CreateAPIKey)
+				serviceAccounts.POST("/:name/keys/:id/rotate", serviceAccountHandler.RotateAPIKey)
+				serviceAccounts.DELETE("/:name/keys/:id", serviceAccountHandler.RevokeAPIKey)
+			}
 		}
 	}
 
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
-	return r
+	return r, authService.Shutdown
+}
+
+// newStore picks the storage backend configured by STORAGE_DRIVER
+func newStore(appConfig *config.Config) (storage.Store, error) {
+	switch appConfig.StorageDriver {
+	case "sqlite":
+		store, err := sqlite.NewStore(appConfig.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Using sqlite storage at " + appConfig.SQLitePath)
+		return store, nil
+	default:
+		if appConfig.MemoryDataDir == "" {
+			return storage.NewMemoryStore(), nil
+		}
+
+		store, err := storage.OpenMemoryStore(storage.DurabilityOptions{
+			Dir:              appConfig.MemoryDataDir,
+			SnapshotEvery:    appConfig.MemorySnapshotEvery,
+			SnapshotInterval: appConfig.MemorySnapshotInterval,
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Using durable memory storage at " + appConfig.MemoryDataDir)
+		return store, nil
+	}
+}
+
+// newKeyManager loads the JWT signing key and the keys of earlier rotations
+func newKeyManager(appConfig *config.Config) (*jwtkeys.Manager, error) {
+	current := jwtkeys.HMACKey(appConfig.JwtSecretID, []byte(appConfig.JwtSecret))
+	if appConfig.JwtPrivateKeyFile != "" {
+		key, err := jwtkeys.LoadFile(appConfig.JwtPrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		current = key
+	}
+
+	var previous []*jwtkeys.Key
+	for _, path := range appConfig.JwtPreviousKeyFiles {
+		key, err := jwtkeys.LoadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, key)
+	}
+	if appConfig.JwtPreviousSecret != "" {
+		previous = append(previous, jwtkeys.HMACKey(appConfig.JwtPreviousSecretID, []byte(appConfig.JwtPreviousSecret)))
+	}
+
+	keys, err := jwtkeys.NewManager(current, previous...)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Signing tokens with %s key %s, %d previous keys accepted", current.Algorithm, current.ID, len(previous))
+	return keys, nil
+}
+
+// newSSOHandler sets up single sign-on with the configured OIDC provider
+func newSSOHandler(appConfig *config.Config, authService *service.AuthService, store storage.Store) (*handler.SSOHandler, error) {
+	roles, err := service.ParseGroupRoles(appConfig.OIDCRoleMapping)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		log.Println("⚠️  OIDC_ROLE_MAPPING is empty, nobody can log in with SSO")
+	}
+
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:       appConfig.OIDCIssuer,
+		ClientID:     appConfig.OIDCClientID,
+		ClientSecret: appConfig.OIDCClientSecret,
+		RedirectURL:  appConfig.OIDCRedirectURL,
+		Scopes:       appConfig.OIDCScopes,
+		GroupsClaim:  appConfig.OIDCGroupsClaim,
+	})
+
+	sso, err := service.NewSSOService(provider, authService, store, roles)
+	if err != nil {
+		return nil, err
+	}
+	return handler.NewSSOHandler(sso, authService, appConfig.OIDCFrontendURL), nil
+}
+
+// loginThrottle is DefaultLoginThrottle with the configured lockout
+func loginThrottle(appConfig *config.Config) service.LoginThrottle {
+	throttle := service.DefaultLoginThrottle
+	if appConfig.LoginLockoutThreshold > 0 {
+		throttle.AccountLockout = appConfig.LoginLockoutThreshold
+	}
+	if appConfig.LoginLockoutDuration > 0 {
+		throttle.LockoutDuration = appConfig.LoginLockoutDuration
+	}
+	return throttle
+}
+
+// passwordPolicy is DefaultPolicy with the configured minimum length
+func passwordPolicy(appConfig *config.Config) password.Policy {
+	passwordRules := password.DefaultPolicy
+	if appConfig.PasswordMinLength > 0 {
+		passwordRules.MinLength = appConfig.PasswordMinLength
+	}
+	return passwordRules
+}
+
+// loadPolicy reads the policy file at path, the built-in policy when path is empty
+func loadPolicy(path string) (*policy.Policy, error) {
+	if path == "" {
+		return policy.Default(), nil
+	}
+
+	rules, err := policy.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Loaded policy from " + path)
+	return rules, nil
+}
+
+// seedStore loads the fixture file at path, the built-in demo data when path is empty
+func seedStore(store storage.Store, path string) error {
+	fixture := seed.Demo()
+	if path != "" {
+		var err error
+		if fixture, err = seed.Load(path); err != nil {
+			return err
+		}
+	}
+
+	if err := seed.Apply(store, fixture); err != nil {
+		return err
+	}
+
+	source := "built-in demo fixture"
+	if path != "" {
+		source = path
+	}
+	log.Println("Seeded storage from " + source)
+	return nil
 }
@@ -3,6 +3,8 @@
 package router
 
 import (
+	"context"
+
 	"abasithdev.github.io/internal-cs-center-backend/internal/handler"
 	"abasithdev.github.io/internal-cs-center-backend/internal/middleware"
 	"abasithdev.github.io/internal-cs-center-backend/internal/service"
@@ -10,7 +12,7 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func NewRouter() *gin.Engine {
+func NewRouter() (*gin.Engine, func(context.Context) error) {
 	store := storage.NewMemoryStore()
 	authService := service.NewAuthService(store, []byte("donttellanyone"))
 	paymentService := service.NewPaymentService(store)
@@ -31,5 +33,5 @@ func NewRouter() *gin.Engine {
 		}
 	}
 
-	return r
+	return r, authService.Shutdown
 }
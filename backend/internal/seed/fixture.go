@@ -0,0 +1,128 @@
+package seed
+
+/*
+Seed data described in fixture files, so demos and bug reproductions load the
+same users and payments on every boot
+*/
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed fixtures/demo.yaml
+var demoFixture []byte
+
+// Fixture is the content of a fixture file. Payments listed explicitly are
+// loaded as they are, Generate adds generated ones after them.
+type Fixture struct {
+	Users    []FixtureUser    `json:"users" yaml:"users"`
+	Payments []FixturePayment `json:"payments" yaml:"payments"`
+	Generate *GeneratorConfig `json:"generate,omitempty" yaml:"generate,omitempty"`
+}
+
+type FixtureUser struct {
+	Email string `json:"email" yaml:"email"`
+	// Password is the plaintext, it is hashed when the user is created
+	Password string `json:"password" yaml:"password"`
+	Role     string `json:"role" yaml:"role"`
+	// Merchants and MerchantGroups limit the payments the user sees,
+	// AllMerchants lets them see every merchant
+	Merchants      []string `json:"merchants,omitempty" yaml:"merchants,omitempty"`
+	MerchantGroups []string `json:"merchant_groups,omitempty" yaml:"merchant_groups,omitempty"`
+	AllMerchants   bool     `json:"all_merchants,omitempty" yaml:"all_merchants,omitempty"`
+}
+
+type FixturePayment struct {
+	ID           string    `json:"id" yaml:"id"`
+	MerchantName string    `json:"merchant_name" yaml:"merchant_name"`
+	Date         time.Time `json:"date" yaml:"date"`
+	Amount       float64   `json:"amount" yaml:"amount"`
+	Status       string    `json:"status" yaml:"status"`
+	Reviewed     bool      `json:"reviewed" yaml:"reviewed"`
+}
+
+// Demo is the built-in fixture used when no fixture file is configured
+func Demo() *Fixture {
+	fixture, err := Parse(demoFixture, ".yaml")
+	if err != nil {
+		panic("seed: invalid demo fixture: " + err.Error())
+	}
+	return fixture
+}
+
+// Load reads a fixture file, the format is picked by its extension
+func Load(path string) (*Fixture, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read fixture: %w", err)
+	}
+
+	fixture, err := Parse(raw, filepath.Ext(path))
+	if err != nil {
+		return nil, fmt.Errorf("fixture %s: %w", path, err)
+	}
+	return fixture, nil
+}
+
+// Parse decodes a fixture in the format named by ext (".json", ".yaml" or
+// ".yml"). Unknown fields are rejected so typos do not silently drop data.
+func Parse(raw []byte, ext string) (*Fixture, error) {
+	fixture := &Fixture{}
+
+	switch strings.ToLower(ext) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(fixture); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(fixture); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported fixture format %q, use .json, .yaml or .yml", ext)
+	}
+
+	if err := fixture.validate(); err != nil {
+		return nil, err
+	}
+	return fixture, nil
+}
+
+func (fixture *Fixture) validate() error {
+	for i, user := range fixture.Users {
+		if user.Email == "" || user.Role == "" {
+			return fmt.Errorf("users[%d]: email and role are required", i)
+		}
+		if !domain.IsRole(user.Role) {
+			return fmt.Errorf("users[%d]: unknown role %q", i, user.Role)
+		}
+	}
+
+	for i, payment := range fixture.Payments {
+		if payment.ID == "" {
+			return fmt.Errorf("payments[%d]: id is required", i)
+		}
+		if !domain.IsPaymentStatus(payment.Status) {
+			return fmt.Errorf("payments[%d]: unknown status %q", i, payment.Status)
+		}
+	}
+
+	if fixture.Generate != nil {
+		return fixture.Generate.validate()
+	}
+	return nil
+}
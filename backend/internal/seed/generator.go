@@ -0,0 +1,160 @@
+package seed
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"github.com/google/uuid"
+)
+
+// DefaultEndDate anchors generated dates when a fixture does not, a fixed
+// instant rather than time.Now keeps every boot identical
+var DefaultEndDate = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// defaultStatuses are split evenly when a config weighs none, refunds and
+// disputes only come from explicit weights
+var defaultStatuses = []string{domain.PaymentStatusCompleted, domain.PaymentStatusProcessing, domain.PaymentStatusFailed}
+
+// GeneratorConfig describes random but reproducible payments: the same
+// config always yields the same payments, IDs included.
+type GeneratorConfig struct {
+	Seed  uint64 `json:"seed" yaml:"seed"`
+	Count int    `json:"count" yaml:"count"`
+
+	// payments are dated in the Days days before EndDate (default 30 days before DefaultEndDate)
+	EndDate time.Time `json:"end_date" yaml:"end_date"`
+	Days    int       `json:"days" yaml:"days"`
+
+	// relative weights, statuses default to an even split of completed,
+	// processing and failed and merchants to a generated name per payment
+	Statuses  map[string]int `json:"statuses" yaml:"statuses"`
+	Merchants map[string]int `json:"merchants" yaml:"merchants"`
+
+	// amounts are whole numbers drawn evenly from [Min, Max] (default 10000-1000000)
+	Amount AmountRange `json:"amount" yaml:"amount"`
+}
+
+type AmountRange struct {
+	Min float64 `json:"min" yaml:"min"`
+	Max float64 `json:"max" yaml:"max"`
+}
+
+func (config *GeneratorConfig) validate() error {
+	if config.Count < 0 {
+		return fmt.Errorf("generate: count must not be negative")
+	}
+	if config.Days < 0 {
+		return fmt.Errorf("generate: days must not be negative")
+	}
+	if config.Amount.Min < 0 || config.Amount.Max < config.Amount.Min {
+		return fmt.Errorf("generate: amount range %v-%v is invalid", config.Amount.Min, config.Amount.Max)
+	}
+
+	for status, weight := range config.Statuses {
+		if !domain.IsPaymentStatus(status) {
+			return fmt.Errorf("generate: unknown status %q", status)
+		}
+		if weight < 0 {
+			return fmt.Errorf("generate: weight of status %q must not be negative", status)
+		}
+	}
+	for merchant, weight := range config.Merchants {
+		if weight < 0 {
+			return fmt.Errorf("generate: weight of merchant %q must not be negative", merchant)
+		}
+	}
+	return nil
+}
+
+// Generate returns config.Count payments, newest first
+func Generate(config GeneratorConfig) []*domain.Payment {
+	rng := rand.New(rand.NewPCG(config.Seed, config.Seed))
+
+	endDate := config.EndDate
+	if endDate.IsZero() {
+		endDate = DefaultEndDate
+	}
+	days := config.Days
+	if days == 0 {
+		days = 30
+	}
+	amount := config.Amount
+	if amount.Max == 0 {
+		amount = AmountRange{Min: 10000, Max: 1000000}
+	}
+
+	pickStatus := newWeightedPicker(config.Statuses)
+	pickMerchant := newWeightedPicker(config.Merchants)
+	span := int64(days) * int64(24*time.Hour)
+
+	payments := make([]*domain.Payment, 0, config.Count)
+	for i := 0; i < config.Count; i++ {
+		id := randomUUID(rng)
+
+		status := defaultStatuses[i%len(defaultStatuses)]
+		if pickStatus != nil {
+			status = pickStatus(rng)
+		}
+
+		merchant := "Merchant" + id[:6]
+		if pickMerchant != nil {
+			merchant = pickMerchant(rng)
+		}
+
+		payments = append(payments, &domain.Payment{
+			ID:           id,
+			MerchantName: merchant,
+			Date:         endDate.Add(-time.Duration(rng.Int64N(span))),
+			Amount:       math.Round(amount.Min + rng.Float64()*(amount.Max-amount.Min)),
+			Status:       status,
+		})
+	}
+
+	slices.SortFunc(payments, func(a, b *domain.Payment) int {
+		return b.Date.Compare(a.Date)
+	})
+	return payments
+}
+
+// newWeightedPicker draws keys in proportion to their weight, nil when no key
+// has any weight. Keys are walked in sorted order because map order is random.
+func newWeightedPicker(weights map[string]int) func(rng *rand.Rand) string {
+	keys := make([]string, 0, len(weights))
+	total := 0
+	for key, weight := range weights {
+		if weight > 0 {
+			keys = append(keys, key)
+			total += weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	slices.Sort(keys)
+
+	return func(rng *rand.Rand) string {
+		n := rng.IntN(total)
+		for _, key := range keys {
+			n -= weights[key]
+			if n < 0 {
+				return key
+			}
+		}
+		return keys[len(keys)-1]
+	}
+}
+
+// randomUUID is a version 4 UUID drawn from rng instead of crypto/rand
+func randomUUID(rng *rand.Rand) string {
+	var raw uuid.UUID
+	binary.BigEndian.PutUint64(raw[:8], rng.Uint64())
+	binary.BigEndian.PutUint64(raw[8:], rng.Uint64())
+	raw[6] = raw[6]&0x0f | 0x40
+	raw[8] = raw[8]&0x3f | 0x80
+	return raw.String()
+}
@@ -0,0 +1,75 @@
+package seed
+
+import (
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/password"
+)
+
+// Store is what Apply writes to, every storage backend satisfies it
+type Store interface {
+	domain.PaymentRepository
+	domain.UserRepository
+}
+
+// Apply loads the fixture in a single transaction. Users that already exist
+// are kept as they are and payments are only loaded into a store without
+// any, so it is safe to call on every boot of a persistent backend.
+func Apply(store Store, fixture *Fixture) error {
+	loadPayments := store.QueryPayments(domain.PaymentQuery{}).Total == 0
+
+	return store.Update(func(tx domain.Tx) error {
+		for _, user := range fixture.Users {
+			if _, exists := tx.GetUserByEmail(user.Email); exists {
+				continue
+			}
+
+			hash, err := password.Hash(user.Password)
+			if err != nil {
+				return err
+			}
+
+			err = tx.CreateUser(&domain.User{
+				Email:          user.Email,
+				PasswordHash:   hash,
+				Role:           user.Role,
+				Merchants:      user.Merchants,
+				MerchantGroups: user.MerchantGroups,
+				AllMerchants:   user.AllMerchants,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if !loadPayments {
+			return nil
+		}
+
+		for _, payment := range fixture.payments() {
+			if err := tx.CreatePayment(payment); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// payments returns the listed payments followed by the generated ones
+func (fixture *Fixture) payments() []*domain.Payment {
+	payments := make([]*domain.Payment, 0, len(fixture.Payments))
+	for _, payment := range fixture.Payments {
+		payments = append(payments, &domain.Payment{
+			ID:           payment.ID,
+			MerchantName: payment.MerchantName,
+			Date:         payment.Date,
+			Amount:       payment.Amount,
+			Status:       payment.Status,
+			Reviewed:     payment.Reviewed,
+		})
+	}
+
+	if fixture.Generate != nil {
+		payments = append(payments, Generate(*fixture.Generate)...)
+	}
+	return payments
+}
@@ -0,0 +1,168 @@
+package seed
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	config := GeneratorConfig{
+		Seed:      7,
+		Count:     200,
+		EndDate:   time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+		Days:      10,
+		Statuses:  map[string]int{"completed": 3, "failed": 1},
+		Merchants: map[string]int{"Kopi Kenangan": 1, "Tokopedia": 1},
+		Amount:    AmountRange{Min: 5000, Max: 6000},
+	}
+
+	payments := Generate(config)
+	require.Len(t, payments, 200)
+	require.Equal(t, payments, Generate(config), "same config must give the same payments")
+
+	ids := map[string]bool{}
+	counts := map[string]int{}
+	for i, payment := range payments {
+		require.False(t, ids[payment.ID], "duplicate id %s", payment.ID)
+		ids[payment.ID] = true
+		counts[payment.Status]++
+
+		require.Contains(t, []string{"Kopi Kenangan", "Tokopedia"}, payment.MerchantName)
+		require.True(t, payment.Amount >= 5000 && payment.Amount <= 6000, "amount %v", payment.Amount)
+		require.Equal(t, float64(int64(payment.Amount)), payment.Amount)
+		require.True(t, payment.Date.After(config.EndDate.AddDate(0, 0, -10)) && !payment.Date.After(config.EndDate))
+		if i > 0 {
+			require.False(t, payment.Date.After(payments[i-1].Date), "payments must be newest first")
+		}
+	}
+
+	require.Zero(t, counts["processing"])
+	require.Greater(t, counts["completed"], counts["failed"]*2)
+
+	config.Seed = 8
+	require.NotEqual(t, payments[0].ID, Generate(config)[0].ID)
+}
+
+func TestGenerate_Defaults(t *testing.T) {
+	payments := Generate(GeneratorConfig{Count: 6})
+	require.Len(t, payments, 6)
+
+	counts := map[string]int{}
+	for _, payment := range payments {
+		counts[payment.Status]++
+		require.Equal(t, "Merchant"+payment.ID[:6], payment.MerchantName)
+		require.False(t, payment.Date.After(DefaultEndDate))
+	}
+	require.Equal(t, map[string]int{"completed": 2, "processing": 2, "failed": 2}, counts)
+}
+
+func TestParse(t *testing.T) {
+	yamlFixture := `
+users:
+  - email: cs@example.com
+    password: secret
+    role: cs
+payments:
+  - id: pay-1
+    merchant_name: Acme
+    date: 2024-05-01T10:00:00Z
+    amount: 1500
+    status: failed
+    reviewed: true
+generate:
+  seed: 1
+  count: 3
+`
+	jsonFixture := `{
+		"users": [{"email": "cs@example.com", "password": "secret", "role": "cs"}],
+		"payments": [{"id": "pay-1", "merchant_name": "Acme", "date": "2024-05-01T10:00:00Z",
+			"amount": 1500, "status": "failed", "reviewed": true}],
+		"generate": {"seed": 1, "count": 3}
+	}`
+
+	fromYAML, err := Parse([]byte(yamlFixture), ".yaml")
+	require.NoError(t, err)
+	fromJSON, err := Parse([]byte(jsonFixture), ".json")
+	require.NoError(t, err)
+	require.Equal(t, fromJSON, fromYAML)
+
+	require.Equal(t, "pay-1", fromYAML.Payments[0].ID)
+	require.True(t, fromYAML.Payments[0].Date.Equal(time.Date(2024, time.May, 1, 10, 0, 0, 0, time.UTC)))
+	require.Len(t, fromYAML.payments(), 4)
+
+	tests := []struct {
+		name    string
+		raw     string
+		ext     string
+		wantErr string
+	}{
+		{name: "unknown field", raw: `{"users": [{"email": "a@b.c", "role": "cs", "rol": "x"}]}`, ext: ".json", wantErr: "unknown field"},
+		{name: "unknown yaml field", raw: "payment:\n  - id: x\n", ext: ".yml", wantErr: "not found"},
+		{name: "unsupported format", raw: "", ext: ".toml", wantErr: "unsupported fixture format"},
+		{name: "user without role", raw: `{"users": [{"email": "a@b.c"}]}`, ext: ".json", wantErr: "users[0]"},
+		{name: "unknown role", raw: `{"users": [{"email": "a@b.c", "role": "root"}]}`, ext: ".json", wantErr: "unknown role"},
+		{name: "payment without id", raw: `{"payments": [{"status": "failed"}]}`, ext: ".json", wantErr: "payments[0]: id"},
+		{name: "unknown status", raw: `{"payments": [{"id": "x", "status": "voided"}]}`, ext: ".json", wantErr: "unknown status"},
+		{name: "bad amount range", raw: `{"generate": {"amount": {"min": 10, "max": 5}}}`, ext: ".json", wantErr: "amount range"},
+		{name: "unknown generated status", raw: `{"generate": {"statuses": {"done": 1}}}`, ext: ".json", wantErr: "unknown status"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.raw), tt.ext)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "repro.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"users": [{"email": "ops@example.com", "role": "operational"}]}`), 0o644))
+
+	fixture, err := Load(path)
+	require.NoError(t, err)
+	require.Equal(t, "ops@example.com", fixture.Users[0].Email)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.Error(t, err)
+}
+
+func TestApply(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, store.CreateUser(&domain.User{Email: "john-cs@durianpay.id", PasswordHash: "changed", Role: "cs"}))
+
+	require.NoError(t, Apply(store, Demo()))
+
+	payments := store.GetPaymentList()
+	require.Len(t, payments, 20)
+	_, exists := store.GetUserByEmail("jane-operational@durianpay.id")
+	require.True(t, exists)
+
+	// existing users are left alone
+	user, _ := store.GetUserByEmail("john-cs@durianpay.id")
+	require.Equal(t, "changed", user.PasswordHash)
+
+	// a second boot adds nothing, not even to a store whose payments changed
+	require.NoError(t, store.DeletePayment(payments[0].ID))
+	require.NoError(t, Apply(store, Demo()))
+	require.Len(t, store.GetPaymentList(), 19)
+
+	// the demo data is the same on every boot
+	other := storage.NewMemoryStore()
+	require.NoError(t, Apply(other, Demo()))
+	for _, payment := range other.GetPaymentList() {
+		if payment.ID == payments[0].ID {
+			continue
+		}
+		stored, exists := store.GetPaymentById(payment.ID)
+		require.True(t, exists)
+		require.Equal(t, payment.Amount, stored.Amount)
+	}
+}
@@ -1,70 +1,467 @@
 package service
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 
 	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
-	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"abasithdev.github.io/internal-cs-center-backend/internal/jwtkeys"
+	"abasithdev.github.io/internal-cs-center-backend/internal/notify"
+	"abasithdev.github.io/internal-cs-center-backend/internal/password"
 )
 
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 7 * 24 * time.Hour
+
+	// expired tokens and login attempts are purged at most this often, on login
+	purgeInterval = time.Hour
+)
+
+var errInvalidRefreshToken = errors.New("Invalid refresh token")
+
 type AuthService struct {
-	jwtSecret       []byte
-	tokenValidation time.Duration
-	store           *storage.MemoryStore
+	keys *jwtkeys.Manager
+	// tokenValidation is the lifetime of access tokens
+	tokenValidation   time.Duration
+	refreshValidation time.Duration
+	store             domain.AuthRepository
+	throttle          LoginThrottle
+
+	passwordPolicy password.Policy
+	// notifier delivers password reset links, resets are off without one
+	notifier      notify.Notifier
+	passwordReset PasswordResetOptions
+	// resetQueue holds the reset links waiting for a worker, resets counts
+	// those queued or being sent so Shutdown can wait for them. resetMu
+	// keeps requests from queueing once the queue is closed.
+	resetQueue  chan passwordResetRequest
+	resetMu     sync.RWMutex
+	resetClosed bool
+	resets      sync.WaitGroup
+
+	lastPurge atomic.Int64 // unix seconds
+}
+
+// TokenPair is what a login or a refresh hands out
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	// ExpiresIn is the lifetime of AccessToken
+	ExpiresIn time.Duration
+}
+
+// NewAuthService signs tokens with an HS256 secret, see NewAuthServiceWithKeys
+func NewAuthService(store domain.AuthRepository, secret []byte) *AuthService {
+	// a manager of one HMAC key cannot fail
+	keys, _ := jwtkeys.NewManager(jwtkeys.HMACKey(jwtkeys.DefaultHMACKeyID, secret))
+	return NewAuthServiceWithKeys(store, keys)
+}
+
+// NewAuthServiceWithKeys signs every token it issues with the current key of
+// keys and accepts tokens signed by any of them
+func NewAuthServiceWithKeys(store domain.AuthRepository, keys *jwtkeys.Manager) *AuthService {
+	return &AuthService{
+		keys:              keys,
+		tokenValidation:   defaultAccessTokenTTL,
+		refreshValidation: defaultRefreshTokenTTL,
+		store:             store,
+		throttle:          DefaultLoginThrottle,
+		passwordPolicy:    password.DefaultPolicy,
+		passwordReset:     PasswordResetOptions{TTL: defaultPasswordResetTTL},
+	}
+}
+
+// SetLoginThrottle replaces DefaultLoginThrottle
+func (auth *AuthService) SetLoginThrottle(throttle LoginThrottle) {
+	auth.throttle = throttle
+}
+
+// Login is Authenticate behind the LoginThrottle of the account and of the
+// client address ip. Throttled attempts get a RateLimitError without the
+// password being checked, for existing and unknown accounts alike.
+func (auth *AuthService) Login(email, plain, ip string) (*domain.User, error) {
+	auth.purgeExpired()
+
+	account, address := accountKey(email), addressKey(ip)
+	now := time.Now()
+	var previous map[string]time.Time
+	err := auth.store.Update(func(tx domain.Tx) error {
+		var err error
+		previous, err = auth.throttle.reserve(tx, map[string]int{
+			account: auth.throttle.AccountLockout,
+			address: auth.throttle.AddressLockout,
+		}, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := auth.Authenticate(email, plain)
+	if err != nil {
+		return nil, err
+	}
+
+	err = auth.store.Update(func(tx domain.Tx) error {
+		return auth.throttle.release(tx, account, address, now, previous[address])
+	})
+	if err != nil {
+		// the login itself is fine, the account just stays counted
+		log.Printf("auth: reset login attempts of %s: %v", email, err)
+	}
+
+	return user, nil
 }
 
-func NewAuthService(store *storage.MemoryStore, secret []byte) *AuthService {
-	return &AuthService{jwtSecret: secret, tokenValidation: time.Hour * 24, store: store}
+// SetTokenTTL changes the lifetime of access and refresh tokens, zero keeps the current one
+func (auth *AuthService) SetTokenTTL(access, refresh time.Duration) {
+	if access > 0 {
+		auth.tokenValidation = access
+	}
+	if refresh > 0 {
+		auth.refreshValidation = refresh
+	}
 }
 
-func (auth *AuthService) Authenticate(email, password string) (*domain.User, error) {
+func (auth *AuthService) Authenticate(email, plain string) (*domain.User, error) {
 	user, valid := auth.store.GetUserByEmail(email)
 
-	if !valid {
-		return nil, errors.New("Invalid user")
+	// unknown users are verified against nothing, which takes as long as a real check
+	stored := ""
+	if valid {
+		stored = user.PasswordHash
 	}
 
-	if user.Password != password {
+	match, needsRehash := password.Verify(stored, plain)
+	if !valid || !match || user.Disabled {
 		return nil, errors.New("Invalid user")
 	}
 
+	if needsRehash {
+		auth.rehash(user, plain)
+	}
+
 	return user, nil
 }
 
-func (auth *AuthService) GenerateToken(user *domain.User) (string, error) {
+// rehash upgrades a legacy or weaker stored hash after a successful login.
+// Failing to do so does not fail the login, it is retried next time.
+func (auth *AuthService) rehash(user *domain.User, plain string) {
+	hash, err := password.Hash(plain)
+	if err != nil {
+		log.Printf("auth: rehash password of %s: %v", user.Email, err)
+		return
+	}
+
+	err = auth.store.Update(func(tx domain.Tx) error {
+		current, exists := tx.GetUserByEmail(user.Email)
+		// leave it alone when the password changed since it was verified
+		if !exists || current.PasswordHash != user.PasswordHash {
+			return nil
+		}
+
+		current.PasswordHash = hash
+		return tx.UpdateUser(current)
+	})
+	if err != nil {
+		log.Printf("auth: rehash password of %s: %v", user.Email, err)
+		return
+	}
+
+	user.PasswordHash = hash
+}
+
+// generateToken signs an access token of the session sid
+func (auth *AuthService) generateToken(user *domain.User, amr []string, sid string) (string, error) {
+	now := time.Now()
 	claim := jwt.MapClaims{
 		"email": user.Email,
 		"role":  user.Role,
+		// amr lists how the user logged in, see HasMFA
+		"amr": amr,
+		// jti identifies the token on the denylist
+		"jti": uuid.NewString(),
+		"iat": now.Unix(),
 		// use standard exp claim (unix timestamp)
-		"exp": time.Now().Add(auth.tokenValidation).Unix(),
+		"exp": now.Add(auth.tokenValidation).Unix(),
+		// sid ties the token to its session, ending the session ends the token
+		"sid": sid,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claim)
+	return auth.keys.Sign(claim)
+}
 
-	// sign using the configured secret (not the token object)
-	return token.SignedString(auth.jwtSecret)
+// JWKS is the public half of the signing keys, for other services verifying
+// our access tokens. It is empty while tokens are signed with HMAC.
+func (auth *AuthService) JWKS() jwtkeys.JWKS {
+	return auth.keys.JWKS()
 }
 
+// ParseToken validates an access token and returns its claims
 func (auth *AuthService) ParseToken(tokenStr string) (jwt.MapClaims, error) {
-	parsed, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		// enforce HMAC signing method
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	claim, err := auth.parse(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// MFA and password change challenges are signed with the same key but
+	// only prove the password
+	if _, typed := claim["typ"]; typed {
+		return nil, errors.New("Invalid token")
+	}
+
+	// a token outside a session would survive its user's logouts and
+	// password resets
+	sid, _ := claim["sid"].(string)
+	email, _ := claim["email"].(string)
+	session, exists := auth.store.GetSession(sid)
+	if sid == "" || !exists || session.Email != email {
+		return nil, errors.New("Invalid token")
+	}
+
+	return claim, nil
+}
+
+// parse checks the signature, expiry and revocation of any token issued here
+func (auth *AuthService) parse(tokenStr string) (jwt.MapClaims, error) {
+	// only the algorithms of our own keys, and each key only for its own
+	parsed, err := jwt.Parse(tokenStr, auth.keys.Keyfunc, jwt.WithValidMethods(auth.keys.Algorithms()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	claim, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok || !parsed.Valid {
+		return nil, errors.New("Invalid token")
+	}
+
+	// a token without jti cannot be revoked, so it is not accepted either
+	jti, _ := claim["jti"].(string)
+	if jti == "" || auth.store.IsTokenRevoked(jti) {
+		return nil, errors.New("Invalid token")
+	}
+
+	return claim, nil
+}
+
+// Authorize parses an access token and loads its user. Users that were
+// deleted or disabled since the token was issued are rejected, and the
+// returned user carries their current role rather than the one in the token.
+func (auth *AuthService) Authorize(tokenStr string) (*domain.User, jwt.MapClaims, error) {
+	claims, err := auth.ParseToken(tokenStr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	email, _ := claims["email"].(string)
+	user, exists := auth.store.GetUserByEmail(email)
+	if !exists || user.Disabled {
+		return nil, nil, errors.New("Invalid token")
+	}
+
+	sid, _ := claims["sid"].(string)
+	auth.touchSession(sid, time.Now())
+
+	return user, claims, nil
+}
+
+// IssueTokens starts a new session for an authenticated user: an access
+// token plus the first refresh token of a new family. amr are the
+// authentication methods of the login, they stay with the session. client
+// is recorded with the session for the user to recognise it by. Users who
+// have to change their password get no tokens for a password login, see
+// NewPasswordChangeChallenge.
+func (auth *AuthService) IssueTokens(user *domain.User, amr []string, client ClientInfo) (*TokenPair, error) {
+	if user.MustChangePassword && slices.Contains(amr, AMRPassword) {
+		return nil, errPasswordChangeNeeded
+	}
+
+	auth.purgeExpired()
+
+	family := uuid.NewString()
+	refreshToken, stored, err := auth.newRefreshToken(family, user.Email, amr)
+	if err != nil {
+		return nil, err
+	}
+
+	err = auth.store.Update(func(tx domain.Tx) error {
+		if err := tx.PutRefreshToken(stored); err != nil {
+			return err
+		}
+		return tx.PutSession(client.newSession(family, user.Email, stored.ExpiresAt))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.tokenPair(user, refreshToken, amr, family)
+}
+
+// Refresh exchanges a refresh token for a new pair. Every refresh token works
+// once: presenting a rotated one means it was copied, so its whole family is
+// revoked and the holder of the latest token has to log in again as well.
+// The session is updated with client.
+func (auth *AuthService) Refresh(refreshToken string, client ClientInfo) (*TokenPair, *domain.User, error) {
+	var user *domain.User
+	var next, sid, reusedBy string
+	var amr []string
+
+	err := auth.store.Update(func(tx domain.Tx) error {
+		current, exists := tx.GetRefreshToken(hashRefreshToken(refreshToken))
+		if !exists || current.Revoked || !time.Now().Before(current.ExpiresAt) {
+			return errInvalidRefreshToken
+		}
+
+		// the revocation has to be committed, so this is not an error yet
+		if current.Rotated {
+			reusedBy = current.Email
+			if err := tx.RevokeRefreshTokens(current.Family); err != nil {
+				return err
+			}
+			return tx.DeleteSession(current.Family)
+		}
+
+		user, exists = tx.GetUserByEmail(current.Email)
+		if !exists || user.Disabled {
+			return errInvalidRefreshToken
+		}
+
+		current.Rotated = true
+		if err := tx.PutRefreshToken(current); err != nil {
+			return err
+		}
+
+		// sessions started before MFA existed did not record how
+		amr = current.AMR
+		if len(amr) == 0 {
+			amr = passwordAMR
 		}
-		return auth.jwtSecret, nil
+
+		raw, stored, err := auth.newRefreshToken(current.Family, current.Email, amr)
+		if err != nil {
+			return err
+		}
+		next, sid = raw, current.Family
+		if err := tx.PutRefreshToken(stored); err != nil {
+			return err
+		}
+
+		// families issued before sessions were recorded get one now
+		session, exists := tx.GetSession(current.Family)
+		if !exists {
+			return tx.PutSession(client.newSession(current.Family, current.Email, stored.ExpiresAt))
+		}
+		client.update(session, stored.ExpiresAt)
+		return tx.PutSession(session)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if reusedBy != "" {
+		log.Printf("auth: refresh token of %s reused, session revoked", reusedBy)
+		return nil, nil, errInvalidRefreshToken
+	}
+
+	pair, err := auth.tokenPair(user, next, amr, sid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pair, user, nil
+}
+
+// Logout revokes the access token described by claims and, when given, the
+// refresh token family of the same user, which ends its session
+func (auth *AuthService) Logout(claims jwt.MapClaims, refreshToken string) error {
+	jti, _ := claims["jti"].(string)
+	email, _ := claims["email"].(string)
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil || jti == "" {
+		return errors.New("Invalid token")
+	}
+
+	return auth.store.Update(func(tx domain.Tx) error {
+		if err := tx.RevokeToken(&domain.RevokedToken{JTI: jti, ExpiresAt: expiresAt.Time}); err != nil {
+			return err
+		}
+
+		if refreshToken == "" {
+			return nil
+		}
+
+		// unknown tokens and other users' tokens are ignored, logging out always succeeds
+		current, exists := tx.GetRefreshToken(hashRefreshToken(refreshToken))
+		if !exists || current.Email != email {
+			return nil
+		}
+		if err := tx.RevokeRefreshTokens(current.Family); err != nil {
+			return err
+		}
+		return tx.DeleteSession(current.Family)
 	})
+}
 
+func (auth *AuthService) tokenPair(user *domain.User, refreshToken string, amr []string, sid string) (*TokenPair, error) {
+	accessToken, err := auth.generateToken(user, amr, sid)
 	if err != nil {
 		return nil, err
 	}
 
-	if claim, ok := parsed.Claims.(jwt.MapClaims); ok && parsed.Valid {
-		return claim, nil
+	return &TokenPair{AccessToken: accessToken, RefreshToken: refreshToken, ExpiresIn: auth.tokenValidation}, nil
+}
+
+// newRefreshToken returns an opaque token for the client and the record
+// stored for it, which only holds its hash
+func (auth *AuthService) newRefreshToken(family, email string, amr []string) (string, *domain.RefreshToken, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, fmt.Errorf("generate refresh token: %w", err)
 	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
 
-	return nil, errors.New("Invalid token")
+	return token, &domain.RefreshToken{
+		Hash:      hashRefreshToken(token),
+		Family:    family,
+		Email:     email,
+		ExpiresAt: time.Now().Add(auth.refreshValidation),
+		AMR:       amr,
+	}, nil
+}
+
+// hashRefreshToken needs no salt or stretching, the token is 256 random bits
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// purgeExpired keeps the token and login attempt tables from growing
+// without bound. It runs at most once per purgeInterval and failures are
+// only logged.
+func (auth *AuthService) purgeExpired() {
+	now := time.Now()
+	last := auth.lastPurge.Load()
+	if now.Unix()-last < int64(purgeInterval/time.Second) || !auth.lastPurge.CompareAndSwap(last, now.Unix()) {
+		return
+	}
+
+	if err := auth.store.PurgeExpiredTokens(now); err != nil {
+		log.Printf("auth: purge expired tokens: %v", err)
+	}
+	if err := auth.store.PurgeLoginAttempts(now.Add(-auth.throttle.Window)); err != nil {
+		log.Printf("auth: purge login attempts: %v", err)
+	}
 }
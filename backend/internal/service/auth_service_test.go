@@ -1,16 +1,24 @@
 package service
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 
 	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/jwtkeys"
+	"abasithdev.github.io/internal-cs-center-backend/internal/password"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
 	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestAuthService_Authenticate(t *testing.T) {
-	store := storage.NewMemoryStore() // Uses seed data with test users
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
 	secret := []byte("test-secret-key")
 	service := NewAuthService(store, secret)
 
@@ -67,8 +75,64 @@ func TestAuthService_Authenticate(t *testing.T) {
 	}
 }
 
+func TestAuthService_AuthenticateUpgradesHashes(t *testing.T) {
+	store := storage.NewMemoryStore()
+	service := NewAuthService(store, []byte("test-secret-key"))
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateUser(&domain.User{Email: "legacy@durianpay.id", PasswordHash: "plain-pass", Role: "cs"}))
+	require.NoError(t, store.CreateUser(&domain.User{Email: "bcrypt@durianpay.id", PasswordHash: string(bcryptHash), Role: "cs"}))
+
+	// a failed login leaves the stored value alone
+	_, err = service.Authenticate("legacy@durianpay.id", "wrong")
+	require.Error(t, err)
+	stored, _ := store.GetUserByEmail("legacy@durianpay.id")
+	require.Equal(t, "plain-pass", stored.PasswordHash)
+
+	for email, plain := range map[string]string{"legacy@durianpay.id": "plain-pass", "bcrypt@durianpay.id": "bcrypt-pass"} {
+		_, err := service.Authenticate(email, plain)
+		require.NoError(t, err)
+
+		stored, _ := store.GetUserByEmail(email)
+		require.True(t, strings.HasPrefix(stored.PasswordHash, "$argon2id$"), stored.PasswordHash)
+		match, needsRehash := password.Verify(stored.PasswordHash, plain)
+		require.True(t, match)
+		require.False(t, needsRehash)
+
+		// and the upgraded hash keeps working
+		_, err = service.Authenticate(email, plain)
+		require.NoError(t, err)
+	}
+}
+
+func TestAuthService_UserJSONHasNoHash(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+
+	user, err := service.Authenticate("john-cs@durianpay.id", "admin123")
+	require.NoError(t, err)
+	require.NotEmpty(t, user.PasswordHash)
+	user.TOTPSecret = "JBSWY3DPEHPK3PXP"
+	user.TOTPLastStep = 57000000
+	user.RecoveryCodes = []string{"hash"}
+
+	raw, err := json.Marshal(user)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"email": "john-cs@durianpay.id", "role": "cs", "disabled": false, "mfa_enabled": false, "must_change_password": false, "all_merchants": true}`, string(raw))
+}
+
+// issueAccessToken logs user in with a password and returns the access token
+func issueAccessToken(t *testing.T, service *AuthService, user *domain.User) string {
+	pair, err := service.IssueTokens(user, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	return pair.AccessToken
+}
+
 func TestAuthService_GenerateAndParseToken(t *testing.T) {
 	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
 	secret := []byte("test-secret-key")
 	service := NewAuthService(store, secret)
 
@@ -78,8 +142,7 @@ func TestAuthService_GenerateAndParseToken(t *testing.T) {
 		Role:  "cs",
 	}
 
-	token, err := service.GenerateToken(user)
-	require.NoError(t, err)
+	token := issueAccessToken(t, service, user)
 	require.NotEmpty(t, token)
 
 	// Parse and verify the token
@@ -96,7 +159,7 @@ func TestAuthService_GenerateAndParseToken(t *testing.T) {
 	expiredService := NewAuthService(store, secret)
 	expiredService.tokenValidation = -time.Hour // Token that expired 1 hour ago
 
-	expiredToken, _ := expiredService.GenerateToken(user)
+	expiredToken := issueAccessToken(t, expiredService, user)
 	_, err = service.ParseToken(expiredToken)
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "token is expired")
@@ -111,13 +174,56 @@ func TestAuthService_GenerateAndParseToken(t *testing.T) {
 
 	// Test token signed with different key
 	differentService := NewAuthService(store, []byte("different-secret"))
-	differentToken, _ := differentService.GenerateToken(user)
+	differentToken := issueAccessToken(t, differentService, user)
 	_, err = service.ParseToken(differentToken)
 	require.Error(t, err)
 }
 
+func TestAuthService_KeyRotation(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	user, _ := store.GetUserByEmail("john-cs@durianpay.id")
+
+	old := jwtkeys.HMACKey(jwtkeys.DefaultHMACKeyID, []byte("test-secret-key"))
+	oldToken := issueAccessToken(t, NewAuthService(store, []byte("test-secret-key")), user)
+
+	current, err := jwtkeys.Generate(jwtkeys.EdDSA)
+	require.NoError(t, err)
+	keys, err := jwtkeys.NewManager(current, old)
+	require.NoError(t, err)
+	service := NewAuthServiceWithKeys(store, keys)
+
+	// new tokens name the new key, tokens of the old key still work
+	token := issueAccessToken(t, service, user)
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	require.NoError(t, err)
+	require.Equal(t, current.ID, parsed.Header["kid"])
+	require.Equal(t, jwtkeys.EdDSA, parsed.Header["alg"])
+
+	_, err = service.ParseToken(token)
+	require.NoError(t, err)
+	_, err = service.ParseToken(oldToken)
+	require.NoError(t, err)
+
+	// so do the other tokens signed here
+	challenge, err := service.NewMFAChallenge(user)
+	require.NoError(t, err)
+	_, err = service.parse(challenge.Token)
+	require.NoError(t, err)
+
+	// once the old key is retired its tokens are rejected
+	retired, err := jwtkeys.NewManager(current)
+	require.NoError(t, err)
+	_, err = NewAuthServiceWithKeys(store, retired).ParseToken(oldToken)
+	require.Error(t, err)
+
+	require.Len(t, service.JWKS().Keys, 1)
+	require.Equal(t, current.ID, service.JWKS().Keys[0].KeyID)
+}
+
 func TestAuthService_TokenValidation(t *testing.T) {
 	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
 	secret := []byte("test-secret-key")
 	service := NewAuthService(store, secret)
 
@@ -127,8 +233,7 @@ func TestAuthService_TokenValidation(t *testing.T) {
 	}
 
 	// Test default validation period
-	token, err := service.GenerateToken(user)
-	require.NoError(t, err)
+	token := issueAccessToken(t, service, user)
 
 	claims, err := service.ParseToken(token)
 	require.NoError(t, err)
@@ -136,16 +241,15 @@ func TestAuthService_TokenValidation(t *testing.T) {
 	exp, ok := claims["exp"].(float64)
 	require.True(t, ok)
 
-	// Verify expiration is about 24 hours in the future (within 1 second tolerance)
-	expectedExp := float64(time.Now().Add(24 * time.Hour).Unix())
+	// Verify expiration is about 15 minutes in the future (within 1 second tolerance)
+	expectedExp := float64(time.Now().Add(15 * time.Minute).Unix())
 	require.InDelta(t, expectedExp, exp, 1.0)
 
 	// Test custom validation period
 	customService := NewAuthService(store, secret)
 	customService.tokenValidation = time.Hour // 1 hour
 
-	token, err = customService.GenerateToken(user)
-	require.NoError(t, err)
+	token = issueAccessToken(t, customService, user)
 
 	claims, err = customService.ParseToken(token)
 	require.NoError(t, err)
@@ -157,3 +261,229 @@ func TestAuthService_TokenValidation(t *testing.T) {
 	expectedExp = float64(time.Now().Add(time.Hour).Unix())
 	require.InDelta(t, expectedExp, exp, 1.0)
 }
+
+func TestAuthService_RefreshRotatesTokens(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+
+	user, err := service.Authenticate("john-cs@durianpay.id", "admin123")
+	require.NoError(t, err)
+	first, err := service.IssueTokens(user, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 15*time.Minute, first.ExpiresIn)
+	require.NotEmpty(t, first.RefreshToken)
+
+	second, refreshed, err := service.Refresh(first.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "john-cs@durianpay.id", refreshed.Email)
+	require.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	require.NotEqual(t, first.AccessToken, second.AccessToken)
+
+	claims, err := service.ParseToken(second.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, "cs", claims["role"])
+
+	// only the hash is stored
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		_, exists := tx.GetRefreshToken(second.RefreshToken)
+		require.False(t, exists)
+		_, exists = tx.GetRefreshToken(hashRefreshToken(second.RefreshToken))
+		require.True(t, exists)
+		return nil
+	}))
+
+	// presenting the rotated token again revokes the whole family, the
+	// latest token included
+	_, _, err = service.Refresh(first.RefreshToken, ClientInfo{})
+	require.Error(t, err)
+	_, _, err = service.Refresh(second.RefreshToken, ClientInfo{})
+	require.Error(t, err)
+
+	// a new login starts a new family
+	fresh, err := service.IssueTokens(user, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	_, _, err = service.Refresh(fresh.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+}
+
+func TestAuthService_RefreshRejects(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+	user, _ := store.GetUserByEmail("john-cs@durianpay.id")
+
+	expiredService := NewAuthService(store, []byte("test-secret-key"))
+	expiredService.refreshValidation = -time.Minute
+	expired, err := expiredService.IssueTokens(user, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+
+	deleted, err := service.IssueTokens(&domain.User{Email: "gone@durianpay.id", Role: "cs"}, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		refreshToken string
+	}{
+		{name: "unknown token", refreshToken: "not-a-token"},
+		{name: "empty token", refreshToken: ""},
+		{name: "expired token", refreshToken: expired.RefreshToken},
+		{name: "user no longer exists", refreshToken: deleted.RefreshToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair, refreshed, err := service.Refresh(tt.refreshToken, ClientInfo{})
+			require.Error(t, err)
+			require.Nil(t, pair)
+			require.Nil(t, refreshed)
+		})
+	}
+}
+
+func TestAuthService_ConcurrentRefresh(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+	user, _ := store.GetUserByEmail("john-cs@durianpay.id")
+
+	pair, err := service.IssueTokens(user, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+
+	// the same token raced from several clients is exchanged at most once
+	const clients = 8
+	results := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			_, _, err := service.Refresh(pair.RefreshToken, ClientInfo{})
+			results <- err
+		}()
+	}
+
+	succeeded := 0
+	for i := 0; i < clients; i++ {
+		if <-results == nil {
+			succeeded++
+		}
+	}
+	require.Equal(t, 1, succeeded)
+}
+
+func TestAuthService_Logout(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+	john, _ := store.GetUserByEmail("john-cs@durianpay.id")
+	jane, _ := store.GetUserByEmail("jane-operational@durianpay.id")
+
+	johnTokens, err := service.IssueTokens(john, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	janeTokens, err := service.IssueTokens(jane, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	otherSession, err := service.IssueTokens(john, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+
+	claims, err := service.ParseToken(johnTokens.AccessToken)
+	require.NoError(t, err)
+
+	// another user's refresh token is not touched
+	require.NoError(t, service.Logout(claims, janeTokens.RefreshToken))
+	_, err = service.ParseToken(johnTokens.AccessToken)
+	require.Error(t, err, "the access token is denylisted")
+	_, _, err = service.Refresh(janeTokens.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+
+	// logging out twice, now with the own refresh token, revokes that session only
+	require.NoError(t, service.Logout(claims, johnTokens.RefreshToken))
+	_, _, err = service.Refresh(johnTokens.RefreshToken, ClientInfo{})
+	require.Error(t, err)
+	_, _, err = service.Refresh(otherSession.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+
+	// the denylist lives in the store, another instance sees it too
+	other := NewAuthService(store, []byte("test-secret-key"))
+	_, err = other.ParseToken(johnTokens.AccessToken)
+	require.Error(t, err)
+
+	require.Error(t, service.Logout(jwt.MapClaims{"email": "john-cs@durianpay.id"}, ""))
+}
+
+func TestAuthService_ParseTokenRequiresJTI(t *testing.T) {
+	store := storage.NewMemoryStore()
+	secret := []byte("test-secret-key")
+	service := NewAuthService(store, secret)
+
+	// tokens issued before revocation existed carry no jti
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"email": "john-cs@durianpay.id",
+		"role":  "cs",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}).SignedString(secret)
+	require.NoError(t, err)
+
+	_, err = service.ParseToken(token)
+	require.Error(t, err)
+}
+
+func TestAuthService_PurgesExpiredTokens(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	user, _ := store.GetUserByEmail("john-cs@durianpay.id")
+
+	expiredService := NewAuthService(store, []byte("test-secret-key"))
+	expiredService.refreshValidation = -time.Minute
+	expired, err := expiredService.IssueTokens(user, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+
+	// the first login of a service purges, later ones wait for the interval
+	service := NewAuthService(store, []byte("test-secret-key"))
+	_, err = service.IssueTokens(user, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		_, exists := tx.GetRefreshToken(hashRefreshToken(expired.RefreshToken))
+		require.False(t, exists)
+		return nil
+	}))
+}
+
+func TestAuthService_DisabledUsers(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+
+	user, err := service.Authenticate("john-cs@durianpay.id", "admin123")
+	require.NoError(t, err)
+	pair, err := service.IssueTokens(user, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+
+	authorized, _, err := service.Authorize(pair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, "cs", authorized.Role)
+
+	// a role change applies to tokens already handed out
+	user.Role = "operational"
+	require.NoError(t, store.UpdateUser(user))
+	authorized, claims, err := service.Authorize(pair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, "operational", authorized.Role)
+	require.Equal(t, "cs", claims["role"])
+
+	user.Disabled = true
+	require.NoError(t, store.UpdateUser(user))
+
+	_, err = service.Authenticate("john-cs@durianpay.id", "admin123")
+	require.Error(t, err)
+	_, _, err = service.Authorize(pair.AccessToken)
+	require.Error(t, err)
+	_, _, err = service.Refresh(pair.RefreshToken, ClientInfo{})
+	require.Error(t, err)
+
+	// deleted users are treated the same
+	jane, _ := store.GetUserByEmail("jane-operational@durianpay.id")
+	janeTokens, err := service.IssueTokens(jane, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteUser(jane.Email))
+	_, _, err = service.Authorize(janeTokens.AccessToken)
+	require.Error(t, err)
+}
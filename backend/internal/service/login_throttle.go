@@ -0,0 +1,145 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+)
+
+// LoginThrottle slows down password guessing. Failures are counted per
+// account and per client address; after FreeAttempts each further failure
+// doubles the wait before the next attempt, and reaching a lockout threshold
+// blocks the key for LockoutDuration. Accounts are tracked whether they exist
+// or not, so throttled responses do not tell them apart.
+type LoginThrottle struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	// AccountLockout and AddressLockout are failure counts, 0 disables the lockout
+	AccountLockout  int
+	AddressLockout  int
+	LockoutDuration time.Duration
+	// Window forgets failures this long after the last one
+	Window time.Duration
+}
+
+// DefaultLoginThrottle allows a few typos, then backs off from 1s to 1m and
+// locks an account after 10 failures or an address after 50
+var DefaultLoginThrottle = LoginThrottle{
+	FreeAttempts:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Minute,
+	AccountLockout:  10,
+	AddressLockout:  50,
+	LockoutDuration: 15 * time.Minute,
+	Window:          time.Hour,
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func addressKey(ip string) string {
+	return "address:" + ip
+}
+
+// delay is the wait after the given number of failures
+func (throttle LoginThrottle) delay(failures int) time.Duration {
+	if failures < throttle.FreeAttempts {
+		return 0
+	}
+
+	delay := throttle.BaseDelay
+	for i := throttle.FreeAttempts; i < failures && delay < throttle.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, throttle.MaxDelay)
+}
+
+// expired reports whether the key starts over: its lockout ended, or it was
+// never locked and its last failure is older than Window
+func (throttle LoginThrottle) expired(attempts *domain.LoginAttempts, now time.Time) bool {
+	if !attempts.LockedUntil.IsZero() {
+		return !now.Before(attempts.LockedUntil)
+	}
+	return now.Sub(attempts.LastFailure) > throttle.Window
+}
+
+// retryAt is when the key may attempt again
+func (throttle LoginThrottle) retryAt(attempts *domain.LoginAttempts) time.Time {
+	retryAt := attempts.LastFailure.Add(throttle.delay(attempts.Failures))
+	if attempts.LockedUntil.After(retryAt) {
+		return attempts.LockedUntil
+	}
+	return retryAt
+}
+
+// reserve counts an attempt against every key before the password is checked,
+// so parallel guesses cannot all slip through before the first one fails.
+// A throttled attempt is not counted and returns a RateLimitError. It returns
+// the last failure of each key before the attempt, for release to put back.
+func (throttle LoginThrottle) reserve(tx domain.Tx, keys map[string]int, now time.Time) (map[string]time.Time, error) {
+	retryAt := now
+	current := map[string]*domain.LoginAttempts{}
+	previous := map[string]time.Time{}
+
+	for key := range keys {
+		attempts, exists := tx.GetLoginAttempts(key)
+		if !exists || throttle.expired(attempts, now) {
+			attempts = &domain.LoginAttempts{Key: key}
+		}
+		current[key] = attempts
+		previous[key] = attempts.LastFailure
+
+		if at := throttle.retryAt(attempts); at.After(retryAt) {
+			retryAt = at
+		}
+	}
+
+	if retryAt.After(now) {
+		return nil, errors.NewRateLimitError(", try again later", retryAt.Sub(now))
+	}
+
+	for key, lockout := range keys {
+		attempts := current[key]
+		attempts.Failures++
+		attempts.LastFailure = now
+		if lockout > 0 && attempts.Failures >= lockout {
+			attempts.LockedUntil = now.Add(throttle.LockoutDuration)
+		}
+		if err := tx.PutLoginAttempts(attempts); err != nil {
+			return nil, err
+		}
+	}
+	return previous, nil
+}
+
+// release undoes the reservation made at reservedAt for a successful login:
+// the account starts over, the address only gets its attempt back so a valid
+// login of one account does not clear guesses against others. A lockout the
+// reservation tripped is lifted with it, and unless the address failed again
+// since, its last failure goes back to previous so it ages out as if the
+// attempt was never counted.
+func (throttle LoginThrottle) release(tx domain.Tx, account, address string, reservedAt, previous time.Time) error {
+	if err := tx.DeleteLoginAttempts(account); err != nil {
+		return err
+	}
+
+	attempts, exists := tx.GetLoginAttempts(address)
+	if !exists || attempts.Failures == 0 {
+		return nil
+	}
+	attempts.Failures--
+	if throttle.AddressLockout == 0 || attempts.Failures < throttle.AddressLockout {
+		attempts.LockedUntil = time.Time{}
+	}
+	if attempts.LastFailure.Equal(reservedAt) {
+		attempts.LastFailure = previous
+	}
+	if attempts.Failures == 0 && attempts.LockedUntil.IsZero() {
+		return tx.DeleteLoginAttempts(address)
+	}
+	return tx.PutLoginAttempts(attempts)
+}
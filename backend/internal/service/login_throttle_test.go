@@ -0,0 +1,266 @@
+package service
+
+import (
+	common_errors "errors"
+	"sync"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginThrottle_Delay(t *testing.T) {
+	throttle := DefaultLoginThrottle
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 0, want: 0},
+		{failures: 2, want: 0},
+		{failures: 3, want: time.Second},
+		{failures: 4, want: 2 * time.Second},
+		{failures: 8, want: 32 * time.Second},
+		{failures: 9, want: time.Minute},
+		{failures: 1000, want: time.Minute},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.want, throttle.delay(tt.failures), "failures %d", tt.failures)
+	}
+}
+
+func TestLoginThrottle_Reserve(t *testing.T) {
+	store := storage.NewMemoryStore()
+	throttle := LoginThrottle{FreeAttempts: 2, BaseDelay: time.Second, MaxDelay: time.Minute, AccountLockout: 4, LockoutDuration: time.Hour, Window: time.Hour}
+	keys := map[string]int{"account:a": throttle.AccountLockout, "address:ip": 0}
+	now := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	reserve := func(at time.Time) error {
+		return store.Update(func(tx domain.Tx) error {
+			_, err := throttle.reserve(tx, keys, at)
+			return err
+		})
+	}
+	retryAfter := func(err error) time.Duration {
+		var rateLimitErr *errors.RateLimitError
+		require.True(t, common_errors.As(err, &rateLimitErr), "expected RateLimitError, got %v", err)
+		return rateLimitErr.RetryAfter
+	}
+
+	// the free attempts go through back to back
+	require.NoError(t, reserve(now))
+	require.NoError(t, reserve(now))
+
+	// then the backoff starts, a throttled attempt is not counted
+	require.Equal(t, time.Second, retryAfter(reserve(now)))
+	require.Equal(t, 500*time.Millisecond, retryAfter(reserve(now.Add(500*time.Millisecond))))
+	require.NoError(t, reserve(now.Add(time.Second)))
+	require.Equal(t, 2*time.Second, retryAfter(reserve(now.Add(time.Second))))
+
+	// the fourth failure locks the account, the address has no lockout
+	require.NoError(t, reserve(now.Add(3*time.Second)))
+	require.Equal(t, time.Hour, retryAfter(reserve(now.Add(3*time.Second))))
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		account, _ := tx.GetLoginAttempts("account:a")
+		require.Equal(t, 4, account.Failures)
+		require.True(t, account.LockedUntil.Equal(now.Add(3*time.Second+time.Hour)))
+		address, _ := tx.GetLoginAttempts("address:ip")
+		require.True(t, address.LockedUntil.IsZero())
+		return nil
+	}))
+
+	// after the cooldown the account starts over
+	require.NoError(t, reserve(now.Add(2*time.Hour)))
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		account, _ := tx.GetLoginAttempts("account:a")
+		require.Equal(t, 1, account.Failures)
+		require.True(t, account.LockedUntil.IsZero())
+		return nil
+	}))
+}
+
+func newThrottledAuthService(t *testing.T) (*AuthService, *storage.MemoryStore) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+	service.SetLoginThrottle(LoginThrottle{FreeAttempts: 3, AccountLockout: 3, AddressLockout: 6, LockoutDuration: time.Hour, Window: time.Hour})
+	return service, store
+}
+
+func TestAuthService_LoginLocksAccounts(t *testing.T) {
+	service, store := newThrottledAuthService(t)
+
+	// unknown accounts are locked the same way as existing ones
+	for _, email := range []string{"john-cs@durianpay.id", "nobody@durianpay.id"} {
+		for i := 0; i < 3; i++ {
+			_, err := service.Login(email, "wrong", "10.0.0.1")
+			require.Error(t, err)
+			var rateLimitErr *errors.RateLimitError
+			require.False(t, common_errors.As(err, &rateLimitErr))
+		}
+
+		_, err := service.Login(email, "wrong", "10.0.0.2")
+		var rateLimitErr *errors.RateLimitError
+		require.True(t, common_errors.As(err, &rateLimitErr), "%s: expected RateLimitError, got %v", email, err)
+		require.InDelta(t, time.Hour.Seconds(), rateLimitErr.RetryAfter.Seconds(), 1)
+	}
+
+	// the right password does not get through a lockout
+	_, err := service.Login("john-cs@durianpay.id", "admin123", "10.0.0.2")
+	require.Error(t, err)
+
+	// other accounts are not affected, and emails differing in case are one account
+	_, err = service.Login("jane-operational@durianpay.id", "admin123", "10.0.0.2")
+	require.NoError(t, err)
+	_, err = service.Login("John-CS@durianpay.id", "admin123", "10.0.0.2")
+	require.Error(t, err)
+
+	// an admin unlock lifts the lockout
+	require.NoError(t, NewUserService(store).UnlockUser("john-cs@durianpay.id"))
+	user, err := service.Login("john-cs@durianpay.id", "admin123", "10.0.0.2")
+	require.NoError(t, err)
+	require.Equal(t, "cs", user.Role)
+}
+
+func TestAuthService_LoginLocksAddresses(t *testing.T) {
+	service, _ := newThrottledAuthService(t)
+
+	// spraying one password over many accounts from one address
+	for _, email := range []string{"a@durianpay.id", "b@durianpay.id", "c@durianpay.id", "d@durianpay.id", "e@durianpay.id", "f@durianpay.id"} {
+		_, err := service.Login(email, "admin123", "10.0.0.1")
+		require.Error(t, err)
+	}
+
+	_, err := service.Login("john-cs@durianpay.id", "admin123", "10.0.0.1")
+	var rateLimitErr *errors.RateLimitError
+	require.True(t, common_errors.As(err, &rateLimitErr), "expected RateLimitError, got %v", err)
+
+	// other addresses still get in
+	_, err = service.Login("john-cs@durianpay.id", "admin123", "10.0.0.2")
+	require.NoError(t, err)
+}
+
+func TestAuthService_LoginAtAddressLockout(t *testing.T) {
+	service, store := newThrottledAuthService(t)
+
+	for _, email := range []string{"a@durianpay.id", "b@durianpay.id", "c@durianpay.id", "d@durianpay.id", "e@durianpay.id"} {
+		_, err := service.Login(email, "wrong", "10.0.0.1")
+		require.Error(t, err)
+	}
+
+	// a correct login as the attempt that reaches the lockout does not lock the address
+	_, err := service.Login("john-cs@durianpay.id", "admin123", "10.0.0.1")
+	require.NoError(t, err)
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		address, _ := tx.GetLoginAttempts(addressKey("10.0.0.1"))
+		require.Equal(t, 5, address.Failures)
+		require.True(t, address.LockedUntil.IsZero())
+		return nil
+	}))
+	_, err = service.Login("jane-operational@durianpay.id", "admin123", "10.0.0.1")
+	require.NoError(t, err)
+
+	// the next failure still does
+	_, err = service.Login("f@durianpay.id", "wrong", "10.0.0.1")
+	require.Error(t, err)
+	_, err = service.Login("john-cs@durianpay.id", "admin123", "10.0.0.1")
+	var rateLimitErr *errors.RateLimitError
+	require.True(t, common_errors.As(err, &rateLimitErr), "expected RateLimitError, got %v", err)
+}
+
+func TestAuthService_LoginResetsOnSuccess(t *testing.T) {
+	service, store := newThrottledAuthService(t)
+
+	for i := 0; i < 2; i++ {
+		_, err := service.Login("john-cs@durianpay.id", "wrong", "10.0.0.1")
+		require.Error(t, err)
+	}
+	_, err := service.Login("john-cs@durianpay.id", "admin123", "10.0.0.1")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		_, exists := tx.GetLoginAttempts(accountKey("john-cs@durianpay.id"))
+		require.False(t, exists, "the account starts over")
+		address, _ := tx.GetLoginAttempts(addressKey("10.0.0.1"))
+		require.Equal(t, 2, address.Failures, "the address keeps its failures")
+		return nil
+	}))
+}
+
+func TestAuthService_LoginReleasesLastFailure(t *testing.T) {
+	service, store := newThrottledAuthService(t)
+	earlier := time.Now().Add(-30 * time.Minute).Truncate(time.Second)
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		if err := tx.PutLoginAttempts(&domain.LoginAttempts{Key: addressKey("10.0.0.1"), Failures: 2, LastFailure: earlier}); err != nil {
+			return err
+		}
+		return tx.PutLoginAttempts(&domain.LoginAttempts{Key: addressKey("10.0.0.2"), Failures: 5, LastFailure: earlier})
+	}))
+
+	// a correct login is no failure, the addresses age from their last real one
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		_, err := service.Login("john-cs@durianpay.id", "admin123", ip)
+		require.NoError(t, err)
+	}
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		address, _ := tx.GetLoginAttempts(addressKey("10.0.0.1"))
+		require.Equal(t, 2, address.Failures)
+		require.True(t, address.LastFailure.Equal(earlier))
+		// the lockout the login tripped is lifted along with it
+		address, _ = tx.GetLoginAttempts(addressKey("10.0.0.2"))
+		require.Equal(t, 5, address.Failures)
+		require.True(t, address.LockedUntil.IsZero())
+		require.True(t, address.LastFailure.Equal(earlier))
+		_, exists := tx.GetLoginAttempts(addressKey("10.0.0.3"))
+		require.False(t, exists, "an address without failures is not kept")
+		return nil
+	}))
+
+	require.NoError(t, store.PurgeLoginAttempts(earlier.Add(time.Minute)))
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+			_, exists := tx.GetLoginAttempts(addressKey(ip))
+			require.False(t, exists, ip)
+		}
+		return nil
+	}))
+}
+
+func TestAuthService_ConcurrentLogin(t *testing.T) {
+	service, _ := newThrottledAuthService(t)
+
+	// parallel guesses are counted before the password is checked, so no
+	// more than the lockout threshold are ever verified
+	const guesses = 12
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	verified := 0
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := service.Login("john-cs@durianpay.id", "wrong", "10.0.0.1")
+			var rateLimitErr *errors.RateLimitError
+			if !common_errors.As(err, &rateLimitErr) {
+				mu.Lock()
+				verified++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 3, verified)
+}
+
+func TestUserService_UnlockUnknownUser(t *testing.T) {
+	users, _ := newUserTestService(t)
+
+	err := users.UnlockUser("ghost@durianpay.id")
+	require.IsType(t, &errors.NotFoundError{}, err)
+}
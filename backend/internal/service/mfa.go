@@ -0,0 +1,307 @@
+package service
+
+/*
+TOTP two-factor authentication. Users with MFA enabled log in in two steps:
+the password gets them a short-lived challenge token, which VerifyMFA
+exchanges for a session once they present a TOTP or recovery code. Access
+tokens list how the user logged in in their amr claim (RFC 8176), so the
+policy can demand a second factor for some permissions.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	common_errors "errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/totp"
+)
+
+// Authentication method references of the amr claim
+const (
+	AMRPassword    = "pwd"
+	AMROneTimeCode = "otp"
+	// AMRMultiFactor is present whenever a second factor was used
+	AMRMultiFactor = "mfa"
+)
+
+const (
+	mfaChallengeTTL = 5 * time.Minute
+	mfaChallengeTyp = "mfa_challenge"
+	// mfaIssuer names the account in authenticator apps
+	mfaIssuer = "Internal CS Center"
+
+	recoveryCodeCount = 10
+	// recoveryCodeLength is in base32 characters, 80 random bits
+	recoveryCodeLength = 16
+)
+
+var (
+	passwordAMR     = []string{AMRPassword}
+	totpAMR         = []string{AMRPassword, AMROneTimeCode, AMRMultiFactor}
+	recoveryCodeAMR = []string{AMRPassword, AMRMultiFactor}
+
+	errInvalidChallenge = common_errors.New("Invalid MFA challenge")
+	errInvalidMFACode   = common_errors.New("Invalid MFA code")
+)
+
+// MFAChallenge is what a password login of a user with MFA enabled gets
+// instead of a TokenPair
+type MFAChallenge struct {
+	Token     string
+	ExpiresIn time.Duration
+}
+
+// MFAEnrollment is a pending TOTP secret, for the user to add to their
+// authenticator app before ConfirmMFA
+type MFAEnrollment struct {
+	Secret string
+	// URI is the otpauth:// provisioning URI, to be shown as a QR code
+	URI string
+}
+
+// HasMFA reports whether the access token described by claims was issued to
+// a login with a second factor
+func HasMFA(claims jwt.MapClaims) bool {
+	amr, _ := claims["amr"].([]any)
+	return slices.Contains(amr, any(AMRMultiFactor))
+}
+
+// mfaKey counts failed codes of an account, apart from failed passwords
+func mfaKey(email string) string {
+	return "mfa:" + strings.ToLower(email)
+}
+
+// NewMFAChallenge returns the challenge token of a user who passed the
+// password step
+func (auth *AuthService) NewMFAChallenge(user *domain.User) (*MFAChallenge, error) {
+	now := time.Now()
+	signed, err := auth.keys.Sign(jwt.MapClaims{
+		"typ":   mfaChallengeTyp,
+		"email": user.Email,
+		"jti":   uuid.NewString(),
+		"iat":   now.Unix(),
+		"exp":   now.Add(mfaChallengeTTL).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MFAChallenge{Token: signed, ExpiresIn: mfaChallengeTTL}, nil
+}
+
+// VerifyMFA completes a login started with NewMFAChallenge. code is a TOTP
+// code or one of the user's recovery codes, which is used up. Failed codes
+// are throttled like failed passwords, and each challenge works once. It
+// returns the user and the authentication methods for IssueTokens.
+func (auth *AuthService) VerifyMFA(challenge, code string) (*domain.User, []string, error) {
+	claims, err := auth.parse(challenge)
+	if err != nil || claims["typ"] != mfaChallengeTyp {
+		return nil, nil, errInvalidChallenge
+	}
+	email, _ := claims["email"].(string)
+	jti, _ := claims["jti"].(string)
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		return nil, nil, errInvalidChallenge
+	}
+
+	key := mfaKey(email)
+	if err := auth.reserveCode(key); err != nil {
+		return nil, nil, err
+	}
+
+	var user *domain.User
+	var amr []string
+	err = auth.store.Update(func(tx domain.Tx) error {
+		var exists bool
+		user, exists = tx.GetUserByEmail(email)
+		if !exists || user.Disabled || !user.MFAEnabled {
+			return errInvalidChallenge
+		}
+
+		if amr = checkSecondFactor(user, code, time.Now()); amr == nil {
+			return errInvalidMFACode
+		}
+
+		if err := tx.UpdateUser(user); err != nil {
+			return err
+		}
+		if err := tx.RevokeToken(&domain.RevokedToken{JTI: jti, ExpiresAt: expiresAt.Time}); err != nil {
+			return err
+		}
+		return tx.DeleteLoginAttempts(key)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, amr, nil
+}
+
+// EnrollMFA starts a TOTP enrolment, replacing one that was not confirmed.
+// MFA stays off until ConfirmMFA.
+func (auth *AuthService) EnrollMFA(email string) (*MFAEnrollment, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	err = auth.store.Update(func(tx domain.Tx) error {
+		user, exists := tx.GetUserByEmail(email)
+		if !exists {
+			return errors.NewNotFoundError(": email: " + email)
+		}
+		if user.MFAEnabled {
+			return errors.NewValidationError(": MFA is already enabled, disable it first")
+		}
+
+		user.TOTPSecret = secret
+		user.TOTPLastStep = 0
+		return tx.UpdateUser(user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MFAEnrollment{Secret: secret, URI: totp.URI(secret, mfaIssuer, email)}, nil
+}
+
+// ConfirmMFA enables MFA once the user shows a code of the pending secret,
+// proving their app has it. It returns the recovery codes, which are only
+// stored hashed and cannot be shown again.
+func (auth *AuthService) ConfirmMFA(email, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = auth.store.Update(func(tx domain.Tx) error {
+		user, exists := tx.GetUserByEmail(email)
+		if !exists {
+			return errors.NewNotFoundError(": email: " + email)
+		}
+		if user.MFAEnabled || user.TOTPSecret == "" {
+			return errors.NewValidationError(": there is no MFA enrolment to confirm")
+		}
+
+		step, valid := totp.Validate(user.TOTPSecret, code, time.Now(), 0)
+		if !valid {
+			return errors.NewValidationError(": invalid code")
+		}
+
+		user.MFAEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = hashes
+		return tx.UpdateUser(user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// DisableMFA turns MFA off, which takes a current TOTP or recovery code.
+// Failed codes count like those of VerifyMFA, so a session from before the
+// enrolment cannot be used to guess them.
+func (auth *AuthService) DisableMFA(email, code string) error {
+	key := mfaKey(email)
+	if err := auth.reserveCode(key); err != nil {
+		return err
+	}
+
+	return auth.store.Update(func(tx domain.Tx) error {
+		user, exists := tx.GetUserByEmail(email)
+		if !exists {
+			return errors.NewNotFoundError(": email: " + email)
+		}
+		if !user.MFAEnabled {
+			return errors.NewValidationError(": MFA is not enabled")
+		}
+		if checkSecondFactor(user, code, time.Now()) == nil {
+			return errors.NewValidationError(": invalid code")
+		}
+
+		clearMFA(user)
+		if err := tx.UpdateUser(user); err != nil {
+			return err
+		}
+		return tx.DeleteLoginAttempts(key)
+	})
+}
+
+// reserveCode counts a code attempt against key before it is checked
+func (auth *AuthService) reserveCode(key string) error {
+	return auth.store.Update(func(tx domain.Tx) error {
+		_, err := auth.throttle.reserve(tx, map[string]int{key: auth.throttle.AccountLockout}, time.Now())
+		return err
+	})
+}
+
+// checkSecondFactor accepts a TOTP code or a recovery code of user and
+// records it as used on user. It returns the authentication methods of the
+// login, nil when code is wrong.
+func checkSecondFactor(user *domain.User, code string, now time.Time) []string {
+	if step, valid := totp.Validate(user.TOTPSecret, code, now, user.TOTPLastStep); valid {
+		user.TOTPLastStep = step
+		return totpAMR
+	}
+
+	hash := hashRecoveryCode(code)
+	if i := slices.Index(user.RecoveryCodes, hash); i >= 0 {
+		user.RecoveryCodes = slices.Delete(slices.Clone(user.RecoveryCodes), i, i+1)
+		return recoveryCodeAMR
+	}
+
+	return nil
+}
+
+// clearMFA removes the enrolment of user, used when they disable MFA or an
+// admin resets it
+func clearMFA(user *domain.User) {
+	user.MFAEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+}
+
+// newRecoveryCodes returns recovery codes formatted for the user and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, recoveryCodeLength*5/8)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, fmt.Errorf("generate recovery code: %w", err)
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(raw))
+		// groups of four are easier to copy from paper
+		code = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case, dashes and spaces, the code may be typed
+// back in any way. Like refresh tokens the codes are random enough to need
+// no stretching.
+func hashRecoveryCode(code string) string {
+	normalized := strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	common_errors "errors"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"abasithdev.github.io/internal-cs-center-backend/internal/totp"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// totpCode is the code of secret offset steps from now
+func totpCode(t *testing.T, secret string, offset int64) string {
+	code, err := totp.Code(secret, totp.Step(time.Now())+offset)
+	require.NoError(t, err)
+	return code
+}
+
+// enrollMFA enables MFA for email and returns its secret and recovery codes
+func enrollMFA(t *testing.T, service *AuthService, email string) (string, []string) {
+	enrollment, err := service.EnrollMFA(email)
+	require.NoError(t, err)
+
+	codes, err := service.ConfirmMFA(email, totpCode(t, enrollment.Secret, -1))
+	require.NoError(t, err)
+	return enrollment.Secret, codes
+}
+
+func newMFATestService(t *testing.T) (*AuthService, *storage.MemoryStore) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	return NewAuthService(store, []byte("test-secret-key")), store
+}
+
+func TestAuthService_EnrollMFA(t *testing.T) {
+	service, store := newMFATestService(t)
+
+	enrollment, err := service.EnrollMFA("john-cs@durianpay.id")
+	require.NoError(t, err)
+	require.Len(t, enrollment.Secret, 32)
+	require.Contains(t, enrollment.URI, "otpauth://totp/Internal%20CS%20Center:john-cs@durianpay.id?")
+	require.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+
+	// pending until confirmed
+	user, _ := store.GetUserByEmail("john-cs@durianpay.id")
+	require.False(t, user.MFAEnabled)
+	require.Equal(t, enrollment.Secret, user.TOTPSecret)
+
+	_, err = service.ConfirmMFA("john-cs@durianpay.id", "000000")
+	require.IsType(t, &errors.ValidationError{}, err)
+
+	codes, err := service.ConfirmMFA("john-cs@durianpay.id", totpCode(t, enrollment.Secret, 0))
+	require.NoError(t, err)
+	require.Len(t, codes, 10)
+	require.Regexp(t, `^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`, codes[0])
+
+	user, _ = store.GetUserByEmail("john-cs@durianpay.id")
+	require.True(t, user.MFAEnabled)
+	require.Len(t, user.RecoveryCodes, 10)
+	require.NotContains(t, user.RecoveryCodes, codes[0], "only hashes are stored")
+
+	_, err = service.EnrollMFA("john-cs@durianpay.id")
+	require.IsType(t, &errors.ValidationError{}, err, "enrolled users have to disable MFA first")
+	_, err = service.ConfirmMFA("john-cs@durianpay.id", totpCode(t, enrollment.Secret, 1))
+	require.IsType(t, &errors.ValidationError{}, err)
+	_, err = service.EnrollMFA("ghost@durianpay.id")
+	require.IsType(t, &errors.NotFoundError{}, err)
+}
+
+func TestAuthService_VerifyMFA(t *testing.T) {
+	service, _ := newMFATestService(t)
+	secret, recoveryCodes := enrollMFA(t, service, "john-cs@durianpay.id")
+
+	user, err := service.Login("john-cs@durianpay.id", "admin123", "10.0.0.1")
+	require.NoError(t, err)
+	require.True(t, user.MFAEnabled)
+
+	challenge, err := service.NewMFAChallenge(user)
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Minute, challenge.ExpiresIn)
+
+	// a challenge is not an access token
+	_, err = service.ParseToken(challenge.Token)
+	require.Error(t, err)
+
+	_, _, err = service.VerifyMFA(challenge.Token, "000000")
+	require.Error(t, err)
+
+	// the code confirming the enrolment was for the previous step, so the current one is new
+	code := totpCode(t, secret, 0)
+	verified, amr, err := service.VerifyMFA(challenge.Token, code)
+	require.NoError(t, err)
+	require.Equal(t, "john-cs@durianpay.id", verified.Email)
+	require.Equal(t, []string{"pwd", "otp", "mfa"}, amr)
+
+	// each challenge works once
+	_, _, err = service.VerifyMFA(challenge.Token, totpCode(t, secret, 1))
+	require.Error(t, err)
+
+	// and each code
+	challenge, err = service.NewMFAChallenge(user)
+	require.NoError(t, err)
+	_, _, err = service.VerifyMFA(challenge.Token, code)
+	require.Error(t, err)
+
+	// recovery codes work once, typed in any case
+	_, amr, err = service.VerifyMFA(challenge.Token, " "+recoveryCodes[0][:9]+recoveryCodes[0][10:]+" ")
+	require.NoError(t, err)
+	require.Equal(t, []string{"pwd", "mfa"}, amr)
+	challenge, err = service.NewMFAChallenge(user)
+	require.NoError(t, err)
+	_, _, err = service.VerifyMFA(challenge.Token, recoveryCodes[0])
+	require.Error(t, err)
+
+	// an access token is not a challenge
+	pair, err := service.IssueTokens(user, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	_, _, err = service.VerifyMFA(pair.AccessToken, totpCode(t, secret, 1))
+	require.Error(t, err)
+}
+
+func TestAuthService_VerifyMFAThrottled(t *testing.T) {
+	service, _ := newMFATestService(t)
+	service.SetLoginThrottle(LoginThrottle{FreeAttempts: 3, AccountLockout: 3, LockoutDuration: time.Hour, Window: time.Hour})
+	secret, _ := enrollMFA(t, service, "john-cs@durianpay.id")
+	user, _ := service.Authenticate("john-cs@durianpay.id", "admin123")
+
+	challenge, err := service.NewMFAChallenge(user)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, _, err := service.VerifyMFA(challenge.Token, "000000")
+		require.Error(t, err)
+	}
+
+	_, _, err = service.VerifyMFA(challenge.Token, totpCode(t, secret, 0))
+	var rateLimitErr *errors.RateLimitError
+	require.True(t, common_errors.As(err, &rateLimitErr), "expected RateLimitError, got %v", err)
+
+	// password failures are counted apart from code failures
+	_, err = service.Login("john-cs@durianpay.id", "admin123", "10.0.0.1")
+	require.NoError(t, err)
+}
+
+func TestAuthService_MFATokens(t *testing.T) {
+	service, _ := newMFATestService(t)
+	secret, _ := enrollMFA(t, service, "john-cs@durianpay.id")
+	user, _ := service.Authenticate("john-cs@durianpay.id", "admin123")
+
+	challenge, err := service.NewMFAChallenge(user)
+	require.NoError(t, err)
+	user, amr, err := service.VerifyMFA(challenge.Token, totpCode(t, secret, 0))
+	require.NoError(t, err)
+	pair, err := service.IssueTokens(user, amr, ClientInfo{})
+	require.NoError(t, err)
+
+	claims, err := service.ParseToken(pair.AccessToken)
+	require.NoError(t, err)
+	require.True(t, HasMFA(claims))
+
+	// the session keeps its methods when refreshed
+	refreshed, _, err := service.Refresh(pair.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+	claims, err = service.ParseToken(refreshed.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, []any{"pwd", "otp", "mfa"}, claims["amr"])
+
+	passwordOnly, err := service.IssueTokens(user, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	claims, err = service.ParseToken(passwordOnly.AccessToken)
+	require.NoError(t, err)
+	require.False(t, HasMFA(claims))
+	require.False(t, HasMFA(jwt.MapClaims{}))
+}
+
+func TestAuthService_DisableMFA(t *testing.T) {
+	service, store := newMFATestService(t)
+	secret, recoveryCodes := enrollMFA(t, service, "john-cs@durianpay.id")
+
+	err := service.DisableMFA("john-cs@durianpay.id", "000000")
+	require.IsType(t, &errors.ValidationError{}, err)
+
+	require.NoError(t, service.DisableMFA("john-cs@durianpay.id", recoveryCodes[1]))
+	user, _ := store.GetUserByEmail("john-cs@durianpay.id")
+	require.False(t, user.MFAEnabled)
+	require.Empty(t, user.TOTPSecret)
+	require.Empty(t, user.RecoveryCodes)
+
+	err = service.DisableMFA("john-cs@durianpay.id", totpCode(t, secret, 0))
+	require.IsType(t, &errors.ValidationError{}, err)
+}
+
+func TestUserService_ResetMFA(t *testing.T) {
+	service, store := newMFATestService(t)
+	users := NewUserService(store)
+	enrollMFA(t, service, "john-cs@durianpay.id")
+
+	require.NoError(t, users.ResetMFA("john-cs@durianpay.id"))
+	user, _ := store.GetUserByEmail("john-cs@durianpay.id")
+	require.False(t, user.MFAEnabled)
+	require.Empty(t, user.TOTPSecret)
+
+	err := users.ResetMFA("ghost@durianpay.id")
+	require.IsType(t, &errors.NotFoundError{}, err)
+}
@@ -0,0 +1,380 @@
+package service
+
+/*
+Password resets and forced password changes. A user who forgot their password
+asks for a reset link, which the Notifier delivers; the link carries a
+single-use token that expires, only its hash is stored. An admin can flag a
+user to change their password: their next password login gets a short-lived
+challenge token instead of a session, which ChangeRequiredPassword exchanges
+for the session once a new password is chosen. New passwords have to satisfy
+the password.Policy, and setting one ends every session of the user.
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	common_errors "errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/notify"
+	"abasithdev.github.io/internal-cs-center-backend/internal/password"
+)
+
+const (
+	defaultPasswordResetTTL = 30 * time.Minute
+	// passwordResetInterval is how soon a user can be sent another link, so
+	// the endpoint cannot be used to flood their inbox
+	passwordResetInterval = time.Minute
+
+	// reset links are sent by this many workers, at most
+	// maxQueuedPasswordResets wait for one and further requests are dropped
+	passwordResetWorkers    = 4
+	maxQueuedPasswordResets = 256
+
+	passwordChangeTTL = 10 * time.Minute
+	passwordChangeTyp = "password_change"
+)
+
+var (
+	errPasswordResetDisabled = common_errors.New("Password reset is not configured")
+	errPasswordResetBusy     = common_errors.New("Too many password resets queued, request dropped")
+	errPasswordResetStopped  = common_errors.New("Password reset is shutting down")
+	errInvalidPasswordChange = common_errors.New("Invalid password change token")
+	errPasswordChangeNeeded  = common_errors.New("Password change required")
+)
+
+// PasswordResetOptions configure the reset links
+type PasswordResetOptions struct {
+	// URL is the page completing a reset, the link adds the email and token
+	// to its query. Without one the message carries the token alone.
+	URL string
+	TTL time.Duration
+}
+
+// PasswordChangeChallenge is what a password login of a user who has to
+// change their password gets instead of a TokenPair
+type PasswordChangeChallenge struct {
+	Token     string
+	ExpiresIn time.Duration
+}
+
+// SetPasswordPolicy replaces password.DefaultPolicy
+func (auth *AuthService) SetPasswordPolicy(policy password.Policy) {
+	auth.passwordPolicy = policy
+}
+
+// passwordResetRequest is a reset link waiting to be sent
+type passwordResetRequest struct {
+	ctx   context.Context
+	email string
+}
+
+// SetPasswordReset turns password resets on, delivering links through
+// notifier. A zero TTL keeps the default.
+func (auth *AuthService) SetPasswordReset(notifier notify.Notifier, options PasswordResetOptions) {
+	if options.TTL <= 0 {
+		options.TTL = defaultPasswordResetTTL
+	}
+	auth.notifier = notifier
+	auth.passwordReset = options
+
+	auth.resetMu.Lock()
+	defer auth.resetMu.Unlock()
+	if auth.resetQueue == nil {
+		auth.resetQueue = make(chan passwordResetRequest, maxQueuedPasswordResets)
+		for range passwordResetWorkers {
+			go auth.sendPasswordResets(auth.resetQueue)
+		}
+	}
+}
+
+func passwordResetKey(ip string) string {
+	return "reset:" + ip
+}
+
+// RequestPasswordReset sends a reset link to a user, replacing any earlier
+// one. Unknown and disabled users, and users who log in with single sign-on,
+// are ignored so the caller cannot tell accounts apart. The link is sent in
+// the background, otherwise the time to answer would tell them apart;
+// failures are logged. Requests are throttled per client address ip like
+// logins, a throttled one returns errors.RateLimitError. When too many links
+// are waiting to be sent the request is dropped with an error.
+func (auth *AuthService) RequestPasswordReset(ctx context.Context, email, ip string) error {
+	if auth.notifier == nil {
+		return errPasswordResetDisabled
+	}
+	auth.purgeExpired()
+
+	err := auth.store.Update(func(tx domain.Tx) error {
+		_, err := auth.throttle.reserve(tx, map[string]int{passwordResetKey(ip): auth.throttle.AddressLockout}, time.Now())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	auth.resetMu.RLock()
+	defer auth.resetMu.RUnlock()
+	if auth.resetClosed {
+		return errPasswordResetStopped
+	}
+
+	auth.resets.Add(1)
+	select {
+	case auth.resetQueue <- passwordResetRequest{ctx: context.WithoutCancel(ctx), email: email}:
+		return nil
+	default:
+		auth.resets.Done()
+		return errPasswordResetBusy
+	}
+}
+
+// sendPasswordResets is a worker sending the links of queue until it closes
+func (auth *AuthService) sendPasswordResets(queue <-chan passwordResetRequest) {
+	for request := range queue {
+		if err := auth.sendPasswordReset(request.ctx, request.email); err != nil {
+			log.Printf("auth: password reset of %s: %v", request.email, err)
+		}
+		auth.resets.Done()
+	}
+}
+
+// Shutdown stops taking password reset requests and waits until the links
+// already queued are sent, or ctx ends
+func (auth *AuthService) Shutdown(ctx context.Context) error {
+	auth.resetMu.Lock()
+	if !auth.resetClosed && auth.resetQueue != nil {
+		close(auth.resetQueue)
+	}
+	auth.resetClosed = true
+	auth.resetMu.Unlock()
+
+	sent := make(chan struct{})
+	go func() {
+		auth.resets.Wait()
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (auth *AuthService) sendPasswordReset(ctx context.Context, email string) error {
+	user, exists := auth.store.GetUserByEmail(email)
+	if !exists || user.Disabled || user.PasswordHash == "" {
+		return nil
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return fmt.Errorf("generate password reset token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	var throttled bool
+	err := auth.store.Update(func(tx domain.Tx) error {
+		if pending, exists := tx.GetPasswordReset(email); exists && now.Sub(pending.CreatedAt) < passwordResetInterval {
+			throttled = true
+			return nil
+		}
+
+		return tx.PutPasswordReset(&domain.PasswordReset{
+			Email:     email,
+			Hash:      hashPasswordResetToken(token),
+			CreatedAt: now,
+			ExpiresAt: now.Add(auth.passwordReset.TTL),
+		})
+	})
+	if err != nil || throttled {
+		return err
+	}
+
+	return auth.notifier.Notify(ctx, notify.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Internal CS Center account. "+
+			"If it was you, %s\n\nThe link works once and expires in %s. "+
+			"If it was not you, ignore this message, your password stays as it is.",
+			auth.passwordResetLink(email, token), auth.passwordReset.TTL),
+		SentAt: now,
+	})
+}
+
+func (auth *AuthService) passwordResetLink(email, token string) string {
+	link, err := url.Parse(auth.passwordReset.URL)
+	if auth.passwordReset.URL == "" || err != nil {
+		return "use this reset token: " + token
+	}
+
+	query := link.Query()
+	query.Set("email", email)
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	return "open " + link.String()
+}
+
+// ResetPassword sets a new password with the token of a reset link. The
+// token is used up, the must change password flag and a login lockout of
+// the account are lifted, and every session of the user ends.
+func (auth *AuthService) ResetPassword(email, token, newPassword string) error {
+	hash, err := auth.newPasswordHash(email, newPassword)
+	if err != nil {
+		return err
+	}
+
+	invalid := errors.NewValidationError(": invalid or expired password reset token")
+	sessions := auth.store.ListSessions(email)
+	err = auth.store.Update(func(tx domain.Tx) error {
+		reset, exists := tx.GetPasswordReset(email)
+		if !exists || !time.Now().Before(reset.ExpiresAt) ||
+			subtle.ConstantTimeCompare([]byte(reset.Hash), []byte(hashPasswordResetToken(token))) != 1 {
+			return invalid
+		}
+
+		user, exists := tx.GetUserByEmail(email)
+		if !exists || user.Disabled {
+			return invalid
+		}
+
+		if err := setPassword(tx, user, hash, sessions); err != nil {
+			return err
+		}
+		if err := tx.DeletePasswordReset(email); err != nil {
+			return err
+		}
+		return tx.DeleteLoginAttempts(accountKey(email))
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("auth: password of %s reset", email)
+	return nil
+}
+
+// NewPasswordChangeChallenge returns the challenge token of a user who
+// logged in with a password they have to change. amr are the authentication
+// methods of the login so far, they carry over to the session.
+func (auth *AuthService) NewPasswordChangeChallenge(user *domain.User, amr []string) (*PasswordChangeChallenge, error) {
+	now := time.Now()
+	signed, err := auth.keys.Sign(jwt.MapClaims{
+		"typ":   passwordChangeTyp,
+		"email": user.Email,
+		"amr":   amr,
+		"jti":   uuid.NewString(),
+		"iat":   now.Unix(),
+		"exp":   now.Add(passwordChangeTTL).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PasswordChangeChallenge{Token: signed, ExpiresIn: passwordChangeTTL}, nil
+}
+
+// ChangeRequiredPassword completes a login started with
+// NewPasswordChangeChallenge by setting a new password, which has to differ
+// from the current one. Each challenge works once and the user's other
+// sessions end. It returns the user and the authentication methods for
+// IssueTokens.
+func (auth *AuthService) ChangeRequiredPassword(challenge, newPassword string) (*domain.User, []string, error) {
+	claims, err := auth.parse(challenge)
+	if err != nil || claims["typ"] != passwordChangeTyp {
+		return nil, nil, errInvalidPasswordChange
+	}
+	email, _ := claims["email"].(string)
+	jti, _ := claims["jti"].(string)
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		return nil, nil, errInvalidPasswordChange
+	}
+
+	var amr []string
+	methods, _ := claims["amr"].([]any)
+	for _, method := range methods {
+		if method, ok := method.(string); ok {
+			amr = append(amr, method)
+		}
+	}
+
+	current, exists := auth.store.GetUserByEmail(email)
+	if !exists {
+		return nil, nil, errInvalidPasswordChange
+	}
+	if same, _ := password.Verify(current.PasswordHash, newPassword); same {
+		return nil, nil, errors.NewValidationError(": the new password must differ from the current one")
+	}
+	hash, err := auth.newPasswordHash(email, newPassword)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var user *domain.User
+	sessions := auth.store.ListSessions(email)
+	err = auth.store.Update(func(tx domain.Tx) error {
+		user, exists = tx.GetUserByEmail(email)
+		// the password changed another way since the challenge was issued
+		if !exists || user.Disabled || !user.MustChangePassword || user.PasswordHash != current.PasswordHash {
+			return errInvalidPasswordChange
+		}
+
+		if err := setPassword(tx, user, hash, sessions); err != nil {
+			return err
+		}
+		return tx.RevokeToken(&domain.RevokedToken{JTI: jti, ExpiresAt: expiresAt.Time})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, amr, nil
+}
+
+// newPasswordHash checks newPassword against the policy and hashes it
+func (auth *AuthService) newPasswordHash(email, newPassword string) (string, error) {
+	if err := auth.passwordPolicy.Validate(newPassword, localPart(email)); err != nil {
+		return "", errors.NewValidationError(": " + err.Error())
+	}
+	return password.Hash(newPassword)
+}
+
+// setPassword stores hash as the password of user and ends the sessions
+// listed before the transaction that still exist
+func setPassword(tx domain.Tx, user *domain.User, hash string, sessions []*domain.Session) error {
+	user.PasswordHash = hash
+	user.MustChangePassword = false
+	if err := tx.UpdateUser(user); err != nil {
+		return err
+	}
+
+	for _, listed := range sessions {
+		if _, exists := tx.GetSession(listed.ID); !exists {
+			continue
+		}
+		if err := terminateSession(tx, listed.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashPasswordResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
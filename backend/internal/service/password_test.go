@@ -0,0 +1,288 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/notify"
+	"abasithdev.github.io/internal-cs-center-backend/internal/password"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+var resetLinkPattern = regexp.MustCompile(`https?://\S+`)
+
+// lastResetToken returns the token of the latest reset link in outbox
+func lastResetToken(t *testing.T, outbox *notify.Outbox) string {
+	t.Helper()
+	messages, err := outbox.Messages()
+	require.NoError(t, err)
+	require.NotEmpty(t, messages)
+
+	link, err := url.Parse(resetLinkPattern.FindString(messages[len(messages)-1].Body))
+	require.NoError(t, err)
+	return link.Query().Get("token")
+}
+
+func setupPasswordReset(t *testing.T) (*AuthService, *storage.MemoryStore, *notify.Outbox) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	outbox, err := notify.NewOutbox(t.TempDir())
+	require.NoError(t, err)
+
+	service := NewAuthService(store, []byte("test-secret-key"))
+	// the tests ask for more links than an address may
+	service.SetLoginThrottle(LoginThrottle{})
+	service.SetPasswordReset(outbox, PasswordResetOptions{URL: "http://localhost:5173/reset-password"})
+	return service, store, outbox
+}
+
+// requestPasswordReset asks for a reset link and waits until it is sent
+func requestPasswordReset(t *testing.T, service *AuthService, email string) {
+	require.NoError(t, service.RequestPasswordReset(context.Background(), email, "10.0.0.1"))
+	service.resets.Wait()
+}
+
+func TestAuthService_ResetPassword(t *testing.T) {
+	service, store, outbox := setupPasswordReset(t)
+	john, _ := store.GetUserByEmail("john-cs@durianpay.id")
+	session, err := service.IssueTokens(john, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+
+	requestPasswordReset(t, service, "john-cs@durianpay.id")
+	messages, err := outbox.Messages()
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, "john-cs@durianpay.id", messages[0].To)
+	require.Contains(t, messages[0].Body, "http://localhost:5173/reset-password?email=john-cs%40durianpay.id&token=")
+	token := lastResetToken(t, outbox)
+
+	// only the hash is stored
+	var stored *domain.PasswordReset
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		stored, _ = tx.GetPasswordReset("john-cs@durianpay.id")
+		return nil
+	}))
+	require.NotEqual(t, token, stored.Hash)
+	require.WithinDuration(t, time.Now().Add(defaultPasswordResetTTL), stored.ExpiresAt, time.Minute)
+
+	// a locked out account can still be recovered
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		return tx.PutLoginAttempts(&domain.LoginAttempts{Key: accountKey("john-cs@durianpay.id"), Failures: 10, LockedUntil: time.Now().Add(time.Hour)})
+	}))
+
+	err = service.ResetPassword("john-cs@durianpay.id", token, "short")
+	require.IsType(t, &errors.ValidationError{}, err)
+	err = service.ResetPassword("john-cs@durianpay.id", "wrong", "a-new-password")
+	require.IsType(t, &errors.ValidationError{}, err)
+	err = service.ResetPassword("jane-operational@durianpay.id", token, "a-new-password")
+	require.IsType(t, &errors.ValidationError{}, err)
+
+	require.NoError(t, service.ResetPassword("john-cs@durianpay.id", token, "a-new-password"))
+	_, err = service.Login("john-cs@durianpay.id", "a-new-password", "10.0.0.1")
+	require.NoError(t, err)
+	_, err = service.Authenticate("john-cs@durianpay.id", "admin123")
+	require.Error(t, err)
+
+	// the sessions from before end, and the token works once
+	_, err = service.ParseToken(session.AccessToken)
+	require.Error(t, err)
+	err = service.ResetPassword("john-cs@durianpay.id", token, "another-password")
+	require.IsType(t, &errors.ValidationError{}, err)
+}
+
+func TestAuthService_RequestPasswordReset(t *testing.T) {
+	service, store, outbox := setupPasswordReset(t)
+	require.NoError(t, store.CreateUser(&domain.User{Email: "sso@durianpay.id", Role: "cs"}))
+	require.NoError(t, store.CreateUser(&domain.User{Email: "gone@durianpay.id", PasswordHash: "x", Role: "cs", Disabled: true}))
+
+	// accounts that cannot be reset look the same as existing ones
+	for _, email := range []string{"nobody@durianpay.id", "sso@durianpay.id", "gone@durianpay.id"} {
+		requestPasswordReset(t, service, email)
+	}
+	messages, err := outbox.Messages()
+	require.NoError(t, err)
+	require.Empty(t, messages)
+
+	// asking again right away keeps the first link
+	requestPasswordReset(t, service, "john-cs@durianpay.id")
+	first := lastResetToken(t, outbox)
+	requestPasswordReset(t, service, "john-cs@durianpay.id")
+	messages, err = outbox.Messages()
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+
+	// a later request replaces it
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		reset, _ := tx.GetPasswordReset("john-cs@durianpay.id")
+		reset.CreatedAt = time.Now().Add(-passwordResetInterval)
+		return tx.PutPasswordReset(reset)
+	}))
+	requestPasswordReset(t, service, "john-cs@durianpay.id")
+	second := lastResetToken(t, outbox)
+	require.NotEqual(t, first, second)
+	err = service.ResetPassword("john-cs@durianpay.id", first, "a-new-password")
+	require.IsType(t, &errors.ValidationError{}, err)
+
+	// expired links do not work
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		reset, _ := tx.GetPasswordReset("john-cs@durianpay.id")
+		reset.ExpiresAt = time.Now().Add(-time.Second)
+		return tx.PutPasswordReset(reset)
+	}))
+	err = service.ResetPassword("john-cs@durianpay.id", second, "a-new-password")
+	require.IsType(t, &errors.ValidationError{}, err)
+
+	// without a notifier resets are off
+	unconfigured := NewAuthService(store, []byte("test-secret-key"))
+	require.Error(t, unconfigured.RequestPasswordReset(context.Background(), "john-cs@durianpay.id", "10.0.0.1"))
+}
+
+func TestAuthService_RequestPasswordResetThrottle(t *testing.T) {
+	service, _, _ := setupPasswordReset(t)
+	service.SetLoginThrottle(DefaultLoginThrottle)
+
+	// an address is throttled whichever accounts it asks for
+	for _, email := range []string{"john-cs@durianpay.id", "nobody@durianpay.id", "jane-operational@durianpay.id"} {
+		require.NoError(t, service.RequestPasswordReset(context.Background(), email, "10.0.0.1"))
+	}
+	err := service.RequestPasswordReset(context.Background(), "someone@durianpay.id", "10.0.0.1")
+	var rateLimitErr *errors.RateLimitError
+	require.ErrorAs(t, err, &rateLimitErr)
+	require.Equal(t, time.Second, rateLimitErr.RetryAfter.Round(time.Second))
+
+	require.NoError(t, service.RequestPasswordReset(context.Background(), "john-cs@durianpay.id", "10.0.0.2"))
+	require.NoError(t, service.Shutdown(context.Background()))
+}
+
+// gatedNotifier holds every message until its gate opens
+type gatedNotifier struct {
+	gate chan struct{}
+	mu   sync.Mutex
+	sent []string
+}
+
+func (notifier *gatedNotifier) Notify(ctx context.Context, message notify.Message) error {
+	<-notifier.gate
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	notifier.sent = append(notifier.sent, message.To)
+	return nil
+}
+
+func TestAuthService_PasswordResetQueue(t *testing.T) {
+	store := storage.NewMemoryStore()
+	service := NewAuthService(store, []byte("test-secret-key"))
+	service.SetLoginThrottle(LoginThrottle{})
+	notifier := &gatedNotifier{gate: make(chan struct{})}
+	service.SetPasswordReset(notifier, PasswordResetOptions{})
+
+	// while nothing is sent, requests beyond the queue are dropped
+	accepted := 0
+	for i := range passwordResetWorkers + maxQueuedPasswordResets + 1 {
+		email := fmt.Sprintf("user%d@durianpay.id", i)
+		require.NoError(t, store.CreateUser(&domain.User{Email: email, PasswordHash: "x", Role: "cs"}))
+		err := service.RequestPasswordReset(context.Background(), email, "10.0.0.1")
+		if err != nil {
+			require.ErrorIs(t, err, errPasswordResetBusy)
+			break
+		}
+		accepted++
+	}
+	require.GreaterOrEqual(t, accepted, maxQueuedPasswordResets)
+	require.LessOrEqual(t, accepted, passwordResetWorkers+maxQueuedPasswordResets)
+
+	// shutting down waits for the queued links, it does not give them up
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, service.Shutdown(ctx), context.DeadlineExceeded)
+	err := service.RequestPasswordReset(context.Background(), "user0@durianpay.id", "10.0.0.1")
+	require.ErrorIs(t, err, errPasswordResetStopped)
+
+	close(notifier.gate)
+	require.NoError(t, service.Shutdown(context.Background()))
+	require.Len(t, notifier.sent, accepted)
+}
+
+func TestAuthService_ChangeRequiredPassword(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+	users := NewUserService(store)
+
+	john, _ := store.GetUserByEmail("john-cs@durianpay.id")
+	before, err := service.IssueTokens(john, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+
+	flag := true
+	_, err = users.UpdateUser("admin@durianpay.id", "john-cs@durianpay.id", UpdateUserRequest{MustChangePassword: &flag})
+	require.NoError(t, err)
+
+	// the next password login gets no tokens, single sign-on still does
+	john, err = service.Login("john-cs@durianpay.id", "admin123", "10.0.0.1")
+	require.NoError(t, err)
+	require.True(t, john.MustChangePassword)
+	_, err = service.IssueTokens(john, passwordAMR, ClientInfo{})
+	require.Error(t, err)
+	_, err = service.IssueTokens(john, []string{"sso"}, ClientInfo{})
+	require.NoError(t, err)
+
+	challenge, err := service.NewPasswordChangeChallenge(john, totpAMR)
+	require.NoError(t, err)
+	_, err = service.ParseToken(challenge.Token)
+	require.Error(t, err)
+
+	_, _, err = service.ChangeRequiredPassword(challenge.Token, "short")
+	require.IsType(t, &errors.ValidationError{}, err)
+	_, _, err = service.ChangeRequiredPassword(challenge.Token, "admin123")
+	require.IsType(t, &errors.ValidationError{}, err)
+	_, _, err = service.ChangeRequiredPassword("invalid", "a-new-password")
+	require.ErrorIs(t, err, errInvalidPasswordChange)
+
+	user, amr, err := service.ChangeRequiredPassword(challenge.Token, "a-new-password")
+	require.NoError(t, err)
+	require.False(t, user.MustChangePassword)
+	require.Equal(t, totpAMR, amr)
+	_, err = service.IssueTokens(user, amr, ClientInfo{})
+	require.NoError(t, err)
+	_, err = service.Authenticate("john-cs@durianpay.id", "a-new-password")
+	require.NoError(t, err)
+
+	// sessions from before end and the challenge works once
+	_, err = service.ParseToken(before.AccessToken)
+	require.Error(t, err)
+	_, _, err = service.ChangeRequiredPassword(challenge.Token, "another-password")
+	require.ErrorIs(t, err, errInvalidPasswordChange)
+
+	// MFA challenges are not password change challenges
+	mfaChallenge, err := service.NewMFAChallenge(user)
+	require.NoError(t, err)
+	_, _, err = service.ChangeRequiredPassword(mfaChallenge.Token, "another-password")
+	require.ErrorIs(t, err, errInvalidPasswordChange)
+}
+
+func TestUserService_PasswordPolicy(t *testing.T) {
+	store := storage.NewMemoryStore()
+	users := NewUserService(store)
+
+	_, err := users.CreateUser(CreateUserRequest{Email: "new@durianpay.id", Password: "new-durianpay", Role: "cs"})
+	require.IsType(t, &errors.ValidationError{}, err)
+	_, err = users.CreateUser(CreateUserRequest{Email: "new@durianpay.id", Password: "password123", Role: "cs"})
+	require.IsType(t, &errors.ValidationError{}, err)
+
+	users.SetPasswordPolicy(password.Policy{MinLength: 20})
+	_, err = users.CreateUser(CreateUserRequest{Email: "new@durianpay.id", Password: "long-enough", Role: "cs"})
+	require.IsType(t, &errors.ValidationError{}, err)
+
+	user, err := users.CreateUser(CreateUserRequest{Email: "new@durianpay.id", Password: "long-enough-for-twenty", Role: "cs", MustChangePassword: true})
+	require.NoError(t, err)
+	require.True(t, user.MustChangePassword)
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+)
+
+// pageCursor is the opaque cursor handed to clients. It pins the sort it was
+// issued for so following it never mixes orders.
+type pageCursor struct {
+	SortBy   string `json:"s"`
+	Order    string `json:"o"`
+	Key      string `json:"k"`
+	ID       string `json:"i"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+func newPageCursor(sortBy, order string, payment *domain.Payment, backward bool) pageCursor {
+	cursor := pageCursor{SortBy: sortBy, Order: order, ID: payment.ID, Backward: backward}
+	if sortBy == domain.PaymentSortAmount {
+		cursor.Key = strconv.FormatFloat(payment.Amount, 'g', -1, 64)
+	} else {
+		cursor.Key = strconv.FormatInt(payment.Date.UnixNano(), 10)
+	}
+	return cursor
+}
+
+func (cursor pageCursor) encode() string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodePageCursor(encoded string) (pageCursor, error) {
+	var cursor pageCursor
+	invalid := errors.NewValidationError(": cursor is malformed")
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, invalid
+	}
+	if err := json.Unmarshal(raw, &cursor); err != nil || cursor.ID == "" {
+		return cursor, invalid
+	}
+
+	switch cursor.SortBy {
+	case domain.PaymentSortDate, domain.PaymentSortAmount:
+	default:
+		return cursor, invalid
+	}
+	if cursor.Order != domain.SortAsc && cursor.Order != domain.SortDesc {
+		return cursor, invalid
+	}
+
+	if _, err := cursor.position(); err != nil {
+		return cursor, invalid
+	}
+
+	return cursor, nil
+}
+
+// position converts the cursor into the store's keyset position
+func (cursor pageCursor) position() (*domain.PaymentCursor, error) {
+	position := &domain.PaymentCursor{ID: cursor.ID, Backward: cursor.Backward}
+
+	if cursor.SortBy == domain.PaymentSortAmount {
+		amount, err := strconv.ParseFloat(cursor.Key, 64)
+		if err != nil {
+			return nil, err
+		}
+		// NaN and infinities would compare no payment against the keyset
+		if math.IsNaN(amount) || math.IsInf(amount, 0) {
+			return nil, strconv.ErrRange
+		}
+		position.Amount = amount
+		return position, nil
+	}
+
+	nanos, err := strconv.ParseInt(cursor.Key, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	position.Date = time.Unix(0, nanos)
+	return position, nil
+}
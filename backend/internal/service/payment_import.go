@@ -0,0 +1,503 @@
+package service
+
+/*
+Bulk payment import. Rows are read one at a time and written in batches, so an
+upload never has to fit in memory.
+*/
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	common_errors "errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+)
+
+const (
+	ImportFormatCSV    = "csv"
+	ImportFormatNDJSON = "ndjson"
+
+	// valid rows are written in transactions of this many payments
+	importBatchSize = 500
+	// the report lists at most this many row errors, the counters stay exact
+	maxImportErrors = 1000
+	// longest NDJSON line accepted
+	maxImportLineBytes = 1 << 20
+)
+
+type ImportRequest struct {
+	Format string // ImportFormatCSV or ImportFormatNDJSON
+	Body   io.Reader
+	// DryRun validates every row and reports what would change without writing
+	DryRun bool
+	// Actor is who imports, recorded on the timelines of the payments
+	Actor string
+	// Scope limits the rows to payments of the merchants of the actor, and
+	// status changes to the transitions its role may make
+	Scope MerchantScope
+}
+
+type ImportReport struct {
+	DryRun  bool `json:"dry_run"`
+	Rows    int  `json:"rows"`
+	Created int  `json:"created"`
+	Updated int  `json:"updated"`
+	Failed  int  `json:"failed"`
+	// Errors has one entry per rejected row, in file order
+	Errors          []ImportRowError `json:"errors"`
+	ErrorsTruncated bool             `json:"errors_truncated,omitempty"`
+}
+
+type ImportRowError struct {
+	// Line is the line of the row in the uploaded file, starting at 1
+	Line   int      `json:"line"`
+	ID     string   `json:"id,omitempty"`
+	Errors []string `json:"errors"`
+}
+
+// importRow is a row before validation, every field as it was written.
+// unreadable is set instead when the row could not be decoded at all.
+type importRow struct {
+	line         int
+	unreadable   string
+	id           string
+	merchantName string
+	date         string
+	amount       string
+	status       string
+	reviewed     string
+}
+
+// importedPayment is a validated row. reviewed is nil when the file did not
+// say; when it did it has to match the current review state, reviews are
+// only recorded through Review and RevertReview.
+type importedPayment struct {
+	line     int
+	payment  domain.Payment
+	reviewed *bool
+}
+
+// Import validates each row of an uploaded payment file and upserts the valid
+// ones. Invalid rows are skipped and reported, and so are rows of merchants
+// outside request.Scope; existing payments outside it are reported as not
+// found. A row changing the status of an existing payment has to follow the
+// lifecycle, by a transition the role of request.Scope may make, and cannot
+// while a refund of it is open; refunded statuses are left to refunds, and an
+// amount cannot drop below what is refunded or being refunded. The reviewed
+// column cannot change the review state, it is only recorded by reviews. A
+// file that cannot be read at all (unknown format, missing CSV columns)
+// returns errors.ValidationError, one that breaks part way is reported up to
+// the broken line.
+func (payment *PaymentService) Import(request ImportRequest) (ImportReport, error) {
+	importer := &paymentImporter{
+		store:     payment.store,
+		actor:     request.Actor,
+		role:      request.Scope.Role,
+		merchants: payment.merchants(request.Scope),
+		report:    ImportReport{DryRun: request.DryRun, Errors: []ImportRowError{}},
+		seen:      map[string]int{},
+	}
+
+	var err error
+	switch request.Format {
+	case ImportFormatCSV:
+		err = readImportCSV(request.Body, importer.add)
+	case ImportFormatNDJSON:
+		err = readImportNDJSON(request.Body, importer.add)
+	default:
+		return ImportReport{}, errors.NewValidationError(": unsupported import format " + strconv.Quote(request.Format))
+	}
+
+	if err == nil {
+		err = importer.flush()
+	}
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	// rows rejected on writing come after the later rows rejected on reading
+	slices.SortStableFunc(importer.report.Errors, func(a, b ImportRowError) int {
+		return cmp.Compare(a.Line, b.Line)
+	})
+	return importer.report, nil
+}
+
+type paymentImporter struct {
+	store domain.PaymentRepository
+	actor string
+	role  string
+	// merchants the actor may import payments of, nil for every merchant
+	merchants []string
+	report    ImportReport
+	// line each ID was first seen on, IDs must be unique within a file
+	seen  map[string]int
+	batch []importedPayment
+}
+
+func (importer *paymentImporter) add(row importRow) error {
+	importer.report.Rows++
+	if row.unreadable != "" {
+		importer.reject(row.line, "", row.unreadable)
+		return nil
+	}
+
+	imported, problems := validateImportRow(row)
+	if row.merchantName != "" && !importer.inScope(row.merchantName) {
+		problems = append(problems, fmt.Sprintf("merchant_name %q is not one of your merchants", row.merchantName))
+	}
+	if row.id != "" {
+		if first, duplicate := importer.seen[row.id]; duplicate {
+			problems = append(problems, fmt.Sprintf("duplicate id, first used on line %d", first))
+		} else {
+			importer.seen[row.id] = row.line
+		}
+	}
+
+	if len(problems) > 0 {
+		importer.reject(row.line, row.id, problems...)
+		return nil
+	}
+
+	importer.batch = append(importer.batch, imported)
+	if len(importer.batch) < importBatchSize {
+		return nil
+	}
+	return importer.flush()
+}
+
+func (importer *paymentImporter) reject(line int, id string, problems ...string) {
+	importer.report.Failed++
+	if len(importer.report.Errors) == maxImportErrors {
+		importer.report.ErrorsTruncated = true
+		return
+	}
+
+	importer.report.Errors = append(importer.report.Errors, ImportRowError{Line: line, ID: id, Errors: problems})
+}
+
+// inScope reports whether the actor may import payments of merchant
+func (importer *paymentImporter) inScope(merchant string) bool {
+	return importer.merchants == nil || slices.Contains(importer.merchants, merchant)
+}
+
+// check returns what keeps a valid row from being written over current, the
+// stored payment or nil, given the refunds of current
+func (importer *paymentImporter) check(imported importedPayment, current *domain.Payment, refunds []*domain.Refund) []string {
+	if current == nil {
+		var problems []string
+		if imported.reviewed != nil && *imported.reviewed {
+			problems = append(problems, "reviewed cannot be set by an import, review the payment instead")
+		}
+		// refunded statuses are only reached by processing refunds
+		if status := imported.payment.Status; status == domain.PaymentStatusRefunded || status == domain.PaymentStatusPartiallyRefunded {
+			problems = append(problems, fmt.Sprintf("status %s needs a processed refund", status))
+		}
+		return problems
+	}
+	if !importer.inScope(current.MerchantName) {
+		return []string{"payment not found"}
+	}
+
+	var problems []string
+	if imported.reviewed != nil && *imported.reviewed != current.Reviewed {
+		problems = append(problems, fmt.Sprintf("reviewed cannot change from %t by an import, review the payment or revert its review instead", current.Reviewed))
+	}
+	refunding := int64(0)
+	for _, refund := range refunds {
+		if refund.Pending() {
+			refunding += cents(refund.Amount)
+		}
+	}
+	if cents(imported.payment.Amount) < refunding {
+		problems = append(problems, "amount is below the "+strconv.FormatFloat(float64(refunding)/100, 'f', 2, 64)+" refunded or being refunded")
+	}
+
+	from, to := current.Status, imported.payment.Status
+	if from == to {
+		return problems
+	}
+	if hasOpenRefund(refunds) {
+		return append(problems, fmt.Sprintf("status cannot change from %s while a refund is open", from))
+	}
+	index := slices.IndexFunc(paymentTransitions, func(transition PaymentTransition) bool {
+		return transition.From == from && transition.To == to
+	})
+	if index < 0 {
+		return append(problems, fmt.Sprintf("status cannot change from %s to %s", from, to))
+	}
+	if roles := paymentTransitions[index].Roles; !slices.Contains(roles, importer.role) {
+		return append(problems, fmt.Sprintf("status %s -> %s needs role %s", from, to, strings.Join(roles, " or ")))
+	}
+	return problems
+}
+
+// flush writes the pending batch in one transaction, a dry run only looks up
+// which rows would be created
+func (importer *paymentImporter) flush() error {
+	batch := importer.batch
+	importer.batch = importer.batch[:0]
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if importer.report.DryRun {
+		for _, imported := range batch {
+			current, exists := importer.store.GetPaymentById(imported.payment.ID)
+			refunds := importer.store.ListRefunds(imported.payment.ID)
+			if problems := importer.check(imported, current, refunds); len(problems) > 0 {
+				importer.reject(imported.line, imported.payment.ID, problems...)
+			} else if exists {
+				importer.report.Updated++
+			} else {
+				importer.report.Created++
+			}
+		}
+		return nil
+	}
+
+	created, updated := 0, 0
+	var rejected []ImportRowError
+	err := importer.store.Update(func(tx domain.Tx) error {
+		created, updated, rejected = 0, 0, nil
+		for _, imported := range batch {
+			payment := imported.payment
+
+			current, exists := tx.GetPaymentById(payment.ID)
+			refunds := tx.ListRefunds(payment.ID)
+			if problems := importer.check(imported, current, refunds); len(problems) > 0 {
+				rejected = append(rejected, ImportRowError{Line: imported.line, ID: payment.ID, Errors: problems})
+				continue
+			}
+			if !exists {
+				if err := tx.CreatePayment(&payment); err != nil {
+					return err
+				}
+				event := newPaymentEvent(payment.ID, domain.PaymentEventCreated, importer.actor)
+				event.To = payment.Status
+				if err := tx.AddPaymentEvent(event); err != nil {
+					return err
+				}
+				created++
+				continue
+			}
+
+			// the file is authoritative, overwrite whatever version is stored.
+			// A won dispute of a partly refunded payment stays partly refunded.
+			if payment.Status == domain.PaymentStatusCompleted && refundedCents(refunds) > 0 {
+				payment.Status = domain.PaymentStatusPartiallyRefunded
+			}
+			payment.Version = current.Version
+			payment.Reviewed, payment.Review = current.Reviewed, current.Review
+			if err := tx.UpdatePayment(&payment); err != nil {
+				return err
+			}
+			if payment.Status != current.Status {
+				event := newPaymentEvent(payment.ID, domain.PaymentEventStatusChanged, importer.actor)
+				event.From, event.To = current.Status, payment.Status
+				if err := tx.AddPaymentEvent(event); err != nil {
+					return err
+				}
+			}
+			updated++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rejected {
+		importer.reject(row.Line, row.ID, row.Errors...)
+	}
+	importer.report.Created += created
+	importer.report.Updated += updated
+	return nil
+}
+
+func validateImportRow(row importRow) (importedPayment, []string) {
+	var problems []string
+	imported := importedPayment{line: row.line, payment: domain.Payment{
+		ID:           row.id,
+		MerchantName: row.merchantName,
+		Status:       row.status,
+	}}
+
+	if row.id == "" {
+		problems = append(problems, "id is required")
+	}
+	if row.merchantName == "" {
+		problems = append(problems, "merchant_name is required")
+	}
+	if !domain.IsPaymentStatus(row.status) {
+		problems = append(problems, fmt.Sprintf("status %q is not one of %s", row.status, strings.Join(domain.PaymentStatuses, ", ")))
+	}
+
+	if amount, err := strconv.ParseFloat(row.amount, 64); err != nil {
+		problems = append(problems, fmt.Sprintf("amount %q is not a number", row.amount))
+	} else if !(amount > 0) || math.IsInf(amount, 1) {
+		problems = append(problems, "amount must be positive")
+	} else {
+		imported.payment.Amount = amount
+	}
+
+	if date, err := parseImportDate(row.date); err != nil {
+		problems = append(problems, fmt.Sprintf("date %q is not RFC 3339 or YYYY-MM-DD", row.date))
+	} else {
+		imported.payment.Date = date
+	}
+
+	if row.reviewed != "" {
+		if reviewed, err := strconv.ParseBool(row.reviewed); err != nil {
+			problems = append(problems, fmt.Sprintf("reviewed %q must be true or false", row.reviewed))
+		} else {
+			imported.reviewed = &reviewed
+		}
+	}
+
+	return imported, problems
+}
+
+func parseImportDate(value string) (time.Time, error) {
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// readImportCSV expects a header row naming the columns, in any order. The
+// reviewed column is optional and unknown columns are ignored.
+func readImportCSV(body io.Reader, add func(importRow) error) error {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return errors.NewValidationError(": unreadable CSV header: " + err.Error())
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	var missing []string
+	for _, name := range []string{"id", "merchant_name", "date", "amount", "status"} {
+		if _, ok := columns[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.NewValidationError(": CSV header is missing " + strings.Join(missing, ", "))
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// a quoting error leaves the reader somewhere in the middle of a
+			// record, nothing after it can be trusted
+			var parseErr *csv.ParseError
+			if !common_errors.As(err, &parseErr) {
+				return err
+			}
+			return add(importRow{
+				line:       parseErr.StartLine,
+				unreadable: fmt.Sprintf("unreadable CSV (%v), the rest of the file was not imported", parseErr.Err),
+			})
+		}
+
+		line, _ := reader.FieldPos(0)
+		err = add(importRow{
+			line:         line,
+			id:           field(record, "id"),
+			merchantName: field(record, "merchant_name"),
+			date:         field(record, "date"),
+			amount:       field(record, "amount"),
+			status:       field(record, "status"),
+			reviewed:     field(record, "reviewed"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readImportNDJSON reads one JSON object per line, blank lines are skipped.
+// A line that is not valid JSON is reported as a failed row.
+func readImportNDJSON(body io.Reader, add func(importRow) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineBytes)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+
+		var decoded struct {
+			ID           string      `json:"id"`
+			MerchantName string      `json:"merchant_name"`
+			Date         string      `json:"date"`
+			Amount       json.Number `json:"amount"`
+			Status       string      `json:"status"`
+			Reviewed     *bool       `json:"reviewed"`
+		}
+
+		var row importRow
+		if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+			row = importRow{line: line, unreadable: "invalid JSON: " + err.Error()}
+		} else {
+			row = importRow{
+				line:         line,
+				id:           strings.TrimSpace(decoded.ID),
+				merchantName: strings.TrimSpace(decoded.MerchantName),
+				date:         strings.TrimSpace(decoded.Date),
+				amount:       decoded.Amount.String(),
+				status:       strings.TrimSpace(decoded.Status),
+			}
+			if decoded.Reviewed != nil {
+				row.reviewed = strconv.FormatBool(*decoded.Reviewed)
+			}
+		}
+
+		if err := add(row); err != nil {
+			return err
+		}
+	}
+
+	err := scanner.Err()
+	if common_errors.Is(err, bufio.ErrTooLong) {
+		return add(importRow{
+			line:       line + 1,
+			unreadable: fmt.Sprintf("line longer than %d bytes, the rest of the file was not imported", maxImportLineBytes),
+		})
+	}
+	return err
+}
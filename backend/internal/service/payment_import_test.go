@@ -0,0 +1,372 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentService_ImportCSV(t *testing.T) {
+	store := storage.NewMemoryStore()
+	service := NewPaymentService(store)
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "existing", MerchantName: "Old", Status: "processing", Amount: 1, Reviewed: true}))
+
+	csv := strings.Join([]string{
+		"id,merchant_name,date,amount,status,extra",
+		"new1,Acme,2024-05-01T10:00:00Z,1500,completed,ignored",
+		"existing,Acme,2024-05-02,2500.50,failed,",
+		"bad1,,yesterday,-3,voided,",
+		"new1,Acme,2024-05-01,10,completed,",
+		`"quoted, id",Acme,2024-05-03,99,processing,`,
+	}, "\n")
+
+	report, err := service.Import(ImportRequest{Format: ImportFormatCSV, Body: strings.NewReader(csv), Actor: "recon", Scope: MerchantScope{Role: domain.RoleOperational, AllMerchants: true}})
+	require.NoError(t, err)
+
+	require.Equal(t, 5, report.Rows)
+	require.Equal(t, 2, report.Created)
+	require.Equal(t, 1, report.Updated)
+	require.Equal(t, 2, report.Failed)
+	require.Len(t, report.Errors, 2)
+
+	require.Equal(t, 4, report.Errors[0].Line)
+	require.Equal(t, "bad1", report.Errors[0].ID)
+	require.Len(t, report.Errors[0].Errors, 4) // merchant, status, amount, date
+	require.Equal(t, 5, report.Errors[1].Line)
+	require.Equal(t, []string{"duplicate id, first used on line 2"}, report.Errors[1].Errors)
+
+	created, exists := store.GetPaymentById("new1")
+	require.True(t, exists)
+	require.Equal(t, 1500.0, created.Amount)
+	require.True(t, created.Date.Equal(time.Date(2024, time.May, 1, 10, 0, 0, 0, time.UTC)))
+	_, exists = store.GetPaymentById("quoted, id")
+	require.True(t, exists)
+
+	// an update replaces the data but keeps the review state the file did not mention
+	updated, _ := store.GetPaymentById("existing")
+	require.Equal(t, "failed", updated.Status)
+	require.Equal(t, 2500.5, updated.Amount)
+	require.True(t, updated.Reviewed)
+	require.Equal(t, int64(2), updated.Version)
+
+	_, exists = store.GetPaymentById("bad1")
+	require.False(t, exists)
+
+	// the timelines say who imported what
+	events := store.ListPaymentEvents("new1")
+	require.Len(t, events, 1)
+	require.Equal(t, domain.PaymentEventCreated, events[0].Type)
+	require.Equal(t, "recon", events[0].Actor)
+	require.Equal(t, "completed", events[0].To)
+	events = store.ListPaymentEvents("existing")
+	require.Len(t, events, 1)
+	require.Equal(t, domain.PaymentEventStatusChanged, events[0].Type)
+	require.Equal(t, []string{"processing", "failed"}, []string{events[0].From, events[0].To})
+}
+
+func TestPaymentService_ImportNDJSON(t *testing.T) {
+	store := storage.NewMemoryStore()
+	service := NewPaymentService(store)
+
+	ndjson := strings.Join([]string{
+		`{"id":"n1","merchant_name":"Acme","date":"2024-05-01","amount":10,"status":"completed","reviewed":false}`,
+		``,
+		`{"id":"n2","merchant_name":"Acme","date":"2024-05-01","amount":"10","status":"completed"}`,
+		`not json`,
+		`{"id":"n3","merchant_name":"Acme","date":"2024-05-01","amount":0,"status":"failed"}`,
+	}, "\n")
+
+	report, err := service.Import(ImportRequest{Format: ImportFormatNDJSON, Body: strings.NewReader(ndjson), Scope: MerchantScope{Role: domain.RoleOperational, AllMerchants: true}})
+	require.NoError(t, err)
+
+	// a quoted amount is still a number, blank lines are not rows
+	require.Equal(t, 4, report.Rows)
+	require.Equal(t, 2, report.Created)
+	require.Equal(t, 2, report.Failed)
+	require.Equal(t, 4, report.Errors[0].Line)
+	require.Contains(t, report.Errors[0].Errors[0], "invalid JSON")
+	require.Equal(t, 5, report.Errors[1].Line)
+	require.Equal(t, []string{"amount must be positive"}, report.Errors[1].Errors)
+
+	imported, exists := store.GetPaymentById("n1")
+	require.True(t, exists)
+	require.False(t, imported.Reviewed)
+}
+
+func TestPaymentService_ImportKeepsReviews(t *testing.T) {
+	store := storage.NewMemoryStore()
+	service := NewPaymentService(store)
+	scope := MerchantScope{Role: domain.RoleOperational, AllMerchants: true}
+	for _, p := range []*domain.Payment{
+		{ID: "approved", MerchantName: "Acme", Status: "completed", Amount: 5},
+		{ID: "open", MerchantName: "Acme", Status: "completed", Amount: 5},
+	} {
+		require.NoError(t, store.CreatePayment(p))
+	}
+	_, err := service.Review("approved", "jane", ReviewRequest{}, 0, scope)
+	require.NoError(t, err)
+
+	csv := "id,merchant_name,date,amount,status,reviewed\n" +
+		"approved,Acme,2024-05-01,6,completed,false\n" +
+		"open,Acme,2024-05-01,6,completed,true\n" +
+		"fresh,Acme,2024-05-01,6,completed,true\n" +
+		"same,Acme,2024-05-01,6,completed,\n"
+
+	// neither undoing a review nor recording one without a reviewer
+	for _, dryRun := range []bool{true, false} {
+		report, err := service.Import(ImportRequest{Format: ImportFormatCSV, Body: strings.NewReader(csv), DryRun: dryRun, Actor: "recon", Scope: scope})
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Created)
+		require.Equal(t, []ImportRowError{
+			{Line: 2, ID: "approved", Errors: []string{"reviewed cannot change from true by an import, review the payment or revert its review instead"}},
+			{Line: 3, ID: "open", Errors: []string{"reviewed cannot change from false by an import, review the payment or revert its review instead"}},
+			{Line: 4, ID: "fresh", Errors: []string{"reviewed cannot be set by an import, review the payment instead"}},
+		}, report.Errors)
+	}
+
+	approved, _ := store.GetPaymentById("approved")
+	require.True(t, approved.Reviewed)
+	require.Equal(t, "jane", approved.Review.Reviewer)
+	require.Equal(t, 5.0, approved.Amount)
+	open, _ := store.GetPaymentById("open")
+	require.False(t, open.Reviewed)
+	_, exists := store.GetPaymentById("fresh")
+	require.False(t, exists)
+
+	// a reviewed column matching the review state is fine, and the review stays
+	report, err := service.Import(ImportRequest{Format: ImportFormatCSV, Actor: "recon", Scope: scope,
+		Body: strings.NewReader("id,merchant_name,date,amount,status,reviewed\napproved,Acme,2024-05-01,6,completed,true\n")})
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Updated)
+	approved, _ = store.GetPaymentById("approved")
+	require.Equal(t, 6.0, approved.Amount)
+	require.Equal(t, "jane", approved.Review.Reviewer)
+	events := store.ListPaymentEvents("approved")
+	require.Equal(t, domain.PaymentEventReviewed, events[len(events)-1].Type)
+}
+
+func TestPaymentService_ImportDryRun(t *testing.T) {
+	store := storage.NewMemoryStore()
+	service := NewPaymentService(store)
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "existing", Status: "processing", Amount: 1}))
+
+	csv := "id,merchant_name,date,amount,status\n" +
+		"existing,Acme,2024-05-01,5,completed\n" +
+		"new,Acme,2024-05-01,5,completed\n" +
+		"broken,Acme,2024-05-01,5,unknown\n"
+
+	report, err := service.Import(ImportRequest{Format: ImportFormatCSV, Body: strings.NewReader(csv), DryRun: true, Scope: MerchantScope{Role: domain.RoleOperational, AllMerchants: true}})
+	require.NoError(t, err)
+	require.True(t, report.DryRun)
+	require.Equal(t, 1, report.Created)
+	require.Equal(t, 1, report.Updated)
+	require.Equal(t, 1, report.Failed)
+
+	// nothing was written
+	existing, _ := store.GetPaymentById("existing")
+	require.Equal(t, "processing", existing.Status)
+	require.Equal(t, int64(1), existing.Version)
+	_, exists := store.GetPaymentById("new")
+	require.False(t, exists)
+}
+
+func TestPaymentService_ImportMerchantScope(t *testing.T) {
+	store := storage.NewMemoryStore()
+	service := NewPaymentService(store)
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "travel1", MerchantName: "Travel Co", Status: "processing", Amount: 1}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "acme1", MerchantName: "Acme", Status: "processing", Amount: 1}))
+
+	csv := "id,merchant_name,date,amount,status\n" +
+		"travel1,Acme,2024-05-01,5,completed\n" +
+		"acme1,Acme,2024-05-01,5,completed\n" +
+		"travel2,Travel Co,2024-05-01,5,completed\n" +
+		"acme2,Acme,2024-05-01,5,completed\n"
+	scope := MerchantScope{Role: domain.RoleOperational, Merchants: []string{"Acme"}}
+
+	for _, dryRun := range []bool{true, false} {
+		report, err := service.Import(ImportRequest{Format: ImportFormatCSV, Body: strings.NewReader(csv), DryRun: dryRun, Scope: scope})
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Created)
+		require.Equal(t, 1, report.Updated)
+		require.Equal(t, 2, report.Failed)
+		// a payment of another merchant does not exist for the importer,
+		// and none can be created for one
+		require.Equal(t, []ImportRowError{
+			{Line: 2, ID: "travel1", Errors: []string{"payment not found"}},
+			{Line: 4, ID: "travel2", Errors: []string{`merchant_name "Travel Co" is not one of your merchants`}},
+		}, report.Errors)
+	}
+
+	untouched, _ := store.GetPaymentById("travel1")
+	require.Equal(t, "Travel Co", untouched.MerchantName)
+	require.Equal(t, "processing", untouched.Status)
+	_, exists := store.GetPaymentById("travel2")
+	require.False(t, exists)
+	imported, _ := store.GetPaymentById("acme1")
+	require.Equal(t, "completed", imported.Status)
+}
+
+func TestPaymentService_ImportStatusFollowsLifecycle(t *testing.T) {
+	store := storage.NewMemoryStore()
+	service := NewPaymentService(store)
+	for _, p := range []*domain.Payment{
+		{ID: "settling", MerchantName: "Acme", Status: "processing", Amount: 5},
+		{ID: "refunded", MerchantName: "Acme", Status: "refunded", Amount: 5},
+		{ID: "paid", MerchantName: "Acme", Status: "completed", Amount: 5},
+	} {
+		require.NoError(t, store.CreatePayment(p))
+	}
+
+	csv := "id,merchant_name,date,amount,status\n" +
+		"settling,Acme,2024-05-01,5,completed\n" +
+		"refunded,Acme,2024-05-01,5,completed\n" +
+		"paid,Acme,2024-05-01,5,disputed\n"
+
+	// cs may dispute a payment but not settle one, and nobody can bring a
+	// refunded payment back
+	for _, dryRun := range []bool{true, false} {
+		report, err := service.Import(ImportRequest{Format: ImportFormatCSV, Body: strings.NewReader(csv), DryRun: dryRun,
+			Scope: MerchantScope{Role: domain.RoleCS, AllMerchants: true}})
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Updated)
+		require.Equal(t, []ImportRowError{
+			{Line: 2, ID: "settling", Errors: []string{"status processing -> completed needs role operational"}},
+			{Line: 3, ID: "refunded", Errors: []string{"status cannot change from refunded to completed"}},
+		}, report.Errors)
+	}
+
+	for id, status := range map[string]string{"settling": "processing", "refunded": "refunded", "paid": "disputed"} {
+		stored, _ := store.GetPaymentById(id)
+		require.Equal(t, status, stored.Status, id)
+	}
+
+	report, err := service.Import(ImportRequest{Format: ImportFormatCSV, Body: strings.NewReader(csv),
+		Scope: MerchantScope{Role: domain.RoleOperational, AllMerchants: true}})
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Updated)
+	require.Equal(t, 1, report.Failed)
+	settled, _ := store.GetPaymentById("settling")
+	require.Equal(t, "completed", settled.Status)
+}
+
+func TestPaymentService_ImportFollowsRefunds(t *testing.T) {
+	store := storage.NewMemoryStore()
+	service := NewPaymentService(store)
+	for _, p := range []*domain.Payment{
+		{ID: "refunding", MerchantName: "Acme", Status: "completed", Amount: 10},
+		{ID: "disputed", MerchantName: "Acme", Status: "disputed", Amount: 10},
+		{ID: "partly", MerchantName: "Acme", Status: "partially_refunded", Amount: 10},
+	} {
+		require.NoError(t, store.CreatePayment(p))
+	}
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		for _, refund := range []*domain.Refund{
+			{ID: "r1", PaymentID: "refunding", Amount: 4, Status: domain.RefundStatusRequested},
+			{ID: "r2", PaymentID: "disputed", Amount: 4, Status: domain.RefundStatusProcessed},
+			{ID: "r3", PaymentID: "partly", Amount: 6, Status: domain.RefundStatusProcessed},
+		} {
+			if err := tx.PutRefund(refund); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	csv := "id,merchant_name,date,amount,status\n" +
+		"refunding,Acme,2024-05-01,3,disputed\n" +
+		"disputed,Acme,2024-05-01,10,completed\n" +
+		"partly,Acme,2024-05-01,5,partially_refunded\n" +
+		"fresh,Acme,2024-05-01,5,refunded\n"
+
+	report, err := service.Import(ImportRequest{Format: ImportFormatCSV, Body: strings.NewReader(csv),
+		Scope: MerchantScope{Role: domain.RoleOperational, AllMerchants: true}})
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Updated)
+	require.Equal(t, []ImportRowError{
+		{Line: 2, ID: "refunding", Errors: []string{
+			"amount is below the 4.00 refunded or being refunded",
+			"status cannot change from completed while a refund is open",
+		}},
+		{Line: 4, ID: "partly", Errors: []string{"amount is below the 6.00 refunded or being refunded"}},
+		{Line: 5, ID: "fresh", Errors: []string{"status refunded needs a processed refund"}},
+	}, report.Errors)
+
+	// a won dispute keeps the processed refund in the status
+	won, _ := store.GetPaymentById("disputed")
+	require.Equal(t, "partially_refunded", won.Status)
+	refunding, _ := store.GetPaymentById("refunding")
+	require.Equal(t, "completed", refunding.Status)
+	require.Equal(t, 10.0, refunding.Amount)
+	_, exists := store.GetPaymentById("fresh")
+	require.False(t, exists)
+}
+
+func TestPaymentService_ImportLargeFile(t *testing.T) {
+	store := storage.NewMemoryStore()
+	service := NewPaymentService(store)
+
+	var builder strings.Builder
+	builder.WriteString("id,merchant_name,date,amount,status\n")
+	rows := importBatchSize*2 + 7
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&builder, "p%d,Acme,2024-05-01,%d,completed\n", i, i+1)
+	}
+
+	report, err := service.Import(ImportRequest{Format: ImportFormatCSV, Body: strings.NewReader(builder.String()), Scope: MerchantScope{Role: domain.RoleOperational, AllMerchants: true}})
+	require.NoError(t, err)
+	require.Equal(t, rows, report.Created)
+	require.Empty(t, report.Errors)
+	require.Equal(t, rows, store.QueryPayments(domain.PaymentQuery{}).Total)
+
+	// the error list is capped, the counters are not
+	builder.Reset()
+	builder.WriteString("id,merchant_name,date,amount,status\n")
+	for i := 0; i < maxImportErrors+5; i++ {
+		fmt.Fprintf(&builder, "bad%d,Acme,2024-05-01,-1,completed\n", i)
+	}
+	report, err = service.Import(ImportRequest{Format: ImportFormatCSV, Body: strings.NewReader(builder.String()), Scope: MerchantScope{Role: domain.RoleOperational, AllMerchants: true}})
+	require.NoError(t, err)
+	require.Equal(t, maxImportErrors+5, report.Failed)
+	require.Len(t, report.Errors, maxImportErrors)
+	require.True(t, report.ErrorsTruncated)
+}
+
+func TestPaymentService_ImportUnreadable(t *testing.T) {
+	service := NewPaymentService(storage.NewMemoryStore())
+
+	tests := []struct {
+		name    string
+		format  string
+		body    string
+		wantErr string
+	}{
+		{name: "unknown format", format: "xlsx", body: "", wantErr: "unsupported import format"},
+		{name: "missing columns", format: ImportFormatCSV, body: "id,amount\np1,5\n", wantErr: "missing merchant_name, date, status"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.Import(ImportRequest{Format: tt.format, Body: strings.NewReader(tt.body), Scope: MerchantScope{Role: domain.RoleOperational, AllMerchants: true}})
+			var validationErr *errors.ValidationError
+			require.ErrorAs(t, err, &validationErr)
+			require.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+
+	// a file that breaks part way keeps the rows before the break
+	csv := "id,merchant_name,date,amount,status\n" +
+		"p1,Acme,2024-05-01,5,completed\n" +
+		"p2,\"Acme,2024-05-01,5,completed\n"
+	report, err := service.Import(ImportRequest{Format: ImportFormatCSV, Body: strings.NewReader(csv), Scope: MerchantScope{Role: domain.RoleOperational, AllMerchants: true}})
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Created)
+	require.Equal(t, 1, report.Failed)
+	require.Equal(t, 3, report.Errors[0].Line)
+	require.Contains(t, report.Errors[0].Errors[0], "unreadable CSV")
+}
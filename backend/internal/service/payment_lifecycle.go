@@ -0,0 +1,125 @@
+package service
+
+/*
+Payment lifecycle. A payment moves between statuses only along the
+transitions below: processing settles as completed or fails, a failed payment
+can be retried, a completed one disputed and a dispute won. Partially_refunded
+and refunded are only reached by processing refunds, a lost dispute included,
+and refunded is final. While a refund is requested or approved the status is
+left to it. Each transition names the roles that may make it and the reason
+codes it accepts, the reason is kept on the status_changed event of the
+timeline.
+*/
+
+import (
+	"slices"
+	"strings"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+)
+
+// PaymentTransition is a status change, who may make it and why
+type PaymentTransition struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Roles   []string `json:"-"`
+	Reasons []string `json:"reasons"`
+}
+
+// StatusChange is a transition requested for a payment
+type StatusChange struct {
+	To     string
+	Reason string
+	Note   string
+}
+
+var paymentTransitions = []PaymentTransition{
+	{
+		From: domain.PaymentStatusProcessing, To: domain.PaymentStatusCompleted,
+		Roles: []string{domain.RoleOperational}, Reasons: []string{"settled"},
+	},
+	{
+		From: domain.PaymentStatusProcessing, To: domain.PaymentStatusFailed,
+		Roles: []string{domain.RoleOperational}, Reasons: []string{"declined", "expired", "fraud_suspected"},
+	},
+	{
+		From: domain.PaymentStatusFailed, To: domain.PaymentStatusProcessing,
+		Roles: []string{domain.RoleOperational}, Reasons: []string{"retried"},
+	},
+	{
+		From: domain.PaymentStatusCompleted, To: domain.PaymentStatusDisputed,
+		Roles: []string{domain.RoleCS, domain.RoleOperational}, Reasons: []string{"chargeback", "customer_complaint"},
+	},
+	{
+		From: domain.PaymentStatusPartiallyRefunded, To: domain.PaymentStatusDisputed,
+		Roles: []string{domain.RoleCS, domain.RoleOperational}, Reasons: []string{"chargeback", "customer_complaint"},
+	},
+	{
+		From: domain.PaymentStatusDisputed, To: domain.PaymentStatusCompleted,
+		Roles: []string{domain.RoleOperational}, Reasons: []string{"dispute_won", "dispute_withdrawn"},
+	},
+}
+
+// Transitions returns the transitions out of status that role may make
+func Transitions(status, role string) []PaymentTransition {
+	transitions := []PaymentTransition{}
+	for _, transition := range paymentTransitions {
+		if transition.From == status && slices.Contains(transition.Roles, role) {
+			transitions = append(transitions, transition)
+		}
+	}
+	return transitions
+}
+
+// Transition moves a payment scope can see to change.To, adding a
+// status_changed event by actor to its timeline. A transition the lifecycle
+// does not have, or one while a refund is open, returns
+// errors.TransitionError, one the role of scope may not make
+// errors.ForbiddenError. A won dispute of a partly refunded payment returns it
+// to partially_refunded. ifMatch is as for Review.
+func (payment *PaymentService) Transition(paymentID, actor string, change StatusChange, ifMatch int64, scope MerchantScope) (*domain.Payment, error) {
+	if !domain.IsPaymentStatus(change.To) {
+		return nil, errors.NewValidationError(": status must be one of " + strings.Join(domain.PaymentStatuses, ", "))
+	}
+	if change.Reason == "" {
+		return nil, errors.NewValidationError(": reason must not be empty")
+	}
+	note, err := paymentNote(change.Note)
+	if err != nil {
+		return nil, err
+	}
+	change.Note = note
+
+	return payment.updatePayment(paymentID, ifMatch, scope, func(tx domain.Tx, p *domain.Payment) (*domain.PaymentEvent, error) {
+		index := slices.IndexFunc(paymentTransitions, func(transition PaymentTransition) bool {
+			return transition.From == p.Status && transition.To == change.To
+		})
+		if index < 0 {
+			return nil, errors.NewTransitionError(": " + p.Status + " -> " + change.To)
+		}
+
+		transition := paymentTransitions[index]
+		if !slices.Contains(transition.Roles, scope.Role) {
+			return nil, errors.NewForbiddenError(": " + p.Status + " -> " + change.To + " needs role " + strings.Join(transition.Roles, " or "))
+		}
+		if !slices.Contains(transition.Reasons, change.Reason) {
+			return nil, errors.NewValidationError(": reason must be one of " + strings.Join(transition.Reasons, ", "))
+		}
+
+		refunds := tx.ListRefunds(p.ID)
+		if hasOpenRefund(refunds) {
+			return nil, errors.NewTransitionError(": " + p.Status + " -> " + change.To + " while a refund is open")
+		}
+		to := change.To
+		if to == domain.PaymentStatusCompleted && refundedCents(refunds) > 0 {
+			to = domain.PaymentStatusPartiallyRefunded
+		}
+
+		event := newPaymentEvent(p.ID, domain.PaymentEventStatusChanged, actor)
+		event.From, event.To = p.Status, to
+		event.Reason, event.Note = change.Reason, change.Note
+		p.Status = to
+		return event, nil
+	})
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"testing"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentTransitions(t *testing.T) {
+	for _, transition := range paymentTransitions {
+		require.True(t, domain.IsPaymentStatus(transition.From), transition.From)
+		require.True(t, domain.IsPaymentStatus(transition.To), transition.To)
+		require.NotEqual(t, transition.From, transition.To)
+		require.NotEmpty(t, transition.Roles, transition.From+" -> "+transition.To)
+		require.NotEmpty(t, transition.Reasons, transition.From+" -> "+transition.To)
+		// only processing refunds leads to these
+		require.NotContains(t, []string{domain.PaymentStatusRefunded, domain.PaymentStatusPartiallyRefunded}, transition.To)
+	}
+
+	require.Empty(t, Transitions(domain.PaymentStatusRefunded, domain.RoleOperational), "refunded is final")
+	require.Empty(t, Transitions(domain.PaymentStatusProcessing, domain.RoleCS))
+	require.Empty(t, Transitions(domain.PaymentStatusCompleted, domain.RoleAdmin))
+
+	var targets []string
+	for _, transition := range Transitions(domain.PaymentStatusCompleted, domain.RoleOperational) {
+		targets = append(targets, transition.To)
+	}
+	require.Equal(t, []string{domain.PaymentStatusDisputed}, targets)
+}
+
+func TestPaymentService_Transition(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay1", MerchantName: "Acme", Status: domain.PaymentStatusProcessing}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay2", MerchantName: "Travel Co", Status: domain.PaymentStatusCompleted}))
+	service := NewPaymentService(store)
+	operational := MerchantScope{Role: domain.RoleOperational, AllMerchants: true}
+	cs := MerchantScope{Role: domain.RoleCS, AllMerchants: true}
+
+	updated, err := service.Transition("pay1", "jane-operational@durianpay.id",
+		StatusChange{To: domain.PaymentStatusCompleted, Reason: "settled", Note: " confirmed by the acquirer "}, 1, operational)
+	require.NoError(t, err)
+	require.Equal(t, domain.PaymentStatusCompleted, updated.Status)
+	require.Equal(t, int64(2), updated.Version)
+
+	events := store.ListPaymentEvents("pay1")
+	require.Len(t, events, 1)
+	require.Equal(t, domain.PaymentEventStatusChanged, events[0].Type)
+	require.Equal(t, "jane-operational@durianpay.id", events[0].Actor)
+	require.Equal(t, domain.PaymentStatusProcessing, events[0].From)
+	require.Equal(t, domain.PaymentStatusCompleted, events[0].To)
+	require.Equal(t, "settled", events[0].Reason)
+	require.Equal(t, "confirmed by the acquirer", events[0].Note)
+
+	// cs may flag a dispute but not settle it
+	_, err = service.Transition("pay1", "john-cs@durianpay.id", StatusChange{To: domain.PaymentStatusDisputed, Reason: "chargeback"}, 0, cs)
+	require.NoError(t, err)
+	_, err = service.Transition("pay1", "john-cs@durianpay.id", StatusChange{To: domain.PaymentStatusCompleted, Reason: "dispute_won"}, 0, cs)
+	require.IsType(t, &errors.ForbiddenError{}, err)
+
+	detail, err := service.GetPaymentDetail("pay1", cs)
+	require.NoError(t, err)
+	require.Empty(t, detail.Transitions)
+	detail, err = service.GetPaymentDetail("pay1", operational)
+	require.NoError(t, err)
+	require.Len(t, detail.Transitions, 1)
+	require.Len(t, detail.Timeline, 3)
+
+	tests := []struct {
+		name    string
+		id      string
+		change  StatusChange
+		ifMatch int64
+		scope   MerchantScope
+		wantErr error
+	}{
+		{
+			name:    "completed back to processing",
+			id:      "pay2",
+			change:  StatusChange{To: domain.PaymentStatusProcessing, Reason: "retried"},
+			scope:   operational,
+			wantErr: &errors.TransitionError{},
+		},
+		{
+			name:    "same status",
+			id:      "pay2",
+			change:  StatusChange{To: domain.PaymentStatusCompleted, Reason: "settled"},
+			scope:   operational,
+			wantErr: &errors.TransitionError{},
+		},
+		{
+			name:    "refunded by hand",
+			id:      "pay2",
+			change:  StatusChange{To: domain.PaymentStatusRefunded, Reason: "duplicate"},
+			scope:   operational,
+			wantErr: &errors.TransitionError{},
+		},
+		{
+			name:    "partially refunded by hand",
+			id:      "pay2",
+			change:  StatusChange{To: domain.PaymentStatusPartiallyRefunded, Reason: "customer_request"},
+			scope:   operational,
+			wantErr: &errors.TransitionError{},
+		},
+		{
+			name:    "reason of another transition",
+			id:      "pay2",
+			change:  StatusChange{To: domain.PaymentStatusDisputed, Reason: "dispute_lost"},
+			scope:   operational,
+			wantErr: &errors.ValidationError{},
+		},
+		{
+			name:    "missing reason",
+			id:      "pay2",
+			change:  StatusChange{To: domain.PaymentStatusDisputed},
+			scope:   operational,
+			wantErr: &errors.ValidationError{},
+		},
+		{
+			name:    "unknown status",
+			id:      "pay2",
+			change:  StatusChange{To: "settled", Reason: "settled"},
+			scope:   operational,
+			wantErr: &errors.ValidationError{},
+		},
+		{
+			name:    "stale version",
+			id:      "pay2",
+			change:  StatusChange{To: domain.PaymentStatusDisputed, Reason: "chargeback"},
+			ifMatch: 5,
+			scope:   operational,
+			wantErr: &errors.ConflictError{},
+		},
+		{
+			name:    "other merchant",
+			id:      "pay2",
+			change:  StatusChange{To: domain.PaymentStatusDisputed, Reason: "chargeback"},
+			scope:   MerchantScope{Role: domain.RoleOperational, Merchants: []string{"Acme"}},
+			wantErr: &errors.NotFoundError{},
+		},
+		{
+			name:    "admin",
+			id:      "pay2",
+			change:  StatusChange{To: domain.PaymentStatusDisputed, Reason: "chargeback"},
+			scope:   MerchantScope{Role: domain.RoleAdmin},
+			wantErr: &errors.ForbiddenError{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.Transition(tt.id, "jane-operational@durianpay.id", tt.change, tt.ifMatch, tt.scope)
+			require.IsType(t, tt.wantErr, err)
+		})
+	}
+
+	// rejected transitions leave the payment and its timeline alone
+	unchanged, _ := store.GetPaymentById("pay2")
+	require.Equal(t, domain.PaymentStatusCompleted, unchanged.Status)
+	require.Equal(t, int64(1), unchanged.Version)
+	require.Empty(t, store.ListPaymentEvents("pay2"))
+}
@@ -0,0 +1,265 @@
+package service
+
+/*
+Refunds. A refund is requested for part or all of a completed payment, or of
+a disputed one when the dispute is lost, then approved or rejected by someone
+other than the requester, and finally reported processed or failed.
+Requested, approved and processed refunds together never exceed the payment
+amount, the check runs in the transaction that writes the refund. Once a
+refund is processed the payment moves to partially_refunded, or refunded when
+nothing is left; no other way leads there, and the status of the payment
+cannot be changed while a refund is open. Every step is on the timeline of the
+payment as a refund event.
+*/
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+)
+
+// RefundRequest asks for money back on a payment
+type RefundRequest struct {
+	Amount float64
+	Reason string
+	Note   string
+}
+
+// refundTransition is a status change of a refund and the roles that may make it
+type refundTransition struct {
+	From  string
+	To    string
+	Roles []string
+}
+
+// refundReasons are the reason codes a refund may be requested for
+// ErrRefundNotFound is returned for a refund the payment does not have. It is
+// an errors.NotFoundError too, check for it before those of payments.
+var ErrRefundNotFound = errors.NewNotFoundError(": refund")
+
+var refundReasons = []string{"customer_request", "merchant_request", "duplicate", "fraud", "dispute_lost"}
+
+var refundTransitions = []refundTransition{
+	{From: "", To: domain.RefundStatusRequested, Roles: []string{domain.RoleCS, domain.RoleOperational}},
+	{From: domain.RefundStatusRequested, To: domain.RefundStatusApproved, Roles: []string{domain.RoleOperational}},
+	{From: domain.RefundStatusRequested, To: domain.RefundStatusRejected, Roles: []string{domain.RoleOperational}},
+	{From: domain.RefundStatusApproved, To: domain.RefundStatusProcessed, Roles: []string{domain.RoleOperational}},
+	{From: domain.RefundStatusApproved, To: domain.RefundStatusFailed, Roles: []string{domain.RoleOperational}},
+}
+
+// refundableStatuses are the payment statuses a refund may be requested in
+var refundableStatuses = []string{domain.PaymentStatusCompleted, domain.PaymentStatusPartiallyRefunded, domain.PaymentStatusDisputed}
+
+// ListRefunds returns the refunds of a payment scope can see, oldest first
+func (payment *PaymentService) ListRefunds(paymentID string, scope MerchantScope) ([]*domain.Refund, error) {
+	if _, err := payment.GetPayment(paymentID, scope); err != nil {
+		return nil, err
+	}
+	return payment.store.ListRefunds(paymentID), nil
+}
+
+// RequestRefund asks for request.Amount back on a payment scope can see, on
+// behalf of actor. An amount above what is left to refund is an
+// errors.ValidationError, a payment that is not completed, partially refunded
+// or disputed an errors.TransitionError.
+func (payment *PaymentService) RequestRefund(paymentID, actor string, request RefundRequest, scope MerchantScope) (*domain.Refund, error) {
+	if math.IsNaN(request.Amount) || cents(request.Amount) <= 0 {
+		return nil, errors.NewValidationError(": amount must be positive")
+	}
+	if !slices.Contains(refundReasons, request.Reason) {
+		return nil, errors.NewValidationError(": reason must be one of " + strings.Join(refundReasons, ", "))
+	}
+	note, err := paymentNote(request.Note)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRefundTransition("", domain.RefundStatusRequested, scope); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	refund := &domain.Refund{
+		ID:          uuid.NewString(),
+		PaymentID:   paymentID,
+		Amount:      float64(cents(request.Amount)) / 100,
+		Status:      domain.RefundStatusRequested,
+		Reason:      request.Reason,
+		Note:        note,
+		RequestedBy: actor,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	err = payment.store.Update(func(tx domain.Tx) error {
+		current, ok := tx.GetPaymentById(paymentID)
+		if !ok || !payment.inScope(current, scope) {
+			return errors.NewNotFoundError("paymentId: " + paymentID)
+		}
+		if !slices.Contains(refundableStatuses, current.Status) {
+			return errors.NewTransitionError(": a " + current.Status + " payment cannot be refunded")
+		}
+
+		left := cents(current.Amount)
+		for _, other := range tx.ListRefunds(paymentID) {
+			if other.Pending() {
+				left -= cents(other.Amount)
+			}
+		}
+		if cents(refund.Amount) > left {
+			return errors.NewValidationError(": amount exceeds the " + strconv.FormatFloat(float64(max(left, 0))/100, 'f', 2, 64) + " left to refund")
+		}
+
+		if err := tx.PutRefund(refund); err != nil {
+			return err
+		}
+		return tx.AddPaymentEvent(newRefundEvent(refund, "", actor, note))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return refund, nil
+}
+
+// UpdateRefund moves a refund of a payment scope can see to status, note is
+// kept on the timeline. Approving or rejecting a refund takes someone other
+// than its requester. Processing one moves the payment to partially_refunded
+// or refunded.
+func (payment *PaymentService) UpdateRefund(paymentID, refundID, actor, status, note string, scope MerchantScope) (*domain.Refund, error) {
+	note, err := paymentNote(note)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated *domain.Refund
+	err = payment.store.Update(func(tx domain.Tx) error {
+		current, ok := tx.GetPaymentById(paymentID)
+		if !ok || !payment.inScope(current, scope) {
+			return errors.NewNotFoundError("paymentId: " + paymentID)
+		}
+		refund, ok := tx.GetRefund(refundID)
+		if !ok || refund.PaymentID != paymentID {
+			return fmt.Errorf("%w: %s", ErrRefundNotFound, refundID)
+		}
+
+		if err := checkRefundTransition(refund.Status, status, scope); err != nil {
+			return err
+		}
+
+		from := refund.Status
+		now := time.Now()
+		if status == domain.RefundStatusApproved || status == domain.RefundStatusRejected {
+			if actor == refund.RequestedBy {
+				return errors.NewForbiddenError(": a refund has to be approved or rejected by someone other than its requester")
+			}
+			refund.DecidedBy, refund.DecidedAt = actor, &now
+		}
+		refund.Status, refund.UpdatedAt = status, now
+
+		if err := tx.PutRefund(refund); err != nil {
+			return err
+		}
+		if err := tx.AddPaymentEvent(newRefundEvent(refund, from, actor, note)); err != nil {
+			return err
+		}
+		if status == domain.RefundStatusProcessed {
+			if err := refundPayment(tx, current, refund, actor); err != nil {
+				return err
+			}
+		}
+
+		updated = refund
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+// private
+
+// checkRefundTransition checks that the refund lifecycle has the change and
+// the role of scope may make it
+func checkRefundTransition(from, to string, scope MerchantScope) error {
+	index := slices.IndexFunc(refundTransitions, func(transition refundTransition) bool {
+		return transition.From == from && transition.To == to
+	})
+	if index < 0 {
+		return errors.NewTransitionError(": refund " + from + " -> " + to)
+	}
+
+	transition := refundTransitions[index]
+	if !slices.Contains(transition.Roles, scope.Role) {
+		return errors.NewForbiddenError(": refund " + to + " needs role " + strings.Join(transition.Roles, " or "))
+	}
+	return nil
+}
+
+// refundPayment moves p to the status its processed refunds leave it in. The
+// status cannot have left refundableStatuses while the refund was open, but
+// is checked again all the same.
+func refundPayment(tx domain.Tx, p *domain.Payment, processed *domain.Refund, actor string) error {
+	status := domain.PaymentStatusPartiallyRefunded
+	if refundedCents(tx.ListRefunds(p.ID)) >= cents(p.Amount) {
+		status = domain.PaymentStatusRefunded
+	}
+	if p.Status == status {
+		return nil
+	}
+	if !slices.Contains(refundableStatuses, p.Status) {
+		return errors.NewTransitionError(": a " + p.Status + " payment cannot be refunded")
+	}
+
+	// the reason of the refund is on its own event, status_changed reasons
+	// are the codes of the lifecycle
+	event := newPaymentEvent(p.ID, domain.PaymentEventStatusChanged, actor)
+	event.From, event.To = p.Status, status
+	event.Note = "refund " + processed.ID
+	p.Status = status
+	if err := tx.UpdatePayment(p); err != nil {
+		return err
+	}
+	return tx.AddPaymentEvent(event)
+}
+
+func newRefundEvent(refund *domain.Refund, from, actor, note string) *domain.PaymentEvent {
+	event := newPaymentEvent(refund.PaymentID, domain.PaymentEventRefund, actor)
+	event.RefundID, event.Amount = refund.ID, refund.Amount
+	event.From, event.To = from, refund.Status
+	event.Reason, event.Note = refund.Reason, note
+	return event
+}
+
+// hasOpenRefund reports whether one of refunds is requested or approved
+func hasOpenRefund(refunds []*domain.Refund) bool {
+	return slices.ContainsFunc(refunds, func(refund *domain.Refund) bool {
+		return refund.Status == domain.RefundStatusRequested || refund.Status == domain.RefundStatusApproved
+	})
+}
+
+// refundedCents adds up the processed refunds of refunds
+func refundedCents(refunds []*domain.Refund) int64 {
+	refunded := int64(0)
+	for _, refund := range refunds {
+		if refund.Status == domain.RefundStatusProcessed {
+			refunded += cents(refund.Amount)
+		}
+	}
+	return refunded
+}
+
+// cents is amount in whole cents, refund amounts are compared in cents so
+// float rounding cannot let them add up past the payment
+func cents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
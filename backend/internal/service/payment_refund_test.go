@@ -0,0 +1,234 @@
+package service
+
+import (
+	"testing"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefundTransitions(t *testing.T) {
+	statuses := []string{domain.RefundStatusRequested, domain.RefundStatusApproved, domain.RefundStatusRejected, domain.RefundStatusProcessed, domain.RefundStatusFailed}
+	for _, transition := range refundTransitions {
+		if transition.From != "" {
+			require.Contains(t, statuses, transition.From)
+		}
+		require.Contains(t, statuses, transition.To)
+		require.NotEmpty(t, transition.Roles, transition.From+" -> "+transition.To)
+	}
+
+	for _, status := range refundableStatuses {
+		require.True(t, domain.IsPaymentStatus(status), status)
+	}
+}
+
+func TestPaymentService_Refund(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay1", MerchantName: "Acme", Amount: 100, Status: domain.PaymentStatusCompleted}))
+	service := NewPaymentService(store)
+	cs := MerchantScope{Role: domain.RoleCS, AllMerchants: true}
+	operational := MerchantScope{Role: domain.RoleOperational, AllMerchants: true}
+	requester, approver := "john-cs@durianpay.id", "jane-operational@durianpay.id"
+
+	partial, err := service.RequestRefund("pay1", requester, RefundRequest{Amount: 30.004, Reason: "customer_request", Note: " wrong size "}, cs)
+	require.NoError(t, err)
+	require.Equal(t, domain.RefundStatusRequested, partial.Status)
+	require.Equal(t, 30.0, partial.Amount)
+	require.Equal(t, "wrong size", partial.Note)
+	require.Equal(t, requester, partial.RequestedBy)
+
+	// requested refunds count against the amount left
+	_, err = service.RequestRefund("pay1", requester, RefundRequest{Amount: 70.01, Reason: "customer_request"}, cs)
+	require.IsType(t, &errors.ValidationError{}, err)
+
+	// the requester cannot decide their own refund
+	_, err = service.UpdateRefund("pay1", partial.ID, requester, domain.RefundStatusApproved, "", operational)
+	require.IsType(t, &errors.ForbiddenError{}, err)
+	_, err = service.UpdateRefund("pay1", partial.ID, approver, domain.RefundStatusApproved, "", cs)
+	require.IsType(t, &errors.ForbiddenError{}, err)
+	_, err = service.UpdateRefund("pay1", partial.ID, approver, domain.RefundStatusProcessed, "", operational)
+	require.IsType(t, &errors.TransitionError{}, err)
+
+	approved, err := service.UpdateRefund("pay1", partial.ID, approver, domain.RefundStatusApproved, "", operational)
+	require.NoError(t, err)
+	require.Equal(t, approver, approved.DecidedBy)
+	require.NotNil(t, approved.DecidedAt)
+
+	processed, err := service.UpdateRefund("pay1", partial.ID, approver, domain.RefundStatusProcessed, "acquirer ref 123", operational)
+	require.NoError(t, err)
+	require.Equal(t, domain.RefundStatusProcessed, processed.Status)
+	require.Equal(t, approver, processed.DecidedBy, "processing keeps the decision")
+
+	current, _ := store.GetPaymentById("pay1")
+	require.Equal(t, domain.PaymentStatusPartiallyRefunded, current.Status)
+	require.Equal(t, int64(2), current.Version)
+
+	// a rejected refund frees its amount again
+	rejected, err := service.RequestRefund("pay1", requester, RefundRequest{Amount: 70, Reason: "merchant_request"}, cs)
+	require.NoError(t, err)
+	_, err = service.UpdateRefund("pay1", rejected.ID, approver, domain.RefundStatusRejected, "no merchant approval", operational)
+	require.NoError(t, err)
+
+	rest, err := service.RequestRefund("pay1", approver, RefundRequest{Amount: 70, Reason: "merchant_request"}, operational)
+	require.NoError(t, err)
+	_, err = service.UpdateRefund("pay1", rest.ID, "lead-operational@durianpay.id", domain.RefundStatusApproved, "", operational)
+	require.NoError(t, err)
+	_, err = service.UpdateRefund("pay1", rest.ID, approver, domain.RefundStatusProcessed, "", operational)
+	require.NoError(t, err)
+
+	current, _ = store.GetPaymentById("pay1")
+	require.Equal(t, domain.PaymentStatusRefunded, current.Status)
+
+	// nothing is left to refund on a refunded payment
+	_, err = service.RequestRefund("pay1", requester, RefundRequest{Amount: 1, Reason: "customer_request"}, cs)
+	require.IsType(t, &errors.TransitionError{}, err)
+
+	refunds, err := service.ListRefunds("pay1", cs)
+	require.NoError(t, err)
+	require.Equal(t, []string{partial.ID, rejected.ID, rest.ID}, []string{refunds[0].ID, refunds[1].ID, refunds[2].ID})
+	require.Equal(t, domain.RefundStatusRejected, refunds[1].Status)
+
+	var refundEvents, statusEvents []*domain.PaymentEvent
+	for _, event := range store.ListPaymentEvents("pay1") {
+		switch event.Type {
+		case domain.PaymentEventRefund:
+			refundEvents = append(refundEvents, event)
+		case domain.PaymentEventStatusChanged:
+			statusEvents = append(statusEvents, event)
+		}
+	}
+	require.Len(t, refundEvents, 8)
+	require.Equal(t, partial.ID, refundEvents[0].RefundID)
+	require.Equal(t, 30.0, refundEvents[0].Amount)
+	require.Empty(t, refundEvents[0].From)
+	require.Equal(t, domain.RefundStatusRequested, refundEvents[0].To)
+	require.Equal(t, "customer_request", refundEvents[0].Reason)
+	require.Equal(t, domain.RefundStatusApproved, refundEvents[2].From)
+	require.Equal(t, domain.RefundStatusProcessed, refundEvents[2].To)
+	require.Equal(t, "acquirer ref 123", refundEvents[2].Note)
+	require.Len(t, statusEvents, 2)
+	require.Equal(t, domain.PaymentStatusCompleted, statusEvents[0].From)
+	require.Equal(t, domain.PaymentStatusPartiallyRefunded, statusEvents[0].To)
+	require.Equal(t, domain.PaymentStatusPartiallyRefunded, statusEvents[1].From)
+	require.Equal(t, domain.PaymentStatusRefunded, statusEvents[1].To)
+	require.Empty(t, statusEvents[1].Reason, "the refund reason stays on the refund events")
+	require.Equal(t, "refund "+rest.ID, statusEvents[1].Note)
+
+	detail, err := service.GetPaymentDetail("pay1", cs)
+	require.NoError(t, err)
+	require.Len(t, detail.Refunds, 3)
+	require.Equal(t, refundReasons, detail.RefundReasons)
+}
+
+func TestPaymentService_RefundRejected(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay1", MerchantName: "Acme", Amount: 100, Status: domain.PaymentStatusCompleted}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay2", MerchantName: "Travel Co", Amount: 100, Status: domain.PaymentStatusProcessing}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay3", MerchantName: "Acme", Amount: 100, Status: domain.PaymentStatusCompleted}))
+	service := NewPaymentService(store)
+	cs := MerchantScope{Role: domain.RoleCS, AllMerchants: true}
+	operational := MerchantScope{Role: domain.RoleOperational, AllMerchants: true}
+
+	tests := []struct {
+		name    string
+		id      string
+		request RefundRequest
+		scope   MerchantScope
+		wantErr error
+	}{
+		{name: "zero amount", id: "pay1", request: RefundRequest{Reason: "duplicate"}, scope: cs, wantErr: &errors.ValidationError{}},
+		{name: "negative amount", id: "pay1", request: RefundRequest{Amount: -5, Reason: "duplicate"}, scope: cs, wantErr: &errors.ValidationError{}},
+		{name: "more than the payment", id: "pay1", request: RefundRequest{Amount: 100.01, Reason: "duplicate"}, scope: cs, wantErr: &errors.ValidationError{}},
+		{name: "unknown reason", id: "pay1", request: RefundRequest{Amount: 5, Reason: "goodwill"}, scope: cs, wantErr: &errors.ValidationError{}},
+		{name: "processing payment", id: "pay2", request: RefundRequest{Amount: 5, Reason: "duplicate"}, scope: cs, wantErr: &errors.TransitionError{}},
+		{name: "other merchant", id: "pay2", request: RefundRequest{Amount: 5, Reason: "duplicate"}, scope: MerchantScope{Role: domain.RoleCS, Merchants: []string{"Acme"}}, wantErr: &errors.NotFoundError{}},
+		{name: "unknown payment", id: "pay9", request: RefundRequest{Amount: 5, Reason: "duplicate"}, scope: cs, wantErr: &errors.NotFoundError{}},
+		{name: "admin", id: "pay1", request: RefundRequest{Amount: 5, Reason: "duplicate"}, scope: MerchantScope{Role: domain.RoleAdmin}, wantErr: &errors.ForbiddenError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.RequestRefund(tt.id, "john-cs@durianpay.id", tt.request, tt.scope)
+			require.IsType(t, tt.wantErr, err)
+		})
+	}
+	require.Empty(t, store.ListRefunds("pay1"))
+	require.Empty(t, store.ListPaymentEvents("pay1"))
+
+	refund, err := service.RequestRefund("pay1", "john-cs@durianpay.id", RefundRequest{Amount: 40, Reason: "customer_request"}, cs)
+	require.NoError(t, err)
+
+	// a refund is only found through its own payment
+	_, err = service.UpdateRefund("pay3", refund.ID, "jane-operational@durianpay.id", domain.RefundStatusApproved, "", operational)
+	require.ErrorIs(t, err, ErrRefundNotFound)
+	_, err = service.UpdateRefund("pay1", "ref-unknown", "jane-operational@durianpay.id", domain.RefundStatusApproved, "", operational)
+	require.ErrorIs(t, err, ErrRefundNotFound)
+	var notFoundErr *errors.NotFoundError
+	require.ErrorAs(t, err, &notFoundErr)
+	_, err = service.UpdateRefund("pay9", refund.ID, "jane-operational@durianpay.id", domain.RefundStatusApproved, "", operational)
+	require.IsType(t, &errors.NotFoundError{}, err)
+	require.NotErrorIs(t, err, ErrRefundNotFound)
+	_, err = service.UpdateRefund("pay1", refund.ID, "jane-operational@durianpay.id", "cancelled", "", operational)
+	require.IsType(t, &errors.TransitionError{}, err)
+
+	_, err = service.UpdateRefund("pay1", refund.ID, "jane-operational@durianpay.id", domain.RefundStatusApproved, "", operational)
+	require.NoError(t, err)
+
+	// the status is left to the refund while it is open
+	_, err = service.Transition("pay1", "john-cs@durianpay.id", StatusChange{To: domain.PaymentStatusDisputed, Reason: "chargeback"}, 0, cs)
+	require.IsType(t, &errors.TransitionError{}, err)
+	detail, err := service.GetPaymentDetail("pay1", cs)
+	require.NoError(t, err)
+	require.Empty(t, detail.Transitions)
+
+	// failing it leaves the payment alone and frees the status again
+	failed, err := service.UpdateRefund("pay1", refund.ID, "jane-operational@durianpay.id", domain.RefundStatusFailed, "acquirer declined", operational)
+	require.NoError(t, err)
+	require.Equal(t, domain.RefundStatusFailed, failed.Status)
+	current, _ := store.GetPaymentById("pay1")
+	require.Equal(t, domain.PaymentStatusCompleted, current.Status)
+	_, err = service.Transition("pay1", "john-cs@durianpay.id", StatusChange{To: domain.PaymentStatusDisputed, Reason: "chargeback"}, 0, cs)
+	require.NoError(t, err)
+}
+
+func TestPaymentService_RefundDisputed(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "won", MerchantName: "Acme", Amount: 100, Status: domain.PaymentStatusCompleted}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "lost", MerchantName: "Acme", Amount: 100, Status: domain.PaymentStatusDisputed}))
+	service := NewPaymentService(store)
+	cs := MerchantScope{Role: domain.RoleCS, AllMerchants: true}
+	operational := MerchantScope{Role: domain.RoleOperational, AllMerchants: true}
+	requester, approver := "john-cs@durianpay.id", "jane-operational@durianpay.id"
+
+	refund := func(id string, amount float64, reason string) {
+		t.Helper()
+		requested, err := service.RequestRefund(id, requester, RefundRequest{Amount: amount, Reason: reason}, cs)
+		require.NoError(t, err)
+		_, err = service.UpdateRefund(id, requested.ID, approver, domain.RefundStatusApproved, "", operational)
+		require.NoError(t, err)
+		_, err = service.UpdateRefund(id, requested.ID, approver, domain.RefundStatusProcessed, "", operational)
+		require.NoError(t, err)
+	}
+
+	// a won dispute returns a partly refunded payment to partially_refunded,
+	// not to completed
+	refund("won", 40, "customer_request")
+	_, err := service.Transition("won", requester, StatusChange{To: domain.PaymentStatusDisputed, Reason: "chargeback"}, 0, cs)
+	require.NoError(t, err)
+	won, err := service.Transition("won", approver, StatusChange{To: domain.PaymentStatusCompleted, Reason: "dispute_won"}, 0, operational)
+	require.NoError(t, err)
+	require.Equal(t, domain.PaymentStatusPartiallyRefunded, won.Status)
+	events := store.ListPaymentEvents("won")
+	last := events[len(events)-1]
+	require.Equal(t, []string{domain.PaymentStatusDisputed, domain.PaymentStatusPartiallyRefunded}, []string{last.From, last.To})
+
+	// a lost dispute is refunded, partly and then in full
+	refund("lost", 40, "dispute_lost")
+	current, _ := store.GetPaymentById("lost")
+	require.Equal(t, domain.PaymentStatusPartiallyRefunded, current.Status)
+	refund("lost", 60, "dispute_lost")
+	current, _ = store.GetPaymentById("lost")
+	require.Equal(t, domain.PaymentStatusRefunded, current.Status)
+}
@@ -0,0 +1,96 @@
+package service
+
+/*
+Payment reviews. A review records who looked at a payment, when, and what
+they concluded: approved, flagged or needs follow-up, with a reason code and
+a note. Only the last review is kept on the payment, every review and revert
+is on the timeline. Sending the same conclusion again changes nothing, so
+retries are safe; a different one replaces it. A revert puts the payment back
+in the unreviewed queue and needs a note saying why.
+*/
+
+import (
+	"slices"
+	"strings"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+)
+
+// ReviewRequest is the conclusion of a review
+type ReviewRequest struct {
+	// Outcome defaults to approved
+	Outcome string
+	// Reason is optional for approvals
+	Reason string
+	Note   string
+}
+
+// reviewReasons are the reason codes each outcome accepts
+var reviewReasons = map[string][]string{
+	domain.ReviewOutcomeApproved:      {"verified", "within_policy"},
+	domain.ReviewOutcomeFlagged:       {"suspected_fraud", "amount_mismatch", "duplicate", "merchant_complaint"},
+	domain.ReviewOutcomeNeedsFollowUp: {"awaiting_merchant", "awaiting_customer", "awaiting_acquirer"},
+}
+
+// Review records the review of a payment by actor. ifMatch is the version the
+// caller last saw, 0 reviews whatever is current. A mismatch returns
+// errors.ConflictError.
+func (payment *PaymentService) Review(paymentID, actor string, request ReviewRequest, ifMatch int64, scope MerchantScope) (*domain.Payment, error) {
+	if request.Outcome == "" {
+		request.Outcome = domain.ReviewOutcomeApproved
+	}
+	if !domain.IsReviewOutcome(request.Outcome) {
+		return nil, errors.NewValidationError(": outcome must be one of " + strings.Join(domain.ReviewOutcomes, ", "))
+	}
+	reasons := reviewReasons[request.Outcome]
+	if request.Reason == "" && request.Outcome != domain.ReviewOutcomeApproved {
+		return nil, errors.NewValidationError(": reason is required for " + request.Outcome)
+	}
+	if request.Reason != "" && !slices.Contains(reasons, request.Reason) {
+		return nil, errors.NewValidationError(": reason must be one of " + strings.Join(reasons, ", "))
+	}
+	note, err := paymentNote(request.Note)
+	if err != nil {
+		return nil, err
+	}
+
+	return payment.updatePayment(paymentID, ifMatch, scope, func(_ domain.Tx, p *domain.Payment) (*domain.PaymentEvent, error) {
+		if p.Review != nil && p.Review.Outcome == request.Outcome && p.Review.Reason == request.Reason && p.Review.Note == note {
+			return nil, errUnchanged
+		}
+
+		event := newPaymentEvent(p.ID, domain.PaymentEventReviewed, actor)
+		event.Outcome, event.Reason, event.Note = request.Outcome, request.Reason, note
+		p.Reviewed = true
+		p.Review = &domain.PaymentReview{Reviewer: actor, At: event.At, Outcome: request.Outcome, Reason: request.Reason, Note: note}
+		return event, nil
+	})
+}
+
+// RevertReview marks a reviewed payment unreviewed again, note says why.
+// Reverting an unreviewed payment changes nothing. ifMatch is as for Review.
+func (payment *PaymentService) RevertReview(paymentID, actor, note string, ifMatch int64, scope MerchantScope) (*domain.Payment, error) {
+	note, err := paymentNote(note)
+	if err != nil {
+		return nil, err
+	}
+	if note == "" {
+		return nil, errors.NewValidationError(": note must not be empty")
+	}
+
+	return payment.updatePayment(paymentID, ifMatch, scope, func(_ domain.Tx, p *domain.Payment) (*domain.PaymentEvent, error) {
+		if !p.Reviewed {
+			return nil, errUnchanged
+		}
+
+		event := newPaymentEvent(p.ID, domain.PaymentEventReviewReverted, actor)
+		event.Note = note
+		if p.Review != nil {
+			event.Outcome = p.Review.Outcome
+		}
+		p.Reviewed = false
+		p.Review = nil
+		return event, nil
+	})
+}
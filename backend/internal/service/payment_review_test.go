@@ -0,0 +1,158 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentService_ReviewOutcome(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay1", MerchantName: "Acme", Status: domain.PaymentStatusCompleted}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay2", MerchantName: "Acme", Status: domain.PaymentStatusFailed}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "legacy", MerchantName: "Acme", Status: domain.PaymentStatusFailed, Reviewed: true}))
+	service := NewPaymentService(store)
+
+	flag := ReviewRequest{Outcome: domain.ReviewOutcomeFlagged, Reason: "amount_mismatch", Note: " amount differs from the acquirer report "}
+	reviewed, err := service.Review("pay1", "jane-operational@durianpay.id", flag, 1, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.True(t, reviewed.Reviewed)
+	require.Equal(t, int64(2), reviewed.Version)
+	require.Equal(t, "jane-operational@durianpay.id", reviewed.Review.Reviewer)
+	require.Equal(t, domain.ReviewOutcomeFlagged, reviewed.Review.Outcome)
+	require.Equal(t, "amount_mismatch", reviewed.Review.Reason)
+	require.Equal(t, "amount differs from the acquirer report", reviewed.Review.Note)
+	require.WithinDuration(t, time.Now(), reviewed.Review.At, time.Minute)
+
+	// the same conclusion again is a no-op, retries with the old version included
+	again, err := service.Review("pay1", "john-cs@durianpay.id", flag, 0, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), again.Version)
+	require.Equal(t, "jane-operational@durianpay.id", again.Review.Reviewer)
+	require.Len(t, store.ListPaymentEvents("pay1"), 1)
+
+	// a different one replaces it
+	approved, err := service.Review("pay1", "john-cs@durianpay.id", ReviewRequest{}, 2, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), approved.Version)
+	require.Equal(t, &domain.PaymentReview{Reviewer: "john-cs@durianpay.id", At: approved.Review.At, Outcome: domain.ReviewOutcomeApproved}, approved.Review)
+
+	events := store.ListPaymentEvents("pay1")
+	require.Len(t, events, 2)
+	require.Equal(t, domain.PaymentEventReviewed, events[0].Type)
+	require.Equal(t, domain.ReviewOutcomeFlagged, events[0].Outcome)
+	require.Equal(t, "amount_mismatch", events[0].Reason)
+	require.Equal(t, domain.ReviewOutcomeApproved, events[1].Outcome)
+
+	tests := []struct {
+		name    string
+		request ReviewRequest
+	}{
+		{name: "unknown outcome", request: ReviewRequest{Outcome: "rejected"}},
+		{name: "flag without reason", request: ReviewRequest{Outcome: domain.ReviewOutcomeFlagged}},
+		{name: "reason of another outcome", request: ReviewRequest{Outcome: domain.ReviewOutcomeNeedsFollowUp, Reason: "duplicate"}},
+		{name: "unknown approval reason", request: ReviewRequest{Reason: "looks_fine"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.Review("pay2", "jane-operational@durianpay.id", tt.request, 0, MerchantScope{AllMerchants: true})
+			require.IsType(t, &errors.ValidationError{}, err)
+		})
+	}
+
+	// payments reviewed before reviews were recorded get one on their next review
+	legacy, err := service.Review("legacy", "jane-operational@durianpay.id", ReviewRequest{}, 0, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), legacy.Version)
+	require.NotNil(t, legacy.Review)
+
+	untouched, _ := store.GetPaymentById("pay2")
+	require.False(t, untouched.Reviewed)
+	require.Nil(t, untouched.Review)
+	require.Empty(t, store.ListPaymentEvents("pay2"))
+}
+
+func TestPaymentService_RevertReview(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay1", MerchantName: "Acme", Status: domain.PaymentStatusCompleted}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay2", MerchantName: "Travel Co", Status: domain.PaymentStatusCompleted, Reviewed: true}))
+	service := NewPaymentService(store)
+
+	follow := ReviewRequest{Outcome: domain.ReviewOutcomeNeedsFollowUp, Reason: "awaiting_merchant"}
+	_, err := service.Review("pay1", "john-cs@durianpay.id", follow, 0, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+
+	_, err = service.RevertReview("pay1", "jane-operational@durianpay.id", " ", 0, MerchantScope{AllMerchants: true})
+	require.IsType(t, &errors.ValidationError{}, err)
+	_, err = service.RevertReview("pay1", "jane-operational@durianpay.id", "reviewed the wrong payment", 1, MerchantScope{AllMerchants: true})
+	require.IsType(t, &errors.ConflictError{}, err)
+	_, err = service.RevertReview("pay2", "jane-operational@durianpay.id", "reviewed the wrong payment", 0, MerchantScope{Role: "cs", Merchants: []string{"Acme"}})
+	require.IsType(t, &errors.NotFoundError{}, err)
+
+	reverted, err := service.RevertReview("pay1", "jane-operational@durianpay.id", "reviewed the wrong payment", 2, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.False(t, reverted.Reviewed)
+	require.Nil(t, reverted.Review)
+	require.Equal(t, int64(3), reverted.Version)
+
+	// reverting again changes nothing
+	again, err := service.RevertReview("pay1", "jane-operational@durianpay.id", "reviewed the wrong payment", 0, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), again.Version)
+
+	events := store.ListPaymentEvents("pay1")
+	require.Len(t, events, 2)
+	require.Equal(t, domain.PaymentEventReviewReverted, events[1].Type)
+	require.Equal(t, "jane-operational@durianpay.id", events[1].Actor)
+	require.Equal(t, domain.ReviewOutcomeNeedsFollowUp, events[1].Outcome)
+	require.Equal(t, "reviewed the wrong payment", events[1].Note)
+
+	// a payment reviewed before reviews were recorded reverts without an outcome
+	legacy, err := service.RevertReview("pay2", "jane-operational@durianpay.id", "not actually checked", 0, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.False(t, legacy.Reviewed)
+	require.Empty(t, store.ListPaymentEvents("pay2")[0].Outcome)
+}
+
+func TestPaymentService_GetListByReview(t *testing.T) {
+	store := storage.NewMemoryStore()
+	for _, id := range []string{"pay1", "pay2", "pay3", "pay4"} {
+		require.NoError(t, store.CreatePayment(&domain.Payment{ID: id, MerchantName: "Acme", Status: domain.PaymentStatusCompleted}))
+	}
+	service := NewPaymentService(store)
+
+	_, err := service.Review("pay1", "john-cs@durianpay.id", ReviewRequest{Outcome: domain.ReviewOutcomeFlagged, Reason: "duplicate"}, 0, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	_, err = service.Review("pay2", "jane-operational@durianpay.id", ReviewRequest{Outcome: domain.ReviewOutcomeFlagged, Reason: "suspected_fraud"}, 0, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	_, err = service.Review("pay3", "jane-operational@durianpay.id", ReviewRequest{}, 0, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+
+	reviewed := true
+	tests := []struct {
+		name    string
+		request ListRequest
+		wantIDs []string
+	}{
+		{name: "outcome", request: ListRequest{ReviewOutcome: domain.ReviewOutcomeFlagged}, wantIDs: []string{"pay1", "pay2"}},
+		{name: "reviewer", request: ListRequest{Reviewer: "jane-operational@durianpay.id"}, wantIDs: []string{"pay2", "pay3"}},
+		{name: "outcome and reviewer", request: ListRequest{ReviewOutcome: domain.ReviewOutcomeFlagged, Reviewer: "john-cs@durianpay.id"}, wantIDs: []string{"pay1"}},
+		{name: "reviewed and outcome", request: ListRequest{Reviewed: &reviewed, ReviewOutcome: domain.ReviewOutcomeApproved}, wantIDs: []string{"pay3"}},
+		{name: "unknown outcome", request: ListRequest{ReviewOutcome: "rejected"}, wantIDs: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.request.SortBy, tt.request.OrderBy = domain.PaymentSortAmount, domain.SortAsc
+			tt.request.Scope = MerchantScope{AllMerchants: true}
+			result := service.GetList(tt.request)
+			require.Equal(t, tt.wantIDs, paymentIDs(result.Data))
+			require.Equal(t, len(tt.wantIDs), result.Total)
+		})
+	}
+}
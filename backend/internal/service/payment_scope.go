@@ -0,0 +1,53 @@
+package service
+
+/*
+Merchant scopes. CS teams are split by merchant portfolio, so a user can be
+limited to the payments of some merchants, named directly or through merchant
+groups of the policy. The scope applies to every read and write of the
+PaymentService; a payment outside it is reported as not found, so its
+existence does not leak. Admins and scopes with AllMerchants see everything,
+any other scope without merchants or groups sees nothing.
+*/
+
+import (
+	"slices"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+)
+
+// MerchantScope is who a payment request is made for. The zero value sees
+// no payments.
+type MerchantScope struct {
+	Role           string
+	Merchants      []string
+	MerchantGroups []string
+	// AllMerchants lifts the limit of Merchants and MerchantGroups
+	AllMerchants bool
+}
+
+// SetMerchantGroups sets the merchant groups users can be limited to, by
+// name. Groups a user names that are not defined match no merchant.
+func (payment *PaymentService) SetMerchantGroups(groups map[string][]string) {
+	payment.merchantGroups = groups
+}
+
+// merchants returns the merchants scope can see, nil when it is unscoped and
+// empty when it sees none
+func (payment *PaymentService) merchants(scope MerchantScope) []string {
+	if scope.Role == domain.RoleAdmin || scope.AllMerchants {
+		return nil
+	}
+
+	merchants := append([]string{}, scope.Merchants...)
+	for _, group := range scope.MerchantGroups {
+		merchants = append(merchants, payment.merchantGroups[group]...)
+	}
+	slices.Sort(merchants)
+	return slices.Compact(merchants)
+}
+
+// inScope reports whether scope can see p
+func (payment *PaymentService) inScope(p *domain.Payment, scope MerchantScope) bool {
+	merchants := payment.merchants(scope)
+	return merchants == nil || slices.Contains(merchants, p.MerchantName)
+}
@@ -1,25 +1,45 @@
 package service
 
 import (
-	"sort"
+	common_errors "errors"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
 
 	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
 	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
-	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
 )
 
+// maxPaymentNoteLength is the longest note in characters
+const maxPaymentNoteLength = 2000
+
+// errUnchanged is returned by a mutation of updatePayment that has nothing to do
+var errUnchanged = common_errors.New("payment unchanged")
+
 type PaymentService struct {
-	store *storage.MemoryStore
+	store domain.PaymentRepository
+
+	merchantGroups map[string][]string
 }
 
 type ListRequest struct {
-	Page    int
-	Size    int
-	Status  string
-	Search  string
-	SortBy  string
-	OrderBy string
+	Page     int
+	Size     int
+	Status   string
+	Search   string
+	Reviewed *bool
+	// ReviewOutcome and Reviewer filter on the last review
+	ReviewOutcome string
+	Reviewer      string
+	SortBy        string
+	OrderBy       string
+	// Cursor is an opaque position from a previous cursor page, "" for the first page
+	Cursor string
+	// Scope limits the list to the merchants of the caller
+	Scope MerchantScope
 }
 
 type ListResult struct {
@@ -28,55 +48,105 @@ type ListResult struct {
 	Page       int               `json:"page"`
 	TotalPages int               `json:"total_pages"`
 	Data       []*domain.Payment `json:"data"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+	PrevCursor string            `json:"prev_cursor,omitempty"`
 }
 
-func NewPaymentService(store *storage.MemoryStore) *PaymentService {
+// PaymentDetail is a payment with its activity timeline, oldest event first,
+// the status transitions the caller may make, the reason codes of each
+// review outcome and the refunds of the payment
+type PaymentDetail struct {
+	Payment       *domain.Payment        `json:"payment"`
+	Timeline      []*domain.PaymentEvent `json:"timeline"`
+	Transitions   []PaymentTransition    `json:"transitions"`
+	ReviewReasons map[string][]string    `json:"review_reasons"`
+	Refunds       []*domain.Refund       `json:"refunds"`
+	RefundReasons []string               `json:"refund_reasons"`
+}
+
+func NewPaymentService(store domain.PaymentRepository) *PaymentService {
 	return &PaymentService{store: store}
 }
 
 func (payment *PaymentService) GetTotalByFilter(request ListRequest) int {
-	filtered := payment.getListPayment(request)
-	return len(filtered)
-}
-
-func (payment *PaymentService) GetStatusSummary() (int, int, int) {
-	all := payment.store.GetPaymentList()
-	completed, process, failed := 0, 0, 0
-	for _, paymentData := range all {
-		switch paymentData.Status {
-		case "completed":
-			completed++
-		case "processing":
-			process++
-		case "failed":
-			failed++
-		}
-	}
+	return payment.store.QueryPayments(payment.query(request)).Total
+}
 
-	return completed, process, failed
+// GetStatusSummary counts the completed, processing and failed payments scope
+// can see
+func (payment *PaymentService) GetStatusSummary(scope MerchantScope) (int, int, int) {
+	counts := payment.store.CountPaymentsByStatus(payment.merchants(scope))
+	return counts[domain.PaymentStatusCompleted], counts[domain.PaymentStatusProcessing], counts[domain.PaymentStatusFailed]
 }
 
-func (payment *PaymentService) GetList(request ListRequest) ListResult {
-	filtered := payment.getListPayment(request)
+// GetPayment returns a payment scope can see, any other is a NotFoundError
+func (payment *PaymentService) GetPayment(paymentID string, scope MerchantScope) (*domain.Payment, error) {
+	current, ok := payment.store.GetPaymentById(paymentID)
+	if !ok || !payment.inScope(current, scope) {
+		return nil, errors.NewNotFoundError("paymentId: " + paymentID)
+	}
+	return current, nil
+}
 
-	switch request.SortBy {
-	case "amount":
-		sort.Slice(filtered, func(i, j int) bool {
-			if request.OrderBy == "asc" {
-				return filtered[i].Amount < filtered[j].Amount
-			}
+// GetPaymentDetail returns a payment scope can see with its timeline.
+// Payments stored before timelines were recorded get a created event at
+// their date.
+func (payment *PaymentService) GetPaymentDetail(paymentID string, scope MerchantScope) (*PaymentDetail, error) {
+	current, err := payment.GetPayment(paymentID, scope)
+	if err != nil {
+		return nil, err
+	}
 
-			return filtered[i].Amount > filtered[j].Amount
-		})
-	default:
-		sort.Slice(filtered, func(i, j int) bool {
-			if request.OrderBy == "asc" {
-				return filtered[i].Date.Before(filtered[j].Date)
-			}
-			return filtered[i].Date.After(filtered[j].Date)
-		})
+	timeline := payment.store.ListPaymentEvents(paymentID)
+	if len(timeline) == 0 || timeline[0].Type != domain.PaymentEventCreated {
+		created := &domain.PaymentEvent{PaymentID: paymentID, Type: domain.PaymentEventCreated, At: current.Date}
+		timeline = append([]*domain.PaymentEvent{created}, timeline...)
+	}
+
+	// the status is left to an open refund
+	refunds := payment.store.ListRefunds(paymentID)
+	transitions := Transitions(current.Status, scope.Role)
+	if hasOpenRefund(refunds) {
+		transitions = []PaymentTransition{}
 	}
 
+	return &PaymentDetail{
+		Payment:       current,
+		Timeline:      timeline,
+		Transitions:   transitions,
+		ReviewReasons: reviewReasons,
+		Refunds:       refunds,
+		RefundReasons: refundReasons,
+	}, nil
+}
+
+// AddNote adds a note by actor to the timeline of a payment scope can see
+func (payment *PaymentService) AddNote(paymentID, actor, note string, scope MerchantScope) (*domain.PaymentEvent, error) {
+	note, err := paymentNote(note)
+	if err != nil {
+		return nil, err
+	}
+	if note == "" {
+		return nil, errors.NewValidationError(": note must not be empty")
+	}
+
+	event := newPaymentEvent(paymentID, domain.PaymentEventNote, actor)
+	event.Note = note
+	err = payment.store.Update(func(tx domain.Tx) error {
+		current, ok := tx.GetPaymentById(paymentID)
+		if !ok || !payment.inScope(current, scope) {
+			return errors.NewNotFoundError("paymentId: " + paymentID)
+		}
+		return tx.AddPaymentEvent(event)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+func (payment *PaymentService) GetList(request ListRequest) ListResult {
 	if request.Size <= 0 {
 		request.Size = 10
 	}
@@ -85,58 +155,166 @@ func (payment *PaymentService) GetList(request ListRequest) ListResult {
 		request.Page = 1
 	}
 
-	start := (request.Page - 1) * request.Size
-	total := len(filtered)
-	if start > total {
-		start = total
-	}
+	query := payment.query(request)
+	query.Offset = (request.Page - 1) * request.Size
+	query.Limit = request.Size
 
-	end := start + request.Size
-	if end > total {
-		end = total
-	}
+	page := payment.store.QueryPayments(query)
 
-	perItems := filtered[start:end]
 	totalPage := 0
-	if total > 0 {
-		totalPage = (total + request.Size - 1) / request.Size
+	if page.Total > 0 {
+		totalPage = (page.Total + request.Size - 1) / request.Size
 	}
 
 	return ListResult{
-		Total:      total,
+		Total:      page.Total,
 		Size:       request.Size,
 		Page:       request.Page,
 		TotalPages: totalPage,
-		Data:       perItems,
+		Data:       page.Items,
 	}
 }
 
-func (payment *PaymentService) Review(paymentID string) error {
-	paymentResult, ok := payment.store.GetPaymentById(paymentID)
-	if !ok {
-		return errors.NewNotFoundError("paymentId: " + paymentID)
+// GetCursorList is keyset pagination: each page is anchored on the sort key and
+// ID of its neighbour, so payments arriving or changing status between page
+// loads neither skip nor repeat rows. The sort is taken from the cursor once
+// one is given.
+func (payment *PaymentService) GetCursorList(request ListRequest) (ListResult, error) {
+	if request.Size <= 0 {
+		request.Size = 10
 	}
 
-	paymentResult.Reviewed = true
-	payment.store.UpdatePayment(paymentResult)
-	return nil
+	query := payment.query(request)
+	if query.SortBy != domain.PaymentSortAmount {
+		query.SortBy = domain.PaymentSortDate
+	}
+	if query.Order != domain.SortAsc {
+		query.Order = domain.SortDesc
+	}
+	query.Limit = request.Size
+
+	var cursor pageCursor
+	if request.Cursor != "" {
+		var err error
+		cursor, err = decodePageCursor(request.Cursor)
+		if err != nil {
+			return ListResult{}, err
+		}
+
+		query.SortBy, query.Order = cursor.SortBy, cursor.Order
+		query.Cursor, _ = cursor.position()
+	}
+
+	page := payment.store.QueryPayments(query)
+	result := ListResult{
+		Total: page.Total,
+		Size:  request.Size,
+		Data:  page.Items,
+	}
+
+	// the first page has no cursor, there is more after it when it is not everything
+	hasNext := page.HasMore || (query.Cursor == nil && page.Total > len(page.Items))
+	hasPrev := query.Cursor != nil
+	if query.Cursor != nil && query.Cursor.Backward {
+		hasNext, hasPrev = true, page.HasMore
+	}
+
+	if len(page.Items) == 0 {
+		// ran off the end, offer the way back from where the client stood
+		if query.Cursor != nil && !query.Cursor.Backward {
+			back := cursor
+			back.Backward = true
+			result.PrevCursor = back.encode()
+		}
+		return result, nil
+	}
+
+	if hasNext {
+		result.NextCursor = newPageCursor(query.SortBy, query.Order, page.Items[len(page.Items)-1], false).encode()
+	}
+	if hasPrev {
+		result.PrevCursor = newPageCursor(query.SortBy, query.Order, page.Items[0], true).encode()
+	}
+
+	return result, nil
 }
 
 // private
-func (payment *PaymentService) getListPayment(request ListRequest) []*domain.Payment {
 
-	all := payment.store.GetPaymentList()
-	filtered := []*domain.Payment{}
-	for _, paymentData := range all {
-		if request.Status != "" && request.Status != paymentData.Status {
-			continue
+// updatePayment is the read-modify-write used by every payment mutation. It
+// runs in a store transaction, so no other write can land between the read
+// and the write. Payments outside scope are not found. mutate reads anything
+// else it needs through tx and returns the event to add to the timeline, if
+// any, or an error to abort; errUnchanged returns the payment as it is without
+// writing.
+func (payment *PaymentService) updatePayment(paymentID string, ifMatch int64, scope MerchantScope, mutate func(domain.Tx, *domain.Payment) (*domain.PaymentEvent, error)) (*domain.Payment, error) {
+	var updated *domain.Payment
+
+	err := payment.store.Update(func(tx domain.Tx) error {
+		current, ok := tx.GetPaymentById(paymentID)
+		if !ok || !payment.inScope(current, scope) {
+			return errors.NewNotFoundError("paymentId: " + paymentID)
 		}
-		if request.Search != "" && !strings.Contains(paymentData.ID, request.Search) {
-			continue
+
+		if ifMatch != 0 && current.Version != ifMatch {
+			return errors.NewConflictError(": paymentId: " + paymentID)
 		}
 
-		filtered = append(filtered, paymentData)
+		event, err := mutate(tx, current)
+		if err == errUnchanged {
+			updated = current
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.UpdatePayment(current); err != nil {
+			return err
+		}
+		if event != nil {
+			if err := tx.AddPaymentEvent(event); err != nil {
+				return err
+			}
+		}
+
+		updated = current
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+// paymentNote trims note and checks its length
+func paymentNote(note string) (string, error) {
+	note = strings.TrimSpace(note)
+	if utf8.RuneCountInString(note) > maxPaymentNoteLength {
+		return "", errors.NewValidationError(": note must be at most " + strconv.Itoa(maxPaymentNoteLength) + " characters")
 	}
+	return note, nil
+}
+
+func newPaymentEvent(paymentID, eventType, actor string) *domain.PaymentEvent {
+	return &domain.PaymentEvent{ID: uuid.NewString(), PaymentID: paymentID, Type: eventType, Actor: actor, At: time.Now()}
+}
+
+// query is the store query of request, limited to its scope
+func (payment *PaymentService) query(request ListRequest) domain.PaymentQuery {
+	query := request.query()
+	query.Merchants = payment.merchants(request.Scope)
+	return query
+}
 
-	return filtered
+func (request ListRequest) query() domain.PaymentQuery {
+	return domain.PaymentQuery{
+		Status:        request.Status,
+		Search:        request.Search,
+		Reviewed:      request.Reviewed,
+		ReviewOutcome: request.ReviewOutcome,
+		Reviewer:      request.Reviewer,
+		SortBy:        request.SortBy,
+		Order:         request.OrderBy,
+	}
 }
@@ -1,10 +1,15 @@
 package service
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
 	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
 	"github.com/stretchr/testify/require"
 )
@@ -12,7 +17,6 @@ import (
 func TestPaymentService_GetList(t *testing.T) {
 	// Create a memory store with test data
 	store := storage.NewMemoryStore()
-	store.ClearPayments() // Clear seeded payments
 	now := time.Now()
 
 	testPayments := []*domain.Payment{
@@ -138,6 +142,7 @@ func TestPaymentService_GetList(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			tt.request.Scope = MerchantScope{AllMerchants: true}
 			result := service.GetList(tt.request)
 
 			require.Equal(t, tt.want, len(result.Data), "expected %d items, got %d", tt.want, len(result.Data))
@@ -165,7 +170,6 @@ func TestPaymentService_GetList(t *testing.T) {
 
 func TestPaymentService_GetStatusSummary(t *testing.T) {
 	store := storage.NewMemoryStore()
-	store.ClearPayments() // Clear seeded payments
 	now := time.Now()
 
 	testPayments := []*domain.Payment{
@@ -181,7 +185,7 @@ func TestPaymentService_GetStatusSummary(t *testing.T) {
 	}
 
 	service := NewPaymentService(store)
-	completed, processing, failed := service.GetStatusSummary()
+	completed, processing, failed := service.GetStatusSummary(MerchantScope{AllMerchants: true})
 
 	require.Equal(t, 3, completed, "expected 3 completed payments")
 	require.Equal(t, 1, processing, "expected 1 processing payment")
@@ -190,7 +194,7 @@ func TestPaymentService_GetStatusSummary(t *testing.T) {
 
 func TestPaymentService_Review(t *testing.T) {
 	store := storage.NewMemoryStore()
-	store.ClearPayments() // Clear seeded payments
+	require.NoError(t, seed.Apply(store, seed.Demo()))
 	service := NewPaymentService(store)
 
 	// Test successful review
@@ -201,22 +205,50 @@ func TestPaymentService_Review(t *testing.T) {
 	}
 	store.UpdatePayment(payment)
 
-	err := service.Review("test1")
+	reviewed, err := service.Review("test1", "jane-operational@durianpay.id", ReviewRequest{}, 0, MerchantScope{AllMerchants: true})
 	require.NoError(t, err)
+	require.True(t, reviewed.Reviewed)
+	require.Equal(t, int64(2), reviewed.Version)
 
 	updated, exists := store.GetPaymentById("test1")
 	require.True(t, exists)
 	require.True(t, updated.Reviewed)
 
 	// Test review non-existent payment
-	err = service.Review("nonexistent")
+	_, err = service.Review("nonexistent", "jane-operational@durianpay.id", ReviewRequest{}, 0, MerchantScope{AllMerchants: true})
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "paymentId: nonexistent")
 }
 
+func TestPaymentService_ReviewIfMatch(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewPaymentService(store)
+
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "test1", Status: "failed"}))
+
+	// another user changed the payment after version 1 was read
+	other, _ := store.GetPaymentById("test1")
+	changed := *other
+	changed.Status = "completed"
+	require.NoError(t, store.UpdatePayment(&changed))
+
+	_, err := service.Review("test1", "jane-operational@durianpay.id", ReviewRequest{}, 1, MerchantScope{AllMerchants: true})
+	var conflictErr *errors.ConflictError
+	require.ErrorAs(t, err, &conflictErr)
+
+	current, _ := store.GetPaymentById("test1")
+	require.False(t, current.Reviewed)
+
+	reviewed, err := service.Review("test1", "jane-operational@durianpay.id", ReviewRequest{}, 2, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.True(t, reviewed.Reviewed)
+	require.Equal(t, "completed", reviewed.Status)
+	require.Equal(t, int64(3), reviewed.Version)
+}
+
 func TestPaymentService_GetTotalByFilter(t *testing.T) {
 	store := storage.NewMemoryStore()
-	store.ClearPayments() // Clear seeded payments
 	now := time.Now()
 
 	testPayments := []*domain.Payment{
@@ -267,8 +299,352 @@ func TestPaymentService_GetTotalByFilter(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			tt.request.Scope = MerchantScope{AllMerchants: true}
 			got := service.GetTotalByFilter(tt.request)
 			require.Equal(t, tt.want, got)
 		})
 	}
 }
+
+func TestPaymentService_GetCursorList(t *testing.T) {
+	store := storage.NewMemoryStore()
+	now := time.Now()
+
+	for i := 1; i <= 5; i++ {
+		store.UpdatePayment(&domain.Payment{
+			ID:     fmt.Sprintf("payment%d", i),
+			Date:   now.Add(-time.Duration(i) * time.Hour), // payment1 is the newest
+			Status: "failed",
+		})
+	}
+
+	service := NewPaymentService(store)
+
+	first, err := service.GetCursorList(ListRequest{Size: 2, Status: "failed", Scope: MerchantScope{AllMerchants: true}})
+	require.NoError(t, err)
+	require.Equal(t, 5, first.Total)
+	require.Equal(t, []string{"payment1", "payment2"}, paymentIDs(first.Data))
+	require.NotEmpty(t, first.NextCursor)
+	require.Empty(t, first.PrevCursor)
+
+	// a new payment on top and one leaving the filtered set must not shift the next page
+	store.UpdatePayment(&domain.Payment{ID: "payment0", Date: now, Status: "failed"})
+	moved, _ := store.GetPaymentById("payment2")
+	moved.Status = "completed"
+	store.UpdatePayment(moved)
+
+	second, err := service.GetCursorList(ListRequest{Size: 2, Status: "failed", Cursor: first.NextCursor, Scope: MerchantScope{AllMerchants: true}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"payment3", "payment4"}, paymentIDs(second.Data))
+	require.NotEmpty(t, second.NextCursor)
+	require.NotEmpty(t, second.PrevCursor)
+
+	last, err := service.GetCursorList(ListRequest{Size: 2, Status: "failed", Cursor: second.NextCursor, Scope: MerchantScope{AllMerchants: true}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"payment5"}, paymentIDs(last.Data))
+	require.Empty(t, last.NextCursor)
+
+	back, err := service.GetCursorList(ListRequest{Size: 2, Status: "failed", Cursor: second.PrevCursor, Scope: MerchantScope{AllMerchants: true}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"payment0", "payment1"}, paymentIDs(back.Data))
+	require.Empty(t, back.PrevCursor)
+	require.NotEmpty(t, back.NextCursor)
+
+	// the cursor keeps the sort it was issued with
+	amountFirst, err := service.GetCursorList(ListRequest{Size: 1, SortBy: "amount", OrderBy: "asc", Scope: MerchantScope{AllMerchants: true}})
+	require.NoError(t, err)
+	followed, err := service.GetCursorList(ListRequest{Size: 1, Cursor: amountFirst.NextCursor, Scope: MerchantScope{AllMerchants: true}})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, followed.Data[0].Amount, amountFirst.Data[0].Amount)
+
+	_, err = service.GetCursorList(ListRequest{Cursor: "not-a-cursor", Scope: MerchantScope{AllMerchants: true}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cursor is malformed")
+
+	// amounts have to be finite to order anything
+	for _, key := range []string{"NaN", "Inf", "-Inf", "1e999"} {
+		cursor := pageCursor{SortBy: domain.PaymentSortAmount, Order: domain.SortAsc, Key: key, ID: "payment1"}
+		_, err = service.GetCursorList(ListRequest{Cursor: cursor.encode(), Scope: MerchantScope{AllMerchants: true}})
+		require.IsType(t, &errors.ValidationError{}, err, key)
+		require.Contains(t, err.Error(), "cursor is malformed", key)
+	}
+}
+
+func paymentIDs(payments []*domain.Payment) []string {
+	ids := make([]string, 0, len(payments))
+	for _, p := range payments {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// fakePaymentRepository is a minimal domain.PaymentRepository that records updates
+// Review used to flip Reviewed on the pointer the store handed out, racing
+// with every list reader. Run with -race.
+func TestPaymentService_ConcurrentReviewAndList(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewPaymentService(store)
+	payments := store.GetPaymentList()
+
+	var wg sync.WaitGroup
+	for _, p := range payments {
+		wg.Add(2)
+		go func(id string) {
+			defer wg.Done()
+			_, err := service.Review(id, "jane-operational@durianpay.id", ReviewRequest{}, 0, MerchantScope{AllMerchants: true})
+			require.NoError(t, err)
+		}(p.ID)
+		go func() {
+			defer wg.Done()
+			for _, listed := range service.GetList(ListRequest{Size: 50, Scope: MerchantScope{AllMerchants: true}}).Data {
+				_ = listed.Reviewed
+			}
+		}()
+	}
+	wg.Wait()
+
+	reviewed := true
+	require.Equal(t, len(payments), service.GetTotalByFilter(ListRequest{Reviewed: &reviewed, Scope: MerchantScope{AllMerchants: true}}))
+}
+
+type fakePaymentRepository struct {
+	payments map[string]*domain.Payment
+	updated  []string
+	events   []*domain.PaymentEvent
+}
+
+func (fake *fakePaymentRepository) GetPaymentList() []*domain.Payment {
+	list := make([]*domain.Payment, 0, len(fake.payments))
+	for _, p := range fake.payments {
+		list = append(list, p)
+	}
+	return list
+}
+
+func (fake *fakePaymentRepository) GetPaymentById(id string) (*domain.Payment, bool) {
+	p, ok := fake.payments[id]
+	return p, ok
+}
+
+func (fake *fakePaymentRepository) CreatePayment(payment *domain.Payment) error {
+	fake.payments[payment.ID] = payment
+	return nil
+}
+
+func (fake *fakePaymentRepository) UpdatePayment(payment *domain.Payment) error {
+	fake.updated = append(fake.updated, payment.ID)
+	fake.payments[payment.ID] = payment
+	return nil
+}
+
+func (fake *fakePaymentRepository) DeletePayment(id string) error {
+	delete(fake.payments, id)
+	return nil
+}
+
+func (fake *fakePaymentRepository) QueryPayments(query domain.PaymentQuery) domain.PaymentPage {
+	return domain.PaymentPage{Total: len(fake.payments)}
+}
+
+func (fake *fakePaymentRepository) CountPaymentsByStatus(merchants []string) map[string]int {
+	return map[string]int{}
+}
+
+func (fake *fakePaymentRepository) ListPaymentEvents(paymentID string) []*domain.PaymentEvent {
+	return fake.events
+}
+
+func (fake *fakePaymentRepository) AddPaymentEvent(event *domain.PaymentEvent) error {
+	fake.events = append(fake.events, event)
+	return nil
+}
+
+func (fake *fakePaymentRepository) ListRefunds(paymentID string) []*domain.Refund {
+	return []*domain.Refund{}
+}
+
+// the fake is single-threaded, a transaction is the repository itself
+func (fake *fakePaymentRepository) Update(fn func(tx domain.Tx) error) error {
+	return fn(fakeTx{fake})
+}
+
+type fakeTx struct {
+	*fakePaymentRepository
+}
+
+func (fakeTx) GetUserByEmail(email string) (*domain.User, bool) { return nil, false }
+func (fakeTx) CreateUser(user *domain.User) error               { return nil }
+func (fakeTx) UpdateUser(user *domain.User) error               { return nil }
+func (fakeTx) DeleteUser(email string) error                    { return nil }
+
+func (fakeTx) GetRefreshToken(hash string) (*domain.RefreshToken, bool) { return nil, false }
+func (fakeTx) PutRefreshToken(token *domain.RefreshToken) error         { return nil }
+func (fakeTx) RevokeRefreshTokens(family string) error                  { return nil }
+func (fakeTx) RevokeUserRefreshTokens(email string) error               { return nil }
+func (fakeTx) RevokeToken(token *domain.RevokedToken) error             { return nil }
+
+func (fakeTx) GetPasswordReset(email string) (*domain.PasswordReset, bool) { return nil, false }
+func (fakeTx) PutPasswordReset(reset *domain.PasswordReset) error          { return nil }
+func (fakeTx) DeletePasswordReset(email string) error                      { return nil }
+
+func (fakeTx) GetLoginAttempts(key string) (*domain.LoginAttempts, bool) { return nil, false }
+func (fakeTx) PutLoginAttempts(attempts *domain.LoginAttempts) error     { return nil }
+func (fakeTx) DeleteLoginAttempts(key string) error                      { return nil }
+
+func TestPaymentService_ReviewWithFakeRepository(t *testing.T) {
+	repo := &fakePaymentRepository{payments: map[string]*domain.Payment{
+		"fake1": {ID: "fake1", Status: "failed"},
+	}}
+	service := NewPaymentService(repo)
+
+	_, err := service.Review("fake1", "jane-operational@durianpay.id", ReviewRequest{}, 0, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"fake1"}, repo.updated)
+	require.True(t, repo.payments["fake1"].Reviewed)
+
+	_, err = service.Review("missing", "jane-operational@durianpay.id", ReviewRequest{}, 0, MerchantScope{AllMerchants: true})
+	require.Error(t, err)
+	require.Len(t, repo.updated, 1)
+}
+
+func (fakeTx) GetServiceAccount(name string) (*domain.ServiceAccount, bool) { return nil, false }
+func (fakeTx) CreateServiceAccount(account *domain.ServiceAccount) error    { return nil }
+func (fakeTx) DeleteServiceAccount(name string) error                       { return nil }
+func (fakeTx) GetAPIKey(id string) (*domain.APIKey, bool)                   { return nil, false }
+func (fakeTx) PutAPIKey(key *domain.APIKey) error                           { return nil }
+
+func (fakeTx) GetRefund(id string) (*domain.Refund, bool) { return nil, false }
+func (fakeTx) PutRefund(refund *domain.Refund) error      { return nil }
+
+func (fakeTx) GetSession(id string) (*domain.Session, bool) { return nil, false }
+func (fakeTx) PutSession(session *domain.Session) error     { return nil }
+func (fakeTx) DeleteSession(id string) error                { return nil }
+func (fakeTx) DeleteUserSessions(email string) error        { return nil }
+
+func TestPaymentService_MerchantScope(t *testing.T) {
+	store := storage.NewMemoryStore()
+	now := time.Now()
+	for _, p := range []*domain.Payment{
+		{ID: "acme1", MerchantName: "Acme", Status: "completed", Date: now},
+		{ID: "acme2", MerchantName: "Acme", Status: "failed", Date: now.Add(-time.Hour)},
+		{ID: "shop1", MerchantName: "Corner Shop", Status: "processing", Date: now},
+		{ID: "travel1", MerchantName: "Travel Co", Status: "completed", Date: now},
+	} {
+		require.NoError(t, store.CreatePayment(p))
+	}
+
+	service := NewPaymentService(store)
+	service.SetMerchantGroups(map[string][]string{"retail": {"Corner Shop"}})
+
+	ids := func(payments []*domain.Payment) []string {
+		var ids []string
+		for _, p := range payments {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	scoped := MerchantScope{Role: "cs", Merchants: []string{"Acme"}, MerchantGroups: []string{"retail"}}
+	result := service.GetList(ListRequest{SortBy: "date", OrderBy: "asc", Scope: scoped})
+	require.Equal(t, 3, result.Total)
+	require.ElementsMatch(t, []string{"acme1", "acme2", "shop1"}, ids(result.Data))
+
+	cursorResult, err := service.GetCursorList(ListRequest{Status: "completed", Scope: scoped})
+	require.NoError(t, err)
+	require.Equal(t, []string{"acme1"}, ids(cursorResult.Data))
+	require.Equal(t, 1, service.GetTotalByFilter(ListRequest{Status: "failed", Scope: scoped}))
+
+	completed, processing, failed := service.GetStatusSummary(scoped)
+	require.Equal(t, []int{1, 1, 1}, []int{completed, processing, failed})
+
+	// payments of other merchants do not exist for the user
+	_, err = service.GetPayment("travel1", scoped)
+	require.IsType(t, &errors.NotFoundError{}, err)
+	_, err = service.Review("travel1", "john-cs@durianpay.id", ReviewRequest{}, 0, scoped)
+	require.IsType(t, &errors.NotFoundError{}, err)
+	untouched, _ := store.GetPaymentById("travel1")
+	require.False(t, untouched.Reviewed)
+
+	reviewed, err := service.Review("shop1", "john-cs@durianpay.id", ReviewRequest{}, 0, scoped)
+	require.NoError(t, err)
+	require.True(t, reviewed.Reviewed)
+	found, err := service.GetPayment("acme2", scoped)
+	require.NoError(t, err)
+	require.Equal(t, "Acme", found.MerchantName)
+
+	// unknown groups match nothing
+	unknown := MerchantScope{Role: "cs", MerchantGroups: []string{"missing"}}
+	require.Zero(t, service.GetList(ListRequest{Scope: unknown}).Total)
+	completed, processing, failed = service.GetStatusSummary(unknown)
+	require.Equal(t, []int{0, 0, 0}, []int{completed, processing, failed})
+
+	// users without merchants see nothing unless they are set to all merchants
+	for _, scope := range []MerchantScope{{Role: "cs"}, {Role: "operational", Merchants: []string{}}} {
+		require.Zero(t, service.GetList(ListRequest{Scope: scope}).Total)
+		completed, processing, failed = service.GetStatusSummary(scope)
+		require.Equal(t, []int{0, 0, 0}, []int{completed, processing, failed})
+		_, err = service.GetPayment("acme1", scope)
+		require.IsType(t, &errors.NotFoundError{}, err)
+		_, err = service.Review("acme1", "john-cs@durianpay.id", ReviewRequest{}, 0, scope)
+		require.IsType(t, &errors.NotFoundError{}, err)
+	}
+
+	// admins and users set to all merchants see everything
+	for _, scope := range []MerchantScope{{Role: "admin", Merchants: []string{"Acme"}}, {Role: "cs", AllMerchants: true}} {
+		require.Equal(t, 4, service.GetList(ListRequest{Scope: scope}).Total)
+		_, err = service.GetPayment("travel1", scope)
+		require.NoError(t, err)
+	}
+}
+
+func TestPaymentService_Timeline(t *testing.T) {
+	store := storage.NewMemoryStore()
+	date := time.Date(2024, time.May, 1, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay1", MerchantName: "Acme", Status: "processing", Date: date}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay2", MerchantName: "Travel Co", Status: "completed", Date: date}))
+	service := NewPaymentService(store)
+
+	// a payment from before timelines starts with its date
+	detail, err := service.GetPaymentDetail("pay1", MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.Equal(t, "pay1", detail.Payment.ID)
+	require.Len(t, detail.Timeline, 1)
+	require.Equal(t, domain.PaymentEventCreated, detail.Timeline[0].Type)
+	require.True(t, date.Equal(detail.Timeline[0].At))
+
+	_, err = service.Review("pay1", "jane-operational@durianpay.id", ReviewRequest{}, 0, MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	note, err := service.AddNote("pay1", "john-cs@durianpay.id", "  customer asked for a receipt  ", MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.Equal(t, "customer asked for a receipt", note.Note)
+
+	detail, err = service.GetPaymentDetail("pay1", MerchantScope{AllMerchants: true})
+	require.NoError(t, err)
+	require.True(t, detail.Payment.Reviewed)
+	require.Len(t, detail.Timeline, 3)
+	review := detail.Timeline[1]
+	require.Equal(t, domain.PaymentEventReviewed, review.Type)
+	require.Equal(t, "jane-operational@durianpay.id", review.Actor)
+	require.WithinDuration(t, time.Now(), review.At, time.Minute)
+	require.Equal(t, domain.PaymentEventNote, detail.Timeline[2].Type)
+	require.Equal(t, "john-cs@durianpay.id", detail.Timeline[2].Actor)
+
+	_, err = service.AddNote("pay1", "john-cs@durianpay.id", " ", MerchantScope{AllMerchants: true})
+	require.IsType(t, &errors.ValidationError{}, err)
+	_, err = service.AddNote("pay1", "john-cs@durianpay.id", strings.Repeat("a", maxPaymentNoteLength+1), MerchantScope{AllMerchants: true})
+	require.IsType(t, &errors.ValidationError{}, err)
+	_, err = service.AddNote("missing", "john-cs@durianpay.id", "note", MerchantScope{AllMerchants: true})
+	require.IsType(t, &errors.NotFoundError{}, err)
+
+	// failed reviews and other merchants leave no trace
+	_, err = service.Review("pay1", "jane-operational@durianpay.id", ReviewRequest{}, 1, MerchantScope{AllMerchants: true})
+	require.IsType(t, &errors.ConflictError{}, err)
+	scoped := MerchantScope{Role: "cs", Merchants: []string{"Acme"}}
+	_, err = service.GetPaymentDetail("pay2", scoped)
+	require.IsType(t, &errors.NotFoundError{}, err)
+	_, err = service.AddNote("pay2", "john-cs@durianpay.id", "note", scoped)
+	require.IsType(t, &errors.NotFoundError{}, err)
+	require.Empty(t, store.ListPaymentEvents("pay2"))
+	require.Len(t, store.ListPaymentEvents("pay1"), 2)
+}
@@ -0,0 +1,325 @@
+package service
+
+/*
+Service accounts are principals for machine clients such as reconciliation
+jobs. They have a role like users but no password; they authenticate with API
+keys sent as bearer tokens in place of a JWT. A key is "csk_<id>_<secret>":
+the id is stored and listed to tell keys apart, of the whole key only the
+SHA-256 is kept. Each key is scoped to a subset of the permissions its
+account's role grants.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	common_errors "errors"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/policy"
+)
+
+// APIKeyPrefix starts every API key, it tells them apart from JWTs
+const APIKeyPrefix = "csk_"
+
+const (
+	// apiKeyUsageResolution limits last-used writes to one per key and interval
+	apiKeyUsageResolution = time.Minute
+	// maxRotationGrace caps how long a rotated key keeps working
+	maxRotationGrace = 7 * 24 * time.Hour
+)
+
+var (
+	serviceAccountName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}$`)
+
+	errInvalidAPIKey = common_errors.New("Invalid API key")
+)
+
+type ServiceAccountService struct {
+	store domain.ServiceAccountRepository
+	rules *policy.Policy
+}
+
+type CreateServiceAccountRequest struct {
+	Name        string
+	Role        string
+	Description string
+}
+
+type CreateAPIKeyRequest struct {
+	Scopes []string
+	// ExpiresAt is optional, keys without one work until they are revoked
+	ExpiresAt *time.Time
+}
+
+// NewAPIKey is a freshly issued key. Secret is the key itself and is not
+// stored, it cannot be shown again.
+type NewAPIKey struct {
+	*domain.APIKey
+	Secret string
+}
+
+// NewServiceAccountService checks key scopes against the role grants of rules
+func NewServiceAccountService(store domain.ServiceAccountRepository, rules *policy.Policy) *ServiceAccountService {
+	return &ServiceAccountService{store: store, rules: rules}
+}
+
+// IsAPIKey tells whether a bearer token is an API key rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+func (accounts *ServiceAccountService) ListServiceAccounts() []*domain.ServiceAccount {
+	return accounts.store.ListServiceAccounts()
+}
+
+func (accounts *ServiceAccountService) GetServiceAccount(name string) (*domain.ServiceAccount, error) {
+	account, exists := accounts.store.GetServiceAccount(name)
+	if !exists {
+		return nil, errors.NewNotFoundError(": service account: " + name)
+	}
+	return account, nil
+}
+
+// CreateServiceAccount registers an account, actor is the admin creating it
+func (accounts *ServiceAccountService) CreateServiceAccount(actor string, request CreateServiceAccountRequest) (*domain.ServiceAccount, error) {
+	if !serviceAccountName.MatchString(request.Name) {
+		return nil, errors.NewValidationError(": name must be 2 to 63 lowercase letters, digits or dashes")
+	}
+	if err := validateRole(request.Role); err != nil {
+		return nil, err
+	}
+
+	account := &domain.ServiceAccount{
+		Name:        request.Name,
+		Role:        request.Role,
+		Description: request.Description,
+		CreatedBy:   actor,
+		CreatedAt:   time.Now(),
+	}
+	err := accounts.store.Update(func(tx domain.Tx) error {
+		return tx.CreateServiceAccount(account)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// DeleteServiceAccount removes the account, its keys stop working at once
+func (accounts *ServiceAccountService) DeleteServiceAccount(name string) error {
+	return accounts.store.Update(func(tx domain.Tx) error {
+		return tx.DeleteServiceAccount(name)
+	})
+}
+
+func (accounts *ServiceAccountService) ListAPIKeys(name string) ([]*domain.APIKey, error) {
+	if _, err := accounts.GetServiceAccount(name); err != nil {
+		return nil, err
+	}
+	return accounts.store.ListAPIKeys(name), nil
+}
+
+func (accounts *ServiceAccountService) CreateAPIKey(name string, request CreateAPIKeyRequest) (*NewAPIKey, error) {
+	now := time.Now()
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(now) {
+		return nil, errors.NewValidationError(": expires_at must be in the future")
+	}
+
+	var issued *NewAPIKey
+	err := accounts.store.Update(func(tx domain.Tx) error {
+		account, exists := tx.GetServiceAccount(name)
+		if !exists {
+			return errors.NewNotFoundError(": service account: " + name)
+		}
+
+		scopes, err := accounts.scopes(account.Role, request.Scopes)
+		if err != nil {
+			return err
+		}
+
+		issued, err = putNewAPIKey(tx, account.Name, scopes, now, request.ExpiresAt)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
+
+// RotateAPIKey replaces a key by a new one with the same scopes and
+// lifetime. The old key keeps working for grace, so clients can switch
+// over, or stops at once when grace is zero.
+func (accounts *ServiceAccountService) RotateAPIKey(name, id string, grace time.Duration) (*NewAPIKey, error) {
+	if grace < 0 || grace > maxRotationGrace {
+		return nil, errors.NewValidationError(": grace period must be between 0 and " + maxRotationGrace.String())
+	}
+
+	now := time.Now()
+	var issued *NewAPIKey
+	err := accounts.store.Update(func(tx domain.Tx) error {
+		old, err := serviceAccountKey(tx, name, id)
+		if err != nil {
+			return err
+		}
+		if !old.Active(now) {
+			return errors.NewValidationError(": key " + id + " is revoked or expired")
+		}
+
+		var expiresAt *time.Time
+		if old.ExpiresAt != nil {
+			expires := now.Add(old.ExpiresAt.Sub(old.CreatedAt))
+			expiresAt = &expires
+		}
+		issued, err = putNewAPIKey(tx, name, old.Scopes, now, expiresAt)
+		if err != nil {
+			return err
+		}
+
+		if grace == 0 {
+			old.RevokedAt = &now
+		} else if until := now.Add(grace); old.ExpiresAt == nil || until.Before(*old.ExpiresAt) {
+			old.ExpiresAt = &until
+		}
+		return tx.PutAPIKey(old)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
+
+// RevokeAPIKey stops a key, revoking it again is not an error
+func (accounts *ServiceAccountService) RevokeAPIKey(name, id string) error {
+	return accounts.store.Update(func(tx domain.Tx) error {
+		key, err := serviceAccountKey(tx, name, id)
+		if err != nil {
+			return err
+		}
+		if key.RevokedAt != nil {
+			return nil
+		}
+
+		now := time.Now()
+		key.RevokedAt = &now
+		return tx.PutAPIKey(key)
+	})
+}
+
+// scopes validates requested scopes against the grants of role, sorted and
+// without duplicates
+func (accounts *ServiceAccountService) scopes(role string, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return nil, errors.NewValidationError(": at least one scope is required")
+	}
+
+	scopes := slices.Clone(requested)
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+	for _, scope := range scopes {
+		if !accounts.rules.Allows(role, scope) {
+			return nil, errors.NewValidationError(": role " + role + " does not grant " + scope)
+		}
+	}
+	return scopes, nil
+}
+
+// serviceAccountKey reads a key, keys of another account are not found either
+func serviceAccountKey(tx domain.Tx, name, id string) (*domain.APIKey, error) {
+	key, exists := tx.GetAPIKey(id)
+	if !exists || key.Account != name {
+		return nil, errors.NewNotFoundError(": api key: " + id)
+	}
+	return key, nil
+}
+
+func putNewAPIKey(tx domain.Tx, account string, scopes []string, now time.Time, expiresAt *time.Time) (*NewAPIKey, error) {
+	id, secret, err := newAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	key := &domain.APIKey{
+		ID:        id,
+		Account:   account,
+		Hash:      hashAPIKey(secret),
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	if err := tx.PutAPIKey(key); err != nil {
+		return nil, err
+	}
+	return &NewAPIKey{APIKey: key, Secret: secret}, nil
+}
+
+// newAPIKey returns the id and the full key, 48 bits of id and 256 bits of secret
+func newAPIKey() (string, string, error) {
+	raw := make([]byte, 6+32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+
+	id := hex.EncodeToString(raw[:6])
+	return id, APIKeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(raw[6:]), nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthorizeAPIKey resolves an API key to its service account. Revoked and
+// expired keys, and keys whose account is gone, are rejected alike.
+func (auth *AuthService) AuthorizeAPIKey(raw string) (*domain.ServiceAccount, *domain.APIKey, error) {
+	id, _, found := strings.Cut(strings.TrimPrefix(raw, APIKeyPrefix), "_")
+	if !IsAPIKey(raw) || !found {
+		return nil, nil, errInvalidAPIKey
+	}
+
+	key, exists := auth.store.GetAPIKey(id)
+	if !exists || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKey(raw))) != 1 {
+		return nil, nil, errInvalidAPIKey
+	}
+
+	now := time.Now()
+	if !key.Active(now) {
+		return nil, nil, errInvalidAPIKey
+	}
+
+	account, exists := auth.store.GetServiceAccount(key.Account)
+	if !exists {
+		return nil, nil, errInvalidAPIKey
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyUsageResolution {
+		auth.touchAPIKey(key.ID, now)
+	}
+
+	return account, key, nil
+}
+
+// touchAPIKey records the use of a key. Failing to do so does not fail the
+// request.
+func (auth *AuthService) touchAPIKey(id string, now time.Time) {
+	err := auth.store.Update(func(tx domain.Tx) error {
+		key, exists := tx.GetAPIKey(id)
+		if !exists {
+			return nil
+		}
+
+		key.LastUsedAt = &now
+		return tx.PutAPIKey(key)
+	})
+	if err != nil {
+		log.Printf("auth: record use of api key %s: %v", id, err)
+	}
+}
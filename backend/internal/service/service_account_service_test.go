@@ -0,0 +1,238 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/policy"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func newServiceAccountTestService(t *testing.T) (*ServiceAccountService, *AuthService, *storage.MemoryStore) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+
+	accounts := NewServiceAccountService(store, policy.Default())
+	_, err := accounts.CreateServiceAccount("admin@durianpay.id", CreateServiceAccountRequest{Name: "recon", Role: domain.RoleOperational})
+	require.NoError(t, err)
+	return accounts, NewAuthService(store, []byte("test-secret-key")), store
+}
+
+func TestServiceAccountService_CreateServiceAccount(t *testing.T) {
+	accounts, _, _ := newServiceAccountTestService(t)
+
+	account, err := accounts.GetServiceAccount("recon")
+	require.NoError(t, err)
+	require.Equal(t, domain.RoleOperational, account.Role)
+	require.Equal(t, "admin@durianpay.id", account.CreatedBy)
+
+	tests := []struct {
+		name    string
+		request CreateServiceAccountRequest
+		wantErr error
+	}{
+		{name: "existing account", request: CreateServiceAccountRequest{Name: "recon", Role: "cs"}, wantErr: &errors.AlreadyExistsError{}},
+		{name: "unknown role", request: CreateServiceAccountRequest{Name: "exporter", Role: "root"}, wantErr: &errors.ValidationError{}},
+		{name: "email as name", request: CreateServiceAccountRequest{Name: "bot@durianpay.id", Role: "cs"}, wantErr: &errors.ValidationError{}},
+		{name: "upper case name", request: CreateServiceAccountRequest{Name: "Exporter", Role: "cs"}, wantErr: &errors.ValidationError{}},
+		{name: "short name", request: CreateServiceAccountRequest{Name: "x", Role: "cs"}, wantErr: &errors.ValidationError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := accounts.CreateServiceAccount("admin@durianpay.id", tt.request)
+			require.IsType(t, tt.wantErr, err)
+		})
+	}
+
+	_, err = accounts.GetServiceAccount("missing")
+	require.IsType(t, &errors.NotFoundError{}, err)
+}
+
+func TestServiceAccountService_CreateAPIKey(t *testing.T) {
+	accounts, auth, store := newServiceAccountTestService(t)
+
+	expires := time.Now().Add(time.Hour)
+	issued, err := accounts.CreateAPIKey("recon", CreateAPIKeyRequest{
+		Scopes:    []string{"payments:review", "payments:read", "payments:read"},
+		ExpiresAt: &expires,
+	})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(issued.Secret, APIKeyPrefix+issued.ID+"_"))
+	require.Equal(t, []string{"payments:read", "payments:review"}, issued.Scopes)
+
+	// only the hash is stored
+	stored, exists := store.GetAPIKey(issued.ID)
+	require.True(t, exists)
+	require.NotEqual(t, issued.Secret, stored.Hash)
+	require.NotContains(t, stored.Hash, strings.TrimPrefix(issued.Secret, APIKeyPrefix+issued.ID+"_"))
+
+	account, key, err := auth.AuthorizeAPIKey(issued.Secret)
+	require.NoError(t, err)
+	require.Equal(t, "recon", account.Name)
+	require.Equal(t, issued.ID, key.ID)
+
+	keys, err := accounts.ListAPIKeys("recon")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.NotNil(t, keys[0].LastUsedAt)
+
+	past := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name    string
+		account string
+		request CreateAPIKeyRequest
+		wantErr error
+	}{
+		{name: "unknown account", account: "missing", request: CreateAPIKeyRequest{Scopes: []string{"payments:read"}}, wantErr: &errors.NotFoundError{}},
+		{name: "no scopes", account: "recon", request: CreateAPIKeyRequest{}, wantErr: &errors.ValidationError{}},
+		{name: "scope beyond role", account: "recon", request: CreateAPIKeyRequest{Scopes: []string{"users:manage"}}, wantErr: &errors.ValidationError{}},
+		{name: "unknown scope", account: "recon", request: CreateAPIKeyRequest{Scopes: []string{"payments:delete"}}, wantErr: &errors.ValidationError{}},
+		{name: "expired", account: "recon", request: CreateAPIKeyRequest{Scopes: []string{"payments:read"}, ExpiresAt: &past}, wantErr: &errors.ValidationError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := accounts.CreateAPIKey(tt.account, tt.request)
+			require.IsType(t, tt.wantErr, err)
+		})
+	}
+
+	_, err = accounts.ListAPIKeys("missing")
+	require.IsType(t, &errors.NotFoundError{}, err)
+}
+
+func TestServiceAccountService_RotateAPIKey(t *testing.T) {
+	accounts, auth, store := newServiceAccountTestService(t)
+
+	expires := time.Now().Add(30 * 24 * time.Hour)
+	old, err := accounts.CreateAPIKey("recon", CreateAPIKeyRequest{Scopes: []string{"payments:read"}, ExpiresAt: &expires})
+	require.NoError(t, err)
+
+	// with a grace period both keys work for now
+	rotated, err := accounts.RotateAPIKey("recon", old.ID, time.Hour)
+	require.NoError(t, err)
+	require.NotEqual(t, old.ID, rotated.ID)
+	require.Equal(t, old.Scopes, rotated.Scopes)
+	require.WithinDuration(t, time.Now().Add(30*24*time.Hour), *rotated.ExpiresAt, time.Minute)
+
+	_, _, err = auth.AuthorizeAPIKey(old.Secret)
+	require.NoError(t, err)
+	_, _, err = auth.AuthorizeAPIKey(rotated.Secret)
+	require.NoError(t, err)
+	stored, _ := store.GetAPIKey(old.ID)
+	require.WithinDuration(t, time.Now().Add(time.Hour), *stored.ExpiresAt, time.Minute)
+
+	// without one the old key stops at once
+	again, err := accounts.RotateAPIKey("recon", rotated.ID, 0)
+	require.NoError(t, err)
+	_, _, err = auth.AuthorizeAPIKey(rotated.Secret)
+	require.Error(t, err)
+	_, _, err = auth.AuthorizeAPIKey(again.Secret)
+	require.NoError(t, err)
+
+	_, err = accounts.RotateAPIKey("recon", rotated.ID, 0)
+	require.IsType(t, &errors.ValidationError{}, err)
+	_, err = accounts.RotateAPIKey("recon", again.ID, 8*24*time.Hour)
+	require.IsType(t, &errors.ValidationError{}, err)
+	_, err = accounts.RotateAPIKey("recon", "missing", 0)
+	require.IsType(t, &errors.NotFoundError{}, err)
+
+	keys, err := accounts.ListAPIKeys("recon")
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+}
+
+func TestServiceAccountService_RevokeAndDelete(t *testing.T) {
+	accounts, auth, _ := newServiceAccountTestService(t)
+	_, err := accounts.CreateServiceAccount("admin@durianpay.id", CreateServiceAccountRequest{Name: "exporter", Role: domain.RoleCS})
+	require.NoError(t, err)
+
+	first, err := accounts.CreateAPIKey("recon", CreateAPIKeyRequest{Scopes: []string{"payments:read"}})
+	require.NoError(t, err)
+	second, err := accounts.CreateAPIKey("recon", CreateAPIKeyRequest{Scopes: []string{"payments:read"}})
+	require.NoError(t, err)
+
+	// keys are only reachable through their own account
+	require.IsType(t, &errors.NotFoundError{}, accounts.RevokeAPIKey("exporter", first.ID))
+
+	require.NoError(t, accounts.RevokeAPIKey("recon", first.ID))
+	require.NoError(t, accounts.RevokeAPIKey("recon", first.ID))
+	_, _, err = auth.AuthorizeAPIKey(first.Secret)
+	require.Error(t, err)
+	_, _, err = auth.AuthorizeAPIKey(second.Secret)
+	require.NoError(t, err)
+
+	require.NoError(t, accounts.DeleteServiceAccount("recon"))
+	_, _, err = auth.AuthorizeAPIKey(second.Secret)
+	require.Error(t, err)
+	require.IsType(t, &errors.NotFoundError{}, accounts.DeleteServiceAccount("recon"))
+}
+
+func TestAuthService_AuthorizeAPIKey(t *testing.T) {
+	accounts, auth, store := newServiceAccountTestService(t)
+
+	issued, err := accounts.CreateAPIKey("recon", CreateAPIKeyRequest{Scopes: []string{"payments:read"}})
+	require.NoError(t, err)
+
+	id, secret, _ := strings.Cut(strings.TrimPrefix(issued.Secret, APIKeyPrefix), "_")
+	for name, key := range map[string]string{
+		"empty":        "",
+		"no prefix":    id + "_" + secret,
+		"no secret":    APIKeyPrefix + id,
+		"wrong secret": APIKeyPrefix + id + "_" + strings.Repeat("A", len(secret)),
+		"unknown id":   APIKeyPrefix + "000000000000_" + secret,
+		"a jwt":        "eyJhbGciOiJIUzI1NiJ9.e30.sig",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := auth.AuthorizeAPIKey(key)
+			require.Error(t, err)
+		})
+	}
+
+	// expired keys are rejected
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		key, _ := tx.GetAPIKey(issued.ID)
+		past := time.Now().Add(-time.Second)
+		key.ExpiresAt = &past
+		return tx.PutAPIKey(key)
+	}))
+	_, _, err = auth.AuthorizeAPIKey(issued.Secret)
+	require.Error(t, err)
+}
+
+func TestAuthService_AuthorizeAPIKeyRecordsUse(t *testing.T) {
+	accounts, auth, store := newServiceAccountTestService(t)
+
+	issued, err := accounts.CreateAPIKey("recon", CreateAPIKeyRequest{Scopes: []string{"payments:read"}})
+	require.NoError(t, err)
+	stored, _ := store.GetAPIKey(issued.ID)
+	require.Nil(t, stored.LastUsedAt)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := auth.AuthorizeAPIKey(issued.Secret)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	stored, _ = store.GetAPIKey(issued.ID)
+	require.NotNil(t, stored.LastUsedAt)
+	first := *stored.LastUsedAt
+
+	// uses within apiKeyUsageResolution are not written again
+	_, _, err = auth.AuthorizeAPIKey(issued.Secret)
+	require.NoError(t, err)
+	stored, _ = store.GetAPIKey(issued.ID)
+	require.True(t, stored.LastUsedAt.Equal(first))
+}
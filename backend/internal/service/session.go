@@ -0,0 +1,136 @@
+package service
+
+/*
+Sessions are the logins of a user, one per device. A session is recorded when
+tokens are issued and shares its ID with the refresh token family; access
+tokens name it in their sid claim. Terminating a session revokes its refresh
+tokens and deletes the record, which also rejects its access tokens at once.
+Deleting a user deletes all of its sessions the same way, so they do not come
+back for a new user of the same email.
+*/
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+)
+
+const (
+	// sessionActivityResolution is how stale LastSeenAt may get, so requests
+	// do not all write to the store
+	sessionActivityResolution = time.Minute
+
+	maxUserAgentLength = 256
+)
+
+// ClientInfo describes the client a session was started or refreshed from
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+func (client ClientInfo) newSession(id, email string, expiresAt time.Time) *domain.Session {
+	now := time.Now()
+	session := &domain.Session{ID: id, Email: email, CreatedAt: now}
+	client.update(session, expiresAt)
+	return session
+}
+
+func (client ClientInfo) update(session *domain.Session, expiresAt time.Time) {
+	userAgent := client.UserAgent
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+
+	session.UserAgent = userAgent
+	session.IP = client.IP
+	session.LastSeenAt = time.Now()
+	session.ExpiresAt = expiresAt
+}
+
+// ListSessions returns the sessions of a user that have not expired, most
+// recently seen first
+func (auth *AuthService) ListSessions(email string) []*domain.Session {
+	now := time.Now()
+
+	sessions := []*domain.Session{}
+	for _, session := range auth.store.ListSessions(email) {
+		if session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// TerminateSession ends a session of the user. Sessions of other users are
+// reported as not found.
+func (auth *AuthService) TerminateSession(email, id string) error {
+	return auth.store.Update(func(tx domain.Tx) error {
+		session, exists := tx.GetSession(id)
+		if !exists || session.Email != email {
+			return errors.NewNotFoundError(": session: " + id)
+		}
+
+		return terminateSession(tx, id)
+	})
+}
+
+// TerminateOtherSessions ends every session of the user except current and
+// returns how many it ended. Sessions started meanwhile are left alone.
+func (auth *AuthService) TerminateOtherSessions(email, current string) (int, error) {
+	sessions := auth.store.ListSessions(email)
+
+	var ended int
+	err := auth.store.Update(func(tx domain.Tx) error {
+		ended = 0
+		for _, listed := range sessions {
+			if listed.ID == current {
+				continue
+			}
+			if _, exists := tx.GetSession(listed.ID); !exists {
+				continue
+			}
+			if err := terminateSession(tx, listed.ID); err != nil {
+				return err
+			}
+			ended++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return ended, nil
+}
+
+func terminateSession(tx domain.Tx, id string) error {
+	if err := tx.RevokeRefreshTokens(id); err != nil {
+		return err
+	}
+	return tx.DeleteSession(id)
+}
+
+// touchSession records activity on a session. Failing to do so does not fail
+// the request.
+func (auth *AuthService) touchSession(id string, now time.Time) {
+	session, exists := auth.store.GetSession(id)
+	if !exists || now.Sub(session.LastSeenAt) < sessionActivityResolution {
+		return
+	}
+
+	err := auth.store.Update(func(tx domain.Tx) error {
+		session, exists := tx.GetSession(id)
+		if !exists {
+			return nil
+		}
+
+		session.LastSeenAt = now
+		return tx.PutSession(session)
+	})
+	if err != nil {
+		log.Printf("auth: record activity of session %s: %v", id, err)
+	}
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthService_Sessions(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+	john, _ := store.GetUserByEmail("john-cs@durianpay.id")
+	jane, _ := store.GetUserByEmail("jane-operational@durianpay.id")
+
+	laptop, err := service.IssueTokens(john, passwordAMR, ClientInfo{UserAgent: "Firefox", IP: "10.0.0.1"})
+	require.NoError(t, err)
+	phone, err := service.IssueTokens(john, passwordAMR, ClientInfo{UserAgent: strings.Repeat("x", 1000), IP: "10.0.0.2"})
+	require.NoError(t, err)
+	janeTokens, err := service.IssueTokens(jane, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+
+	claims, err := service.ParseToken(laptop.AccessToken)
+	require.NoError(t, err)
+	laptopID, _ := claims["sid"].(string)
+	require.NotEmpty(t, laptopID)
+	claims, err = service.ParseToken(phone.AccessToken)
+	require.NoError(t, err)
+	phoneID, _ := claims["sid"].(string)
+
+	sessions := service.ListSessions("john-cs@durianpay.id")
+	require.Len(t, sessions, 2)
+	session, exists := store.GetSession(laptopID)
+	require.True(t, exists)
+	require.Equal(t, "Firefox", session.UserAgent)
+	require.Equal(t, "10.0.0.1", session.IP)
+	session, _ = store.GetSession(phoneID)
+	require.Len(t, session.UserAgent, maxUserAgentLength)
+
+	// refreshing keeps the session and records the client
+	refreshed, _, err := service.Refresh(laptop.RefreshToken, ClientInfo{UserAgent: "Firefox", IP: "10.0.0.9"})
+	require.NoError(t, err)
+	claims, err = service.ParseToken(refreshed.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, laptopID, claims["sid"])
+	session, _ = store.GetSession(laptopID)
+	require.Equal(t, "10.0.0.9", session.IP)
+
+	// other users' sessions cannot be terminated, nor can unknown ones
+	err = service.TerminateSession("jane-operational@durianpay.id", laptopID)
+	require.IsType(t, &errors.NotFoundError{}, err)
+	err = service.TerminateSession("john-cs@durianpay.id", "missing")
+	require.IsType(t, &errors.NotFoundError{}, err)
+
+	// terminating ends the refresh and the access tokens at once
+	require.NoError(t, service.TerminateSession("john-cs@durianpay.id", phoneID))
+	_, err = service.ParseToken(phone.AccessToken)
+	require.Error(t, err)
+	_, _, err = service.Refresh(phone.RefreshToken, ClientInfo{})
+	require.Error(t, err)
+	_, err = service.ParseToken(refreshed.AccessToken)
+	require.NoError(t, err)
+
+	// ending the other sessions keeps the current one and other users'
+	second, err := service.IssueTokens(john, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	ended, err := service.TerminateOtherSessions("john-cs@durianpay.id", laptopID)
+	require.NoError(t, err)
+	require.Equal(t, 1, ended)
+	_, err = service.ParseToken(second.AccessToken)
+	require.Error(t, err)
+	_, err = service.ParseToken(refreshed.AccessToken)
+	require.NoError(t, err)
+	_, err = service.ParseToken(janeTokens.AccessToken)
+	require.NoError(t, err)
+
+	sessions = service.ListSessions("john-cs@durianpay.id")
+	require.Len(t, sessions, 1)
+	require.Equal(t, laptopID, sessions[0].ID)
+
+	// logging out with the refresh token ends the session too
+	claims, err = service.ParseToken(refreshed.AccessToken)
+	require.NoError(t, err)
+	require.NoError(t, service.Logout(claims, refreshed.RefreshToken))
+	require.Empty(t, service.ListSessions("john-cs@durianpay.id"))
+}
+
+func TestAuthService_SessionOfAnotherUser(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+	john, _ := store.GetUserByEmail("john-cs@durianpay.id")
+	jane, _ := store.GetUserByEmail("jane-operational@durianpay.id")
+
+	johnTokens, err := service.IssueTokens(john, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	claims, err := service.ParseToken(johnTokens.AccessToken)
+	require.NoError(t, err)
+
+	// a token naming a session of someone else is not accepted
+	forged, err := service.generateToken(jane, passwordAMR, claims["sid"].(string))
+	require.NoError(t, err)
+	_, err = service.ParseToken(forged)
+	require.Error(t, err)
+
+	// and neither is one outside a session
+	sessionless, err := service.generateToken(jane, passwordAMR, "")
+	require.NoError(t, err)
+	_, err = service.ParseToken(sessionless)
+	require.Error(t, err)
+}
+
+func TestAuthService_RefreshRecordsLegacySession(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+	john, _ := store.GetUserByEmail("john-cs@durianpay.id")
+
+	// a refresh token family issued before sessions were recorded
+	raw, stored, err := service.newRefreshToken("legacy", john.Email, passwordAMR)
+	require.NoError(t, err)
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		return tx.PutRefreshToken(stored)
+	}))
+
+	_, _, err = service.Refresh(raw, ClientInfo{UserAgent: "curl", IP: "10.0.0.1"})
+	require.NoError(t, err)
+	session, exists := store.GetSession("legacy")
+	require.True(t, exists)
+	require.Equal(t, "curl", session.UserAgent)
+	require.Equal(t, john.Email, session.Email)
+}
+
+func TestAuthService_AuthorizeRecordsActivity(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	service := NewAuthService(store, []byte("test-secret-key"))
+	john, _ := store.GetUserByEmail("john-cs@durianpay.id")
+
+	pair, err := service.IssueTokens(john, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	claims, err := service.ParseToken(pair.AccessToken)
+	require.NoError(t, err)
+	sid := claims["sid"].(string)
+
+	// recent activity is not written again
+	before, _ := store.GetSession(sid)
+	_, _, err = service.Authorize(pair.AccessToken)
+	require.NoError(t, err)
+	session, _ := store.GetSession(sid)
+	require.Equal(t, before.LastSeenAt, session.LastSeenAt)
+
+	stale := time.Now().Add(-time.Hour)
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		session.LastSeenAt = stale
+		return tx.PutSession(session)
+	}))
+	_, _, err = service.Authorize(pair.AccessToken)
+	require.NoError(t, err)
+	session, _ = store.GetSession(sid)
+	require.True(t, session.LastSeenAt.After(stale.Add(time.Minute)))
+}
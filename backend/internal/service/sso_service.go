@@ -0,0 +1,210 @@
+package service
+
+/*
+Single sign-on through an OpenID Connect IdP. The browser is sent to the IdP
+with a PKCE challenge; the state, nonce and verifier of the attempt travel in
+a signed state token the handler keeps in a cookie until the callback. Users
+are provisioned on their first login, and their role follows their IdP
+groups on every login.
+*/
+
+import (
+	"context"
+	"crypto/subtle"
+	common_errors "errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/oidc"
+)
+
+// AMRFederated marks sessions of an SSO login when the IdP does not say how
+// the user authenticated. It is not one of the RFC 8176 values.
+const AMRFederated = "fed"
+
+const (
+	ssoStateTTL = 10 * time.Minute
+	ssoStateTyp = "oidc_state"
+)
+
+var errSSOLogin = common_errors.New("SSO login failed")
+
+// IdentityProvider is the part of oidc.Provider the SSO flow needs
+type IdentityProvider interface {
+	AuthCodeURL(ctx context.Context, state, nonce, challenge string) (string, error)
+	Exchange(ctx context.Context, code, verifier, nonce string) (*oidc.Identity, error)
+}
+
+// GroupRole grants Role to members of the IdP group Group
+type GroupRole struct {
+	Group string
+	Role  string
+}
+
+type SSOService struct {
+	provider IdentityProvider
+	auth     *AuthService
+	store    domain.UserRepository
+	// roles is ordered, the first group the user is in decides
+	roles []GroupRole
+}
+
+func NewSSOService(provider IdentityProvider, auth *AuthService, store domain.UserRepository, roles []GroupRole) (*SSOService, error) {
+	for _, mapping := range roles {
+		if err := validateRole(mapping.Role); err != nil {
+			return nil, fmt.Errorf("group %q: %w", mapping.Group, err)
+		}
+	}
+
+	return &SSOService{provider: provider, auth: auth, store: store, roles: roles}, nil
+}
+
+// ParseGroupRoles reads a mapping like "cs-admins=admin,cs-ops=operational".
+// The first group in the list the user is a member of decides their role.
+func ParseGroupRoles(raw string) ([]GroupRole, error) {
+	var roles []GroupRole
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		group, role, found := strings.Cut(entry, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !found || group == "" || role == "" {
+			return nil, fmt.Errorf("invalid group mapping %q, use group=role", entry)
+		}
+		roles = append(roles, GroupRole{Group: group, Role: role})
+	}
+	return roles, nil
+}
+
+// BeginLogin returns the IdP URL to send the browser to, and the state
+// token to hand back to CompleteLogin with the callback
+func (sso *SSOService) BeginLogin(ctx context.Context) (string, string, error) {
+	var values [3]string
+	for i := range values {
+		value, err := oidc.RandomString()
+		if err != nil {
+			return "", "", err
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	authURL, err := sso.provider.AuthCodeURL(ctx, state, nonce, oidc.Challenge(verifier))
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	stateToken, err := sso.auth.keys.Sign(jwt.MapClaims{
+		"typ":      ssoStateTyp,
+		"jti":      uuid.NewString(),
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"iat":      now.Unix(),
+		"exp":      now.Add(ssoStateTTL).Unix(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return authURL, stateToken, nil
+}
+
+// CompleteLogin handles the IdP callback: it checks state against the state
+// token of BeginLogin, redeems code and provisions the user. It returns the
+// user and the authentication methods for IssueTokens. Why a login failed is
+// only logged, the caller gets the same error each time.
+func (sso *SSOService) CompleteLogin(ctx context.Context, stateToken, state, code string) (*domain.User, []string, error) {
+	claims, err := sso.auth.parse(stateToken)
+	if err != nil || claims["typ"] != ssoStateTyp {
+		log.Printf("sso: invalid state token: %v", err)
+		return nil, nil, errSSOLogin
+	}
+
+	expected, _ := claims["state"].(string)
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(state)) != 1 {
+		log.Printf("sso: state mismatch")
+		return nil, nil, errSSOLogin
+	}
+
+	nonce, _ := claims["nonce"].(string)
+	verifier, _ := claims["verifier"].(string)
+	identity, err := sso.provider.Exchange(ctx, code, verifier, nonce)
+	if err != nil {
+		log.Printf("sso: %v", err)
+		return nil, nil, errSSOLogin
+	}
+
+	user, err := sso.provision(identity)
+	if err != nil {
+		log.Printf("sso: %s (%s): %v", identity.Email, identity.Subject, err)
+		return nil, nil, errSSOLogin
+	}
+
+	amr := identity.AMR
+	if len(amr) == 0 {
+		amr = []string{AMRFederated}
+	}
+	return user, amr, nil
+}
+
+// provision creates the user of identity on their first login and keeps
+// their role in line with their groups afterwards
+func (sso *SSOService) provision(identity *oidc.Identity) (*domain.User, error) {
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, fmt.Errorf("no verified email")
+	}
+
+	role := sso.role(identity.Groups)
+	if role == "" {
+		return nil, fmt.Errorf("none of the groups %v grants a role", identity.Groups)
+	}
+
+	var user *domain.User
+	err := sso.store.Update(func(tx domain.Tx) error {
+		existing, exists := tx.GetUserByEmail(identity.Email)
+		if !exists {
+			// without a password hash the user can only log in through the IdP,
+			// and without merchants they see no payments until an admin assigns some
+			user = &domain.User{Email: identity.Email, Role: role}
+			return tx.CreateUser(user)
+		}
+
+		if existing.Disabled {
+			return fmt.Errorf("user is disabled")
+		}
+		user = existing
+		if user.Role == role {
+			return nil
+		}
+		user.Role = role
+		return tx.UpdateUser(user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// role is the role of the first mapping whose group is among groups
+func (sso *SSOService) role(groups []string) string {
+	for _, mapping := range sso.roles {
+		for _, group := range groups {
+			if group == mapping.Group {
+				return mapping.Role
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/oidc"
+	"abasithdev.github.io/internal-cs-center-backend/internal/oidc/oidctest"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+var testGroupRoles = []GroupRole{
+	{Group: "cs-admins", Role: "admin"},
+	{Group: "cs-ops", Role: "operational"},
+	{Group: "cs-agents", Role: "cs"},
+}
+
+func newSSOTestService(t *testing.T) (*SSOService, *oidctest.IdP, *storage.MemoryStore) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+
+	idp := oidctest.NewIdP(t)
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:       idp.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "http://localhost/callback",
+	})
+
+	sso, err := NewSSOService(provider, NewAuthService(store, []byte("test-secret-key")), store, testGroupRoles)
+	require.NoError(t, err)
+	return sso, idp, store
+}
+
+// ssoLogin runs the whole flow for the claims the IdP currently hands out
+func ssoLogin(t *testing.T, sso *SSOService, idp *oidctest.IdP) (*domain.User, []string, error) {
+	authURL, stateToken, err := sso.BeginLogin(context.Background())
+	require.NoError(t, err)
+
+	callback := idp.Authorize(t, authURL)
+	return sso.CompleteLogin(context.Background(), stateToken, callback.Query().Get("state"), callback.Query().Get("code"))
+}
+
+func TestSSOService_ProvisionsUsers(t *testing.T) {
+	sso, idp, store := newSSOTestService(t)
+
+	// first login creates the user with the role of their first mapped group
+	idp.SetClaims(jwt.MapClaims{"sub": "u-1", "email": "sso@durianpay.id", "groups": []string{"everyone", "cs-agents", "cs-ops"}})
+	user, amr, err := ssoLogin(t, sso, idp)
+	require.NoError(t, err)
+	require.Equal(t, "operational", user.Role)
+	require.Equal(t, []string{AMRFederated}, amr)
+
+	stored, exists := store.GetUserByEmail("sso@durianpay.id")
+	require.True(t, exists)
+	require.Equal(t, "operational", stored.Role)
+	require.Empty(t, stored.PasswordHash)
+
+	// there is no password to log in with
+	_, err = sso.auth.Authenticate("sso@durianpay.id", "")
+	require.Error(t, err)
+
+	// later logins follow group changes, and the IdP's amr is kept
+	idp.SetClaims(jwt.MapClaims{"sub": "u-1", "email": "sso@durianpay.id", "groups": []string{"cs-agents"}, "amr": []string{"pwd", "mfa"}})
+	user, amr, err = ssoLogin(t, sso, idp)
+	require.NoError(t, err)
+	require.Equal(t, "cs", user.Role)
+	require.Equal(t, []string{"pwd", "mfa"}, amr)
+	stored, _ = store.GetUserByEmail("sso@durianpay.id")
+	require.Equal(t, "cs", stored.Role)
+
+	// existing local users are linked by email
+	idp.SetClaims(jwt.MapClaims{"sub": "u-2", "email": "john-cs@durianpay.id", "groups": "cs-admins"})
+	user, _, err = ssoLogin(t, sso, idp)
+	require.NoError(t, err)
+	require.Equal(t, "admin", user.Role)
+	stored, _ = store.GetUserByEmail("john-cs@durianpay.id")
+	require.NotEmpty(t, stored.PasswordHash, "the local password is left alone")
+}
+
+func TestSSOService_RejectsLogins(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		setup  func(t *testing.T, store *storage.MemoryStore)
+	}{
+		{name: "no mapped group", claims: jwt.MapClaims{"sub": "u-1", "email": "sso@durianpay.id", "groups": []string{"everyone"}}},
+		{name: "no groups", claims: jwt.MapClaims{"sub": "u-1", "email": "sso@durianpay.id"}},
+		{name: "no email", claims: jwt.MapClaims{"sub": "u-1", "groups": []string{"cs-agents"}}},
+		{name: "unverified email", claims: jwt.MapClaims{"sub": "u-1", "email": "john-cs@durianpay.id", "email_verified": false, "groups": []string{"cs-admins"}}},
+		{
+			name:   "disabled user",
+			claims: jwt.MapClaims{"sub": "u-1", "email": "john-cs@durianpay.id", "groups": []string{"cs-agents"}},
+			setup: func(t *testing.T, store *storage.MemoryStore) {
+				user, _ := store.GetUserByEmail("john-cs@durianpay.id")
+				user.Disabled = true
+				require.NoError(t, store.UpdateUser(user))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sso, idp, store := newSSOTestService(t)
+			if tt.setup != nil {
+				tt.setup(t, store)
+			}
+			idp.SetClaims(tt.claims)
+
+			_, _, err := ssoLogin(t, sso, idp)
+			require.Equal(t, errSSOLogin, err)
+			_, exists := store.GetUserByEmail("sso@durianpay.id")
+			require.False(t, exists)
+		})
+	}
+}
+
+func TestSSOService_ChecksState(t *testing.T) {
+	sso, idp, _ := newSSOTestService(t)
+	idp.SetClaims(jwt.MapClaims{"sub": "u-1", "email": "sso@durianpay.id", "groups": []string{"cs-agents"}})
+
+	authURL, stateToken, err := sso.BeginLogin(context.Background())
+	require.NoError(t, err)
+	callback := idp.Authorize(t, authURL)
+	code := callback.Query().Get("code")
+
+	// a callback of another attempt, as in login CSRF
+	_, otherState, err := sso.BeginLogin(context.Background())
+	require.NoError(t, err)
+	_, _, err = sso.CompleteLogin(context.Background(), otherState, callback.Query().Get("state"), code)
+	require.Equal(t, errSSOLogin, err)
+
+	_, _, err = sso.CompleteLogin(context.Background(), "", callback.Query().Get("state"), code)
+	require.Equal(t, errSSOLogin, err)
+
+	// the state token is not an access token either
+	_, err = sso.auth.ParseToken(stateToken)
+	require.Error(t, err)
+
+	_, _, err = sso.CompleteLogin(context.Background(), stateToken, callback.Query().Get("state"), code)
+	require.NoError(t, err)
+}
+
+func TestParseGroupRoles(t *testing.T) {
+	roles, err := ParseGroupRoles(" cs-admins=admin, cs-ops = operational ,,")
+	require.NoError(t, err)
+	require.Equal(t, []GroupRole{{Group: "cs-admins", Role: "admin"}, {Group: "cs-ops", Role: "operational"}}, roles)
+
+	roles, err = ParseGroupRoles("")
+	require.NoError(t, err)
+	require.Empty(t, roles)
+
+	_, err = ParseGroupRoles("cs-admins")
+	require.ErrorContains(t, err, "use group=role")
+
+	_, err = NewSSOService(nil, nil, nil, []GroupRole{{Group: "cs-admins", Role: "root"}})
+	require.ErrorContains(t, err, `group "cs-admins"`)
+}
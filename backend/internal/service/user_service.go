@@ -0,0 +1,254 @@
+package service
+
+import (
+	"net/mail"
+	"slices"
+	"strings"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/password"
+)
+
+type UserService struct {
+	store          domain.UserRepository
+	passwordPolicy password.Policy
+}
+
+type CreateUserRequest struct {
+	Email    string
+	Password string
+	Role     string
+	// MustChangePassword makes the user replace the password on first login
+	MustChangePassword bool
+	// Merchants and MerchantGroups limit the payments the user sees,
+	// AllMerchants lets them see every merchant
+	Merchants      []string
+	MerchantGroups []string
+	AllMerchants   bool
+}
+
+// UpdateUserRequest changes the fields that are set and leaves the rest alone
+type UpdateUserRequest struct {
+	Role     *string
+	Disabled *bool
+	// MustChangePassword makes the user choose a new password at their next
+	// password login
+	MustChangePassword *bool
+	// Merchants and MerchantGroups replace the lists of the user. A user
+	// with neither sees no payments unless AllMerchants is set.
+	Merchants      *[]string
+	MerchantGroups *[]string
+	AllMerchants   *bool
+}
+
+func NewUserService(store domain.UserRepository) *UserService {
+	return &UserService{store: store, passwordPolicy: password.DefaultPolicy}
+}
+
+// SetPasswordPolicy replaces password.DefaultPolicy
+func (users *UserService) SetPasswordPolicy(policy password.Policy) {
+	users.passwordPolicy = policy
+}
+
+func (users *UserService) ListUsers() []*domain.User {
+	return users.store.ListUsers()
+}
+
+func (users *UserService) GetUser(email string) (*domain.User, error) {
+	user, exists := users.store.GetUserByEmail(email)
+	if !exists {
+		return nil, errors.NewNotFoundError(": email: " + email)
+	}
+	return user, nil
+}
+
+func (users *UserService) CreateUser(request CreateUserRequest) (*domain.User, error) {
+	address, err := mail.ParseAddress(request.Email)
+	if err != nil || address.Address != request.Email {
+		return nil, errors.NewValidationError(": email " + request.Email + " is not an email address")
+	}
+	if err := validateRole(request.Role); err != nil {
+		return nil, err
+	}
+	if err := users.passwordPolicy.Validate(request.Password, localPart(request.Email)); err != nil {
+		return nil, errors.NewValidationError(": " + err.Error())
+	}
+	merchants, err := merchantNames("merchants", request.Merchants)
+	if err != nil {
+		return nil, err
+	}
+	merchantGroups, err := merchantNames("merchant_groups", request.MerchantGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := password.Hash(request.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &domain.User{
+		Email:        request.Email,
+		PasswordHash: hash,
+		Role:         request.Role,
+
+		MustChangePassword: request.MustChangePassword,
+		Merchants:          merchants,
+		MerchantGroups:     merchantGroups,
+		AllMerchants:       request.AllMerchants,
+	}
+	if err := users.store.CreateUser(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UpdateUser changes the role, disabled or must change password flag, or the
+// merchants of a user. actor is the admin making the change, who cannot lock
+// themselves out.
+func (users *UserService) UpdateUser(actor, email string, request UpdateUserRequest) (*domain.User, error) {
+	if request.Role != nil {
+		if err := validateRole(*request.Role); err != nil {
+			return nil, err
+		}
+	}
+	if request.Merchants != nil {
+		merchants, err := merchantNames("merchants", *request.Merchants)
+		if err != nil {
+			return nil, err
+		}
+		request.Merchants = &merchants
+	}
+	if request.MerchantGroups != nil {
+		merchantGroups, err := merchantNames("merchant_groups", *request.MerchantGroups)
+		if err != nil {
+			return nil, err
+		}
+		request.MerchantGroups = &merchantGroups
+	}
+
+	if actor == email {
+		if request.Role != nil && *request.Role != domain.RoleAdmin {
+			return nil, errors.NewValidationError(": you cannot change your own role")
+		}
+		if request.Disabled != nil && *request.Disabled {
+			return nil, errors.NewValidationError(": you cannot disable your own account")
+		}
+	}
+
+	var updated *domain.User
+	err := users.store.Update(func(tx domain.Tx) error {
+		user, exists := tx.GetUserByEmail(email)
+		if !exists {
+			return errors.NewNotFoundError(": email: " + email)
+		}
+
+		if request.Role != nil {
+			user.Role = *request.Role
+		}
+		if request.Disabled != nil {
+			user.Disabled = *request.Disabled
+		}
+		if request.MustChangePassword != nil {
+			user.MustChangePassword = *request.MustChangePassword
+		}
+		if request.Merchants != nil {
+			user.Merchants = *request.Merchants
+		}
+		if request.MerchantGroups != nil {
+			user.MerchantGroups = *request.MerchantGroups
+		}
+		if request.AllMerchants != nil {
+			user.AllMerchants = *request.AllMerchants
+		}
+
+		updated = user
+		return tx.UpdateUser(user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteUser removes the account together with everything that could still
+// act for it: its refresh tokens, sessions, login attempts and pending
+// password reset. Tokens issued to it stay dead when the email is reused.
+func (users *UserService) DeleteUser(actor, email string) error {
+	if actor == email {
+		return errors.NewValidationError(": you cannot delete your own account")
+	}
+	return users.store.Update(func(tx domain.Tx) error {
+		if err := tx.DeleteUser(email); err != nil {
+			return err
+		}
+		if err := tx.RevokeUserRefreshTokens(email); err != nil {
+			return err
+		}
+		if err := tx.DeleteUserSessions(email); err != nil {
+			return err
+		}
+		if err := tx.DeleteLoginAttempts(accountKey(email)); err != nil {
+			return err
+		}
+		return tx.DeletePasswordReset(email)
+	})
+}
+
+// UnlockUser lifts a login lockout of the account before its cooldown ends.
+// Lockouts of client addresses are left alone.
+func (users *UserService) UnlockUser(email string) error {
+	return users.store.Update(func(tx domain.Tx) error {
+		if _, exists := tx.GetUserByEmail(email); !exists {
+			return errors.NewNotFoundError(": email: " + email)
+		}
+		return tx.DeleteLoginAttempts(accountKey(email))
+	})
+}
+
+// ResetMFA turns MFA off for a user who lost both their authenticator and
+// their recovery codes, they can enrol again after their next login
+func (users *UserService) ResetMFA(email string) error {
+	return users.store.Update(func(tx domain.Tx) error {
+		user, exists := tx.GetUserByEmail(email)
+		if !exists {
+			return errors.NewNotFoundError(": email: " + email)
+		}
+
+		clearMFA(user)
+		if err := tx.UpdateUser(user); err != nil {
+			return err
+		}
+		return tx.DeleteLoginAttempts(mfaKey(email))
+	})
+}
+
+// localPart is the part of email before the @, which passwords must not contain
+func localPart(email string) string {
+	name, _, _ := strings.Cut(email, "@")
+	return name
+}
+
+// merchantNames trims and dedupes the merchant or group names of field, an
+// empty list is nil
+func merchantNames(field string, names []string) ([]string, error) {
+	var cleaned []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, "\r\n") {
+			return nil, errors.NewValidationError(": " + field + " must not contain empty names or line breaks")
+		}
+		if !slices.Contains(cleaned, name) {
+			cleaned = append(cleaned, name)
+		}
+	}
+	return cleaned, nil
+}
+
+func validateRole(role string) error {
+	if !domain.IsRole(role) {
+		return errors.NewValidationError(": role must be one of " + strings.Join(domain.Roles, ", "))
+	}
+	return nil
+}
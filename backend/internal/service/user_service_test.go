@@ -0,0 +1,186 @@
+package service
+
+import (
+	common_errors "errors"
+	"testing"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/password"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func newUserTestService(t *testing.T) (*UserService, *storage.MemoryStore) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	return NewUserService(store), store
+}
+
+func TestUserService_CreateUser(t *testing.T) {
+	users, store := newUserTestService(t)
+
+	user, err := users.CreateUser(CreateUserRequest{Email: "new@durianpay.id", Password: "long-enough", Role: "cs"})
+	require.NoError(t, err)
+	require.Equal(t, "cs", user.Role)
+	require.False(t, user.Disabled)
+
+	stored, exists := store.GetUserByEmail("new@durianpay.id")
+	require.True(t, exists)
+	match, _ := password.Verify(stored.PasswordHash, "long-enough")
+	require.True(t, match)
+
+	tests := []struct {
+		name    string
+		request CreateUserRequest
+		wantErr error
+	}{
+		{name: "existing user", request: CreateUserRequest{Email: "john-cs@durianpay.id", Password: "long-enough", Role: "cs"}, wantErr: &errors.AlreadyExistsError{}},
+		{name: "unknown role", request: CreateUserRequest{Email: "a@durianpay.id", Password: "long-enough", Role: "root"}, wantErr: &errors.ValidationError{}},
+		{name: "short password", request: CreateUserRequest{Email: "a@durianpay.id", Password: "short", Role: "cs"}, wantErr: &errors.ValidationError{}},
+		{name: "not an email", request: CreateUserRequest{Email: "Jane <a@durianpay.id>", Password: "long-enough", Role: "cs"}, wantErr: &errors.ValidationError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := users.CreateUser(tt.request)
+			require.IsType(t, tt.wantErr, err)
+		})
+	}
+}
+
+func TestUserService_UpdateUser(t *testing.T) {
+	users, store := newUserTestService(t)
+	admin := "admin@durianpay.id"
+	operational := domain.RoleOperational
+	disabled := true
+	enabled := false
+	cs := domain.RoleCS
+
+	user, err := users.UpdateUser(admin, "john-cs@durianpay.id", UpdateUserRequest{Role: &operational})
+	require.NoError(t, err)
+	require.Equal(t, "operational", user.Role)
+
+	user, err = users.UpdateUser(admin, "john-cs@durianpay.id", UpdateUserRequest{Disabled: &disabled})
+	require.NoError(t, err)
+	require.True(t, user.Disabled)
+	require.Equal(t, "operational", user.Role, "fields left out stay as they are")
+
+	stored, _ := store.GetUserByEmail("john-cs@durianpay.id")
+	require.True(t, stored.Disabled)
+	require.NotEmpty(t, stored.PasswordHash)
+
+	_, err = users.UpdateUser(admin, "john-cs@durianpay.id", UpdateUserRequest{Disabled: &enabled})
+	require.NoError(t, err)
+
+	invalidRole := "root"
+	tests := []struct {
+		name    string
+		email   string
+		request UpdateUserRequest
+		wantErr error
+	}{
+		{name: "unknown user", email: "ghost@durianpay.id", request: UpdateUserRequest{Role: &cs}, wantErr: &errors.NotFoundError{}},
+		{name: "unknown role", email: "john-cs@durianpay.id", request: UpdateUserRequest{Role: &invalidRole}, wantErr: &errors.ValidationError{}},
+		{name: "demote yourself", email: admin, request: UpdateUserRequest{Role: &cs}, wantErr: &errors.ValidationError{}},
+		{name: "disable yourself", email: admin, request: UpdateUserRequest{Disabled: &disabled}, wantErr: &errors.ValidationError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := users.UpdateUser(admin, tt.email, tt.request)
+			require.IsType(t, tt.wantErr, err)
+		})
+	}
+}
+
+func TestUserService_Merchants(t *testing.T) {
+	users, store := newUserTestService(t)
+
+	user, err := users.CreateUser(CreateUserRequest{Email: "new@durianpay.id", Password: "long-enough", Role: "cs",
+		Merchants: []string{" Acme ", "Acme", "Corner Shop"}, MerchantGroups: []string{"retail"}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"Acme", "Corner Shop"}, user.Merchants)
+	require.Equal(t, []string{"retail"}, user.MerchantGroups)
+
+	_, err = users.CreateUser(CreateUserRequest{Email: "other@durianpay.id", Password: "long-enough", Role: "cs", Merchants: []string{" "}})
+	require.IsType(t, &errors.ValidationError{}, err)
+	_, err = users.UpdateUser("admin@durianpay.id", "new@durianpay.id", UpdateUserRequest{MerchantGroups: &[]string{"a\nb"}})
+	require.IsType(t, &errors.ValidationError{}, err)
+
+	// an empty list clears the merchants, a missing one keeps them
+	_, err = users.UpdateUser("admin@durianpay.id", "new@durianpay.id", UpdateUserRequest{Merchants: &[]string{}})
+	require.NoError(t, err)
+	stored, _ := store.GetUserByEmail("new@durianpay.id")
+	require.Empty(t, stored.Merchants)
+	require.Equal(t, []string{"retail"}, stored.MerchantGroups)
+	require.False(t, stored.AllMerchants)
+
+	// every merchant takes the flag, not empty lists
+	allMerchants := true
+	_, err = users.UpdateUser("admin@durianpay.id", "new@durianpay.id", UpdateUserRequest{MerchantGroups: &[]string{}, AllMerchants: &allMerchants})
+	require.NoError(t, err)
+	stored, _ = store.GetUserByEmail("new@durianpay.id")
+	require.Empty(t, stored.MerchantGroups)
+	require.True(t, stored.AllMerchants)
+}
+
+func TestUserService_DeleteUser(t *testing.T) {
+	users, _ := newUserTestService(t)
+
+	require.NoError(t, users.DeleteUser("admin@durianpay.id", "john-cs@durianpay.id"))
+	_, err := users.GetUser("john-cs@durianpay.id")
+	var notFoundErr *errors.NotFoundError
+	require.True(t, common_errors.As(err, &notFoundErr))
+
+	err = users.DeleteUser("admin@durianpay.id", "john-cs@durianpay.id")
+	require.True(t, common_errors.As(err, &notFoundErr))
+
+	var validationErr *errors.ValidationError
+	err = users.DeleteUser("admin@durianpay.id", "admin@durianpay.id")
+	require.True(t, common_errors.As(err, &validationErr))
+
+	require.Len(t, users.ListUsers(), 2)
+}
+
+func TestUserService_DeleteUserEndsSessions(t *testing.T) {
+	users, store := newUserTestService(t)
+	auth := NewAuthService(store, []byte("test-secret-key"))
+	john, _ := store.GetUserByEmail("john-cs@durianpay.id")
+
+	pair, err := auth.IssueTokens(john, passwordAMR, ClientInfo{})
+	require.NoError(t, err)
+	// a refresh token family issued before sessions were recorded
+	legacy, stored, err := auth.newRefreshToken("legacy", john.Email, passwordAMR)
+	require.NoError(t, err)
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		if err := tx.PutRefreshToken(stored); err != nil {
+			return err
+		}
+		if err := tx.PutLoginAttempts(&domain.LoginAttempts{Key: accountKey(john.Email), Failures: 2}); err != nil {
+			return err
+		}
+		return tx.PutPasswordReset(&domain.PasswordReset{Email: john.Email, Hash: "hash"})
+	}))
+
+	require.NoError(t, users.DeleteUser("admin@durianpay.id", john.Email))
+	_, err = users.CreateUser(CreateUserRequest{Email: john.Email, Password: "long-enough", Role: "cs"})
+	require.NoError(t, err)
+
+	// nothing of the deleted account works for the new one
+	_, err = auth.ParseToken(pair.AccessToken)
+	require.Error(t, err)
+	_, _, err = auth.Refresh(pair.RefreshToken, ClientInfo{})
+	require.Error(t, err)
+	_, _, err = auth.Refresh(legacy, ClientInfo{})
+	require.Error(t, err)
+	require.Empty(t, auth.ListSessions(john.Email))
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		_, exists := tx.GetLoginAttempts(accountKey(john.Email))
+		require.False(t, exists)
+		_, exists = tx.GetPasswordReset(john.Email)
+		require.False(t, exists)
+		return nil
+	}))
+}
@@ -5,66 +5,257 @@ In memory storage
 */
 
 import (
+	"log"
+	"sort"
 	"sync"
 	"time"
 
 	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
-	"github.com/google/uuid"
 )
 
 type MemoryStore struct {
 	mu       sync.RWMutex
 	users    map[string]*domain.User
 	payments map[string]*domain.Payment
+	index    *paymentIndex
+	// timelines by payment ID, in the order the events were added
+	paymentEvents map[string][]*domain.PaymentEvent
+	refunds       map[string]*domain.Refund
+
+	// refresh tokens by hash, revoked access tokens by jti
+	refreshTokens map[string]*domain.RefreshToken
+	revokedTokens map[string]*domain.RevokedToken
+	sessions      map[string]*domain.Session
+	loginAttempts map[string]*domain.LoginAttempts
+	// pending password resets by email
+	passwordResets map[string]*domain.PasswordReset
+
+	serviceAccounts map[string]*domain.ServiceAccount
+	apiKeys         map[string]*domain.APIKey
+
+	// nil unless opened with OpenMemoryStore
+	wal *writeAheadLog
 }
 
+// NewMemoryStore returns an empty store, load data with seed.Apply
 func NewMemoryStore() *MemoryStore {
-	store := &MemoryStore{
+	return &MemoryStore{
 		users:    map[string]*domain.User{},
 		payments: map[string]*domain.Payment{},
+		index:    newPaymentIndex(),
+
+		paymentEvents: map[string][]*domain.PaymentEvent{},
+		refunds:       map[string]*domain.Refund{},
+
+		refreshTokens: map[string]*domain.RefreshToken{},
+		revokedTokens: map[string]*domain.RevokedToken{},
+		sessions:      map[string]*domain.Session{},
+		loginAttempts: map[string]*domain.LoginAttempts{},
+
+		passwordResets: map[string]*domain.PasswordReset{},
+
+		serviceAccounts: map[string]*domain.ServiceAccount{},
+		apiKeys:         map[string]*domain.APIKey{},
 	}
+}
 
-	store.seed()
+// User
+func (store *MemoryStore) ListUsers() []*domain.User {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	users := make([]*domain.User, 0, len(store.users))
+	for _, user := range store.users {
+		users = append(users, copyUser(user))
+	}
 
-	return store
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	return users
 }
 
-func (store *MemoryStore) seed() {
-	store.users["john-cs@durianpay.id"] = &domain.User{
-		Email:    "john-cs@durianpay.id",
-		Password: "admin123",
-		Role:     "cs",
+func (store *MemoryStore) GetUserByEmail(email string) (*domain.User, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	user, valid := store.users[email]
+	if !valid {
+		return nil, false
 	}
+	return copyUser(user), true
+}
+
+func (store *MemoryStore) CreateUser(user *domain.User) error {
+	return store.Update(func(tx domain.Tx) error {
+		return tx.CreateUser(user)
+	})
+}
+
+func (store *MemoryStore) UpdateUser(user *domain.User) error {
+	return store.Update(func(tx domain.Tx) error {
+		return tx.UpdateUser(user)
+	})
+}
+
+func (store *MemoryStore) DeleteUser(email string) error {
+	return store.Update(func(tx domain.Tx) error {
+		return tx.DeleteUser(email)
+	})
+}
 
-	store.users["jane-operational@durianpay.id"] = &domain.User{
-		Email:    "jane-operational@durianpay.id",
-		Password: "admin123",
-		Role:     "operational",
+// Token
+func (store *MemoryStore) IsTokenRevoked(jti string) bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	_, revoked := store.revokedTokens[jti]
+	return revoked
+}
+
+func (store *MemoryStore) PurgeExpiredTokens(now time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if !store.hasExpiredTokens(now) {
+		return nil
 	}
+	return store.commit(walOp{Op: opPurgeTokens, Before: &now})
+}
 
-	// seed for payments
-	statuses := []string{"completed", "processing", "failed"}
-	for i := 0; i < 20; i++ {
-		id := uuid.New().String()
-		payment := &domain.Payment{
-			ID:           id,
-			MerchantName: "Merchant" + id[:6],
-			Date:         time.Now().Add(time.Duration(-i) * 24 * time.Hour),
-			Amount:       float64(10000 + i*25),
-			Status:       statuses[i%len(statuses)],
-			Reviewed:     false,
+func (store *MemoryStore) hasExpiredTokens(now time.Time) bool {
+	for _, token := range store.refreshTokens {
+		if token.ExpiresAt.Before(now) {
+			return true
+		}
+	}
+	for _, token := range store.revokedTokens {
+		if token.ExpiresAt.Before(now) {
+			return true
+		}
+	}
+	for _, session := range store.sessions {
+		if session.ExpiresAt.Before(now) {
+			return true
+		}
+	}
+	for _, reset := range store.passwordResets {
+		if reset.ExpiresAt.Before(now) {
+			return true
 		}
+	}
+	return false
+}
 
-		store.payments[id] = payment
+// Sessions
+func (store *MemoryStore) GetSession(id string) (*domain.Session, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	session, ok := store.sessions[id]
+	if !ok {
+		return nil, false
 	}
+	copied := *session
+	return &copied, true
 }
 
-// User
-func (store *MemoryStore) GetUserByEmail(email string) (*domain.User, bool) {
+func (store *MemoryStore) ListSessions(email string) []*domain.Session {
 	store.mu.RLock()
 	defer store.mu.RUnlock()
-	user, valid := store.users[email]
-	return user, valid
+
+	sessions := []*domain.Session{}
+	for _, session := range store.sessions {
+		if session.Email == email {
+			copied := *session
+			sessions = append(sessions, &copied)
+		}
+	}
+
+	sortSessions(sessions)
+	return sessions
+}
+
+// sortSessions orders by last seen, most recent first, then by ID
+func sortSessions(sessions []*domain.Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastSeenAt.Equal(sessions[j].LastSeenAt) {
+			return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+}
+
+// Login attempts
+func (store *MemoryStore) PurgeLoginAttempts(before time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, attempts := range store.loginAttempts {
+		if loginAttemptsExpired(attempts, before) {
+			return store.commit(walOp{Op: opPurgeLoginAttempts, Before: &before})
+		}
+	}
+	return nil
+}
+
+func loginAttemptsExpired(attempts *domain.LoginAttempts, before time.Time) bool {
+	return attempts.LastFailure.Before(before) && attempts.LockedUntil.Before(before)
+}
+
+// Service accounts
+func (store *MemoryStore) ListServiceAccounts() []*domain.ServiceAccount {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	accounts := make([]*domain.ServiceAccount, 0, len(store.serviceAccounts))
+	for _, account := range store.serviceAccounts {
+		copied := *account
+		accounts = append(accounts, &copied)
+	}
+
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	return accounts
+}
+
+func (store *MemoryStore) GetServiceAccount(name string) (*domain.ServiceAccount, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	account, ok := store.serviceAccounts[name]
+	if !ok {
+		return nil, false
+	}
+	copied := *account
+	return &copied, true
+}
+
+func (store *MemoryStore) ListAPIKeys(account string) []*domain.APIKey {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	keys := []*domain.APIKey{}
+	for _, key := range store.apiKeys {
+		if key.Account == account {
+			keys = append(keys, copyAPIKey(key))
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+func (store *MemoryStore) GetAPIKey(id string) (*domain.APIKey, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	key, ok := store.apiKeys[id]
+	if !ok {
+		return nil, false
+	}
+	return copyAPIKey(key), true
 }
 
 // Payment
@@ -75,7 +266,7 @@ func (store *MemoryStore) GetPaymentList() []*domain.Payment {
 	response := make([]*domain.Payment, 0, len(store.payments))
 
 	for _, payment := range store.payments {
-		response = append(response, payment)
+		response = append(response, copyPayment(payment))
 	}
 
 	return response
@@ -86,20 +277,78 @@ func (store *MemoryStore) GetPaymentById(id string) (*domain.Payment, bool) {
 	defer store.mu.RUnlock()
 
 	payment, ok := store.payments[id]
+	if !ok {
+		return nil, false
+	}
 
-	return payment, ok
+	return copyPayment(payment), true
 }
 
-func (store *MemoryStore) UpdatePayment(payment *domain.Payment) {
-	store.mu.Lock()
-	defer store.mu.Unlock()
+// QueryPayments answers a filtered, sorted page from the secondary indexes
+func (store *MemoryStore) QueryPayments(query domain.PaymentQuery) domain.PaymentPage {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	page := store.index.query(store.payments, query)
+	for i, payment := range page.Items {
+		page.Items[i] = copyPayment(payment)
+	}
+
+	return page
+}
+
+func (store *MemoryStore) CountPaymentsByStatus(merchants []string) map[string]int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.index.countByStatus(merchants)
+}
+
+func (store *MemoryStore) ListPaymentEvents(paymentID string) []*domain.PaymentEvent {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	events := make([]*domain.PaymentEvent, 0, len(store.paymentEvents[paymentID]))
+	for _, event := range store.paymentEvents[paymentID] {
+		copied := *event
+		events = append(events, &copied)
+	}
+
+	// events added in one go can share a timestamp, they keep their order
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+	return events
+}
+
+func (store *MemoryStore) ListRefunds(paymentID string) []*domain.Refund {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
 
-	store.payments[payment.ID] = payment
+	return listRefunds(store.refunds, nil, paymentID)
+}
+
+func (store *MemoryStore) CreatePayment(payment *domain.Payment) error {
+	return store.Update(func(tx domain.Tx) error {
+		return tx.CreatePayment(payment)
+	})
+}
+
+func (store *MemoryStore) UpdatePayment(payment *domain.Payment) error {
+	return store.Update(func(tx domain.Tx) error {
+		return tx.UpdatePayment(payment)
+	})
+}
+
+func (store *MemoryStore) DeletePayment(id string) error {
+	return store.Update(func(tx domain.Tx) error {
+		return tx.DeletePayment(id)
+	})
 }
 
 func (store *MemoryStore) ClearPayments() {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
-	store.payments = make(map[string]*domain.Payment)
+	if err := store.commit(walOp{Op: opClearPayments}); err != nil {
+		log.Printf("storage: clear payments: %v", err)
+	}
 }
@@ -0,0 +1,531 @@
+package storage
+
+/*
+Transactions for MemoryStore. Update holds the write lock for the whole
+callback, writes are staged on top of the committed maps and committed as a
+single log entry, so they replay all-or-nothing as well.
+*/
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+)
+
+var _ domain.Tx = (*memoryTx)(nil)
+
+type memoryTx struct {
+	store *MemoryStore
+
+	// staged values by key, nil marks a delete
+	payments map[string]*domain.Payment
+	users    map[string]*domain.User
+	tokens   map[string]*domain.RefreshToken
+	sessions map[string]*domain.Session
+	resets   map[string]*domain.PasswordReset
+	attempts map[string]*domain.LoginAttempts
+	accounts map[string]*domain.ServiceAccount
+	keys     map[string]*domain.APIKey
+	refunds  map[string]*domain.Refund
+	ops      []walOp
+}
+
+func (store *MemoryStore) Update(fn func(tx domain.Tx) error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	tx := &memoryTx{
+		store:    store,
+		payments: map[string]*domain.Payment{},
+		users:    map[string]*domain.User{},
+		tokens:   map[string]*domain.RefreshToken{},
+		sessions: map[string]*domain.Session{},
+		resets:   map[string]*domain.PasswordReset{},
+		attempts: map[string]*domain.LoginAttempts{},
+		accounts: map[string]*domain.ServiceAccount{},
+		keys:     map[string]*domain.APIKey{},
+		refunds:  map[string]*domain.Refund{},
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	return store.commit(tx.ops...)
+}
+
+func (tx *memoryTx) payment(id string) (*domain.Payment, bool) {
+	if staged, ok := tx.payments[id]; ok {
+		return staged, staged != nil
+	}
+
+	payment, ok := tx.store.payments[id]
+	return payment, ok
+}
+
+func (tx *memoryTx) user(email string) (*domain.User, bool) {
+	if staged, ok := tx.users[email]; ok {
+		return staged, staged != nil
+	}
+
+	user, ok := tx.store.users[email]
+	return user, ok
+}
+
+func (tx *memoryTx) GetPaymentById(id string) (*domain.Payment, bool) {
+	payment, ok := tx.payment(id)
+	if !ok {
+		return nil, false
+	}
+
+	return copyPayment(payment), true
+}
+
+func (tx *memoryTx) CreatePayment(payment *domain.Payment) error {
+	if _, exists := tx.payment(payment.ID); exists {
+		return errors.NewAlreadyExistsError(": paymentId: " + payment.ID)
+	}
+
+	tx.putPayment(payment, 1)
+	return nil
+}
+
+func (tx *memoryTx) UpdatePayment(payment *domain.Payment) error {
+	version := int64(1)
+	if current, exists := tx.payment(payment.ID); exists {
+		if current.Version != payment.Version {
+			return errors.NewConflictError(": paymentId: " + payment.ID)
+		}
+		version = current.Version + 1
+	}
+
+	tx.putPayment(payment, version)
+	return nil
+}
+
+// putPayment stages a copy at the given version so later changes to the
+// caller's struct cannot bypass the version check
+func (tx *memoryTx) putPayment(payment *domain.Payment, version int64) {
+	stored := copyPayment(payment)
+	stored.Version = version
+
+	tx.payments[stored.ID] = stored
+	tx.ops = append(tx.ops, walOp{Op: opPutPayment, Payment: stored})
+	payment.Version = version
+}
+
+func (tx *memoryTx) DeletePayment(id string) error {
+	if _, exists := tx.payment(id); !exists {
+		return errors.NewNotFoundError(": paymentId: " + id)
+	}
+
+	// apply drops the refunds as well, stage that so later reads agree
+	for _, refund := range listRefunds(tx.store.refunds, tx.refunds, id) {
+		tx.refunds[refund.ID] = nil
+	}
+
+	tx.payments[id] = nil
+	tx.ops = append(tx.ops, walOp{Op: opDeletePayment, ID: id})
+	return nil
+}
+
+func (tx *memoryTx) AddPaymentEvent(event *domain.PaymentEvent) error {
+	if _, exists := tx.payment(event.PaymentID); !exists {
+		return errors.NewNotFoundError(": paymentId: " + event.PaymentID)
+	}
+
+	stored := *event
+	tx.ops = append(tx.ops, walOp{Op: opAddPaymentEvent, PaymentEvent: &stored})
+	return nil
+}
+
+func (tx *memoryTx) GetUserByEmail(email string) (*domain.User, bool) {
+	user, ok := tx.user(email)
+	if !ok {
+		return nil, false
+	}
+
+	return copyUser(user), true
+}
+
+func (tx *memoryTx) CreateUser(user *domain.User) error {
+	if _, exists := tx.user(user.Email); exists {
+		return errors.NewAlreadyExistsError(": email: " + user.Email)
+	}
+
+	tx.putUser(user)
+	return nil
+}
+
+func (tx *memoryTx) UpdateUser(user *domain.User) error {
+	if _, exists := tx.user(user.Email); !exists {
+		return errors.NewNotFoundError(": email: " + user.Email)
+	}
+
+	tx.putUser(user)
+	return nil
+}
+
+func (tx *memoryTx) putUser(user *domain.User) {
+	stored := copyUser(user)
+	tx.users[stored.Email] = stored
+	tx.ops = append(tx.ops, walOp{Op: opPutUser, User: newUserRecord(stored)})
+}
+
+func (tx *memoryTx) DeleteUser(email string) error {
+	if _, exists := tx.user(email); !exists {
+		return errors.NewNotFoundError(": email: " + email)
+	}
+
+	tx.users[email] = nil
+	tx.ops = append(tx.ops, walOp{Op: opDeleteUser, ID: email})
+	return nil
+}
+
+func (tx *memoryTx) refreshToken(hash string) (*domain.RefreshToken, bool) {
+	if staged, ok := tx.tokens[hash]; ok {
+		return staged, true
+	}
+
+	token, ok := tx.store.refreshTokens[hash]
+	return token, ok
+}
+
+func (tx *memoryTx) GetRefreshToken(hash string) (*domain.RefreshToken, bool) {
+	token, ok := tx.refreshToken(hash)
+	if !ok {
+		return nil, false
+	}
+
+	copied := *token
+	return &copied, true
+}
+
+func (tx *memoryTx) PutRefreshToken(token *domain.RefreshToken) error {
+	stored := *token
+	tx.tokens[stored.Hash] = &stored
+	tx.ops = append(tx.ops, walOp{Op: opPutRefreshToken, RefreshToken: &stored})
+	return nil
+}
+
+func (tx *memoryTx) RevokeRefreshTokens(family string) error {
+	return tx.revokeRefreshTokens(func(token *domain.RefreshToken) bool {
+		return token.Family == family
+	})
+}
+
+func (tx *memoryTx) RevokeUserRefreshTokens(email string) error {
+	return tx.revokeRefreshTokens(func(token *domain.RefreshToken) bool {
+		return token.Email == email
+	})
+}
+
+func (tx *memoryTx) revokeRefreshTokens(match func(*domain.RefreshToken) bool) error {
+	var hashes []string
+	for hash, token := range tx.store.refreshTokens {
+		if match(token) {
+			hashes = append(hashes, hash)
+		}
+	}
+	for hash, token := range tx.tokens {
+		if _, committed := tx.store.refreshTokens[hash]; !committed && match(token) {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	for _, hash := range hashes {
+		token, _ := tx.GetRefreshToken(hash)
+		if token.Revoked {
+			continue
+		}
+		token.Revoked = true
+		tx.PutRefreshToken(token)
+	}
+	return nil
+}
+
+func (tx *memoryTx) RevokeToken(token *domain.RevokedToken) error {
+	stored := *token
+	tx.ops = append(tx.ops, walOp{Op: opRevokeToken, RevokedToken: &stored})
+	return nil
+}
+
+func (tx *memoryTx) GetSession(id string) (*domain.Session, bool) {
+	session, ok := tx.sessions[id]
+	if !ok {
+		session, ok = tx.store.sessions[id]
+	}
+	if !ok || session == nil {
+		return nil, false
+	}
+
+	copied := *session
+	return &copied, true
+}
+
+func (tx *memoryTx) PutSession(session *domain.Session) error {
+	stored := *session
+	tx.sessions[stored.ID] = &stored
+	tx.ops = append(tx.ops, walOp{Op: opPutSession, Session: &stored})
+	return nil
+}
+
+func (tx *memoryTx) DeleteSession(id string) error {
+	if _, exists := tx.GetSession(id); !exists {
+		return nil
+	}
+
+	tx.sessions[id] = nil
+	tx.ops = append(tx.ops, walOp{Op: opDeleteSession, ID: id})
+	return nil
+}
+
+func (tx *memoryTx) DeleteUserSessions(email string) error {
+	var ids []string
+	for id, session := range tx.store.sessions {
+		if session.Email == email {
+			ids = append(ids, id)
+		}
+	}
+	for id, session := range tx.sessions {
+		if _, committed := tx.store.sessions[id]; !committed && session != nil && session.Email == email {
+			ids = append(ids, id)
+		}
+	}
+
+	for _, id := range ids {
+		if session, exists := tx.GetSession(id); exists && session.Email == email {
+			tx.DeleteSession(id)
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) GetPasswordReset(email string) (*domain.PasswordReset, bool) {
+	reset, ok := tx.resets[email]
+	if !ok {
+		reset, ok = tx.store.passwordResets[email]
+	}
+	if !ok || reset == nil {
+		return nil, false
+	}
+
+	copied := *reset
+	return &copied, true
+}
+
+func (tx *memoryTx) PutPasswordReset(reset *domain.PasswordReset) error {
+	stored := *reset
+	tx.resets[stored.Email] = &stored
+	tx.ops = append(tx.ops, walOp{Op: opPutPasswordReset, PasswordReset: newPasswordResetRecord(&stored)})
+	return nil
+}
+
+func (tx *memoryTx) DeletePasswordReset(email string) error {
+	if _, exists := tx.GetPasswordReset(email); !exists {
+		return nil
+	}
+
+	tx.resets[email] = nil
+	tx.ops = append(tx.ops, walOp{Op: opDeletePasswordReset, ID: email})
+	return nil
+}
+
+func (tx *memoryTx) GetLoginAttempts(key string) (*domain.LoginAttempts, bool) {
+	attempts, ok := tx.attempts[key]
+	if !ok {
+		attempts, ok = tx.store.loginAttempts[key]
+	}
+	if !ok || attempts == nil {
+		return nil, false
+	}
+
+	copied := *attempts
+	return &copied, true
+}
+
+func (tx *memoryTx) PutLoginAttempts(attempts *domain.LoginAttempts) error {
+	stored := *attempts
+	tx.attempts[stored.Key] = &stored
+	tx.ops = append(tx.ops, walOp{Op: opPutLoginAttempts, LoginAttempts: &stored})
+	return nil
+}
+
+func (tx *memoryTx) DeleteLoginAttempts(key string) error {
+	if _, exists := tx.GetLoginAttempts(key); !exists {
+		return nil
+	}
+
+	tx.attempts[key] = nil
+	tx.ops = append(tx.ops, walOp{Op: opDeleteLoginAttempts, ID: key})
+	return nil
+}
+
+func (tx *memoryTx) GetServiceAccount(name string) (*domain.ServiceAccount, bool) {
+	account, ok := tx.accounts[name]
+	if !ok {
+		account, ok = tx.store.serviceAccounts[name]
+	}
+	if !ok || account == nil {
+		return nil, false
+	}
+
+	copied := *account
+	return &copied, true
+}
+
+func (tx *memoryTx) CreateServiceAccount(account *domain.ServiceAccount) error {
+	if _, exists := tx.GetServiceAccount(account.Name); exists {
+		return errors.NewAlreadyExistsError(": service account: " + account.Name)
+	}
+
+	stored := *account
+	tx.accounts[stored.Name] = &stored
+	tx.ops = append(tx.ops, walOp{Op: opPutServiceAccount, ServiceAccount: &stored})
+	return nil
+}
+
+func (tx *memoryTx) DeleteServiceAccount(name string) error {
+	if _, exists := tx.GetServiceAccount(name); !exists {
+		return errors.NewNotFoundError(": service account: " + name)
+	}
+
+	// apply drops the keys as well, stage that so later reads agree
+	for id, key := range tx.store.apiKeys {
+		if key.Account == name {
+			tx.keys[id] = nil
+		}
+	}
+	for id, key := range tx.keys {
+		if key != nil && key.Account == name {
+			tx.keys[id] = nil
+		}
+	}
+
+	tx.accounts[name] = nil
+	tx.ops = append(tx.ops, walOp{Op: opDeleteServiceAccount, ID: name})
+	return nil
+}
+
+func (tx *memoryTx) GetAPIKey(id string) (*domain.APIKey, bool) {
+	key, ok := tx.keys[id]
+	if !ok {
+		key, ok = tx.store.apiKeys[id]
+	}
+	if !ok || key == nil {
+		return nil, false
+	}
+
+	return copyAPIKey(key), true
+}
+
+func (tx *memoryTx) PutAPIKey(key *domain.APIKey) error {
+	if _, exists := tx.GetServiceAccount(key.Account); !exists {
+		return errors.NewNotFoundError(": service account: " + key.Account)
+	}
+
+	stored := copyAPIKey(key)
+	tx.keys[stored.ID] = stored
+	tx.ops = append(tx.ops, walOp{Op: opPutAPIKey, APIKey: newAPIKeyRecord(stored)})
+	return nil
+}
+
+func (tx *memoryTx) GetRefund(id string) (*domain.Refund, bool) {
+	refund, ok := tx.refunds[id]
+	if !ok {
+		refund, ok = tx.store.refunds[id]
+	}
+	if !ok || refund == nil {
+		return nil, false
+	}
+
+	return copyRefund(refund), true
+}
+
+func (tx *memoryTx) ListRefunds(paymentID string) []*domain.Refund {
+	return listRefunds(tx.store.refunds, tx.refunds, paymentID)
+}
+
+func (tx *memoryTx) PutRefund(refund *domain.Refund) error {
+	if _, exists := tx.payment(refund.PaymentID); !exists {
+		return errors.NewNotFoundError(": paymentId: " + refund.PaymentID)
+	}
+
+	stored := copyRefund(refund)
+	tx.refunds[stored.ID] = stored
+	tx.ops = append(tx.ops, walOp{Op: opPutRefund, Refund: stored})
+	return nil
+}
+
+// listRefunds returns copies of the refunds of a payment, oldest first, with
+// staged ones (nil for deleted) taking precedence over committed
+func listRefunds(committed, staged map[string]*domain.Refund, paymentID string) []*domain.Refund {
+	refunds := []*domain.Refund{}
+	for id, refund := range committed {
+		if _, ok := staged[id]; !ok && refund.PaymentID == paymentID {
+			refunds = append(refunds, copyRefund(refund))
+		}
+	}
+	for _, refund := range staged {
+		if refund != nil && refund.PaymentID == paymentID {
+			refunds = append(refunds, copyRefund(refund))
+		}
+	}
+
+	sort.Slice(refunds, func(i, j int) bool {
+		if !refunds[i].CreatedAt.Equal(refunds[j].CreatedAt) {
+			return refunds[i].CreatedAt.Before(refunds[j].CreatedAt)
+		}
+		return refunds[i].ID < refunds[j].ID
+	})
+	return refunds
+}
+
+func copyRefund(refund *domain.Refund) *domain.Refund {
+	copied := *refund
+	if refund.DecidedAt != nil {
+		decidedAt := *refund.DecidedAt
+		copied.DecidedAt = &decidedAt
+	}
+	return &copied
+}
+
+func copyPayment(payment *domain.Payment) *domain.Payment {
+	copied := *payment
+	if payment.Review != nil {
+		review := *payment.Review
+		copied.Review = &review
+	}
+	return &copied
+}
+
+func copyUser(user *domain.User) *domain.User {
+	copied := *user
+	copied.RecoveryCodes = slices.Clone(user.RecoveryCodes)
+	copied.Merchants = slices.Clone(user.Merchants)
+	copied.MerchantGroups = slices.Clone(user.MerchantGroups)
+	return &copied
+}
+
+func copyAPIKey(key *domain.APIKey) *domain.APIKey {
+	copied := *key
+	copied.Scopes = slices.Clone(key.Scopes)
+	copied.ExpiresAt = copyTime(key.ExpiresAt)
+	copied.LastUsedAt = copyTime(key.LastUsedAt)
+	copied.RevokedAt = copyTime(key.RevokedAt)
+	return &copied
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	copied := *t
+	return &copied
+}
@@ -0,0 +1,627 @@
+package storage
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+)
+
+// orderedIndex keeps payment IDs sorted by (key, id), so every sort order has
+// a deterministic tie-break and a page is a range of ranks. Entries live in
+// bounded chunks so writes stay cheap as the index grows into the hundreds of
+// thousands, and reaching a rank skips whole chunks.
+type orderedIndex[K cmp.Ordered] struct {
+	chunks [][]indexEntry[K]
+	size   int
+}
+
+const indexChunkSize = 256
+
+type indexEntry[K cmp.Ordered] struct {
+	key K
+	id  string
+}
+
+func compareEntry[K cmp.Ordered](a indexEntry[K], b indexEntry[K]) int {
+	if c := cmp.Compare(a.key, b.key); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.id, b.id)
+}
+
+// chunkFor returns the first chunk whose last entry is >= entry, or the last chunk
+func (idx *orderedIndex[K]) chunkFor(entry indexEntry[K]) int {
+	pos, _ := slices.BinarySearchFunc(idx.chunks, entry, func(chunk []indexEntry[K], target indexEntry[K]) int {
+		return compareEntry(chunk[len(chunk)-1], target)
+	})
+	return min(pos, len(idx.chunks)-1)
+}
+
+func (idx *orderedIndex[K]) insert(key K, id string) {
+	entry := indexEntry[K]{key: key, id: id}
+	if len(idx.chunks) == 0 {
+		idx.chunks = [][]indexEntry[K]{{entry}}
+		idx.size = 1
+		return
+	}
+
+	c := idx.chunkFor(entry)
+	chunk := idx.chunks[c]
+	pos, found := slices.BinarySearchFunc(chunk, entry, compareEntry[K])
+	if found {
+		return
+	}
+	chunk = slices.Insert(chunk, pos, entry)
+	idx.size++
+
+	if len(chunk) <= 2*indexChunkSize {
+		idx.chunks[c] = chunk
+		return
+	}
+
+	// split so no chunk grows without bound
+	head := slices.Clone(chunk[:indexChunkSize])
+	tail := slices.Clone(chunk[indexChunkSize:])
+	idx.chunks[c] = head
+	idx.chunks = slices.Insert(idx.chunks, c+1, tail)
+}
+
+func (idx *orderedIndex[K]) remove(key K, id string) {
+	if len(idx.chunks) == 0 {
+		return
+	}
+
+	entry := indexEntry[K]{key: key, id: id}
+	c := idx.chunkFor(entry)
+	pos, found := slices.BinarySearchFunc(idx.chunks[c], entry, compareEntry[K])
+	if !found {
+		return
+	}
+
+	idx.chunks[c] = slices.Delete(idx.chunks[c], pos, pos+1)
+	idx.size--
+	if len(idx.chunks[c]) == 0 {
+		idx.chunks = slices.Delete(idx.chunks, c, c+1)
+	}
+}
+
+// bounds returns how many entries sort before (key, id) and how many sort
+// before or at it, so the position is found even if that entry was removed
+func (idx *orderedIndex[K]) bounds(key K, id string) (int, int) {
+	if len(idx.chunks) == 0 {
+		return 0, 0
+	}
+
+	entry := indexEntry[K]{key: key, id: id}
+	c := idx.chunkFor(entry)
+	pos, found := slices.BinarySearchFunc(idx.chunks[c], entry, compareEntry[K])
+
+	lower := pos
+	for _, chunk := range idx.chunks[:c] {
+		lower += len(chunk)
+	}
+	if found {
+		return lower, lower + 1
+	}
+	return lower, lower
+}
+
+func (idx *orderedIndex[K]) len() int {
+	return idx.size
+}
+
+// iterate calls fn with the ids from the given rank onwards, in descending
+// order when desc is set, until fn returns false
+func (idx *orderedIndex[K]) iterate(rank int, desc bool, fn func(id string) bool) {
+	if rank >= idx.size {
+		return
+	}
+
+	if !desc {
+		c := 0
+		for ; rank >= len(idx.chunks[c]); c++ {
+			rank -= len(idx.chunks[c])
+		}
+		for ; c < len(idx.chunks); c++ {
+			for _, entry := range idx.chunks[c][rank:] {
+				if !fn(entry.id) {
+					return
+				}
+			}
+			rank = 0
+		}
+		return
+	}
+
+	c := len(idx.chunks) - 1
+	for ; rank >= len(idx.chunks[c]); c-- {
+		rank -= len(idx.chunks[c])
+	}
+	for ; c >= 0; c-- {
+		chunk := idx.chunks[c]
+		for i := len(chunk) - 1 - rank; i >= 0; i-- {
+			if !fn(chunk[i].id) {
+				return
+			}
+		}
+		rank = 0
+	}
+}
+
+// indexCursor walks an orderedIndex entry by entry, for merging it with others
+type indexCursor[K cmp.Ordered] struct {
+	chunks [][]indexEntry[K]
+	c, i   int
+	desc   bool
+}
+
+// cursor starts at the first entry in the given order, the index must not be empty
+func (idx *orderedIndex[K]) cursor(desc bool) *indexCursor[K] {
+	cursor := &indexCursor[K]{chunks: idx.chunks, desc: desc}
+	if desc {
+		cursor.c = len(idx.chunks) - 1
+		cursor.i = len(idx.chunks[cursor.c]) - 1
+	}
+	return cursor
+}
+
+func (cursor *indexCursor[K]) entry() indexEntry[K] {
+	return cursor.chunks[cursor.c][cursor.i]
+}
+
+// advance moves to the next entry and reports whether there is one
+func (cursor *indexCursor[K]) advance() bool {
+	if !cursor.desc {
+		if cursor.i++; cursor.i == len(cursor.chunks[cursor.c]) {
+			cursor.c, cursor.i = cursor.c+1, 0
+		}
+		return cursor.c < len(cursor.chunks)
+	}
+
+	if cursor.i--; cursor.i < 0 {
+		if cursor.c--; cursor.c < 0 {
+			return false
+		}
+		cursor.i = len(cursor.chunks[cursor.c]) - 1
+	}
+	return true
+}
+
+// mergedIndex ranks the entries of disjoint indexes as if they were one
+type mergedIndex[K cmp.Ordered] []*orderedIndex[K]
+
+func (merged mergedIndex[K]) len() int {
+	size := 0
+	for _, idx := range merged {
+		size += idx.len()
+	}
+	return size
+}
+
+func (merged mergedIndex[K]) iterate(rank int, desc bool, fn func(id string) bool) {
+	cursors := make([]*indexCursor[K], 0, len(merged))
+	for _, idx := range merged {
+		if idx.len() > 0 {
+			cursors = append(cursors, idx.cursor(desc))
+		}
+	}
+
+	for len(cursors) > 0 {
+		next := 0
+		for i := 1; i < len(cursors); i++ {
+			if c := compareEntry(cursors[i].entry(), cursors[next].entry()); (!desc && c < 0) || (desc && c > 0) {
+				next = i
+			}
+		}
+
+		entry := cursors[next].entry()
+		if !cursors[next].advance() {
+			cursors = slices.Delete(cursors, next, next+1)
+		}
+		if rank > 0 {
+			rank--
+			continue
+		}
+		if !fn(entry.id) {
+			return
+		}
+	}
+}
+
+// sortedViews is one payment subset ordered by every sortable field
+type sortedViews struct {
+	byDate   orderedIndex[int64]
+	byAmount orderedIndex[float64]
+}
+
+type ranked interface {
+	len() int
+	iterate(rank int, desc bool, fn func(id string) bool)
+}
+
+// paymentViews is a payment subset a query walks, one sortedViews or several
+// merged
+type paymentViews interface {
+	len() int
+	sortedBy(field string) ranked
+	cursorBounds(field string, cursor *domain.PaymentCursor) (int, int)
+}
+
+func (views *sortedViews) len() int {
+	return views.byDate.len()
+}
+
+func (views *sortedViews) sortedBy(field string) ranked {
+	if field == domain.PaymentSortAmount {
+		return &views.byAmount
+	}
+	return &views.byDate
+}
+
+func (views *sortedViews) cursorBounds(field string, cursor *domain.PaymentCursor) (int, int) {
+	if field == domain.PaymentSortAmount {
+		return views.byAmount.bounds(cursor.Amount, cursor.ID)
+	}
+	return views.byDate.bounds(cursor.Date.UnixNano(), cursor.ID)
+}
+
+func (views *sortedViews) add(key paymentKey, id string) {
+	views.byDate.insert(key.date, id)
+	views.byAmount.insert(key.amount, id)
+}
+
+func (views *sortedViews) remove(key paymentKey, id string) {
+	views.byDate.remove(key.date, id)
+	views.byAmount.remove(key.amount, id)
+}
+
+// mergedViews are disjoint payment subsets walked as one
+type mergedViews []*sortedViews
+
+func (merged mergedViews) len() int {
+	size := 0
+	for _, views := range merged {
+		size += views.len()
+	}
+	return size
+}
+
+func (merged mergedViews) sortedBy(field string) ranked {
+	if field == domain.PaymentSortAmount {
+		indexes := make(mergedIndex[float64], len(merged))
+		for i, views := range merged {
+			indexes[i] = &views.byAmount
+		}
+		return indexes
+	}
+
+	indexes := make(mergedIndex[int64], len(merged))
+	for i, views := range merged {
+		indexes[i] = &views.byDate
+	}
+	return indexes
+}
+
+// cursorBounds adds up the bounds in each subset, which is the position in
+// the merged order since the subsets do not overlap
+func (merged mergedViews) cursorBounds(field string, cursor *domain.PaymentCursor) (int, int) {
+	lower, upper := 0, 0
+	for _, views := range merged {
+		l, u := views.cursorBounds(field, cursor)
+		lower, upper = lower+l, upper+u
+	}
+	return lower, upper
+}
+
+// merchantPayments are the payments of one merchant, also counted by status
+// so a scoped summary does not walk them
+type merchantPayments struct {
+	sortedViews
+	statuses map[string]int
+}
+
+// paymentKey is what a payment was indexed under. It is kept separately from
+// the payment so a caller mutating a shared pointer cannot desync the index.
+type paymentKey struct {
+	date     int64
+	amount   float64
+	status   string
+	reviewed bool
+	merchant string
+}
+
+func keyOf(payment *domain.Payment) paymentKey {
+	return paymentKey{
+		date:     payment.Date.UnixNano(),
+		amount:   payment.Amount,
+		status:   payment.Status,
+		reviewed: payment.Reviewed,
+		merchant: payment.MerchantName,
+	}
+}
+
+// paymentIndex holds the secondary indexes of MemoryStore
+type paymentIndex struct {
+	keys       map[string]paymentKey
+	all        *sortedViews
+	byStatus   map[string]*sortedViews
+	byReviewed map[bool]*sortedViews
+	byMerchant map[string]*merchantPayments
+}
+
+func newPaymentIndex() *paymentIndex {
+	return &paymentIndex{
+		keys:       map[string]paymentKey{},
+		all:        &sortedViews{},
+		byStatus:   map[string]*sortedViews{},
+		byReviewed: map[bool]*sortedViews{false: {}, true: {}},
+		byMerchant: map[string]*merchantPayments{},
+	}
+}
+
+func (index *paymentIndex) put(payment *domain.Payment) {
+	index.remove(payment.ID)
+
+	key := keyOf(payment)
+	index.keys[payment.ID] = key
+	index.all.add(key, payment.ID)
+
+	status, ok := index.byStatus[key.status]
+	if !ok {
+		status = &sortedViews{}
+		index.byStatus[key.status] = status
+	}
+	status.add(key, payment.ID)
+	index.byReviewed[key.reviewed].add(key, payment.ID)
+
+	merchant, ok := index.byMerchant[key.merchant]
+	if !ok {
+		merchant = &merchantPayments{statuses: map[string]int{}}
+		index.byMerchant[key.merchant] = merchant
+	}
+	merchant.add(key, payment.ID)
+	merchant.statuses[key.status]++
+}
+
+func (index *paymentIndex) remove(id string) {
+	key, ok := index.keys[id]
+	if !ok {
+		return
+	}
+
+	delete(index.keys, id)
+	index.all.remove(key, id)
+	index.byReviewed[key.reviewed].remove(key, id)
+
+	status := index.byStatus[key.status]
+	status.remove(key, id)
+	if status.len() == 0 {
+		delete(index.byStatus, key.status)
+	}
+
+	merchant := index.byMerchant[key.merchant]
+	merchant.remove(key, id)
+	if merchant.statuses[key.status]--; merchant.statuses[key.status] == 0 {
+		delete(merchant.statuses, key.status)
+	}
+	if merchant.len() == 0 {
+		delete(index.byMerchant, key.merchant)
+	}
+}
+
+// countByStatus counts the payments of merchants, nil for every merchant
+func (index *paymentIndex) countByStatus(merchants []string) map[string]int {
+	if merchants == nil {
+		counts := make(map[string]int, len(index.byStatus))
+		for status, views := range index.byStatus {
+			counts[status] = views.len()
+		}
+		return counts
+	}
+
+	counts := map[string]int{}
+	for _, merchant := range index.merchantsOf(merchants) {
+		for status, count := range merchant.statuses {
+			counts[status] += count
+		}
+	}
+	return counts
+}
+
+// merchantsOf returns the payments of each of merchants that has any, once
+func (index *paymentIndex) merchantsOf(merchants []string) []*merchantPayments {
+	var found []*merchantPayments
+	seen := make(map[string]bool, len(merchants))
+	for _, name := range merchants {
+		if merchant, ok := index.byMerchant[name]; ok && !seen[name] {
+			seen[name] = true
+			found = append(found, merchant)
+		}
+	}
+	return found
+}
+
+// merchantViews returns the payments of merchants as one subset
+func (index *paymentIndex) merchantViews(merchants []string) paymentViews {
+	found := index.merchantsOf(merchants)
+	if len(found) == 1 {
+		return &found[0].sortedViews
+	}
+
+	merged := make(mergedViews, len(found))
+	for i, merchant := range found {
+		merged[i] = &merchant.sortedViews
+	}
+	return merged
+}
+
+// query walks the narrowest index for the filters in sort order. Without
+// residual filters the page is read straight off the index positions.
+func (index *paymentIndex) query(payments map[string]*domain.Payment, query domain.PaymentQuery) domain.PaymentPage {
+	page := domain.PaymentPage{Items: []*domain.Payment{}}
+
+	var views paymentViews = index.all
+	residual := newResidualFilter(query)
+	switch {
+	case query.Status != "":
+		status := index.byStatus[query.Status]
+		if status == nil {
+			return page
+		}
+		views, residual.status = status, ""
+	case query.Reviewed != nil:
+		views = index.byReviewed[*query.Reviewed]
+		residual.reviewed = nil
+	}
+
+	// the payments of the merchants of a scope are walked instead when they
+	// are fewer
+	if query.Merchants != nil {
+		if merchants := index.merchantViews(query.Merchants); merchants.len() <= views.len() {
+			views, residual = merchants, newResidualFilter(query)
+			residual.merchants = nil
+		}
+	}
+
+	if query.Cursor != nil {
+		return index.queryFromCursor(payments, query, views, residual)
+	}
+
+	sorted := views.sortedBy(query.SortBy)
+	desc := query.Order != domain.SortAsc
+	offset := max(query.Offset, 0)
+	limit := max(query.Limit, 0)
+
+	if !residual.active() {
+		page.Total = sorted.len()
+		if limit > 0 {
+			sorted.iterate(offset, desc, func(id string) bool {
+				page.Items = append(page.Items, payments[id])
+				return len(page.Items) < limit
+			})
+		}
+		return page
+	}
+
+	sorted.iterate(0, desc, func(id string) bool {
+		payment := payments[id]
+		if !residual.matches(payment) {
+			return true
+		}
+
+		if page.Total >= offset && page.Total < offset+limit {
+			page.Items = append(page.Items, payment)
+		}
+		page.Total++
+		return true
+	})
+
+	return page
+}
+
+// queryFromCursor pages by position instead of offset, so rows arriving or
+// leaving earlier in the order do not shift the page
+func (index *paymentIndex) queryFromCursor(payments map[string]*domain.Payment, query domain.PaymentQuery, views paymentViews, residual residualFilter) domain.PaymentPage {
+	page := domain.PaymentPage{Items: []*domain.Payment{}}
+	sorted := views.sortedBy(query.SortBy)
+	desc := query.Order != domain.SortAsc
+	limit := max(query.Limit, 0)
+	hasResidual := residual.active()
+
+	if !hasResidual {
+		page.Total = sorted.len()
+	} else {
+		sorted.iterate(0, false, func(id string) bool {
+			if residual.matches(payments[id]) {
+				page.Total++
+			}
+			return true
+		})
+	}
+
+	if limit == 0 {
+		return page
+	}
+
+	// walk away from the cursor: towards larger keys for forward-ascending and
+	// backward-descending pages, towards smaller keys otherwise
+	lower, upper := views.cursorBounds(query.SortBy, query.Cursor)
+	towardsLarger := desc == query.Cursor.Backward
+	start, walkDesc := upper, false
+	if !towardsLarger {
+		start, walkDesc = sorted.len()-lower, true
+	}
+
+	sorted.iterate(start, walkDesc, func(id string) bool {
+		payment := payments[id]
+		if hasResidual && !residual.matches(payment) {
+			return true
+		}
+		if len(page.Items) == limit {
+			page.HasMore = true
+			return false
+		}
+		page.Items = append(page.Items, payment)
+		return true
+	})
+
+	if query.Cursor.Backward {
+		slices.Reverse(page.Items)
+	}
+
+	return page
+}
+
+// residualFilter holds the conditions of a query that no index answers, they
+// are checked payment by payment
+type residualFilter struct {
+	status   string
+	search   string
+	reviewed *bool
+	outcome  string
+	reviewer string
+	// merchants is nil for every merchant
+	merchants map[string]bool
+}
+
+func newResidualFilter(query domain.PaymentQuery) residualFilter {
+	residual := residualFilter{status: query.Status, search: query.Search, reviewed: query.Reviewed, outcome: query.ReviewOutcome, reviewer: query.Reviewer}
+	if query.Merchants != nil {
+		residual.merchants = make(map[string]bool, len(query.Merchants))
+		for _, merchant := range query.Merchants {
+			residual.merchants[merchant] = true
+		}
+	}
+	return residual
+}
+
+func (residual residualFilter) active() bool {
+	return residual.status != "" || residual.search != "" || residual.reviewed != nil || residual.outcome != "" || residual.reviewer != "" || residual.merchants != nil
+}
+
+func (residual residualFilter) matches(payment *domain.Payment) bool {
+	if residual.status != "" && payment.Status != residual.status {
+		return false
+	}
+	if residual.search != "" && !strings.Contains(payment.ID, residual.search) {
+		return false
+	}
+	if residual.reviewed != nil && payment.Reviewed != *residual.reviewed {
+		return false
+	}
+	if (residual.outcome != "" || residual.reviewer != "") && payment.Review == nil {
+		return false
+	}
+	if residual.outcome != "" && payment.Review.Outcome != residual.outcome {
+		return false
+	}
+	if residual.reviewer != "" && payment.Review.Reviewer != residual.reviewer {
+		return false
+	}
+	if residual.merchants != nil && !residual.merchants[payment.MerchantName] {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+)
+
+// Query cost should not grow with the store: compare -bench output across sizes
+func BenchmarkMemoryStore_QueryPayments(b *testing.B) {
+	statuses := []string{"completed", "processing", "failed"}
+
+	for _, size := range []int{10_000, 100_000, 300_000} {
+		store := NewMemoryStore()
+		store.ClearPayments()
+		now := time.Now()
+		for i := 0; i < size; i++ {
+			store.UpdatePayment(&domain.Payment{
+				ID:           fmt.Sprintf("payment-%07d", i),
+				MerchantName: fmt.Sprintf("merchant-%d", i%(size/100)),
+				Date:         now.Add(-time.Duration(i) * time.Minute),
+				Amount:       float64(i % 5000),
+				Status:       statuses[i%len(statuses)],
+			})
+		}
+
+		query := domain.PaymentQuery{Status: "failed", SortBy: domain.PaymentSortAmount, Offset: 50, Limit: 10}
+		b.Run(fmt.Sprintf("status_page/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				store.QueryPayments(query)
+				store.CountPaymentsByStatus(nil)
+			}
+		})
+
+		// every merchant has a hundred payments, so the scope is the same size at every store size
+		merchants := []string{"merchant-1", "merchant-2"}
+		scoped := domain.PaymentQuery{Merchants: merchants, Offset: 50, Limit: 10}
+		b.Run(fmt.Sprintf("scoped_page/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				store.QueryPayments(scoped)
+				store.CountPaymentsByStatus(merchants)
+			}
+		})
+	}
+}
+
+func TestOrderedIndex_ChunksStaySorted(t *testing.T) {
+	var idx orderedIndex[int]
+	const n = 5 * indexChunkSize
+
+	// interleave inserts from both ends to force splits in the middle
+	for i := 0; i < n; i++ {
+		key := i / 2
+		if i%2 == 1 {
+			key = n - i/2
+		}
+		idx.insert(key, fmt.Sprintf("id-%05d", i))
+	}
+	if idx.len() != n || len(idx.chunks) < 2 {
+		t.Fatalf("expected %d entries over several chunks, got %d in %d", n, idx.len(), len(idx.chunks))
+	}
+
+	var prev *indexEntry[int]
+	for _, chunk := range idx.chunks {
+		for i := range chunk {
+			if prev != nil && compareEntry(*prev, chunk[i]) >= 0 {
+				t.Fatalf("entries out of order around %q", chunk[i].id)
+			}
+			prev = &chunk[i]
+		}
+	}
+
+	for _, desc := range []bool{false, true} {
+		seen := 0
+		idx.iterate(n-3, desc, func(id string) bool {
+			seen++
+			return true
+		})
+		if seen != 3 {
+			t.Fatalf("expected 3 ids from rank %d (desc=%v), got %d", n-3, desc, seen)
+		}
+	}
+
+	var first, last string
+	idx.iterate(0, true, func(id string) bool { first = id; return false })
+	idx.iterate(n-1, false, func(id string) bool { last = id; return false })
+	if first != last {
+		t.Fatalf("rank 0 descending %q should be last ascending %q", first, last)
+	}
+
+	for i := 0; i < n; i += 2 {
+		idx.remove(i/2, fmt.Sprintf("id-%05d", i))
+	}
+	if idx.len() != n/2 {
+		t.Fatalf("expected %d entries after removal, got %d", n/2, idx.len())
+	}
+}
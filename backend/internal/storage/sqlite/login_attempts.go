@@ -0,0 +1,52 @@
+package sqlite
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+)
+
+func (store *Store) PurgeLoginAttempts(before time.Time) error {
+	_, err := store.db.Exec(`DELETE FROM login_attempts WHERE last_failure < ? AND locked_until < ?`,
+		before.UnixNano(), before.UnixNano())
+	return err
+}
+
+func getLoginAttempts(db querier, key string) (*domain.LoginAttempts, bool) {
+	attempts := &domain.LoginAttempts{}
+	var lastFailure, lockedUntil int64
+	err := db.QueryRow(`SELECT key, failures, last_failure, locked_until FROM login_attempts WHERE key = ?`, key).
+		Scan(&attempts.Key, &attempts.Failures, &lastFailure, &lockedUntil)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("sqlite: get login attempts %q: %v", key, err)
+		}
+		return nil, false
+	}
+
+	attempts.LastFailure = time.Unix(0, lastFailure)
+	if lockedUntil != 0 {
+		attempts.LockedUntil = time.Unix(0, lockedUntil)
+	}
+	return attempts, true
+}
+
+func putLoginAttempts(db querier, attempts *domain.LoginAttempts) error {
+	var lockedUntil int64
+	if !attempts.LockedUntil.IsZero() {
+		lockedUntil = attempts.LockedUntil.UnixNano()
+	}
+
+	_, err := db.Exec(`INSERT INTO login_attempts (key, failures, last_failure, locked_until) VALUES (?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = excluded.failures, last_failure = excluded.last_failure, locked_until = excluded.locked_until`,
+		attempts.Key, attempts.Failures, attempts.LastFailure.UnixNano(), lockedUntil)
+	return err
+}
+
+func deleteLoginAttempts(db querier, key string) error {
+	_, err := db.Exec(`DELETE FROM login_attempts WHERE key = ?`, key)
+	return err
+}
@@ -0,0 +1,14 @@
+CREATE TABLE users (
+    email    TEXT PRIMARY KEY,
+    password TEXT NOT NULL,
+    role     TEXT NOT NULL
+);
+
+CREATE TABLE payments (
+    id            TEXT PRIMARY KEY,
+    merchant_name TEXT    NOT NULL,
+    date          INTEGER NOT NULL,
+    amount        REAL    NOT NULL,
+    status        TEXT    NOT NULL,
+    reviewed      INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,6 @@
+CREATE INDEX idx_payments_date ON payments (date, id);
+CREATE INDEX idx_payments_amount ON payments (amount, id);
+CREATE INDEX idx_payments_status_date ON payments (status, date, id);
+CREATE INDEX idx_payments_status_amount ON payments (status, amount, id);
+CREATE INDEX idx_payments_reviewed_date ON payments (reviewed, date, id);
+CREATE INDEX idx_payments_reviewed_amount ON payments (reviewed, amount, id);
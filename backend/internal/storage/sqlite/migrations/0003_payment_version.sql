@@ -0,0 +1 @@
+ALTER TABLE payments ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
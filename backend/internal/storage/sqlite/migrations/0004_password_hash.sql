@@ -0,0 +1,2 @@
+-- existing plaintext values are hashed by the application on the next login
+ALTER TABLE users RENAME COLUMN password TO password_hash;
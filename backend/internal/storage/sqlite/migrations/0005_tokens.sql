@@ -0,0 +1,18 @@
+CREATE TABLE refresh_tokens (
+    hash       TEXT    PRIMARY KEY,
+    family     TEXT    NOT NULL,
+    email      TEXT    NOT NULL,
+    expires_at INTEGER NOT NULL,
+    rotated    INTEGER NOT NULL DEFAULT 0,
+    revoked    INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX refresh_tokens_family ON refresh_tokens (family);
+CREATE INDEX refresh_tokens_expires_at ON refresh_tokens (expires_at);
+
+CREATE TABLE revoked_tokens (
+    jti        TEXT    PRIMARY KEY,
+    expires_at INTEGER NOT NULL
+);
+
+CREATE INDEX revoked_tokens_expires_at ON revoked_tokens (expires_at);
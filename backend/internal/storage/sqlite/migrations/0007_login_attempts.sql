@@ -0,0 +1,6 @@
+CREATE TABLE login_attempts (
+    key          TEXT    PRIMARY KEY,
+    failures     INTEGER NOT NULL,
+    last_failure INTEGER NOT NULL,
+    locked_until INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,22 @@
+CREATE TABLE service_accounts (
+    name        TEXT    PRIMARY KEY,
+    role        TEXT    NOT NULL,
+    description TEXT    NOT NULL DEFAULT '',
+    created_by  TEXT    NOT NULL DEFAULT '',
+    created_at  INTEGER NOT NULL
+);
+
+-- expires_at, last_used_at and revoked_at are 0 when unset
+CREATE TABLE api_keys (
+    id           TEXT    PRIMARY KEY,
+    account      TEXT    NOT NULL,
+    hash         TEXT    NOT NULL,
+    -- permissions the key may use, space separated
+    scopes       TEXT    NOT NULL DEFAULT '',
+    created_at   INTEGER NOT NULL,
+    expires_at   INTEGER NOT NULL DEFAULT 0,
+    last_used_at INTEGER NOT NULL DEFAULT 0,
+    revoked_at   INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX api_keys_account ON api_keys (account, created_at);
@@ -0,0 +1,12 @@
+CREATE TABLE sessions (
+    id           TEXT    PRIMARY KEY,
+    email        TEXT    NOT NULL,
+    user_agent   TEXT    NOT NULL DEFAULT '',
+    ip           TEXT    NOT NULL DEFAULT '',
+    created_at   INTEGER NOT NULL,
+    last_seen_at INTEGER NOT NULL,
+    expires_at   INTEGER NOT NULL
+);
+
+CREATE INDEX sessions_email ON sessions (email, last_seen_at);
+CREATE INDEX sessions_expires_at ON sessions (expires_at);
@@ -0,0 +1,11 @@
+ALTER TABLE users ADD COLUMN must_change_password INTEGER NOT NULL DEFAULT 0;
+
+-- the pending reset of each user, hash is the SHA-256 of the emailed token
+CREATE TABLE password_resets (
+    email      TEXT    PRIMARY KEY,
+    hash       TEXT    NOT NULL,
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL
+);
+
+CREATE INDEX password_resets_expires_at ON password_resets (expires_at);
@@ -0,0 +1,6 @@
+-- the merchants and merchant groups a user is limited to, newline separated
+-- since merchant names may contain spaces; empty for every merchant
+ALTER TABLE users ADD COLUMN merchants TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN merchant_groups TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX idx_payments_merchant_date ON payments (merchant_name, date, id);
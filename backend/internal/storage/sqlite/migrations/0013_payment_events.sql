@@ -0,0 +1,15 @@
+-- the activity timeline of each payment, seq keeps the order of events
+-- sharing a timestamp
+CREATE TABLE payment_events (
+    seq         INTEGER PRIMARY KEY,
+    id          TEXT    NOT NULL UNIQUE,
+    payment_id  TEXT    NOT NULL,
+    type        TEXT    NOT NULL,
+    actor       TEXT    NOT NULL DEFAULT '',
+    at          INTEGER NOT NULL,
+    from_status TEXT    NOT NULL DEFAULT '',
+    to_status   TEXT    NOT NULL DEFAULT '',
+    note        TEXT    NOT NULL DEFAULT ''
+);
+
+CREATE INDEX payment_events_payment ON payment_events (payment_id, at, seq);
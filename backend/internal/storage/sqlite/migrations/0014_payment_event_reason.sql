@@ -0,0 +1,2 @@
+-- the reason code of a status change
+ALTER TABLE payment_events ADD COLUMN reason TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+-- the last review of a payment, review_outcome is empty when there is none
+ALTER TABLE payments ADD COLUMN review_by TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN review_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN review_outcome TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN review_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN review_note TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE payment_events ADD COLUMN outcome TEXT NOT NULL DEFAULT '';
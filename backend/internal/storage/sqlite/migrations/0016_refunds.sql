@@ -0,0 +1,20 @@
+-- decided_at is 0 until the refund is approved or rejected
+CREATE TABLE refunds (
+    id           TEXT    PRIMARY KEY,
+    payment_id   TEXT    NOT NULL,
+    amount       REAL    NOT NULL,
+    status       TEXT    NOT NULL,
+    reason       TEXT    NOT NULL,
+    note         TEXT    NOT NULL DEFAULT '',
+    requested_by TEXT    NOT NULL DEFAULT '',
+    created_at   INTEGER NOT NULL,
+    decided_by   TEXT    NOT NULL DEFAULT '',
+    decided_at   INTEGER NOT NULL DEFAULT 0,
+    updated_at   INTEGER NOT NULL
+);
+
+CREATE INDEX refunds_payment ON refunds (payment_id, created_at);
+
+-- the refund of a refund event
+ALTER TABLE payment_events ADD COLUMN refund_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE payment_events ADD COLUMN amount REAL NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- users without merchants or merchant groups see no payments unless
+-- all_merchants is set; existing users are not granted it, an admin has to
+ALTER TABLE users ADD COLUMN all_merchants INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,39 @@
+package sqlite
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+)
+
+func getPasswordReset(db querier, email string) (*domain.PasswordReset, bool) {
+	reset := &domain.PasswordReset{}
+	var createdAt, expiresAt int64
+	err := db.QueryRow(`SELECT email, hash, created_at, expires_at FROM password_resets WHERE email = ?`, email).
+		Scan(&reset.Email, &reset.Hash, &createdAt, &expiresAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("sqlite: get password reset: %v", err)
+		}
+		return nil, false
+	}
+
+	reset.CreatedAt = time.Unix(0, createdAt)
+	reset.ExpiresAt = time.Unix(0, expiresAt)
+	return reset, true
+}
+
+func putPasswordReset(db querier, reset *domain.PasswordReset) error {
+	_, err := db.Exec(`INSERT INTO password_resets (email, hash, created_at, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(email) DO UPDATE SET
+			hash = excluded.hash, created_at = excluded.created_at, expires_at = excluded.expires_at`,
+		reset.Email, reset.Hash, reset.CreatedAt.UnixNano(), reset.ExpiresAt.UnixNano())
+	return err
+}
+
+func deletePasswordReset(db querier, email string) error {
+	_, err := db.Exec(`DELETE FROM password_resets WHERE email = ?`, email)
+	return err
+}
@@ -0,0 +1,50 @@
+package sqlite
+
+import (
+	"log"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+)
+
+func (store *Store) ListPaymentEvents(paymentID string) []*domain.PaymentEvent {
+	events := []*domain.PaymentEvent{}
+
+	rows, err := store.db.Query(`SELECT id, payment_id, type, actor, at, from_status, to_status, outcome, reason, note, refund_id, amount
+		FROM payment_events WHERE payment_id = ? ORDER BY at, seq`, paymentID)
+	if err != nil {
+		log.Printf("sqlite: list payment events: %v", err)
+		return events
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event := &domain.PaymentEvent{}
+		var at int64
+		err := rows.Scan(&event.ID, &event.PaymentID, &event.Type, &event.Actor, &at, &event.From, &event.To, &event.Outcome, &event.Reason, &event.Note, &event.RefundID, &event.Amount)
+		if err != nil {
+			log.Printf("sqlite: list payment events: %v", err)
+			return events
+		}
+		event.At = time.Unix(0, at)
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("sqlite: list payment events: %v", err)
+	}
+
+	return events
+}
+
+func addPaymentEvent(db querier, event *domain.PaymentEvent) error {
+	if _, exists := getPaymentById(db, event.PaymentID); !exists {
+		return errors.NewNotFoundError(": paymentId: " + event.PaymentID)
+	}
+
+	_, err := db.Exec(`INSERT INTO payment_events (id, payment_id, type, actor, at, from_status, to_status, outcome, reason, note, refund_id, amount)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.ID, event.PaymentID, event.Type, event.Actor, event.At.UnixNano(), event.From, event.To, event.Outcome, event.Reason, event.Note, event.RefundID, event.Amount)
+	return err
+}
@@ -0,0 +1,84 @@
+package sqlite
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+)
+
+const refundColumns = `id, payment_id, amount, status, reason, note, requested_by, created_at, decided_by, decided_at, updated_at`
+
+func scanRefund(row rowScanner) (*domain.Refund, error) {
+	refund := &domain.Refund{}
+	var createdAt, decidedAt, updatedAt int64
+	err := row.Scan(&refund.ID, &refund.PaymentID, &refund.Amount, &refund.Status, &refund.Reason, &refund.Note,
+		&refund.RequestedBy, &createdAt, &refund.DecidedBy, &decidedAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	refund.CreatedAt = time.Unix(0, createdAt)
+	refund.DecidedAt = optionalTime(decidedAt)
+	refund.UpdatedAt = time.Unix(0, updatedAt)
+	return refund, nil
+}
+
+func (store *Store) ListRefunds(paymentID string) []*domain.Refund {
+	return listRefunds(store.db, paymentID)
+}
+
+func listRefunds(db querier, paymentID string) []*domain.Refund {
+	refunds := []*domain.Refund{}
+
+	rows, err := db.Query(`SELECT `+refundColumns+` FROM refunds WHERE payment_id = ? ORDER BY created_at, id`, paymentID)
+	if err != nil {
+		log.Printf("sqlite: list refunds: %v", err)
+		return refunds
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		refund, err := scanRefund(rows)
+		if err != nil {
+			log.Printf("sqlite: list refunds: %v", err)
+			return refunds
+		}
+		refunds = append(refunds, refund)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("sqlite: list refunds: %v", err)
+	}
+
+	return refunds
+}
+
+func getRefund(db querier, id string) (*domain.Refund, bool) {
+	refund, err := scanRefund(db.QueryRow(`SELECT `+refundColumns+` FROM refunds WHERE id = ?`, id))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("sqlite: get refund %q: %v", id, err)
+		}
+		return nil, false
+	}
+
+	return refund, true
+}
+
+func putRefund(db querier, refund *domain.Refund) error {
+	if _, exists := getPaymentById(db, refund.PaymentID); !exists {
+		return errors.NewNotFoundError(": paymentId: " + refund.PaymentID)
+	}
+
+	_, err := db.Exec(`INSERT INTO refunds (`+refundColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			payment_id = excluded.payment_id, amount = excluded.amount, status = excluded.status, reason = excluded.reason,
+			note = excluded.note, requested_by = excluded.requested_by, created_at = excluded.created_at,
+			decided_by = excluded.decided_by, decided_at = excluded.decided_at, updated_at = excluded.updated_at`,
+		refund.ID, refund.PaymentID, refund.Amount, refund.Status, refund.Reason, refund.Note,
+		refund.RequestedBy, refund.CreatedAt.UnixNano(), refund.DecidedBy, optionalNanos(refund.DecidedAt), refund.UpdatedAt.UnixNano())
+	return err
+}
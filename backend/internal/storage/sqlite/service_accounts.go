@@ -0,0 +1,185 @@
+package sqlite
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+)
+
+const (
+	serviceAccountColumns = `name, role, description, created_by, created_at`
+	apiKeyColumns         = `id, account, hash, scopes, created_at, expires_at, last_used_at, revoked_at`
+)
+
+func scanServiceAccount(row rowScanner) (*domain.ServiceAccount, error) {
+	account := &domain.ServiceAccount{}
+	var createdAt int64
+	if err := row.Scan(&account.Name, &account.Role, &account.Description, &account.CreatedBy, &createdAt); err != nil {
+		return nil, err
+	}
+
+	account.CreatedAt = time.Unix(0, createdAt)
+	return account, nil
+}
+
+func scanAPIKey(row rowScanner) (*domain.APIKey, error) {
+	key := &domain.APIKey{}
+	var scopes string
+	var createdAt, expiresAt, lastUsedAt, revokedAt int64
+	if err := row.Scan(&key.ID, &key.Account, &key.Hash, &scopes, &createdAt, &expiresAt, &lastUsedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+
+	key.Scopes = splitList(scopes)
+	key.CreatedAt = time.Unix(0, createdAt)
+	key.ExpiresAt = optionalTime(expiresAt)
+	key.LastUsedAt = optionalTime(lastUsedAt)
+	key.RevokedAt = optionalTime(revokedAt)
+	return key, nil
+}
+
+// optionalTime reads a nanosecond column where 0 means unset
+func optionalTime(nanos int64) *time.Time {
+	if nanos == 0 {
+		return nil
+	}
+	t := time.Unix(0, nanos)
+	return &t
+}
+
+func optionalNanos(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (store *Store) ListServiceAccounts() []*domain.ServiceAccount {
+	accounts := []*domain.ServiceAccount{}
+
+	rows, err := store.db.Query(`SELECT ` + serviceAccountColumns + ` FROM service_accounts ORDER BY name`)
+	if err != nil {
+		log.Printf("sqlite: list service accounts: %v", err)
+		return accounts
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		account, err := scanServiceAccount(rows)
+		if err != nil {
+			log.Printf("sqlite: list service accounts: %v", err)
+			return accounts
+		}
+		accounts = append(accounts, account)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("sqlite: list service accounts: %v", err)
+	}
+
+	return accounts
+}
+
+func (store *Store) GetServiceAccount(name string) (*domain.ServiceAccount, bool) {
+	return getServiceAccount(store.db, name)
+}
+
+func (store *Store) ListAPIKeys(account string) []*domain.APIKey {
+	keys := []*domain.APIKey{}
+
+	rows, err := store.db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE account = ? ORDER BY created_at, id`, account)
+	if err != nil {
+		log.Printf("sqlite: list api keys: %v", err)
+		return keys
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			log.Printf("sqlite: list api keys: %v", err)
+			return keys
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("sqlite: list api keys: %v", err)
+	}
+
+	return keys
+}
+
+func (store *Store) GetAPIKey(id string) (*domain.APIKey, bool) {
+	return getAPIKey(store.db, id)
+}
+
+func getServiceAccount(db querier, name string) (*domain.ServiceAccount, bool) {
+	account, err := scanServiceAccount(db.QueryRow(`SELECT `+serviceAccountColumns+` FROM service_accounts WHERE name = ?`, name))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("sqlite: get service account %q: %v", name, err)
+		}
+		return nil, false
+	}
+
+	return account, true
+}
+
+func createServiceAccount(db querier, account *domain.ServiceAccount) error {
+	result, err := db.Exec(`INSERT INTO service_accounts (`+serviceAccountColumns+`) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO NOTHING`,
+		account.Name, account.Role, account.Description, account.CreatedBy, account.CreatedAt.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.NewAlreadyExistsError(": service account: " + account.Name)
+	}
+	return nil
+}
+
+func deleteServiceAccount(db querier, name string) error {
+	result, err := db.Exec(`DELETE FROM service_accounts WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.NewNotFoundError(": service account: " + name)
+	}
+
+	_, err = db.Exec(`DELETE FROM api_keys WHERE account = ?`, name)
+	return err
+}
+
+func getAPIKey(db querier, id string) (*domain.APIKey, bool) {
+	key, err := scanAPIKey(db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("sqlite: get api key %q: %v", id, err)
+		}
+		return nil, false
+	}
+
+	return key, true
+}
+
+func putAPIKey(db querier, key *domain.APIKey) error {
+	if _, exists := getServiceAccount(db, key.Account); !exists {
+		return errors.NewNotFoundError(": service account: " + key.Account)
+	}
+
+	_, err := db.Exec(`INSERT INTO api_keys (`+apiKeyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			account = excluded.account, hash = excluded.hash, scopes = excluded.scopes, created_at = excluded.created_at,
+			expires_at = excluded.expires_at, last_used_at = excluded.last_used_at, revoked_at = excluded.revoked_at`,
+		key.ID, key.Account, key.Hash, strings.Join(key.Scopes, " "), key.CreatedAt.UnixNano(),
+		optionalNanos(key.ExpiresAt), optionalNanos(key.LastUsedAt), optionalNanos(key.RevokedAt))
+	return err
+}
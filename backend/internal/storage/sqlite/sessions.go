@@ -0,0 +1,85 @@
+package sqlite
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+)
+
+const sessionColumns = `id, email, user_agent, ip, created_at, last_seen_at, expires_at`
+
+func scanSession(row rowScanner) (*domain.Session, error) {
+	session := &domain.Session{}
+	var createdAt, lastSeenAt, expiresAt int64
+	if err := row.Scan(&session.ID, &session.Email, &session.UserAgent, &session.IP, &createdAt, &lastSeenAt, &expiresAt); err != nil {
+		return nil, err
+	}
+
+	session.CreatedAt = time.Unix(0, createdAt)
+	session.LastSeenAt = time.Unix(0, lastSeenAt)
+	session.ExpiresAt = time.Unix(0, expiresAt)
+	return session, nil
+}
+
+func (store *Store) GetSession(id string) (*domain.Session, bool) {
+	return getSession(store.db, id)
+}
+
+func (store *Store) ListSessions(email string) []*domain.Session {
+	sessions := []*domain.Session{}
+
+	rows, err := store.db.Query(`SELECT `+sessionColumns+` FROM sessions WHERE email = ? ORDER BY last_seen_at DESC, id`, email)
+	if err != nil {
+		log.Printf("sqlite: list sessions: %v", err)
+		return sessions
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			log.Printf("sqlite: list sessions: %v", err)
+			return sessions
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("sqlite: list sessions: %v", err)
+	}
+	return sessions
+}
+
+func getSession(db querier, id string) (*domain.Session, bool) {
+	session, err := scanSession(db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("sqlite: get session: %v", err)
+		}
+		return nil, false
+	}
+
+	return session, true
+}
+
+func putSession(db querier, session *domain.Session) error {
+	_, err := db.Exec(`INSERT INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			email = excluded.email, user_agent = excluded.user_agent, ip = excluded.ip, created_at = excluded.created_at,
+			last_seen_at = excluded.last_seen_at, expires_at = excluded.expires_at`,
+		session.ID, session.Email, session.UserAgent, session.IP,
+		session.CreatedAt.UnixNano(), session.LastSeenAt.UnixNano(), session.ExpiresAt.UnixNano())
+	return err
+}
+
+func deleteSession(db querier, id string) error {
+	_, err := db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+func deleteUserSessions(db querier, email string) error {
+	_, err := db.Exec(`DELETE FROM sessions WHERE email = ?`, email)
+	return err
+}
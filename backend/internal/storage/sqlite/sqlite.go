@@ -0,0 +1,541 @@
+package sqlite
+
+/*
+SQLite storage, pure Go driver so the binary needs neither cgo nor a database server
+*/
+
+import (
+	"database/sql"
+	common_errors "errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage"
+
+	_ "modernc.org/sqlite"
+)
+
+var _ storage.Store = (*Store)(nil)
+
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore opens (or creates) the database at path and brings its schema up
+// to date before returning
+func NewStore(path string) (*Store, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create database directory: %w", err)
+		}
+	}
+
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, serialise in the pool rather than retrying SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+func (store *Store) Close() error {
+	return store.db.Close()
+}
+
+// querier is what *sql.DB and *sql.Tx have in common, so every statement
+// below runs the same inside and outside Update
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// User
+func (store *Store) GetUserByEmail(email string) (*domain.User, bool) {
+	return getUserByEmail(store.db, email)
+}
+
+func (store *Store) CreateUser(user *domain.User) error {
+	return createUser(store.db, user)
+}
+
+func (store *Store) UpdateUser(user *domain.User) error {
+	return updateUser(store.db, user)
+}
+
+func (store *Store) DeleteUser(email string) error {
+	return deleteUser(store.db, email)
+}
+
+const userColumns = `email, password_hash, role, disabled, mfa_enabled, totp_secret, totp_last_step, recovery_codes, must_change_password,
+	merchants, merchant_groups, all_merchants`
+
+func scanUser(row rowScanner) (*domain.User, error) {
+	user := &domain.User{}
+	var recoveryCodes, merchants, merchantGroups string
+	err := row.Scan(&user.Email, &user.PasswordHash, &user.Role, &user.Disabled,
+		&user.MFAEnabled, &user.TOTPSecret, &user.TOTPLastStep, &recoveryCodes, &user.MustChangePassword,
+		&merchants, &merchantGroups, &user.AllMerchants)
+	if err != nil {
+		return nil, err
+	}
+	user.RecoveryCodes = splitList(recoveryCodes)
+	user.Merchants = splitLines(merchants)
+	user.MerchantGroups = splitLines(merchantGroups)
+	return user, nil
+}
+
+// splitLines reads a newline separated column, for values that may contain
+// spaces. Empty is nil like on a new domain value.
+func splitLines(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	return strings.Split(raw, "\n")
+}
+
+// splitList reads a space separated column, empty is nil like on a new domain value
+func splitList(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	return strings.Fields(raw)
+}
+
+func (store *Store) ListUsers() []*domain.User {
+	users := []*domain.User{}
+
+	rows, err := store.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY email`)
+	if err != nil {
+		log.Printf("sqlite: list users: %v", err)
+		return users
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			log.Printf("sqlite: list users: %v", err)
+			return users
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("sqlite: list users: %v", err)
+	}
+
+	return users
+}
+
+func getUserByEmail(db querier, email string) (*domain.User, bool) {
+	user, err := scanUser(db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, email))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("sqlite: get user %q: %v", email, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+func createUser(db querier, user *domain.User) error {
+	result, err := db.Exec(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(email) DO NOTHING`, user.Email, user.PasswordHash, user.Role, user.Disabled,
+		user.MFAEnabled, user.TOTPSecret, user.TOTPLastStep, strings.Join(user.RecoveryCodes, " "), user.MustChangePassword,
+		strings.Join(user.Merchants, "\n"), strings.Join(user.MerchantGroups, "\n"), user.AllMerchants)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.NewAlreadyExistsError(": email: " + user.Email)
+	}
+	return nil
+}
+
+func updateUser(db querier, user *domain.User) error {
+	result, err := db.Exec(`UPDATE users SET password_hash = ?, role = ?, disabled = ?,
+		mfa_enabled = ?, totp_secret = ?, totp_last_step = ?, recovery_codes = ?, must_change_password = ?,
+		merchants = ?, merchant_groups = ?, all_merchants = ? WHERE email = ?`,
+		user.PasswordHash, user.Role, user.Disabled,
+		user.MFAEnabled, user.TOTPSecret, user.TOTPLastStep, strings.Join(user.RecoveryCodes, " "), user.MustChangePassword,
+		strings.Join(user.Merchants, "\n"), strings.Join(user.MerchantGroups, "\n"), user.AllMerchants, user.Email)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.NewNotFoundError(": email: " + user.Email)
+	}
+	return nil
+}
+
+func deleteUser(db querier, email string) error {
+	result, err := db.Exec(`DELETE FROM users WHERE email = ?`, email)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.NewNotFoundError(": email: " + email)
+	}
+	return nil
+}
+
+// Payment
+const paymentColumns = `id, merchant_name, date, amount, status, reviewed, version,
+	review_by, review_at, review_outcome, review_reason, review_note`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPayment(row rowScanner) (*domain.Payment, error) {
+	payment := &domain.Payment{}
+	review := &domain.PaymentReview{}
+	var date, reviewAt int64
+	err := row.Scan(&payment.ID, &payment.MerchantName, &date, &payment.Amount, &payment.Status, &payment.Reviewed, &payment.Version,
+		&review.Reviewer, &reviewAt, &review.Outcome, &review.Reason, &review.Note)
+	if err != nil {
+		return nil, err
+	}
+
+	payment.Date = time.Unix(0, date)
+	if review.Outcome != "" {
+		review.At = time.Unix(0, reviewAt)
+		payment.Review = review
+	}
+	return payment, nil
+}
+
+func (store *Store) GetPaymentList() []*domain.Payment {
+	response := []*domain.Payment{}
+
+	rows, err := store.db.Query(`SELECT ` + paymentColumns + ` FROM payments`)
+	if err != nil {
+		log.Printf("sqlite: list payments: %v", err)
+		return response
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			log.Printf("sqlite: list payments: %v", err)
+			return response
+		}
+		response = append(response, payment)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("sqlite: list payments: %v", err)
+	}
+
+	return response
+}
+
+func (store *Store) GetPaymentById(id string) (*domain.Payment, bool) {
+	return getPaymentById(store.db, id)
+}
+
+func (store *Store) CreatePayment(payment *domain.Payment) error {
+	return createPayment(store.db, payment)
+}
+
+func (store *Store) UpdatePayment(payment *domain.Payment) error {
+	return updatePayment(store.db, payment)
+}
+
+func (store *Store) DeletePayment(id string) error {
+	return deletePayment(store.db, id)
+}
+
+func getPaymentById(db querier, id string) (*domain.Payment, bool) {
+	payment, err := scanPayment(db.QueryRow(`SELECT `+paymentColumns+` FROM payments WHERE id = ?`, id))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("sqlite: get payment %q: %v", id, err)
+		}
+		return nil, false
+	}
+
+	return payment, true
+}
+
+func createPayment(db querier, payment *domain.Payment) error {
+	review := reviewColumns(payment.Review)
+	result, err := db.Exec(`INSERT INTO payments (`+paymentColumns+`) VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO NOTHING`,
+		append([]any{payment.ID, payment.MerchantName, payment.Date.UnixNano(), payment.Amount, payment.Status, payment.Reviewed}, review...)...)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.NewAlreadyExistsError(": paymentId: " + payment.ID)
+	}
+
+	payment.Version = 1
+	return nil
+}
+
+func updatePayment(db querier, payment *domain.Payment) error {
+	// compare-and-swap on the version, the row is only touched when nobody wrote since it was read
+	args := []any{payment.MerchantName, payment.Date.UnixNano(), payment.Amount, payment.Status, payment.Reviewed}
+	args = append(args, reviewColumns(payment.Review)...)
+	result, err := db.Exec(`UPDATE payments SET
+			merchant_name = ?, date = ?, amount = ?, status = ?, reviewed = ?, version = version + 1,
+			review_by = ?, review_at = ?, review_outcome = ?, review_reason = ?, review_note = ?
+		WHERE id = ? AND version = ?`,
+		append(args, payment.ID, payment.Version)...)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 1 {
+		payment.Version++
+		return nil
+	}
+
+	// either a new payment or a stale version, inserting tells them apart atomically
+	err = createPayment(db, payment)
+	var existsErr *errors.AlreadyExistsError
+	if common_errors.As(err, &existsErr) {
+		return errors.NewConflictError(": paymentId: " + payment.ID)
+	}
+	return err
+}
+
+// reviewColumns are the review_* values of review, blank for none
+func reviewColumns(review *domain.PaymentReview) []any {
+	if review == nil {
+		return []any{"", 0, "", "", ""}
+	}
+	return []any{review.Reviewer, review.At.UnixNano(), review.Outcome, review.Reason, review.Note}
+}
+
+func deletePayment(db querier, id string) error {
+	result, err := db.Exec(`DELETE FROM payments WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.NewNotFoundError(": paymentId: " + id)
+	}
+
+	if _, err := db.Exec(`DELETE FROM payment_events WHERE payment_id = ?`, id); err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM refunds WHERE payment_id = ?`, id)
+	return err
+}
+
+func (store *Store) ClearPayments() {
+	if _, err := store.db.Exec(`DELETE FROM payments`); err != nil {
+		log.Printf("sqlite: clear payments: %v", err)
+	}
+	if _, err := store.db.Exec(`DELETE FROM payment_events`); err != nil {
+		log.Printf("sqlite: clear payment events: %v", err)
+	}
+	if _, err := store.db.Exec(`DELETE FROM refunds`); err != nil {
+		log.Printf("sqlite: clear refunds: %v", err)
+	}
+}
+
+// paymentFilter renders the WHERE clause shared by the count and page queries
+func paymentFilter(query domain.PaymentQuery) (string, []any) {
+	var conditions []string
+	var args []any
+
+	if query.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, query.Status)
+	}
+	if query.Reviewed != nil {
+		conditions = append(conditions, "reviewed = ?")
+		args = append(args, *query.Reviewed)
+	}
+	if query.ReviewOutcome != "" {
+		conditions = append(conditions, "review_outcome = ?")
+		args = append(args, query.ReviewOutcome)
+	}
+	if query.Reviewer != "" {
+		conditions = append(conditions, "review_outcome != '' AND review_by = ?")
+		args = append(args, query.Reviewer)
+	}
+	if query.Search != "" {
+		// instr keeps the case-sensitive substring semantics of MemoryStore
+		conditions = append(conditions, "instr(id, ?) > 0")
+		args = append(args, query.Search)
+	}
+	if query.Merchants != nil {
+		if len(query.Merchants) == 0 {
+			conditions = append(conditions, "0")
+		} else {
+			conditions = append(conditions, "merchant_name IN (?"+strings.Repeat(", ?", len(query.Merchants)-1)+")")
+			for _, merchant := range query.Merchants {
+				args = append(args, merchant)
+			}
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func sortColumn(query domain.PaymentQuery) string {
+	if query.SortBy == domain.PaymentSortAmount {
+		return "amount"
+	}
+	return "date"
+}
+
+func paymentOrder(query domain.PaymentQuery) string {
+	direction := "DESC"
+	if query.Order == domain.SortAsc {
+		direction = "ASC"
+	}
+
+	return " ORDER BY " + sortColumn(query) + " " + direction + ", id " + direction
+}
+
+func (store *Store) QueryPayments(query domain.PaymentQuery) domain.PaymentPage {
+	page := domain.PaymentPage{Items: []*domain.Payment{}}
+	where, args := paymentFilter(query)
+
+	if err := store.db.QueryRow(`SELECT COUNT(*) FROM payments`+where, args...).Scan(&page.Total); err != nil {
+		log.Printf("sqlite: count payments: %v", err)
+		return page
+	}
+
+	if query.Limit <= 0 || page.Total == 0 {
+		return page
+	}
+
+	if query.Cursor != nil {
+		return store.queryPaymentsFromCursor(query, page)
+	}
+
+	rows, err := store.db.Query(`SELECT `+paymentColumns+` FROM payments`+where+paymentOrder(query)+` LIMIT ? OFFSET ?`,
+		append(args, query.Limit, max(query.Offset, 0))...)
+	if err != nil {
+		log.Printf("sqlite: query payments: %v", err)
+		return page
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			log.Printf("sqlite: query payments: %v", err)
+			return page
+		}
+		page.Items = append(page.Items, payment)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("sqlite: query payments: %v", err)
+	}
+
+	return page
+}
+
+// queryPaymentsFromCursor is keyset paging: rows are selected relative to the
+// cursor's (sort key, id) instead of by offset
+func (store *Store) queryPaymentsFromCursor(query domain.PaymentQuery, page domain.PaymentPage) domain.PaymentPage {
+	where, args := paymentFilter(query)
+	column := sortColumn(query)
+
+	var key any = query.Cursor.Date.UnixNano()
+	if column == "amount" {
+		key = query.Cursor.Amount
+	}
+
+	// walk away from the cursor: towards larger keys for forward-ascending and
+	// backward-descending pages, towards smaller keys otherwise
+	towardsLarger := (query.Order != domain.SortAsc) == query.Cursor.Backward
+	comparison, direction := "<", "DESC"
+	if towardsLarger {
+		comparison, direction = ">", "ASC"
+	}
+
+	keyset := "(" + column + " " + comparison + " ? OR (" + column + " = ? AND id " + comparison + " ?))"
+	if where == "" {
+		where = " WHERE " + keyset
+	} else {
+		where += " AND " + keyset
+	}
+	args = append(args, key, key, query.Cursor.ID, query.Limit+1)
+
+	rows, err := store.db.Query(`SELECT `+paymentColumns+` FROM payments`+where+
+		` ORDER BY `+column+` `+direction+`, id `+direction+` LIMIT ?`, args...)
+	if err != nil {
+		log.Printf("sqlite: query payments: %v", err)
+		return page
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			log.Printf("sqlite: query payments: %v", err)
+			return page
+		}
+		if len(page.Items) == query.Limit {
+			page.HasMore = true
+			break
+		}
+		page.Items = append(page.Items, payment)
+	}
+
+	if query.Cursor.Backward {
+		slices.Reverse(page.Items)
+	}
+
+	return page
+}
+
+func (store *Store) CountPaymentsByStatus(merchants []string) map[string]int {
+	counts := map[string]int{}
+
+	where, args := paymentFilter(domain.PaymentQuery{Merchants: merchants})
+	rows, err := store.db.Query(`SELECT status, COUNT(*) FROM payments`+where+` GROUP BY status`, args...)
+	if err != nil {
+		log.Printf("sqlite: count payments by status: %v", err)
+		return counts
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			log.Printf("sqlite: count payments by status: %v", err)
+			return counts
+		}
+		counts[status] = count
+	}
+
+	return counts
+}
@@ -0,0 +1,77 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"testing"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T) *Store {
+	store, err := NewStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLiteStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Store {
+		store := newTestStore(t)
+		require.NoError(t, seed.Apply(store, seed.Demo()))
+		return store
+	})
+}
+
+func TestSQLiteStore_Migrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	store, err := NewStore(path)
+	require.NoError(t, err)
+
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	var applied int
+	require.NoError(t, store.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied))
+	require.Equal(t, len(migrations), applied)
+	require.NoError(t, store.Close())
+
+	// Reopening an up to date database applies nothing new and keeps the data
+	store, err = NewStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied))
+	require.Equal(t, len(migrations), applied)
+}
+
+func TestSQLiteStore_SurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	store, err := NewStore(path)
+	require.NoError(t, err)
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+
+	payments := store.GetPaymentList()
+	require.Len(t, payments, 20)
+
+	reviewed := payments[0]
+	reviewed.Reviewed = true
+	store.UpdatePayment(reviewed)
+	require.NoError(t, store.Close())
+
+	store, err = NewStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	// Seeding again must not duplicate anything
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	require.Len(t, store.GetPaymentList(), 20)
+
+	persisted, exists := store.GetPaymentById(reviewed.ID)
+	require.True(t, exists)
+	require.True(t, persisted.Reviewed)
+}
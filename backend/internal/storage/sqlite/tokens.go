@@ -0,0 +1,86 @@
+package sqlite
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+)
+
+func (store *Store) IsTokenRevoked(jti string) bool {
+	var found int
+	err := store.db.QueryRow(`SELECT 1 FROM revoked_tokens WHERE jti = ?`, jti).Scan(&found)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			// fail closed, a token that cannot be checked is not accepted
+			log.Printf("sqlite: check revoked token %q: %v", jti, err)
+			return true
+		}
+		return false
+	}
+
+	return true
+}
+
+func (store *Store) PurgeExpiredTokens(now time.Time) error {
+	if _, err := store.db.Exec(`DELETE FROM refresh_tokens WHERE expires_at < ?`, now.UnixNano()); err != nil {
+		return err
+	}
+
+	if _, err := store.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < ?`, now.UnixNano()); err != nil {
+		return err
+	}
+
+	if _, err := store.db.Exec(`DELETE FROM password_resets WHERE expires_at < ?`, now.UnixNano()); err != nil {
+		return err
+	}
+
+	_, err := store.db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, now.UnixNano())
+	return err
+}
+
+func getRefreshToken(db querier, hash string) (*domain.RefreshToken, bool) {
+	token := &domain.RefreshToken{}
+	var expiresAt int64
+	var amr string
+	err := db.QueryRow(`SELECT hash, family, email, expires_at, amr, rotated, revoked FROM refresh_tokens WHERE hash = ?`, hash).
+		Scan(&token.Hash, &token.Family, &token.Email, &expiresAt, &amr, &token.Rotated, &token.Revoked)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("sqlite: get refresh token: %v", err)
+		}
+		return nil, false
+	}
+
+	token.ExpiresAt = time.Unix(0, expiresAt)
+	token.AMR = splitList(amr)
+	return token, true
+}
+
+func putRefreshToken(db querier, token *domain.RefreshToken) error {
+	_, err := db.Exec(`INSERT INTO refresh_tokens (hash, family, email, expires_at, amr, rotated, revoked) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(hash) DO UPDATE SET
+			family = excluded.family, email = excluded.email, expires_at = excluded.expires_at,
+			amr = excluded.amr, rotated = excluded.rotated, revoked = excluded.revoked`,
+		token.Hash, token.Family, token.Email, token.ExpiresAt.UnixNano(), strings.Join(token.AMR, " "), token.Rotated, token.Revoked)
+	return err
+}
+
+func revokeRefreshTokens(db querier, family string) error {
+	_, err := db.Exec(`UPDATE refresh_tokens SET revoked = 1 WHERE family = ?`, family)
+	return err
+}
+
+func revokeUserRefreshTokens(db querier, email string) error {
+	_, err := db.Exec(`UPDATE refresh_tokens SET revoked = 1 WHERE email = ?`, email)
+	return err
+}
+
+func revokeToken(db querier, token *domain.RevokedToken) error {
+	_, err := db.Exec(`INSERT INTO revoked_tokens (jti, expires_at) VALUES (?, ?)
+		ON CONFLICT(jti) DO UPDATE SET expires_at = max(expires_at, excluded.expires_at)`,
+		token.JTI, token.ExpiresAt.UnixNano())
+	return err
+}
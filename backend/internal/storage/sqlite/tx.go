@@ -0,0 +1,159 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+)
+
+var _ domain.Tx = (*sqliteTx)(nil)
+
+type sqliteTx struct {
+	tx *sql.Tx
+}
+
+// Update runs fn inside a database transaction. The pool holds a single
+// connection, so the transaction also excludes every other reader and writer
+// of this Store until it ends.
+func (store *Store) Update(fn func(tx domain.Tx) error) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+
+	if err := fn(&sqliteTx{tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (tx *sqliteTx) GetPaymentById(id string) (*domain.Payment, bool) {
+	return getPaymentById(tx.tx, id)
+}
+
+func (tx *sqliteTx) CreatePayment(payment *domain.Payment) error {
+	return createPayment(tx.tx, payment)
+}
+
+func (tx *sqliteTx) UpdatePayment(payment *domain.Payment) error {
+	return updatePayment(tx.tx, payment)
+}
+
+func (tx *sqliteTx) DeletePayment(id string) error {
+	return deletePayment(tx.tx, id)
+}
+
+func (tx *sqliteTx) AddPaymentEvent(event *domain.PaymentEvent) error {
+	return addPaymentEvent(tx.tx, event)
+}
+
+func (tx *sqliteTx) GetRefund(id string) (*domain.Refund, bool) {
+	return getRefund(tx.tx, id)
+}
+
+func (tx *sqliteTx) ListRefunds(paymentID string) []*domain.Refund {
+	return listRefunds(tx.tx, paymentID)
+}
+
+func (tx *sqliteTx) PutRefund(refund *domain.Refund) error {
+	return putRefund(tx.tx, refund)
+}
+
+func (tx *sqliteTx) GetUserByEmail(email string) (*domain.User, bool) {
+	return getUserByEmail(tx.tx, email)
+}
+
+func (tx *sqliteTx) CreateUser(user *domain.User) error {
+	return createUser(tx.tx, user)
+}
+
+func (tx *sqliteTx) UpdateUser(user *domain.User) error {
+	return updateUser(tx.tx, user)
+}
+
+func (tx *sqliteTx) DeleteUser(email string) error {
+	return deleteUser(tx.tx, email)
+}
+
+func (tx *sqliteTx) GetRefreshToken(hash string) (*domain.RefreshToken, bool) {
+	return getRefreshToken(tx.tx, hash)
+}
+
+func (tx *sqliteTx) PutRefreshToken(token *domain.RefreshToken) error {
+	return putRefreshToken(tx.tx, token)
+}
+
+func (tx *sqliteTx) RevokeRefreshTokens(family string) error {
+	return revokeRefreshTokens(tx.tx, family)
+}
+
+func (tx *sqliteTx) RevokeUserRefreshTokens(email string) error {
+	return revokeUserRefreshTokens(tx.tx, email)
+}
+
+func (tx *sqliteTx) RevokeToken(token *domain.RevokedToken) error {
+	return revokeToken(tx.tx, token)
+}
+
+func (tx *sqliteTx) GetSession(id string) (*domain.Session, bool) {
+	return getSession(tx.tx, id)
+}
+
+func (tx *sqliteTx) PutSession(session *domain.Session) error {
+	return putSession(tx.tx, session)
+}
+
+func (tx *sqliteTx) DeleteSession(id string) error {
+	return deleteSession(tx.tx, id)
+}
+
+func (tx *sqliteTx) DeleteUserSessions(email string) error {
+	return deleteUserSessions(tx.tx, email)
+}
+
+func (tx *sqliteTx) GetPasswordReset(email string) (*domain.PasswordReset, bool) {
+	return getPasswordReset(tx.tx, email)
+}
+
+func (tx *sqliteTx) PutPasswordReset(reset *domain.PasswordReset) error {
+	return putPasswordReset(tx.tx, reset)
+}
+
+func (tx *sqliteTx) DeletePasswordReset(email string) error {
+	return deletePasswordReset(tx.tx, email)
+}
+
+func (tx *sqliteTx) GetLoginAttempts(key string) (*domain.LoginAttempts, bool) {
+	return getLoginAttempts(tx.tx, key)
+}
+
+func (tx *sqliteTx) PutLoginAttempts(attempts *domain.LoginAttempts) error {
+	return putLoginAttempts(tx.tx, attempts)
+}
+
+func (tx *sqliteTx) DeleteLoginAttempts(key string) error {
+	return deleteLoginAttempts(tx.tx, key)
+}
+
+func (tx *sqliteTx) GetServiceAccount(name string) (*domain.ServiceAccount, bool) {
+	return getServiceAccount(tx.tx, name)
+}
+
+func (tx *sqliteTx) CreateServiceAccount(account *domain.ServiceAccount) error {
+	return createServiceAccount(tx.tx, account)
+}
+
+func (tx *sqliteTx) DeleteServiceAccount(name string) error {
+	return deleteServiceAccount(tx.tx, name)
+}
+
+func (tx *sqliteTx) GetAPIKey(id string) (*domain.APIKey, bool) {
+	return getAPIKey(tx.tx, id)
+}
+
+func (tx *sqliteTx) PutAPIKey(key *domain.APIKey) error {
+	return putAPIKey(tx.tx, key)
+}
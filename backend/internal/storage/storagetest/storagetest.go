@@ -0,0 +1,1216 @@
+// Package storagetest holds the behaviour every storage backend must share.
+// Backends run it from their own tests with a factory for a freshly seeded store.
+package storagetest
+
+import (
+	common_errors "errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/errors"
+	"abasithdev.github.io/internal-cs-center-backend/internal/password"
+	"github.com/stretchr/testify/require"
+)
+
+// Store is the surface exercised by the suite
+type Store interface {
+	domain.PaymentRepository
+	domain.UserRepository
+	domain.TokenRepository
+	domain.LoginAttemptRepository
+	domain.ServiceAccountRepository
+	ClearPayments()
+}
+
+// Run executes every scenario against stores built by newStore. The factory
+// must return an isolated store loaded with seed.Demo().
+func Run(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("GetUserByEmail", func(t *testing.T) { testGetUserByEmail(t, newStore(t)) })
+	t.Run("PaymentOperations", func(t *testing.T) { testPaymentOperations(t, newStore(t)) })
+	t.Run("ConcurrentAccess", func(t *testing.T) { testConcurrentAccess(t, newStore(t)) })
+	t.Run("CreateAndDeletePayment", func(t *testing.T) { testCreateAndDeletePayment(t, newStore(t)) })
+	t.Run("CreateAndDeleteUser", func(t *testing.T) { testCreateAndDeleteUser(t, newStore(t)) })
+	t.Run("QueryPayments", func(t *testing.T) { testQueryPayments(t, newStore(t)) })
+	t.Run("QueryPaymentsFromCursor", func(t *testing.T) { testQueryPaymentsFromCursor(t, newStore(t)) })
+	t.Run("PaymentVersions", func(t *testing.T) { testPaymentVersions(t, newStore(t)) })
+	t.Run("HandsOutCopies", func(t *testing.T) { testHandsOutCopies(t, newStore(t)) })
+	t.Run("Update", func(t *testing.T) { testUpdate(t, newStore(t)) })
+	t.Run("ConcurrentUpdates", func(t *testing.T) { testConcurrentUpdates(t, newStore(t)) })
+	t.Run("Tokens", func(t *testing.T) { testTokens(t, newStore(t)) })
+	t.Run("LoginAttempts", func(t *testing.T) { testLoginAttempts(t, newStore(t)) })
+	t.Run("ServiceAccounts", func(t *testing.T) { testServiceAccounts(t, newStore(t)) })
+	t.Run("Sessions", func(t *testing.T) { testSessions(t, newStore(t)) })
+	t.Run("PasswordResets", func(t *testing.T) { testPasswordResets(t, newStore(t)) })
+	t.Run("PaymentEvents", func(t *testing.T) { testPaymentEvents(t, newStore(t)) })
+	t.Run("PaymentReviews", func(t *testing.T) { testPaymentReviews(t, newStore(t)) })
+	t.Run("Refunds", func(t *testing.T) { testRefunds(t, newStore(t)) })
+}
+
+func testGetUserByEmail(t *testing.T, store Store) {
+	// Test existing user (from seed data)
+	user, exists := store.GetUserByEmail("john-cs@durianpay.id")
+	require.True(t, exists)
+	require.Equal(t, "john-cs@durianpay.id", user.Email)
+	require.Equal(t, "cs", user.Role)
+
+	// the seeded password is stored hashed
+	require.NotEqual(t, "admin123", user.PasswordHash)
+	match, needsRehash := password.Verify(user.PasswordHash, "admin123")
+	require.True(t, match)
+	require.False(t, needsRehash)
+
+	// Test non-existent user
+	_, exists = store.GetUserByEmail("nonexistent@example.com")
+	require.False(t, exists)
+}
+
+func testPaymentOperations(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+	now := time.Now()
+
+	// Test GetPaymentList with empty store
+	initial := store.GetPaymentList()
+	require.Empty(t, initial)
+
+	// Test UpdatePayment
+	payment := &domain.Payment{
+		ID:           "test1",
+		MerchantName: "Test Merchant",
+		Date:         now,
+		Amount:       100.0,
+		Status:       "processing",
+		Reviewed:     false,
+	}
+	store.UpdatePayment(payment)
+
+	// Test GetPaymentById
+	retrieved, exists := store.GetPaymentById("test1")
+	require.True(t, exists)
+	require.Equal(t, payment.ID, retrieved.ID)
+	require.Equal(t, payment.MerchantName, retrieved.MerchantName)
+	require.True(t, payment.Date.Equal(retrieved.Date))
+	require.Equal(t, payment.Amount, retrieved.Amount)
+	require.Equal(t, payment.Status, retrieved.Status)
+	require.Equal(t, payment.Reviewed, retrieved.Reviewed)
+
+	// Test GetPaymentList after adding
+	list := store.GetPaymentList()
+	require.Len(t, list, 1)
+	require.Equal(t, payment.ID, list[0].ID)
+
+	// Test updating existing payment
+	payment.Status = "completed"
+	payment.Reviewed = true
+	store.UpdatePayment(payment)
+
+	updated, exists := store.GetPaymentById("test1")
+	require.True(t, exists)
+	require.Equal(t, "completed", updated.Status)
+	require.True(t, updated.Reviewed)
+
+	// Test non-existent payment
+	_, exists = store.GetPaymentById("nonexistent")
+	require.False(t, exists)
+}
+
+func testConcurrentAccess(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+	done := make(chan bool)
+
+	// Concurrent reads
+	for i := 0; i < 10; i++ {
+		go func() {
+			store.GetUserByEmail("john-cs@durianpay.id")
+			store.GetPaymentList()
+			done <- true
+		}()
+	}
+
+	// Concurrent writes
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			payment := &domain.Payment{
+				ID:     fmt.Sprintf("payment%d", i),
+				Status: "processing",
+			}
+			store.UpdatePayment(payment)
+			done <- true
+		}(i)
+	}
+
+	// Wait for all goroutines
+	for i := 0; i < 20; i++ {
+		<-done
+	}
+
+	// Verify final state
+	payments := store.GetPaymentList()
+	require.Len(t, payments, 10)
+}
+
+func testCreateAndDeletePayment(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+
+	payment := &domain.Payment{ID: "test1", Status: "processing"}
+	require.NoError(t, store.CreatePayment(payment))
+
+	// Creating the same ID twice is rejected
+	err := store.CreatePayment(&domain.Payment{ID: "test1"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "paymentId: test1")
+
+	require.NoError(t, store.DeletePayment("test1"))
+	_, exists := store.GetPaymentById("test1")
+	require.False(t, exists)
+
+	// Deleting a missing payment returns not found
+	err = store.DeletePayment("test1")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Data not found")
+}
+
+func testCreateAndDeleteUser(t *testing.T, store Store) {
+	user := &domain.User{Email: "new@durianpay.id", PasswordHash: "$argon2id$stored", Role: "cs"}
+	require.NoError(t, store.CreateUser(user))
+
+	retrieved, exists := store.GetUserByEmail("new@durianpay.id")
+	require.True(t, exists)
+	require.Equal(t, "cs", retrieved.Role)
+	require.Equal(t, "$argon2id$stored", retrieved.PasswordHash)
+
+	retrieved.PasswordHash = "$argon2id$changed"
+	retrieved.Role = "operational"
+	require.NoError(t, store.UpdateUser(retrieved))
+	updated, _ := store.GetUserByEmail("new@durianpay.id")
+	require.Equal(t, "$argon2id$changed", updated.PasswordHash)
+	require.Equal(t, "operational", updated.Role)
+
+	updated.Disabled = true
+	require.NoError(t, store.UpdateUser(updated))
+	disabled, _ := store.GetUserByEmail("new@durianpay.id")
+	require.True(t, disabled.Disabled)
+
+	disabled.MFAEnabled = true
+	disabled.TOTPSecret = "JBSWY3DPEHPK3PXP"
+	disabled.TOTPLastStep = 57000000
+	disabled.RecoveryCodes = []string{"hash-a", "hash-b"}
+	disabled.MustChangePassword = true
+	disabled.Merchants = []string{"Acme Store", "Corner Shop"}
+	disabled.MerchantGroups = []string{"retail"}
+	disabled.AllMerchants = true
+	require.NoError(t, store.UpdateUser(disabled))
+	enrolled, _ := store.GetUserByEmail("new@durianpay.id")
+	require.Equal(t, disabled, enrolled)
+	enrolled.RecoveryCodes[0] = "changed"
+	again, _ := store.GetUserByEmail("new@durianpay.id")
+	require.Equal(t, []string{"hash-a", "hash-b"}, again.RecoveryCodes, "recovery codes are copied")
+
+	emails := []string{}
+	for _, user := range store.ListUsers() {
+		emails = append(emails, user.Email)
+	}
+	require.Equal(t, []string{"admin@durianpay.id", "jane-operational@durianpay.id", "john-cs@durianpay.id", "new@durianpay.id"}, emails)
+
+	err := store.UpdateUser(&domain.User{Email: "ghost@durianpay.id", Role: "cs"})
+	var notFoundErr *errors.NotFoundError
+	require.True(t, common_errors.As(err, &notFoundErr), "expected NotFoundError, got %v", err)
+
+	// Seeded users cannot be created twice
+	err = store.CreateUser(&domain.User{Email: "john-cs@durianpay.id"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Data already exists")
+
+	require.NoError(t, store.DeleteUser("new@durianpay.id"))
+	_, exists = store.GetUserByEmail("new@durianpay.id")
+	require.False(t, exists)
+
+	err = store.DeleteUser("new@durianpay.id")
+	require.Error(t, err)
+}
+
+func ids(payments []*domain.Payment) []string {
+	result := make([]string, 0, len(payments))
+	for _, p := range payments {
+		result = append(result, p.ID)
+	}
+	return result
+}
+
+func testQueryPayments(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+	now := time.Now()
+	reviewed, notReviewed := true, false
+
+	for _, p := range []*domain.Payment{
+		{ID: "pay-a", MerchantName: "Acme Store", Date: now.Add(-3 * time.Hour), Amount: 300, Status: "completed"},
+		{ID: "pay-b", Date: now.Add(-2 * time.Hour), Amount: 100, Status: "failed", Reviewed: true},
+		{ID: "pay-c", MerchantName: "Acme Store", Date: now.Add(-1 * time.Hour), Amount: 200, Status: "completed"},
+		{ID: "pay-d", Date: now.Add(-1 * time.Hour), Amount: 200, Status: "processing"},
+		{ID: "other", MerchantName: "Corner Shop", Date: now, Amount: 50, Status: "failed"},
+	} {
+		require.NoError(t, store.CreatePayment(p))
+	}
+
+	tests := []struct {
+		name      string
+		query     domain.PaymentQuery
+		wantTotal int
+		wantIDs   []string
+	}{
+		{
+			name:      "default sort is date desc with id tie-break",
+			query:     domain.PaymentQuery{Limit: 10},
+			wantTotal: 5,
+			wantIDs:   []string{"other", "pay-d", "pay-c", "pay-b", "pay-a"},
+		},
+		{
+			name:      "amount asc",
+			query:     domain.PaymentQuery{SortBy: domain.PaymentSortAmount, Order: domain.SortAsc, Limit: 10},
+			wantTotal: 5,
+			wantIDs:   []string{"other", "pay-b", "pay-c", "pay-d", "pay-a"},
+		},
+		{
+			name:      "status filter",
+			query:     domain.PaymentQuery{Status: "completed", Order: domain.SortAsc, Limit: 10},
+			wantTotal: 2,
+			wantIDs:   []string{"pay-a", "pay-c"},
+		},
+		{
+			name:      "reviewed filter",
+			query:     domain.PaymentQuery{Reviewed: &reviewed, Limit: 10},
+			wantTotal: 1,
+			wantIDs:   []string{"pay-b"},
+		},
+		{
+			name:      "status and reviewed filter",
+			query:     domain.PaymentQuery{Status: "failed", Reviewed: &notReviewed, Limit: 10},
+			wantTotal: 1,
+			wantIDs:   []string{"other"},
+		},
+		{
+			name:      "search with paging",
+			query:     domain.PaymentQuery{Search: "pay-", Offset: 1, Limit: 2},
+			wantTotal: 4,
+			wantIDs:   []string{"pay-c", "pay-b"},
+		},
+		{
+			name:      "merchant filter",
+			query:     domain.PaymentQuery{Merchants: []string{"Acme Store", "Corner Shop"}, Limit: 10},
+			wantTotal: 3,
+			wantIDs:   []string{"other", "pay-c", "pay-a"},
+		},
+		{
+			name:      "merchant filter by amount with paging",
+			query:     domain.PaymentQuery{Merchants: []string{"Corner Shop", "Acme Store"}, SortBy: domain.PaymentSortAmount, Order: domain.SortAsc, Offset: 1, Limit: 1},
+			wantTotal: 3,
+			wantIDs:   []string{"pay-c"},
+		},
+		{
+			name:      "merchant and reviewed filter",
+			query:     domain.PaymentQuery{Merchants: []string{"Acme Store", "Corner Shop"}, Reviewed: &notReviewed, Order: domain.SortAsc, Limit: 10},
+			wantTotal: 3,
+			wantIDs:   []string{"pay-a", "pay-c", "other"},
+		},
+		{
+			name:      "merchant and status filter",
+			query:     domain.PaymentQuery{Status: "completed", Merchants: []string{"Corner Shop"}, Limit: 10},
+			wantTotal: 0,
+			wantIDs:   []string{},
+		},
+		{
+			name:      "no merchants",
+			query:     domain.PaymentQuery{Merchants: []string{}, Limit: 10},
+			wantTotal: 0,
+			wantIDs:   []string{},
+		},
+		{
+			name:      "page straight off the index",
+			query:     domain.PaymentQuery{Offset: 4, Limit: 2},
+			wantTotal: 5,
+			wantIDs:   []string{"pay-a"},
+		},
+		{
+			name:      "count only",
+			query:     domain.PaymentQuery{Status: "failed"},
+			wantTotal: 2,
+			wantIDs:   []string{},
+		},
+		{
+			name:      "unknown status",
+			query:     domain.PaymentQuery{Status: "refunded", Limit: 10},
+			wantTotal: 0,
+			wantIDs:   []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := store.QueryPayments(tt.query)
+			require.Equal(t, tt.wantTotal, page.Total)
+			require.Equal(t, tt.wantIDs, ids(page.Items))
+		})
+	}
+
+	require.Equal(t, map[string]int{"completed": 2, "failed": 2, "processing": 1}, store.CountPaymentsByStatus(nil))
+	require.Equal(t, map[string]int{"completed": 2, "failed": 1}, store.CountPaymentsByStatus([]string{"Acme Store", "Corner Shop", "Acme Store", "Nobody"}))
+	require.Empty(t, store.CountPaymentsByStatus([]string{}))
+
+	// Updates move payments between indexes
+	moved, _ := store.GetPaymentById("pay-d")
+	moved.Status = "completed"
+	moved.Reviewed = true
+	moved.Amount = 1000
+	moved.MerchantName = "Acme Store"
+	store.UpdatePayment(moved)
+
+	page := store.QueryPayments(domain.PaymentQuery{Status: "completed", SortBy: domain.PaymentSortAmount, Limit: 10})
+	require.Equal(t, []string{"pay-d", "pay-a", "pay-c"}, ids(page.Items))
+	require.Zero(t, store.QueryPayments(domain.PaymentQuery{Status: "processing"}).Total)
+	require.Equal(t, 2, store.QueryPayments(domain.PaymentQuery{Reviewed: &reviewed}).Total)
+
+	require.NoError(t, store.DeletePayment("pay-a"))
+	require.Equal(t, map[string]int{"completed": 2, "failed": 2}, store.CountPaymentsByStatus(nil))
+	require.Equal(t, map[string]int{"completed": 2}, store.CountPaymentsByStatus([]string{"Acme Store"}))
+
+	store.ClearPayments()
+	require.Zero(t, store.QueryPayments(domain.PaymentQuery{}).Total)
+	require.Empty(t, store.CountPaymentsByStatus(nil))
+}
+
+func testQueryPaymentsFromCursor(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+	now := time.Now()
+
+	// pay-b and pay-c share a date so the ID tie-break matters
+	for _, p := range []*domain.Payment{
+		{ID: "pay-a", MerchantName: "Acme Store", Date: now.Add(-3 * time.Hour), Amount: 300, Status: "failed"},
+		{ID: "pay-b", MerchantName: "Corner Shop", Date: now.Add(-2 * time.Hour), Amount: 100, Status: "failed"},
+		{ID: "pay-c", MerchantName: "Acme Store", Date: now.Add(-2 * time.Hour), Amount: 200, Status: "completed"},
+		{ID: "pay-d", MerchantName: "Travel Co", Date: now.Add(-1 * time.Hour), Amount: 400, Status: "failed"},
+	} {
+		require.NoError(t, store.CreatePayment(p))
+	}
+
+	b, _ := store.GetPaymentById("pay-b")
+	c, _ := store.GetPaymentById("pay-c")
+
+	tests := []struct {
+		name        string
+		query       domain.PaymentQuery
+		wantIDs     []string
+		wantHasMore bool
+	}{
+		{
+			name:        "forward desc after tie",
+			query:       domain.PaymentQuery{Limit: 1, Cursor: &domain.PaymentCursor{Date: c.Date, ID: "pay-c"}},
+			wantIDs:     []string{"pay-b"},
+			wantHasMore: true,
+		},
+		{
+			name:    "forward desc reaches the end",
+			query:   domain.PaymentQuery{Limit: 5, Cursor: &domain.PaymentCursor{Date: c.Date, ID: "pay-c"}},
+			wantIDs: []string{"pay-b", "pay-a"},
+		},
+		{
+			name:    "backward desc",
+			query:   domain.PaymentQuery{Limit: 5, Cursor: &domain.PaymentCursor{Date: b.Date, ID: "pay-b", Backward: true}},
+			wantIDs: []string{"pay-d", "pay-c"},
+		},
+		{
+			name:        "backward asc keeps page order",
+			query:       domain.PaymentQuery{Order: domain.SortAsc, Limit: 1, Cursor: &domain.PaymentCursor{Date: c.Date, ID: "pay-c", Backward: true}},
+			wantIDs:     []string{"pay-b"},
+			wantHasMore: true,
+		},
+		{
+			name:    "amount asc with status filter",
+			query:   domain.PaymentQuery{Status: "failed", SortBy: domain.PaymentSortAmount, Order: domain.SortAsc, Limit: 5, Cursor: &domain.PaymentCursor{Amount: 100, ID: "pay-b"}},
+			wantIDs: []string{"pay-a", "pay-d"},
+		},
+		{
+			name:    "forward desc over merchants",
+			query:   domain.PaymentQuery{Merchants: []string{"Acme Store", "Corner Shop"}, Limit: 5, Cursor: &domain.PaymentCursor{Date: c.Date, ID: "pay-c"}},
+			wantIDs: []string{"pay-b", "pay-a"},
+		},
+		{
+			name:        "backward asc over merchants",
+			query:       domain.PaymentQuery{Merchants: []string{"Acme Store", "Corner Shop"}, Order: domain.SortAsc, Limit: 1, Cursor: &domain.PaymentCursor{Date: c.Date, ID: "pay-c", Backward: true}},
+			wantIDs:     []string{"pay-b"},
+			wantHasMore: true,
+		},
+		{
+			name:    "amount desc over merchants with status filter",
+			query:   domain.PaymentQuery{Status: "failed", Merchants: []string{"Acme Store", "Corner Shop"}, SortBy: domain.PaymentSortAmount, Limit: 5, Cursor: &domain.PaymentCursor{Amount: 350, ID: "gone"}},
+			wantIDs: []string{"pay-a", "pay-b"},
+		},
+		{
+			name:    "cursor row no longer exists",
+			query:   domain.PaymentQuery{SortBy: domain.PaymentSortAmount, Limit: 5, Cursor: &domain.PaymentCursor{Amount: 250, ID: "gone"}},
+			wantIDs: []string{"pay-c", "pay-b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := store.QueryPayments(tt.query)
+			require.Equal(t, tt.wantIDs, ids(page.Items))
+			require.Equal(t, tt.wantHasMore, page.HasMore)
+		})
+	}
+}
+
+func testPaymentVersions(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+
+	created := &domain.Payment{ID: "versioned", Status: "processing"}
+	require.NoError(t, store.CreatePayment(created))
+	require.Equal(t, int64(1), created.Version)
+
+	first, _ := store.GetPaymentById("versioned")
+	second, _ := store.GetPaymentById("versioned")
+	require.Equal(t, int64(1), first.Version)
+
+	// two writers start from version 1, the second one must lose
+	firstCopy, secondCopy := *first, *second
+	firstCopy.Status = "completed"
+	require.NoError(t, store.UpdatePayment(&firstCopy))
+	require.Equal(t, int64(2), firstCopy.Version)
+
+	secondCopy.Reviewed = true
+	err := store.UpdatePayment(&secondCopy)
+	var conflictErr *errors.ConflictError
+	require.True(t, common_errors.As(err, &conflictErr), "expected ConflictError, got %v", err)
+	require.Equal(t, int64(1), secondCopy.Version)
+
+	stored, _ := store.GetPaymentById("versioned")
+	require.Equal(t, "completed", stored.Status)
+	require.False(t, stored.Reviewed)
+	require.Equal(t, int64(2), stored.Version)
+
+	// an upsert of an unknown payment starts at version 1 whatever it carries
+	fresh := &domain.Payment{ID: "fresh", Status: "failed", Version: 7}
+	require.NoError(t, store.UpdatePayment(fresh))
+	require.Equal(t, int64(1), fresh.Version)
+}
+
+func testHandsOutCopies(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+
+	payment := &domain.Payment{ID: "copied", Status: "processing", Amount: 10}
+	require.NoError(t, store.CreatePayment(payment))
+
+	// neither the written struct nor anything read back aliases the stored payment
+	payment.Status = "changed"
+	byID, _ := store.GetPaymentById("copied")
+	byID.Amount = 99
+	store.GetPaymentList()[0].Reviewed = true
+	store.QueryPayments(domain.PaymentQuery{Limit: 1}).Items[0].Status = "changed"
+
+	stored, _ := store.GetPaymentById("copied")
+	require.Equal(t, "processing", stored.Status)
+	require.Equal(t, 10.0, stored.Amount)
+	require.False(t, stored.Reviewed)
+
+	user, _ := store.GetUserByEmail("john-cs@durianpay.id")
+	user.Role = "operational"
+	user, _ = store.GetUserByEmail("john-cs@durianpay.id")
+	require.Equal(t, "cs", user.Role)
+}
+
+func testUpdate(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "from", Amount: 100, Status: "completed"}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "to", Amount: 0, Status: "completed"}))
+
+	// a failing callback leaves no trace
+	errAbort := common_errors.New("abort")
+	err := store.Update(func(tx domain.Tx) error {
+		from, _ := tx.GetPaymentById("from")
+		from.Amount = 0
+		require.NoError(t, tx.UpdatePayment(from))
+		require.NoError(t, tx.CreatePayment(&domain.Payment{ID: "ghost", Status: "failed"}))
+		require.NoError(t, tx.DeleteUser("jane-operational@durianpay.id"))
+
+		// the transaction reads its own writes
+		staged, _ := tx.GetPaymentById("from")
+		require.Equal(t, 0.0, staged.Amount)
+		_, exists := tx.GetUserByEmail("jane-operational@durianpay.id")
+		require.False(t, exists)
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+
+	from, _ := store.GetPaymentById("from")
+	require.Equal(t, 100.0, from.Amount)
+	require.Equal(t, int64(1), from.Version)
+	_, exists := store.GetPaymentById("ghost")
+	require.False(t, exists)
+	_, exists = store.GetUserByEmail("jane-operational@durianpay.id")
+	require.True(t, exists)
+
+	// a successful one applies every write
+	err = store.Update(func(tx domain.Tx) error {
+		from, _ := tx.GetPaymentById("from")
+		to, _ := tx.GetPaymentById("to")
+		from.Amount, to.Amount = 40, 60
+		if err := tx.UpdatePayment(from); err != nil {
+			return err
+		}
+		if err := tx.UpdatePayment(to); err != nil {
+			return err
+		}
+		return tx.CreateUser(&domain.User{Email: "auditor@durianpay.id", Role: "operational"})
+	})
+	require.NoError(t, err)
+
+	from, _ = store.GetPaymentById("from")
+	to, _ := store.GetPaymentById("to")
+	require.Equal(t, 40.0, from.Amount)
+	require.Equal(t, 60.0, to.Amount)
+	require.Equal(t, int64(2), to.Version)
+	_, exists = store.GetUserByEmail("auditor@durianpay.id")
+	require.True(t, exists)
+
+	// errors from inside the transaction come back unchanged
+	err = store.Update(func(tx domain.Tx) error {
+		return tx.CreatePayment(&domain.Payment{ID: "from"})
+	})
+	var existsErr *errors.AlreadyExistsError
+	require.True(t, common_errors.As(err, &existsErr), "expected AlreadyExistsError, got %v", err)
+}
+
+// testConcurrentUpdates moves amounts between payments from many goroutines
+// while others read and scribble on what they read. The total only stays put
+// when every read-modify-write is atomic; run with -race to also catch shared
+// pointers.
+func testConcurrentUpdates(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+
+	const accounts, workers, transfers = 5, 8, 25
+	for i := 0; i < accounts; i++ {
+		require.NoError(t, store.CreatePayment(&domain.Payment{ID: fmt.Sprintf("account%d", i), Amount: 100, Status: "completed"}))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < transfers; i++ {
+				from := fmt.Sprintf("account%d", (w+i)%accounts)
+				to := fmt.Sprintf("account%d", (w+i+1)%accounts)
+
+				err := store.Update(func(tx domain.Tx) error {
+					source, _ := tx.GetPaymentById(from)
+					target, _ := tx.GetPaymentById(to)
+					source.Amount--
+					target.Amount++
+					if err := tx.UpdatePayment(source); err != nil {
+						return err
+					}
+					return tx.UpdatePayment(target)
+				})
+				if err != nil {
+					t.Errorf("transfer: %v", err)
+					return
+				}
+			}
+		}(w)
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < transfers; i++ {
+				for _, payment := range store.GetPaymentList() {
+					payment.Amount = -1
+				}
+				page := store.QueryPayments(domain.PaymentQuery{Limit: accounts})
+				for _, payment := range page.Items {
+					payment.Reviewed = true
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0.0
+	var versions int64
+	for _, payment := range store.GetPaymentList() {
+		require.False(t, payment.Reviewed)
+		total += payment.Amount
+		versions += payment.Version
+	}
+	require.Equal(t, 100.0*accounts, total)
+	// every transfer wrote two payments once each on top of the initial versions
+	require.Equal(t, int64(accounts+2*workers*transfers), versions)
+}
+
+func testTokens(t *testing.T, store Store) {
+	now := time.Now()
+	put := func(token *domain.RefreshToken) {
+		require.NoError(t, store.Update(func(tx domain.Tx) error {
+			return tx.PutRefreshToken(token)
+		}))
+	}
+	get := func(hash string) (*domain.RefreshToken, bool) {
+		var token *domain.RefreshToken
+		var exists bool
+		require.NoError(t, store.Update(func(tx domain.Tx) error {
+			token, exists = tx.GetRefreshToken(hash)
+			return nil
+		}))
+		return token, exists
+	}
+
+	put(&domain.RefreshToken{Hash: "a1", Family: "a", Email: "john-cs@durianpay.id", ExpiresAt: now.Add(time.Hour)})
+	put(&domain.RefreshToken{Hash: "b1", Family: "b", Email: "john-cs@durianpay.id", ExpiresAt: now.Add(time.Hour), AMR: []string{"pwd", "otp", "mfa"}})
+	put(&domain.RefreshToken{Hash: "old", Family: "c", Email: "john-cs@durianpay.id", ExpiresAt: now.Add(-time.Hour)})
+
+	token, exists := get("a1")
+	require.True(t, exists)
+	require.Equal(t, "a", token.Family)
+	require.True(t, token.ExpiresAt.Equal(now.Add(time.Hour)))
+	require.False(t, token.Rotated)
+	require.Nil(t, token.AMR)
+	token, _ = get("b1")
+	require.Equal(t, []string{"pwd", "otp", "mfa"}, token.AMR)
+	_, exists = get("missing")
+	require.False(t, exists)
+
+	// rotating and revoking in one transaction, including a token staged in it
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		current, _ := tx.GetRefreshToken("a1")
+		current.Rotated = true
+		require.NoError(t, tx.PutRefreshToken(current))
+		require.NoError(t, tx.PutRefreshToken(&domain.RefreshToken{Hash: "a2", Family: "a", Email: current.Email, ExpiresAt: now.Add(time.Hour)}))
+		return tx.RevokeRefreshTokens("a")
+	}))
+
+	for _, hash := range []string{"a1", "a2"} {
+		token, _ := get(hash)
+		require.True(t, token.Revoked, hash)
+	}
+	token, _ = get("a1")
+	require.True(t, token.Rotated)
+	token, _ = get("b1")
+	require.False(t, token.Revoked, "other families are left alone")
+
+	// a rolled back revocation leaves no trace
+	errAbort := common_errors.New("abort")
+	err := store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.RevokeRefreshTokens("b"))
+		require.NoError(t, tx.RevokeToken(&domain.RevokedToken{JTI: "ghost", ExpiresAt: now.Add(time.Hour)}))
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+	token, _ = get("b1")
+	require.False(t, token.Revoked)
+	require.False(t, store.IsTokenRevoked("ghost"))
+
+	// denylist
+	require.False(t, store.IsTokenRevoked("jti-1"))
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		if err := tx.RevokeToken(&domain.RevokedToken{JTI: "jti-1", ExpiresAt: now.Add(time.Hour)}); err != nil {
+			return err
+		}
+		return tx.RevokeToken(&domain.RevokedToken{JTI: "jti-old", ExpiresAt: now.Add(-time.Hour)})
+	}))
+	require.True(t, store.IsTokenRevoked("jti-1"))
+	require.True(t, store.IsTokenRevoked("jti-old"))
+
+	// revoking the tokens of a user, including one staged in the transaction
+	put(&domain.RefreshToken{Hash: "admin1", Family: "d", Email: "admin@durianpay.id", ExpiresAt: now.Add(time.Hour)})
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.PutRefreshToken(&domain.RefreshToken{Hash: "b2", Family: "b", Email: "john-cs@durianpay.id", ExpiresAt: now.Add(time.Hour)}))
+		return tx.RevokeUserRefreshTokens("john-cs@durianpay.id")
+	}))
+	for _, hash := range []string{"b1", "b2"} {
+		token, _ := get(hash)
+		require.True(t, token.Revoked, hash)
+	}
+	token, _ = get("admin1")
+	require.False(t, token.Revoked, "other users are left alone")
+
+	// purging drops only what expired
+	require.NoError(t, store.PurgeExpiredTokens(now))
+	_, exists = get("old")
+	require.False(t, exists)
+	_, exists = get("b1")
+	require.True(t, exists)
+	require.False(t, store.IsTokenRevoked("jti-old"))
+	require.True(t, store.IsTokenRevoked("jti-1"))
+
+	// nothing left to purge is not an error
+	require.NoError(t, store.PurgeExpiredTokens(now))
+}
+
+func testLoginAttempts(t *testing.T, store Store) {
+	now := time.Now()
+	get := func(key string) (*domain.LoginAttempts, bool) {
+		var attempts *domain.LoginAttempts
+		var exists bool
+		require.NoError(t, store.Update(func(tx domain.Tx) error {
+			attempts, exists = tx.GetLoginAttempts(key)
+			return nil
+		}))
+		return attempts, exists
+	}
+
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.PutLoginAttempts(&domain.LoginAttempts{Key: "account:a", Failures: 1, LastFailure: now}))
+		require.NoError(t, tx.PutLoginAttempts(&domain.LoginAttempts{Key: "account:old", Failures: 3, LastFailure: now.Add(-2 * time.Hour)}))
+		require.NoError(t, tx.PutLoginAttempts(&domain.LoginAttempts{
+			Key: "account:locked", Failures: 10, LastFailure: now.Add(-2 * time.Hour), LockedUntil: now.Add(time.Hour),
+		}))
+
+		// read your writes, then overwrite
+		attempts, exists := tx.GetLoginAttempts("account:a")
+		require.True(t, exists)
+		attempts.Failures++
+		return tx.PutLoginAttempts(attempts)
+	}))
+
+	attempts, exists := get("account:a")
+	require.True(t, exists)
+	require.Equal(t, 2, attempts.Failures)
+	require.True(t, attempts.LastFailure.Equal(now))
+	require.True(t, attempts.LockedUntil.IsZero())
+	locked, _ := get("account:locked")
+	require.True(t, locked.LockedUntil.Equal(now.Add(time.Hour)))
+
+	// rolled back writes leave no trace
+	errAbort := common_errors.New("abort")
+	err := store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.DeleteLoginAttempts("account:a"))
+		_, exists := tx.GetLoginAttempts("account:a")
+		require.False(t, exists)
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+	_, exists = get("account:a")
+	require.True(t, exists)
+
+	// only attempts whose failure and lockout both lie before the cut-off are purged
+	require.NoError(t, store.PurgeLoginAttempts(now.Add(-time.Hour)))
+	_, exists = get("account:old")
+	require.False(t, exists)
+	_, exists = get("account:locked")
+	require.True(t, exists)
+	_, exists = get("account:a")
+	require.True(t, exists)
+
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.DeleteLoginAttempts("account:a"))
+		return tx.DeleteLoginAttempts("account:missing")
+	}))
+	_, exists = get("account:a")
+	require.False(t, exists)
+}
+
+func testServiceAccounts(t *testing.T, store Store) {
+	now := time.Now()
+	expires := now.Add(time.Hour)
+
+	require.Empty(t, store.ListServiceAccounts())
+
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.CreateServiceAccount(&domain.ServiceAccount{Name: "recon", Role: domain.RoleOperational, CreatedBy: "admin@test.com", CreatedAt: now}))
+		require.NoError(t, tx.CreateServiceAccount(&domain.ServiceAccount{Name: "exporter", Role: domain.RoleCS, Description: "nightly export", CreatedAt: now}))
+
+		var alreadyExists *errors.AlreadyExistsError
+		require.ErrorAs(t, tx.CreateServiceAccount(&domain.ServiceAccount{Name: "recon", Role: domain.RoleCS, CreatedAt: now}), &alreadyExists)
+
+		require.NoError(t, tx.PutAPIKey(&domain.APIKey{ID: "key2", Account: "recon", Hash: "h2", Scopes: []string{"payments:read"}, CreatedAt: now.Add(time.Second)}))
+		require.NoError(t, tx.PutAPIKey(&domain.APIKey{
+			ID: "key1", Account: "recon", Hash: "h1", Scopes: []string{"payments:read", "payments:write"}, CreatedAt: now, ExpiresAt: &expires,
+		}))
+		require.NoError(t, tx.PutAPIKey(&domain.APIKey{ID: "key3", Account: "exporter", Hash: "h3", Scopes: []string{"payments:read"}, CreatedAt: now}))
+
+		var notFound *errors.NotFoundError
+		require.ErrorAs(t, tx.PutAPIKey(&domain.APIKey{ID: "key4", Account: "missing", Hash: "h4", CreatedAt: now}), &notFound)
+
+		// read your writes, then overwrite
+		key, exists := tx.GetAPIKey("key1")
+		require.True(t, exists)
+		key.LastUsedAt = &now
+		return tx.PutAPIKey(key)
+	}))
+
+	accounts := store.ListServiceAccounts()
+	require.Len(t, accounts, 2)
+	require.Equal(t, "exporter", accounts[0].Name)
+	require.Equal(t, "nightly export", accounts[0].Description)
+	require.Equal(t, "recon", accounts[1].Name)
+	require.Equal(t, "admin@test.com", accounts[1].CreatedBy)
+	require.True(t, accounts[1].CreatedAt.Equal(now))
+
+	keys := store.ListAPIKeys("recon")
+	require.Len(t, keys, 2)
+	require.Equal(t, "key1", keys[0].ID)
+	require.Equal(t, "key2", keys[1].ID)
+	require.Equal(t, "h1", keys[0].Hash)
+	require.Equal(t, []string{"payments:read", "payments:write"}, keys[0].Scopes)
+	require.True(t, keys[0].ExpiresAt.Equal(expires))
+	require.True(t, keys[0].LastUsedAt.Equal(now))
+	require.Nil(t, keys[0].RevokedAt)
+	require.Nil(t, keys[1].ExpiresAt)
+	require.Empty(t, store.ListAPIKeys("missing"))
+
+	// keys handed out are copies
+	key, exists := store.GetAPIKey("key1")
+	require.True(t, exists)
+	key.Scopes[0] = "users:manage"
+	*key.ExpiresAt = now
+	key, _ = store.GetAPIKey("key1")
+	require.Equal(t, "payments:read", key.Scopes[0])
+	require.True(t, key.ExpiresAt.Equal(expires))
+
+	// rolled back writes leave no trace
+	errAbort := common_errors.New("abort")
+	err := store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.DeleteServiceAccount("recon"))
+		_, exists := tx.GetAPIKey("key1")
+		require.False(t, exists)
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+	_, exists = store.GetServiceAccount("recon")
+	require.True(t, exists)
+
+	// deleting an account drops its keys
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		return tx.DeleteServiceAccount("recon")
+	}))
+	_, exists = store.GetServiceAccount("recon")
+	require.False(t, exists)
+	_, exists = store.GetAPIKey("key1")
+	require.False(t, exists)
+	require.Empty(t, store.ListAPIKeys("recon"))
+	_, exists = store.GetAPIKey("key3")
+	require.True(t, exists)
+
+	var notFound *errors.NotFoundError
+	require.ErrorAs(t, store.Update(func(tx domain.Tx) error {
+		return tx.DeleteServiceAccount("recon")
+	}), &notFound)
+}
+
+func testSessions(t *testing.T, store Store) {
+	now := time.Now()
+	put := func(session *domain.Session) {
+		require.NoError(t, store.Update(func(tx domain.Tx) error {
+			return tx.PutSession(session)
+		}))
+	}
+
+	put(&domain.Session{ID: "laptop", Email: "john-cs@durianpay.id", UserAgent: "Firefox", IP: "10.0.0.1", CreatedAt: now.Add(-time.Hour), LastSeenAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour)})
+	put(&domain.Session{ID: "phone", Email: "john-cs@durianpay.id", UserAgent: "Safari", IP: "10.0.0.2", CreatedAt: now.Add(-time.Hour), LastSeenAt: now, ExpiresAt: now.Add(time.Hour)})
+	put(&domain.Session{ID: "stale", Email: "john-cs@durianpay.id", CreatedAt: now.Add(-2 * time.Hour), LastSeenAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)})
+	put(&domain.Session{ID: "admin", Email: "admin@durianpay.id", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)})
+
+	session, exists := store.GetSession("laptop")
+	require.True(t, exists)
+	require.Equal(t, "Firefox", session.UserAgent)
+	require.Equal(t, "10.0.0.1", session.IP)
+	require.True(t, session.LastSeenAt.Equal(now.Add(-time.Minute)))
+	require.True(t, session.ExpiresAt.Equal(now.Add(time.Hour)))
+	_, exists = store.GetSession("missing")
+	require.False(t, exists)
+
+	sessionIDs := func(email string) []string {
+		var ids []string
+		for _, session := range store.ListSessions(email) {
+			ids = append(ids, session.ID)
+		}
+		return ids
+	}
+	require.Equal(t, []string{"phone", "laptop", "stale"}, sessionIDs("john-cs@durianpay.id"), "most recently seen first")
+	require.Empty(t, store.ListSessions("nobody@durianpay.id"))
+
+	// updating and deleting in one transaction, including a session staged in it
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		laptop, exists := tx.GetSession("laptop")
+		require.True(t, exists)
+		laptop.LastSeenAt = now.Add(time.Minute)
+		laptop.IP = "10.0.0.3"
+		require.NoError(t, tx.PutSession(laptop))
+
+		require.NoError(t, tx.PutSession(&domain.Session{ID: "tablet", Email: "john-cs@durianpay.id", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}))
+		require.NoError(t, tx.DeleteSession("tablet"))
+		_, exists = tx.GetSession("tablet")
+		require.False(t, exists)
+
+		require.NoError(t, tx.DeleteSession("phone"))
+		return tx.DeleteSession("missing")
+	}))
+	require.Equal(t, []string{"laptop", "stale"}, sessionIDs("john-cs@durianpay.id"))
+	session, _ = store.GetSession("laptop")
+	require.Equal(t, "10.0.0.3", session.IP)
+
+	// a rolled back delete leaves the session
+	errAbort := common_errors.New("abort")
+	err := store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.DeleteSession("laptop"))
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+	_, exists = store.GetSession("laptop")
+	require.True(t, exists)
+
+	// purging drops expired sessions
+	require.NoError(t, store.PurgeExpiredTokens(now))
+	require.Equal(t, []string{"laptop"}, sessionIDs("john-cs@durianpay.id"))
+	require.Equal(t, []string{"admin"}, sessionIDs("admin@durianpay.id"))
+
+	// deleting the sessions of a user, including one staged in the transaction
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.PutSession(&domain.Session{ID: "tablet", Email: "john-cs@durianpay.id", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}))
+		return tx.DeleteUserSessions("john-cs@durianpay.id")
+	}))
+	require.Empty(t, store.ListSessions("john-cs@durianpay.id"))
+	_, exists = store.GetSession("tablet")
+	require.False(t, exists)
+	require.Equal(t, []string{"admin"}, sessionIDs("admin@durianpay.id"))
+}
+
+func testPasswordResets(t *testing.T, store Store) {
+	now := time.Now()
+	get := func(email string) (*domain.PasswordReset, bool) {
+		var reset *domain.PasswordReset
+		var exists bool
+		require.NoError(t, store.Update(func(tx domain.Tx) error {
+			reset, exists = tx.GetPasswordReset(email)
+			return nil
+		}))
+		return reset, exists
+	}
+	put := func(reset *domain.PasswordReset) {
+		require.NoError(t, store.Update(func(tx domain.Tx) error {
+			return tx.PutPasswordReset(reset)
+		}))
+	}
+
+	put(&domain.PasswordReset{Email: "john-cs@durianpay.id", Hash: "first", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	reset, exists := get("john-cs@durianpay.id")
+	require.True(t, exists)
+	require.Equal(t, "first", reset.Hash)
+	require.True(t, reset.ExpiresAt.Equal(now.Add(time.Hour)))
+	_, exists = get("admin@durianpay.id")
+	require.False(t, exists)
+
+	// a new request replaces the pending one
+	put(&domain.PasswordReset{Email: "john-cs@durianpay.id", Hash: "second", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	reset, _ = get("john-cs@durianpay.id")
+	require.Equal(t, "second", reset.Hash)
+
+	// deleting, including a reset staged in the same transaction
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.PutPasswordReset(&domain.PasswordReset{Email: "admin@durianpay.id", Hash: "staged", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+		require.NoError(t, tx.DeletePasswordReset("admin@durianpay.id"))
+		_, exists := tx.GetPasswordReset("admin@durianpay.id")
+		require.False(t, exists)
+		require.NoError(t, tx.DeletePasswordReset("missing@durianpay.id"))
+		return tx.DeletePasswordReset("john-cs@durianpay.id")
+	}))
+	_, exists = get("john-cs@durianpay.id")
+	require.False(t, exists)
+	_, exists = get("admin@durianpay.id")
+	require.False(t, exists)
+
+	// purging drops expired resets only
+	put(&domain.PasswordReset{Email: "john-cs@durianpay.id", Hash: "live", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	put(&domain.PasswordReset{Email: "admin@durianpay.id", Hash: "stale", CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)})
+	require.NoError(t, store.PurgeExpiredTokens(now))
+	_, exists = get("john-cs@durianpay.id")
+	require.True(t, exists)
+	_, exists = get("admin@durianpay.id")
+	require.False(t, exists)
+}
+
+func testPaymentEvents(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+	now := time.Now()
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay-a", Status: "processing"}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay-b", Status: "processing"}))
+	require.Empty(t, store.ListPaymentEvents("pay-a"))
+
+	// written in one transaction with the payment, events sharing a time keep their order
+	err := store.Update(func(tx domain.Tx) error {
+		payment, _ := tx.GetPaymentById("pay-a")
+		payment.Status = "completed"
+		if err := tx.UpdatePayment(payment); err != nil {
+			return err
+		}
+		for _, event := range []*domain.PaymentEvent{
+			{ID: "ev-2", PaymentID: "pay-a", Type: domain.PaymentEventStatusChanged, Actor: "jane-operational@durianpay.id", At: now, From: "processing", To: "completed", Reason: "settled"},
+			{ID: "ev-3", PaymentID: "pay-a", Type: domain.PaymentEventNote, Actor: "john-cs@durianpay.id", At: now, Note: "customer called"},
+			{ID: "ev-1", PaymentID: "pay-a", Type: domain.PaymentEventCreated, At: now.Add(-time.Hour), To: "processing"},
+			{ID: "ev-b", PaymentID: "pay-b", Type: domain.PaymentEventReviewed, At: now},
+		} {
+			if err := tx.AddPaymentEvent(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	events := store.ListPaymentEvents("pay-a")
+	require.Len(t, events, 3)
+	require.Equal(t, []string{"ev-1", "ev-2", "ev-3"}, []string{events[0].ID, events[1].ID, events[2].ID})
+	require.True(t, now.Equal(events[1].At))
+	events[1].At = time.Time{}
+	require.Equal(t, &domain.PaymentEvent{ID: "ev-2", PaymentID: "pay-a", Type: domain.PaymentEventStatusChanged,
+		Actor: "jane-operational@durianpay.id", From: "processing", To: "completed", Reason: "settled"}, events[1])
+	events[2].Note = "changed"
+	require.Equal(t, "customer called", store.ListPaymentEvents("pay-a")[2].Note, "events are copies")
+
+	// events need their payment, and a failed transaction adds none
+	err = store.Update(func(tx domain.Tx) error {
+		return tx.AddPaymentEvent(&domain.PaymentEvent{ID: "ev-ghost", PaymentID: "ghost", Type: domain.PaymentEventNote, At: now})
+	})
+	var notFoundErr *errors.NotFoundError
+	require.True(t, common_errors.As(err, &notFoundErr), "expected NotFoundError, got %v", err)
+	errAbort := common_errors.New("abort")
+	err = store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.AddPaymentEvent(&domain.PaymentEvent{ID: "ev-4", PaymentID: "pay-a", Type: domain.PaymentEventNote, At: now}))
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+	require.Len(t, store.ListPaymentEvents("pay-a"), 3)
+
+	// and they go away with it
+	require.NoError(t, store.DeletePayment("pay-a"))
+	require.Empty(t, store.ListPaymentEvents("pay-a"))
+	require.Len(t, store.ListPaymentEvents("pay-b"), 1)
+	store.ClearPayments()
+	require.Empty(t, store.ListPaymentEvents("pay-b"))
+}
+
+func testPaymentReviews(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+	at := time.Now().Add(-time.Minute)
+	flagged := &domain.PaymentReview{Reviewer: "john-cs@durianpay.id", At: at, Outcome: domain.ReviewOutcomeFlagged, Reason: "duplicate", Note: "same as pay-b"}
+	for _, payment := range []*domain.Payment{
+		{ID: "pay-a", Status: "completed", Reviewed: true, Review: flagged},
+		{ID: "pay-b", Status: "completed", Reviewed: true},
+		{ID: "pay-c", Status: "completed"},
+	} {
+		require.NoError(t, store.CreatePayment(payment))
+	}
+
+	stored, _ := store.GetPaymentById("pay-a")
+	require.True(t, at.Equal(stored.Review.At))
+	stored.Review.At = at
+	require.Equal(t, flagged, stored.Review)
+	stored.Review.Note = "changed"
+	again, _ := store.GetPaymentById("pay-a")
+	require.Equal(t, "same as pay-b", again.Review.Note, "reviews are copies")
+	legacy, _ := store.GetPaymentById("pay-b")
+	require.Nil(t, legacy.Review)
+
+	approved := &domain.PaymentReview{Reviewer: "jane-operational@durianpay.id", At: at, Outcome: domain.ReviewOutcomeApproved}
+	legacy.Review = approved
+	require.NoError(t, store.UpdatePayment(legacy))
+	legacy, _ = store.GetPaymentById("pay-b")
+	require.Equal(t, domain.ReviewOutcomeApproved, legacy.Review.Outcome)
+
+	ids := func(query domain.PaymentQuery) []string {
+		query.SortBy, query.Order, query.Limit = domain.PaymentSortDate, domain.SortAsc, 10
+		found := []string{}
+		for _, payment := range store.QueryPayments(query).Items {
+			found = append(found, payment.ID)
+		}
+		return found
+	}
+	reviewed := true
+	require.Equal(t, []string{"pay-a"}, ids(domain.PaymentQuery{ReviewOutcome: domain.ReviewOutcomeFlagged}))
+	require.Equal(t, []string{"pay-b"}, ids(domain.PaymentQuery{Reviewer: "jane-operational@durianpay.id", Reviewed: &reviewed}))
+	require.Equal(t, []string{}, ids(domain.PaymentQuery{ReviewOutcome: domain.ReviewOutcomeFlagged, Reviewer: "jane-operational@durianpay.id"}))
+	require.Equal(t, []string{"pay-a"}, ids(domain.PaymentQuery{Status: "completed", Reviewer: "john-cs@durianpay.id"}))
+
+	// clearing the review clears the filters too
+	stored, _ = store.GetPaymentById("pay-a")
+	stored.Reviewed, stored.Review = false, nil
+	require.NoError(t, store.UpdatePayment(stored))
+	require.Empty(t, ids(domain.PaymentQuery{Reviewer: "john-cs@durianpay.id"}))
+	stored, _ = store.GetPaymentById("pay-a")
+	require.Nil(t, stored.Review)
+}
+
+func testRefunds(t *testing.T, store Store) {
+	store.ClearPayments() // Clear seeded payments
+	now := time.Now()
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay-a", Amount: 100, Status: "completed"}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "pay-b", Amount: 50, Status: "completed"}))
+	require.Empty(t, store.ListRefunds("pay-a"))
+
+	decided := now.Add(time.Minute)
+	err := store.Update(func(tx domain.Tx) error {
+		for _, refund := range []*domain.Refund{
+			{ID: "ref-2", PaymentID: "pay-a", Amount: 40, Status: domain.RefundStatusRequested, Reason: "customer_request", RequestedBy: "john-cs@durianpay.id", CreatedAt: now, UpdatedAt: now},
+			{ID: "ref-1", PaymentID: "pay-a", Amount: 10.5, Status: domain.RefundStatusRequested, Reason: "duplicate", Note: "charged twice", RequestedBy: "john-cs@durianpay.id", CreatedAt: now.Add(-time.Hour), UpdatedAt: now},
+			{ID: "ref-b", PaymentID: "pay-b", Amount: 50, Status: domain.RefundStatusRequested, Reason: "fraud", RequestedBy: "john-cs@durianpay.id", CreatedAt: now, UpdatedAt: now},
+		} {
+			if err := tx.PutRefund(refund); err != nil {
+				return err
+			}
+		}
+		require.Len(t, tx.ListRefunds("pay-a"), 2, "a transaction sees its own refunds")
+
+		// putting a refund again replaces it
+		refund, ok := tx.GetRefund("ref-2")
+		require.True(t, ok)
+		refund.Status, refund.DecidedBy, refund.DecidedAt, refund.UpdatedAt = domain.RefundStatusApproved, "jane-operational@durianpay.id", &decided, decided
+		return tx.PutRefund(refund)
+	})
+	require.NoError(t, err)
+
+	refunds := store.ListRefunds("pay-a")
+	require.Len(t, refunds, 2)
+	require.Equal(t, []string{"ref-1", "ref-2"}, []string{refunds[0].ID, refunds[1].ID})
+	require.Equal(t, 10.5, refunds[0].Amount)
+	require.Equal(t, "charged twice", refunds[0].Note)
+	require.Nil(t, refunds[0].DecidedAt)
+	require.Equal(t, domain.RefundStatusApproved, refunds[1].Status)
+	require.Equal(t, "jane-operational@durianpay.id", refunds[1].DecidedBy)
+	require.True(t, decided.Equal(*refunds[1].DecidedAt))
+	require.True(t, decided.Equal(refunds[1].UpdatedAt))
+	require.True(t, now.Equal(refunds[1].CreatedAt))
+
+	refunds[1].Status = domain.RefundStatusProcessed
+	*refunds[1].DecidedAt = time.Time{}
+	again := store.ListRefunds("pay-a")[1]
+	require.Equal(t, domain.RefundStatusApproved, again.Status, "refunds are copies")
+	require.True(t, decided.Equal(*again.DecidedAt))
+
+	// refunds need their payment, and a failed transaction puts none
+	err = store.Update(func(tx domain.Tx) error {
+		return tx.PutRefund(&domain.Refund{ID: "ref-ghost", PaymentID: "ghost", Amount: 1, Status: domain.RefundStatusRequested, CreatedAt: now, UpdatedAt: now})
+	})
+	var notFoundErr *errors.NotFoundError
+	require.True(t, common_errors.As(err, &notFoundErr), "expected NotFoundError, got %v", err)
+	errAbort := common_errors.New("abort")
+	err = store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.PutRefund(&domain.Refund{ID: "ref-3", PaymentID: "pay-a", Amount: 1, Status: domain.RefundStatusRequested, CreatedAt: now, UpdatedAt: now}))
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+	require.Len(t, store.ListRefunds("pay-a"), 2)
+
+	// and they go away with it
+	require.NoError(t, store.DeletePayment("pay-a"))
+	require.Empty(t, store.ListRefunds("pay-a"))
+	err = store.Update(func(tx domain.Tx) error {
+		_, ok := tx.GetRefund("ref-1")
+		require.False(t, ok)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, store.ListRefunds("pay-b"), 1)
+	store.ClearPayments()
+	require.Empty(t, store.ListRefunds("pay-b"))
+}
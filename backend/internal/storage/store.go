@@ -0,0 +1,14 @@
+package storage
+
+import "abasithdev.github.io/internal-cs-center-backend/internal/domain"
+
+// Store is a complete storage backend, one implementation per persistence engine
+type Store interface {
+	domain.PaymentRepository
+	domain.UserRepository
+	domain.TokenRepository
+	domain.LoginAttemptRepository
+	domain.ServiceAccountRepository
+}
+
+var _ Store = (*MemoryStore)(nil)
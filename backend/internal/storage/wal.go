@@ -0,0 +1,676 @@
+package storage
+
+/*
+Optional durability for MemoryStore: every committed mutation is appended to
+an append-only log before it is applied, and the log is periodically compacted
+into a snapshot. Boot replays snapshot + log.
+
+Log line format: "<crc32 of payload, 8 hex digits> <json payload>\n", one line
+per commit so multi-op commits replay all-or-nothing.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+
+	defaultSnapshotEvery = 1000
+)
+
+const (
+	opPutPayment    = "put_payment"
+	opDeletePayment = "delete_payment"
+	opClearPayments = "clear_payments"
+	opPutUser       = "put_user"
+	opDeleteUser    = "delete_user"
+
+	opAddPaymentEvent = "add_payment_event"
+	opPutRefund       = "put_refund"
+
+	opPutRefreshToken = "put_refresh_token"
+	opRevokeToken     = "revoke_token"
+	opPurgeTokens     = "purge_tokens"
+	opPutSession      = "put_session"
+	opDeleteSession   = "delete_session"
+
+	opPutPasswordReset    = "put_password_reset"
+	opDeletePasswordReset = "delete_password_reset"
+
+	opPutLoginAttempts    = "put_login_attempts"
+	opDeleteLoginAttempts = "delete_login_attempts"
+	opPurgeLoginAttempts  = "purge_login_attempts"
+
+	opPutServiceAccount    = "put_service_account"
+	opDeleteServiceAccount = "delete_service_account"
+	opPutAPIKey            = "put_api_key"
+)
+
+// walOp is a single state change. Ops carry the full new value rather than a
+// delta so replaying an entry twice (crash between snapshot and truncate) is harmless.
+type walOp struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id,omitempty"`
+	Payment *domain.Payment `json:"payment,omitempty"`
+	User    *userRecord     `json:"user,omitempty"`
+
+	PaymentEvent *domain.PaymentEvent `json:"payment_event,omitempty"`
+	Refund       *domain.Refund       `json:"refund,omitempty"`
+
+	RefreshToken *domain.RefreshToken `json:"refresh_token,omitempty"`
+	RevokedToken *domain.RevokedToken `json:"revoked_token,omitempty"`
+	Session      *domain.Session      `json:"session,omitempty"`
+
+	PasswordReset *passwordResetRecord `json:"password_reset,omitempty"`
+
+	LoginAttempts *domain.LoginAttempts `json:"login_attempts,omitempty"`
+
+	ServiceAccount *domain.ServiceAccount `json:"service_account,omitempty"`
+	APIKey         *apiKeyRecord          `json:"api_key,omitempty"`
+	// Before is the cut-off of opPurgeTokens and opPurgeLoginAttempts
+	Before *time.Time `json:"before,omitempty"`
+}
+
+// userRecord is a persisted user. domain.User keeps the password hash and
+// the MFA secrets out of JSON, so it cannot be written as is.
+type userRecord struct {
+	Email        string `json:"email"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	Role         string `json:"role"`
+	Disabled     bool   `json:"disabled,omitempty"`
+	MFAEnabled   bool   `json:"mfa_enabled,omitempty"`
+	TOTPSecret   string `json:"totp_secret,omitempty"`
+	TOTPLastStep int64  `json:"totp_last_step,omitempty"`
+	// RecoveryCodes are hashes, like on domain.User
+	RecoveryCodes      []string `json:"recovery_codes,omitempty"`
+	MustChangePassword bool     `json:"must_change_password,omitempty"`
+	Merchants          []string `json:"merchants,omitempty"`
+	MerchantGroups     []string `json:"merchant_groups,omitempty"`
+	AllMerchants       bool     `json:"all_merchants,omitempty"`
+	// LegacyPassword is the plaintext password written before hashing was
+	// introduced, it is upgraded on the user's next login
+	LegacyPassword string `json:"password,omitempty"`
+}
+
+func newUserRecord(user *domain.User) *userRecord {
+	return &userRecord{
+		Email: user.Email, PasswordHash: user.PasswordHash, Role: user.Role, Disabled: user.Disabled,
+		MFAEnabled: user.MFAEnabled, TOTPSecret: user.TOTPSecret, TOTPLastStep: user.TOTPLastStep, RecoveryCodes: user.RecoveryCodes,
+		MustChangePassword: user.MustChangePassword, Merchants: user.Merchants, MerchantGroups: user.MerchantGroups,
+		AllMerchants: user.AllMerchants,
+	}
+}
+
+func (record *userRecord) user() *domain.User {
+	user := &domain.User{
+		Email: record.Email, PasswordHash: record.PasswordHash, Role: record.Role, Disabled: record.Disabled,
+		MFAEnabled: record.MFAEnabled, TOTPSecret: record.TOTPSecret, TOTPLastStep: record.TOTPLastStep, RecoveryCodes: record.RecoveryCodes,
+		MustChangePassword: record.MustChangePassword, Merchants: record.Merchants, MerchantGroups: record.MerchantGroups,
+		AllMerchants: record.AllMerchants,
+	}
+	if user.PasswordHash == "" {
+		user.PasswordHash = record.LegacyPassword
+	}
+	return user
+}
+
+// passwordResetRecord is a persisted password reset, domain.PasswordReset
+// keeps the hash out of JSON
+type passwordResetRecord struct {
+	domain.PasswordReset
+	Hash string `json:"hash"`
+}
+
+func newPasswordResetRecord(reset *domain.PasswordReset) *passwordResetRecord {
+	return &passwordResetRecord{PasswordReset: *reset, Hash: reset.Hash}
+}
+
+func (record *passwordResetRecord) reset() *domain.PasswordReset {
+	reset := record.PasswordReset
+	reset.Hash = record.Hash
+	return &reset
+}
+
+// apiKeyRecord is a persisted API key, domain.APIKey keeps the hash out of JSON
+type apiKeyRecord struct {
+	domain.APIKey
+	Hash string `json:"hash"`
+}
+
+func newAPIKeyRecord(key *domain.APIKey) *apiKeyRecord {
+	return &apiKeyRecord{APIKey: *key, Hash: key.Hash}
+}
+
+func (record *apiKeyRecord) key() *domain.APIKey {
+	key := record.APIKey
+	key.Hash = record.Hash
+	return &key
+}
+
+type walEntry struct {
+	Ops []walOp `json:"ops"`
+}
+
+type snapshot struct {
+	TakenAt  time.Time         `json:"taken_at"`
+	Users    []*userRecord     `json:"users"`
+	Payments []*domain.Payment `json:"payments"`
+	// PaymentEvents keeps the order of each timeline
+	PaymentEvents []*domain.PaymentEvent `json:"payment_events,omitempty"`
+	Refunds       []*domain.Refund       `json:"refunds,omitempty"`
+
+	RefreshTokens []*domain.RefreshToken  `json:"refresh_tokens,omitempty"`
+	RevokedTokens []*domain.RevokedToken  `json:"revoked_tokens,omitempty"`
+	Sessions      []*domain.Session       `json:"sessions,omitempty"`
+	LoginAttempts []*domain.LoginAttempts `json:"login_attempts,omitempty"`
+
+	PasswordResets []*passwordResetRecord `json:"password_resets,omitempty"`
+
+	ServiceAccounts []*domain.ServiceAccount `json:"service_accounts,omitempty"`
+	APIKeys         []*apiKeyRecord          `json:"api_keys,omitempty"`
+}
+
+// DurabilityOptions configures OpenMemoryStore
+type DurabilityOptions struct {
+	// Dir holds wal.log and snapshot.json, it is created if missing
+	Dir string
+	// SnapshotEvery compacts the log after this many commits (default 1000)
+	SnapshotEvery int
+	// SnapshotInterval additionally compacts on a timer when there are pending commits, 0 disables
+	SnapshotInterval time.Duration
+}
+
+// logFile is the part of *os.File the log uses
+type logFile interface {
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+type writeAheadLog struct {
+	opts    DurabilityOptions
+	file    logFile
+	pending int // commits appended since the last snapshot
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// OpenMemoryStore returns a MemoryStore whose state survives restarts. Existing
+// state in opts.Dir is replayed before the store is returned.
+func OpenMemoryStore(opts DurabilityOptions) (*MemoryStore, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("durability dir must not be empty")
+	}
+	if opts.SnapshotEvery <= 0 {
+		opts.SnapshotEvery = defaultSnapshotEvery
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create durability dir: %w", err)
+	}
+
+	store := NewMemoryStore()
+
+	if err := store.loadSnapshot(filepath.Join(opts.Dir, snapshotFileName)); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(opts.Dir, walFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open log: %w", err)
+	}
+
+	replayed, err := store.replayLog(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	store.wal = &writeAheadLog{opts: opts, file: file, pending: replayed, stop: make(chan struct{})}
+
+	if opts.SnapshotInterval > 0 {
+		go store.snapshotLoop(store.wal.stop, opts.SnapshotInterval)
+	}
+
+	return store, nil
+}
+
+func (store *MemoryStore) loadSnapshot(path string) error {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+
+	for _, record := range snap.Users {
+		store.users[record.Email] = record.user()
+	}
+	for _, payment := range snap.Payments {
+		store.payments[payment.ID] = payment
+		store.index.put(payment)
+	}
+	for _, event := range snap.PaymentEvents {
+		store.paymentEvents[event.PaymentID] = append(store.paymentEvents[event.PaymentID], event)
+	}
+	for _, refund := range snap.Refunds {
+		store.refunds[refund.ID] = refund
+	}
+	for _, token := range snap.RefreshTokens {
+		store.refreshTokens[token.Hash] = token
+	}
+	for _, token := range snap.RevokedTokens {
+		store.revokedTokens[token.JTI] = token
+	}
+	for _, session := range snap.Sessions {
+		store.sessions[session.ID] = session
+	}
+	for _, attempts := range snap.LoginAttempts {
+		store.loginAttempts[attempts.Key] = attempts
+	}
+	for _, record := range snap.PasswordResets {
+		store.passwordResets[record.Email] = record.reset()
+	}
+	for _, account := range snap.ServiceAccounts {
+		store.serviceAccounts[account.Name] = account
+	}
+	for _, record := range snap.APIKeys {
+		store.apiKeys[record.ID] = record.key()
+	}
+
+	return nil
+}
+
+// replayLog applies every intact entry. A damaged final line is what a crash
+// mid-append leaves behind, so it is cut off. Damage followed by intact
+// entries means the file is corrupt and is reported instead.
+func (store *MemoryStore) replayLog(file *os.File) (int, error) {
+	reader := bufio.NewReader(file)
+	var offset int64
+	replayed := 0
+
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) == 0 && readErr == io.EOF {
+			return replayed, nil
+		}
+		if readErr != nil && readErr != io.EOF {
+			return replayed, fmt.Errorf("read log: %w", readErr)
+		}
+
+		entry, decodeErr := decodeWalLine(line)
+		if decodeErr == nil && readErr == io.EOF {
+			decodeErr = fmt.Errorf("missing newline")
+		}
+		if decodeErr != nil {
+			// only the last line may be damaged
+			rest, _ := io.ReadAll(reader)
+			if len(bytes.TrimSpace(rest)) > 0 {
+				return replayed, fmt.Errorf("corrupt log entry at offset %d: %w", offset, decodeErr)
+			}
+
+			log.Printf("storage: truncating incomplete log tail at offset %d", offset)
+			if err := file.Truncate(offset); err != nil {
+				return replayed, fmt.Errorf("truncate log: %w", err)
+			}
+			return replayed, nil
+		}
+
+		for _, op := range entry.Ops {
+			store.apply(op)
+		}
+		offset += int64(len(line))
+		replayed++
+	}
+}
+
+func encodeWalLine(entry walEntry) ([]byte, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	line := make([]byte, 0, len(payload)+10)
+	line = fmt.Appendf(line, "%08x ", crc32.ChecksumIEEE(payload))
+	line = append(line, payload...)
+	return append(line, '\n'), nil
+}
+
+func decodeWalLine(line []byte) (walEntry, error) {
+	var entry walEntry
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	if len(line) < 10 || line[8] != ' ' {
+		return entry, fmt.Errorf("malformed entry")
+	}
+
+	var checksum uint32
+	if _, err := fmt.Sscanf(string(line[:8]), "%08x", &checksum); err != nil {
+		return entry, fmt.Errorf("malformed checksum: %w", err)
+	}
+
+	payload := line[9:]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return entry, fmt.Errorf("checksum mismatch")
+	}
+
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// commit makes ops durable, when a log is configured, then applies them.
+// Callers must hold the write lock.
+func (store *MemoryStore) commit(ops ...walOp) error {
+	if store.wal != nil {
+		line, err := encodeWalLine(walEntry{Ops: ops})
+		if err != nil {
+			return err
+		}
+		offset, err := store.wal.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("append log: %w", err)
+		}
+		if _, err := store.wal.file.Write(line); err != nil {
+			return store.wal.discard(offset, fmt.Errorf("append log: %w", err))
+		}
+		if err := store.wal.file.Sync(); err != nil {
+			return store.wal.discard(offset, fmt.Errorf("sync log: %w", err))
+		}
+		store.wal.pending++
+	}
+
+	for _, op := range ops {
+		store.apply(op)
+	}
+
+	if store.wal != nil && store.wal.pending >= store.wal.opts.SnapshotEvery {
+		if err := store.snapshotLocked(); err != nil {
+			// the commit itself is durable in the log, compaction is retried next time
+			log.Printf("storage: snapshot failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// discard cuts a failed append off the log again, a torn line followed by
+// later entries would make the log unreadable on the next start
+func (wal *writeAheadLog) discard(offset int64, cause error) error {
+	if err := wal.file.Truncate(offset); err != nil {
+		return fmt.Errorf("%w, truncate log: %v", cause, err)
+	}
+	if _, err := wal.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("%w, seek log: %v", cause, err)
+	}
+	return cause
+}
+
+// apply mutates the in-memory state, shared by live commits and replay
+func (store *MemoryStore) apply(op walOp) {
+	switch op.Op {
+	case opPutPayment:
+		store.payments[op.Payment.ID] = op.Payment
+		store.index.put(op.Payment)
+	case opDeletePayment:
+		delete(store.payments, op.ID)
+		delete(store.paymentEvents, op.ID)
+		for id, refund := range store.refunds {
+			if refund.PaymentID == op.ID {
+				delete(store.refunds, id)
+			}
+		}
+		store.index.remove(op.ID)
+	case opClearPayments:
+		store.payments = make(map[string]*domain.Payment)
+		store.paymentEvents = make(map[string][]*domain.PaymentEvent)
+		store.refunds = make(map[string]*domain.Refund)
+		store.index = newPaymentIndex()
+	case opAddPaymentEvent:
+		events := store.paymentEvents[op.PaymentEvent.PaymentID]
+		// events are appended, skip one replayed on top of a snapshot holding it
+		if slices.ContainsFunc(events, func(event *domain.PaymentEvent) bool { return event.ID == op.PaymentEvent.ID }) {
+			break
+		}
+		store.paymentEvents[op.PaymentEvent.PaymentID] = append(events, op.PaymentEvent)
+	case opPutRefund:
+		store.refunds[op.Refund.ID] = op.Refund
+	case opPutUser:
+		store.users[op.User.Email] = op.User.user()
+	case opDeleteUser:
+		delete(store.users, op.ID)
+	case opPutRefreshToken:
+		store.refreshTokens[op.RefreshToken.Hash] = op.RefreshToken
+	case opRevokeToken:
+		store.revokedTokens[op.RevokedToken.JTI] = op.RevokedToken
+	case opPurgeTokens:
+		for hash, token := range store.refreshTokens {
+			if token.ExpiresAt.Before(*op.Before) {
+				delete(store.refreshTokens, hash)
+			}
+		}
+		for jti, token := range store.revokedTokens {
+			if token.ExpiresAt.Before(*op.Before) {
+				delete(store.revokedTokens, jti)
+			}
+		}
+		for id, session := range store.sessions {
+			if session.ExpiresAt.Before(*op.Before) {
+				delete(store.sessions, id)
+			}
+		}
+		for email, reset := range store.passwordResets {
+			if reset.ExpiresAt.Before(*op.Before) {
+				delete(store.passwordResets, email)
+			}
+		}
+	case opPutSession:
+		store.sessions[op.Session.ID] = op.Session
+	case opDeleteSession:
+		delete(store.sessions, op.ID)
+	case opPutPasswordReset:
+		store.passwordResets[op.PasswordReset.Email] = op.PasswordReset.reset()
+	case opDeletePasswordReset:
+		delete(store.passwordResets, op.ID)
+	case opPutLoginAttempts:
+		store.loginAttempts[op.LoginAttempts.Key] = op.LoginAttempts
+	case opDeleteLoginAttempts:
+		delete(store.loginAttempts, op.ID)
+	case opPurgeLoginAttempts:
+		for key, attempts := range store.loginAttempts {
+			if loginAttemptsExpired(attempts, *op.Before) {
+				delete(store.loginAttempts, key)
+			}
+		}
+	case opPutServiceAccount:
+		store.serviceAccounts[op.ServiceAccount.Name] = op.ServiceAccount
+	case opDeleteServiceAccount:
+		delete(store.serviceAccounts, op.ID)
+		for id, key := range store.apiKeys {
+			if key.Account == op.ID {
+				delete(store.apiKeys, id)
+			}
+		}
+	case opPutAPIKey:
+		store.apiKeys[op.APIKey.ID] = op.APIKey.key()
+	}
+}
+
+// Snapshot compacts the log into a new snapshot. It is a no-op for a store
+// opened without durability.
+func (store *MemoryStore) Snapshot() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.wal == nil {
+		return nil
+	}
+	return store.snapshotLocked()
+}
+
+func (store *MemoryStore) snapshotLocked() error {
+	snap := snapshot{
+		TakenAt:  time.Now(),
+		Users:    make([]*userRecord, 0, len(store.users)),
+		Payments: make([]*domain.Payment, 0, len(store.payments)),
+	}
+	for _, user := range store.users {
+		snap.Users = append(snap.Users, newUserRecord(user))
+	}
+	for _, payment := range store.payments {
+		snap.Payments = append(snap.Payments, payment)
+	}
+	for _, events := range store.paymentEvents {
+		snap.PaymentEvents = append(snap.PaymentEvents, events...)
+	}
+	for _, refund := range store.refunds {
+		snap.Refunds = append(snap.Refunds, refund)
+	}
+	for _, token := range store.refreshTokens {
+		snap.RefreshTokens = append(snap.RefreshTokens, token)
+	}
+	for _, token := range store.revokedTokens {
+		snap.RevokedTokens = append(snap.RevokedTokens, token)
+	}
+	for _, session := range store.sessions {
+		snap.Sessions = append(snap.Sessions, session)
+	}
+	for _, attempts := range store.loginAttempts {
+		snap.LoginAttempts = append(snap.LoginAttempts, attempts)
+	}
+	for _, reset := range store.passwordResets {
+		snap.PasswordResets = append(snap.PasswordResets, newPasswordResetRecord(reset))
+	}
+	for _, account := range store.serviceAccounts {
+		snap.ServiceAccounts = append(snap.ServiceAccounts, account)
+	}
+	for _, key := range store.apiKeys {
+		snap.APIKeys = append(snap.APIKeys, newAPIKeyRecord(key))
+	}
+
+	raw, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	dir := store.wal.opts.Dir
+	if err := writeFileAtomic(filepath.Join(dir, snapshotFileName), raw); err != nil {
+		return err
+	}
+
+	// everything in the log is now in the snapshot; a crash before this truncate
+	// only means those entries get replayed on top of it, which is idempotent
+	if err := store.wal.file.Truncate(0); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	if _, err := store.wal.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	store.wal.pending = 0
+	return nil
+}
+
+func (store *MemoryStore) snapshotLoop(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			store.mu.Lock()
+			if store.wal != nil && store.wal.pending > 0 {
+				if err := store.snapshotLocked(); err != nil {
+					log.Printf("storage: periodic snapshot failed: %v", err)
+				}
+			}
+			store.mu.Unlock()
+		}
+	}
+}
+
+// Close writes a final snapshot and releases the log file. It is a no-op for
+// a store opened without durability.
+func (store *MemoryStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.wal == nil {
+		return nil
+	}
+
+	store.wal.stopOnce.Do(func() { close(store.wal.stop) })
+
+	snapErr := store.snapshotLocked()
+	closeErr := store.wal.file.Close()
+	store.wal = nil
+
+	if snapErr != nil {
+		return snapErr
+	}
+	return closeErr
+}
+
+// writeFileAtomic replaces path with data so readers see either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
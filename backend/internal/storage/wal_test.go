@@ -0,0 +1,424 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"abasithdev.github.io/internal-cs-center-backend/internal/domain"
+	"abasithdev.github.io/internal-cs-center-backend/internal/seed"
+	"abasithdev.github.io/internal-cs-center-backend/internal/storage/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+func openDurable(t *testing.T, dir string, snapshotEvery int) *MemoryStore {
+	store, err := OpenMemoryStore(DurabilityOptions{Dir: dir, SnapshotEvery: snapshotEvery})
+	require.NoError(t, err)
+	return store
+}
+
+// crash drops the store without the final snapshot Close would write
+func crash(t *testing.T, store *MemoryStore) {
+	require.NoError(t, store.wal.file.Close())
+	store.wal = nil
+}
+
+func TestDurableMemoryStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Store {
+		store := openDurable(t, t.TempDir(), 5)
+		t.Cleanup(func() { store.Close() })
+		require.NoError(t, seed.Apply(store, seed.Demo()))
+		return store
+	})
+}
+
+func TestDurableMemoryStore_ReplaysLogAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openDurable(t, dir, 1000)
+	require.NoError(t, seed.Apply(store, seed.Demo()))
+	payments := store.GetPaymentList()
+	require.Len(t, payments, 20)
+
+	reviewed := payments[0]
+	reviewed.Reviewed = true
+	store.UpdatePayment(reviewed)
+	require.NoError(t, store.DeletePayment(payments[1].ID))
+	require.NoError(t, store.CreateUser(&domain.User{Email: "new@durianpay.id", Role: "cs"}))
+	crash(t, store)
+
+	// nothing was snapshotted, state comes from the log alone
+	_, err := os.Stat(filepath.Join(dir, snapshotFileName))
+	require.True(t, os.IsNotExist(err))
+
+	store = openDurable(t, dir, 1000)
+	defer store.Close()
+
+	require.Len(t, store.GetPaymentList(), 19)
+	persisted, exists := store.GetPaymentById(reviewed.ID)
+	require.True(t, exists)
+	require.True(t, persisted.Reviewed)
+	_, exists = store.GetPaymentById(payments[1].ID)
+	require.False(t, exists)
+	_, exists = store.GetUserByEmail("new@durianpay.id")
+	require.True(t, exists)
+}
+
+func TestDurableMemoryStore_SnapshotCompactsLog(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openDurable(t, dir, 3)
+	for _, id := range []string{"p1", "p2", "p3", "p4"} {
+		require.NoError(t, store.CreatePayment(&domain.Payment{ID: id, Status: "processing"}))
+	}
+	crash(t, store)
+
+	// three commits went into the snapshot, the fourth is still in the log
+	_, err := os.Stat(filepath.Join(dir, snapshotFileName))
+	require.NoError(t, err)
+	raw, err := os.ReadFile(filepath.Join(dir, walFileName))
+	require.NoError(t, err)
+	require.Contains(t, string(raw), `"p4"`)
+	require.NotContains(t, string(raw), `"p1"`)
+
+	store = openDurable(t, dir, 3)
+	require.Len(t, store.GetPaymentList(), 4)
+
+	store.ClearPayments()
+	require.NoError(t, store.Close())
+
+	// Close leaves an empty log and a snapshot with the final state
+	raw, err = os.ReadFile(filepath.Join(dir, walFileName))
+	require.NoError(t, err)
+	require.Empty(t, raw)
+
+	store = openDurable(t, dir, 3)
+	defer store.Close()
+	require.Empty(t, store.GetPaymentList())
+}
+
+func TestDurableMemoryStore_TruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openDurable(t, dir, 1000)
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p1", Status: "processing"}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p2", Status: "processing"}))
+	crash(t, store)
+
+	// simulate a crash half way through appending the second entry
+	logPath := filepath.Join(dir, walFileName)
+	raw, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(logPath, raw[:len(raw)-7], 0o644))
+
+	store = openDurable(t, dir, 1000)
+	_, exists := store.GetPaymentById("p1")
+	require.True(t, exists)
+	_, exists = store.GetPaymentById("p2")
+	require.False(t, exists)
+
+	// the damaged tail is gone, so new entries replay cleanly after it
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p3", Status: "failed"}))
+	crash(t, store)
+
+	store = openDurable(t, dir, 1000)
+	defer store.Close()
+	require.Len(t, store.GetPaymentList(), 2)
+	_, exists = store.GetPaymentById("p3")
+	require.True(t, exists)
+}
+
+func TestDurableMemoryStore_TransactionReplaysAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openDurable(t, dir, 1000)
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p1", Status: "processing"}))
+	err := store.Update(func(tx domain.Tx) error {
+		if err := tx.CreatePayment(&domain.Payment{ID: "p2", Status: "processing"}); err != nil {
+			return err
+		}
+		if err := tx.DeletePayment("p1"); err != nil {
+			return err
+		}
+		return tx.CreateUser(&domain.User{Email: "new@durianpay.id", Role: "cs"})
+	})
+	require.NoError(t, err)
+	crash(t, store)
+
+	// the whole transaction is a single log line
+	logPath := filepath.Join(dir, walFileName)
+	raw, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Equal(t, 2, bytes.Count(raw, []byte("\n")))
+
+	store = openDurable(t, dir, 1000)
+	_, exists := store.GetPaymentById("p2")
+	require.True(t, exists)
+	_, exists = store.GetPaymentById("p1")
+	require.False(t, exists)
+	crash(t, store)
+
+	// torn while appending the transaction: none of its writes survive
+	require.NoError(t, os.WriteFile(logPath, raw[:len(raw)-7], 0o644))
+
+	store = openDurable(t, dir, 1000)
+	defer store.Close()
+	_, exists = store.GetPaymentById("p1")
+	require.True(t, exists)
+	_, exists = store.GetPaymentById("p2")
+	require.False(t, exists)
+	_, exists = store.GetUserByEmail("new@durianpay.id")
+	require.False(t, exists)
+}
+
+func TestDurableMemoryStore_PersistsPasswordHashes(t *testing.T) {
+	dir := t.TempDir()
+
+	// a snapshot from before hashing, with a plaintext password field
+	legacy := `{"taken_at":"2024-01-01T00:00:00Z","payments":[],
+		"users":[{"email":"old@durianpay.id","password":"admin123","role":"cs"}]}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, snapshotFileName), []byte(legacy), 0o644))
+
+	store := openDurable(t, dir, 1000)
+	old, exists := store.GetUserByEmail("old@durianpay.id")
+	require.True(t, exists)
+	require.Equal(t, "admin123", old.PasswordHash)
+
+	old.PasswordHash = "$argon2id$upgraded"
+	require.NoError(t, store.UpdateUser(old))
+	require.NoError(t, store.CreateUser(&domain.User{Email: "new@durianpay.id", PasswordHash: "$argon2id$new", Role: "cs", MustChangePassword: true,
+		Merchants: []string{"Acme Store"}, MerchantGroups: []string{"retail"}}))
+	crash(t, store)
+
+	// replayed from the log
+	store = openDurable(t, dir, 1000)
+	user, _ := store.GetUserByEmail("new@durianpay.id")
+	require.Equal(t, "$argon2id$new", user.PasswordHash)
+	require.True(t, user.MustChangePassword)
+	require.NoError(t, store.Close())
+
+	// and from the snapshot Close wrote
+	store = openDurable(t, dir, 1000)
+	defer store.Close()
+	old, _ = store.GetUserByEmail("old@durianpay.id")
+	require.Equal(t, "$argon2id$upgraded", old.PasswordHash)
+	user, _ = store.GetUserByEmail("new@durianpay.id")
+	require.Equal(t, "$argon2id$new", user.PasswordHash)
+	require.True(t, user.MustChangePassword)
+	require.Equal(t, []string{"Acme Store"}, user.Merchants)
+	require.Equal(t, []string{"retail"}, user.MerchantGroups)
+}
+
+func TestDurableMemoryStore_PersistsAuthState(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	store := openDurable(t, dir, 1000)
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.PutRefreshToken(&domain.RefreshToken{Hash: "live", Family: "f", Email: "john-cs@durianpay.id", ExpiresAt: now.Add(time.Hour)}))
+		require.NoError(t, tx.PutRefreshToken(&domain.RefreshToken{Hash: "stale", Family: "g", Email: "john-cs@durianpay.id", ExpiresAt: now.Add(-time.Hour)}))
+		require.NoError(t, tx.RevokeToken(&domain.RevokedToken{JTI: "revoked", ExpiresAt: now.Add(time.Hour)}))
+		require.NoError(t, tx.PutLoginAttempts(&domain.LoginAttempts{Key: "account:a", Failures: 4, LastFailure: now}))
+		require.NoError(t, tx.CreateServiceAccount(&domain.ServiceAccount{Name: "recon", Role: domain.RoleOperational, CreatedAt: now}))
+		require.NoError(t, tx.PutAPIKey(&domain.APIKey{ID: "key", Account: "recon", Hash: "secret-hash", Scopes: []string{"payments:read"}, CreatedAt: now}))
+		require.NoError(t, tx.PutSession(&domain.Session{ID: "f", Email: "john-cs@durianpay.id", IP: "10.0.0.1", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}))
+		require.NoError(t, tx.PutSession(&domain.Session{ID: "g", Email: "john-cs@durianpay.id", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(-time.Hour)}))
+		require.NoError(t, tx.PutSession(&domain.Session{ID: "h", Email: "john-cs@durianpay.id", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}))
+		require.NoError(t, tx.PutPasswordReset(&domain.PasswordReset{Email: "john-cs@durianpay.id", Hash: "reset-hash", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+		require.NoError(t, tx.PutPasswordReset(&domain.PasswordReset{Email: "admin@durianpay.id", Hash: "stale", CreatedAt: now, ExpiresAt: now.Add(-time.Hour)}))
+		return tx.RevokeToken(&domain.RevokedToken{JTI: "expired", ExpiresAt: now.Add(-time.Hour)})
+	}))
+	require.NoError(t, store.PurgeExpiredTokens(now))
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.DeleteSession("h"))
+		return tx.RevokeRefreshTokens("f")
+	}))
+	crash(t, store)
+
+	check := func(store *MemoryStore) {
+		require.True(t, store.IsTokenRevoked("revoked"))
+		require.False(t, store.IsTokenRevoked("expired"))
+		require.NoError(t, store.Update(func(tx domain.Tx) error {
+			live, exists := tx.GetRefreshToken("live")
+			require.True(t, exists)
+			require.True(t, live.Revoked)
+			_, exists = tx.GetRefreshToken("stale")
+			require.False(t, exists)
+			attempts, exists := tx.GetLoginAttempts("account:a")
+			require.True(t, exists)
+			require.Equal(t, 4, attempts.Failures)
+			reset, exists := tx.GetPasswordReset("john-cs@durianpay.id")
+			require.True(t, exists)
+			require.Equal(t, "reset-hash", reset.Hash)
+			_, exists = tx.GetPasswordReset("admin@durianpay.id")
+			require.False(t, exists)
+			return nil
+		}))
+		_, exists := store.GetServiceAccount("recon")
+		require.True(t, exists)
+		key, exists := store.GetAPIKey("key")
+		require.True(t, exists)
+		require.Equal(t, "secret-hash", key.Hash)
+		require.Equal(t, []string{"payments:read"}, key.Scopes)
+		sessions := store.ListSessions("john-cs@durianpay.id")
+		require.Len(t, sessions, 1)
+		require.Equal(t, "f", sessions[0].ID)
+		require.Equal(t, "10.0.0.1", sessions[0].IP)
+	}
+
+	// replayed from the log
+	store = openDurable(t, dir, 1000)
+	check(store)
+	require.NoError(t, store.Close())
+
+	// and from the snapshot Close wrote
+	store = openDurable(t, dir, 1000)
+	defer store.Close()
+	check(store)
+}
+
+func TestDurableMemoryStore_PersistsPaymentEvents(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	store := openDurable(t, dir, 1000)
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p1", Status: "processing"}))
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.AddPaymentEvent(&domain.PaymentEvent{ID: "e1", PaymentID: "p1", Type: domain.PaymentEventCreated, At: now}))
+		return tx.AddPaymentEvent(&domain.PaymentEvent{ID: "e2", PaymentID: "p1", Type: domain.PaymentEventNote, Actor: "john-cs@durianpay.id", At: now, Note: "called"})
+	}))
+	crash(t, store)
+
+	// replayed from the log
+	store = openDurable(t, dir, 1000)
+	events := store.ListPaymentEvents("p1")
+	require.Len(t, events, 2)
+	require.Equal(t, "called", events[1].Note)
+	logged, err := os.ReadFile(filepath.Join(dir, walFileName))
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// a crash between writing the snapshot and truncating the log replays
+	// the log on top of the snapshot, the events are not added twice
+	require.NoError(t, os.WriteFile(filepath.Join(dir, walFileName), logged, 0o644))
+	store = openDurable(t, dir, 1000)
+	defer store.Close()
+	events = store.ListPaymentEvents("p1")
+	require.Len(t, events, 2)
+	require.Equal(t, []string{"e1", "e2"}, []string{events[0].ID, events[1].ID})
+}
+
+func TestDurableMemoryStore_PersistsRefunds(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	store := openDurable(t, dir, 1000)
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p1", Amount: 100, Status: "completed"}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p2", Amount: 100, Status: "completed"}))
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		require.NoError(t, tx.PutRefund(&domain.Refund{ID: "r1", PaymentID: "p1", Amount: 25, Status: domain.RefundStatusRequested, RequestedBy: "john-cs@durianpay.id", CreatedAt: now, UpdatedAt: now}))
+		return tx.PutRefund(&domain.Refund{ID: "r2", PaymentID: "p2", Amount: 100, Status: domain.RefundStatusRequested, CreatedAt: now, UpdatedAt: now})
+	}))
+	require.NoError(t, store.Update(func(tx domain.Tx) error {
+		refund, _ := tx.GetRefund("r1")
+		refund.Status, refund.DecidedBy, refund.DecidedAt = domain.RefundStatusApproved, "jane-operational@durianpay.id", &now
+		return tx.PutRefund(refund)
+	}))
+	require.NoError(t, store.DeletePayment("p2"))
+	crash(t, store)
+
+	// replayed from the log
+	store = openDurable(t, dir, 1000)
+	refunds := store.ListRefunds("p1")
+	require.Len(t, refunds, 1)
+	require.Equal(t, domain.RefundStatusApproved, refunds[0].Status)
+	require.Equal(t, "jane-operational@durianpay.id", refunds[0].DecidedBy)
+	require.Empty(t, store.ListRefunds("p2"))
+	require.NoError(t, store.Close())
+
+	// and from the snapshot
+	store = openDurable(t, dir, 1000)
+	defer store.Close()
+	refunds = store.ListRefunds("p1")
+	require.Len(t, refunds, 1)
+	require.Equal(t, 25.0, refunds[0].Amount)
+	require.True(t, now.Equal(*refunds[0].DecidedAt))
+}
+
+func TestDurableMemoryStore_CorruptMiddleEntry(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openDurable(t, dir, 1000)
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p1", Status: "processing"}))
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p2", Status: "processing"}))
+	crash(t, store)
+
+	logPath := filepath.Join(dir, walFileName)
+	raw, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	raw[12] ^= 0xff // flip a byte inside the first entry
+	require.NoError(t, os.WriteFile(logPath, raw, 0o644))
+
+	_, err = OpenMemoryStore(DurabilityOptions{Dir: dir})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "corrupt log entry at offset 0: checksum mismatch")
+}
+
+// tornFile fails the next write after writing half of it
+type tornFile struct {
+	*os.File
+	tear bool
+}
+
+func (file *tornFile) Write(p []byte) (int, error) {
+	if !file.tear {
+		return file.File.Write(p)
+	}
+	file.tear = false
+	n, _ := file.File.Write(p[:len(p)/2])
+	return n, errors.New("disk full")
+}
+
+func TestDurableMemoryStore_FailedAppendIsCutOff(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openDurable(t, dir, 1000)
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p1", Status: "processing"}))
+	file := &tornFile{File: store.wal.file.(*os.File), tear: true}
+	store.wal.file = file
+	require.ErrorContains(t, store.CreatePayment(&domain.Payment{ID: "p2", Status: "processing"}), "disk full")
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p3", Status: "processing"}))
+	crash(t, store)
+
+	// the torn line is gone, so the entry after it still loads
+	store = openDurable(t, dir, 1000)
+	defer store.Close()
+	_, ok := store.GetPaymentById("p2")
+	require.False(t, ok)
+	_, ok = store.GetPaymentById("p3")
+	require.True(t, ok)
+}
+
+func TestDurableMemoryStore_PeriodicSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := OpenMemoryStore(DurabilityOptions{Dir: dir, SnapshotInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.CreatePayment(&domain.Payment{ID: "p1", Status: "processing"}))
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, snapshotFileName))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryStore_NotDurableByDefault(t *testing.T) {
+	store := NewMemoryStore()
+	require.NoError(t, store.Snapshot())
+	require.NoError(t, store.Close())
+}
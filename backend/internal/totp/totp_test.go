@@ -0,0 +1,96 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rfcSecret is the SHA-1 seed of the RFC 6238 test vectors
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+
+	for _, tt := range tests {
+		code, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		require.NoError(t, err)
+		require.Equal(t, tt.want, code, "time %d", tt.unix)
+	}
+
+	_, err := Code("not base32!", 1)
+	require.Error(t, err)
+	_, err = Code("", 1)
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	code := func(step int64) string {
+		code, err := Code(rfcSecret, step)
+		require.NoError(t, err)
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current step", code: code(current), wantStep: current, wantOK: true},
+		{name: "previous step", code: code(current - 1), wantStep: current - 1, wantOK: true},
+		{name: "next step", code: code(current + 1), wantStep: current + 1, wantOK: true},
+		{name: "with spaces", code: "050 471", wantStep: current, wantOK: true},
+		{name: "too old", code: code(current - 2)},
+		{name: "too new", code: code(current + 2)},
+		{name: "already used", code: code(current), lastStep: current},
+		{name: "older than the last used", code: code(current - 1), lastStep: current},
+		{name: "wrong code", code: "000000"},
+		{name: "wrong length", code: "05047"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, tt.code, now, tt.lastStep)
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.wantStep, step)
+		})
+	}
+}
+
+func TestGenerateSecretAndURI(t *testing.T) {
+	secret, err := GenerateSecret()
+	require.NoError(t, err)
+	require.Len(t, secret, 32)
+
+	other, err := GenerateSecret()
+	require.NoError(t, err)
+	require.NotEqual(t, secret, other)
+
+	uri, err := url.Parse(URI(secret, "CS Center", "john-cs@durianpay.id"))
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", uri.Scheme)
+	require.Equal(t, "totp", uri.Host)
+	require.Equal(t, "/CS Center:john-cs@durianpay.id", uri.Path)
+	require.Equal(t, secret, uri.Query().Get("secret"))
+	require.Equal(t, "CS Center", uri.Query().Get("issuer"))
+	require.Equal(t, "6", uri.Query().Get("digits"))
+	require.Equal(t, "30", uri.Query().Get("period"))
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,3 +20,17 @@ func QueryInt(ctx *gin.Context, key string, defaultVal int) int {
 	}
 	return i
 }
+
+// QueryBool returns nil when the key is absent so callers can tell "not filtered" from false
+func QueryBool(ctx *gin.Context, key string) (*bool, error) {
+	value := ctx.Query(key)
+	if value == "" {
+		return nil, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
@@ -81,3 +81,38 @@ func TestQueryInt(t *testing.T) {
 		})
 	}
 }
+
+func TestQueryBool(t *testing.T) {
+	tests := []struct {
+		name      string
+		rawQuery  string
+		want      *bool
+		wantError bool
+	}{
+		{name: "missing parameter", rawQuery: ""},
+		{name: "true", rawQuery: "reviewed=true", want: boolPtr(true)},
+		{name: "false", rawQuery: "reviewed=false", want: boolPtr(false)},
+		{name: "invalid value", rawQuery: "reviewed=maybe", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/?"+tt.rawQuery, nil)
+
+			got, err := QueryBool(c, "reviewed")
+			if tt.wantError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -2,10 +2,93 @@ import api from "./axiosClient";
 
 export interface LoginResponse{
     token: string;
+    refresh_token: string;
+    expires_in: number;
     role: "cs" | "operation";
 }
 
-export async function Login(email:string, password: string): Promise<LoginResponse> {
+// users with MFA enabled get a challenge instead of tokens
+export interface MFAChallengeResponse{
+    mfa_required: true;
+    mfa_token: string;
+    expires_in: number;
+}
+
+// users an admin asked to change their password get a challenge instead of tokens
+export interface PasswordChangeResponse{
+    password_change_required: true;
+    password_change_token: string;
+    expires_in: number;
+}
+
+export async function Login(email:string, password: string): Promise<LoginResponse | MFAChallengeResponse | PasswordChangeResponse> {
     const {data} = await api.post("/auth/login", {email, password})
     return data
-}
\ No newline at end of file
+}
+
+export async function VerifyMFA(mfaToken: string, code: string): Promise<LoginResponse | PasswordChangeResponse> {
+    const {data} = await api.post("/auth/mfa/verify", {mfa_token: mfaToken, code})
+    return data
+}
+
+export async function ChangePassword(passwordChangeToken: string, newPassword: string): Promise<LoginResponse> {
+    const {data} = await api.post("/auth/password/change", {password_change_token: passwordChangeToken, new_password: newPassword})
+    return data
+}
+
+// the answer is the same whether the account exists or not
+export async function ForgotPassword(email: string): Promise<void> {
+    await api.post("/auth/password/forgot", {email})
+}
+
+export async function ResetPassword(email: string, token: string, newPassword: string): Promise<void> {
+    await api.post("/auth/password/reset", {email, token, new_password: newPassword})
+}
+
+// the tokens are passed in because local storage is cleared while the request is in flight
+export async function Logout(token: string, refreshToken: string | null): Promise<void> {
+    await api.post("/auth/logout", refreshToken ? {refresh_token: refreshToken} : undefined, {
+        headers: {Authorization: `Bearer ${token}`}
+    })
+}
+
+export interface CurrentUser{
+    email: string;
+    role: string;
+    // the permissions this token can use, and those that need an MFA login first
+    permissions: string[];
+    mfa_required: string[];
+    mfa_enabled: boolean;
+    amr: string[];
+    session_id?: string;
+    expires_at?: string;
+}
+
+export interface Session{
+    id: string;
+    user_agent: string;
+    ip: string;
+    created_at: string;
+    last_seen_at: string;
+    expires_at: string;
+    current: boolean;
+}
+
+export async function Me(): Promise<CurrentUser> {
+    const {data} = await api.get("/auth/me")
+    return data
+}
+
+export async function ListSessions(): Promise<Session[]> {
+    const {data} = await api.get("/auth/sessions")
+    return data
+}
+
+export async function TerminateSession(id: string): Promise<void> {
+    await api.delete(`/auth/sessions/${encodeURIComponent(id)}`)
+}
+
+// ends every session but the current one
+export async function TerminateOtherSessions(): Promise<void> {
+    await api.delete("/auth/sessions")
+}
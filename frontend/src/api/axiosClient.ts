@@ -1,4 +1,4 @@
-import axios from "axios"
+import axios, { type InternalAxiosRequestConfig } from "axios"
 
 const api = axios.create({
     baseURL: import.meta.env.VITE_API_BASE_URL
@@ -12,4 +12,41 @@ api.interceptors.request.use((config) => {
     return config
 })
 
-export default api
\ No newline at end of file
+// one refresh at a time, concurrent 401s wait for the same one
+let refreshing: Promise<string | null> | null = null
+
+async function refreshAccessToken(): Promise<string | null> {
+    const refreshToken = localStorage.getItem("refresh_token")
+    if(!refreshToken){
+        return null
+    }
+
+    try {
+        const {data} = await axios.post(`${import.meta.env.VITE_API_BASE_URL}/auth/refresh`, {refresh_token: refreshToken})
+        localStorage.setItem("token", data.token)
+        localStorage.setItem("refresh_token", data.refresh_token)
+        return data.token
+    } catch {
+        localStorage.clear()
+        return null
+    }
+}
+
+api.interceptors.response.use(undefined, async (error) => {
+    const config = error.config as (InternalAxiosRequestConfig & { _retried?: boolean }) | undefined
+    if(error.response?.status !== 401 || !config || config._retried || config.url?.startsWith("/auth/")){
+        return Promise.reject(error)
+    }
+
+    refreshing ??= refreshAccessToken().finally(() => { refreshing = null })
+    const token = await refreshing
+    if(!token){
+        return Promise.reject(error)
+    }
+
+    config._retried = true
+    config.headers.Authorization = `Bearer ${token}`
+    return api(config)
+})
+
+export default api
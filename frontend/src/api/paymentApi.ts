@@ -1,11 +1,42 @@
 import api from "./axiosClient";
-import type { PaymentResponse } from "@/type/payment";
+import type { Payment, PaymentDetail, PaymentEvent, PaymentResponse, PaymentStatus, Refund, RefundStatus, ReviewOutcome } from "@/type/payment";
 
 export async function getPayments(params: Record<string, string | number | boolean> ): Promise<PaymentResponse> {
     const{data} = await api.get("/payments",{params});
     return data;
 }
 
-export async function reviewPayment(id:string): Promise<void> {
-    await api.put(`/payments/${id}/review`);
-}
\ No newline at end of file
+export async function getPayment(id: string): Promise<PaymentDetail> {
+    const {data} = await api.get(`/payments/${encodeURIComponent(id)}`);
+    return data;
+}
+
+export async function reviewPayment(id:string, review?: {outcome: ReviewOutcome; reason?: string; note?: string}): Promise<Payment> {
+    const {data} = await api.put(`/payments/${encodeURIComponent(id)}/review`, review);
+    return data;
+}
+
+export async function revertPaymentReview(id: string, note: string): Promise<Payment> {
+    const {data} = await api.post(`/payments/${encodeURIComponent(id)}/review/revert`, {note});
+    return data;
+}
+
+export async function addPaymentNote(id: string, note: string): Promise<PaymentEvent> {
+    const {data} = await api.post(`/payments/${encodeURIComponent(id)}/notes`, {note});
+    return data;
+}
+
+export async function changePaymentStatus(id: string, status: PaymentStatus, reason: string, note: string): Promise<Payment> {
+    const {data} = await api.put(`/payments/${encodeURIComponent(id)}/status`, {status, reason, note});
+    return data;
+}
+
+export async function requestRefund(id: string, amount: number, reason: string, note: string): Promise<Refund> {
+    const {data} = await api.post(`/payments/${encodeURIComponent(id)}/refunds`, {amount, reason, note});
+    return data;
+}
+
+export async function updateRefund(id: string, refundId: string, status: RefundStatus, note: string): Promise<Refund> {
+    const {data} = await api.put(`/payments/${encodeURIComponent(id)}/refunds/${encodeURIComponent(refundId)}/status`, {status, note});
+    return data;
+}
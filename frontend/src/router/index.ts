@@ -2,6 +2,9 @@ import { createRouter, createWebHistory } from 'vue-router'
 import DashboardPage from '@/pages/DashboardPage.vue'
 import { useAuthStore } from '@/stores/auth'
 import LoginPage from '@/pages/LoginPage.vue'
+import SSOCallbackPage from '@/pages/SSOCallbackPage.vue'
+import ResetPasswordPage from '@/pages/ResetPasswordPage.vue'
+import PaymentDetailPage from '@/pages/PaymentDetailPage.vue'
 
 const router = createRouter({
   history: createWebHistory(),
@@ -14,11 +17,24 @@ const router = createRouter({
       path:"/login",
       component: LoginPage
     },
+    {
+      path: "/sso",
+      component: SSOCallbackPage
+    },
+    {
+      path: "/reset-password",
+      component: ResetPasswordPage
+    },
     {
       path: '/dashboard',
       component: DashboardPage,
       meta: {requiresAuth: true},
     },
+    {
+      path: '/payments/:id',
+      component: PaymentDetailPage,
+      meta: {requiresAuth: true},
+    },
   ],
 })
 
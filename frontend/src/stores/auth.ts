@@ -1,10 +1,16 @@
 import { defineStore } from "pinia";
-import { Login } from "@/api/authApi";
+import { ChangePassword, Login, Logout, Me, VerifyMFA, type LoginResponse, type PasswordChangeResponse } from "@/api/authApi";
 
 interface AuthState{
     token: string | null;
     role: string | null;
     email: string | null;
+    // loaded from /auth/me, empty until then
+    permissions: string[];
+    // pending second login step, kept in memory only
+    mfaToken: string | null;
+    // pending password change an admin asked for, kept in memory only
+    passwordChangeToken: string | null;
 }
 
 export const useAuthStore = defineStore("auth",{
@@ -12,21 +18,75 @@ export const useAuthStore = defineStore("auth",{
         token: localStorage.getItem("token"),
         role: localStorage.getItem("role"),
         email: localStorage.getItem("email"),
+        permissions: [],
+        mfaToken: null,
+        passwordChangeToken: null,
     }),
     actions: {
-        async login(email: string, password: string){
+        // login resolves to true when another step is needed, a TOTP code
+        // (see verifyMFA) or a new password (see changePassword)
+        async login(email: string, password: string): Promise<boolean> {
             const response = await Login(email, password);
+            this.email = email;
+            if ("mfa_required" in response) {
+                this.mfaToken = response.mfa_token;
+                return true;
+            }
+            return this.completeLogin(response, email);
+        },
+        async verifyMFA(code: string): Promise<boolean> {
+            if(!this.mfaToken || !this.email){
+                throw new Error("Login again");
+            }
+            const response = await VerifyMFA(this.mfaToken, code);
+            this.mfaToken = null;
+            return this.completeLogin(response, this.email);
+        },
+        async changePassword(newPassword: string){
+            if(!this.passwordChangeToken || !this.email){
+                throw new Error("Login again");
+            }
+            const response = await ChangePassword(this.passwordChangeToken, newPassword);
+            this.passwordChangeToken = null;
+            this.startSession(response, this.email);
+        },
+        completeLogin(response: LoginResponse | PasswordChangeResponse, email: string): boolean {
+            if ("password_change_required" in response) {
+                this.passwordChangeToken = response.password_change_token;
+                return true;
+            }
+            this.startSession(response, email);
+            return false;
+        },
+        startSession(response: LoginResponse, email: string){
             this.token = response.token;
             this.role = response.role;
             this.email = email;
             localStorage.setItem("token", response.token);
+            localStorage.setItem("refresh_token", response.refresh_token);
             localStorage.setItem("role", response.role);
             localStorage.setItem("email", email);
         },
+        // loadCurrentUser picks up role changes made since the login
+        async loadCurrentUser(){
+            const me = await Me();
+            this.role = me.role;
+            this.email = me.email;
+            this.permissions = me.permissions;
+            localStorage.setItem("role", me.role);
+            localStorage.setItem("email", me.email);
+        },
         logout() {
+            // revoke the session server side, the local state goes either way
+            if(this.token){
+                Logout(this.token, localStorage.getItem("refresh_token")).catch(() => {});
+            }
             this.token=null;
             this.role=null;
             this.email=null;
+            this.permissions=[];
+            this.mfaToken=null;
+            this.passwordChangeToken=null;
             localStorage.clear();
         }
     }
@@ -1,10 +1,23 @@
+export type PaymentStatus = "completed" | "processing" | "failed" | "refunded" | "partially_refunded" | "disputed";
+
 export interface Payment{
     id: string;
     merchant_name: string;
     date: string;
     amount:number;
-    status: "completed" | "processing" | "failed";
+    status: PaymentStatus;
     reviewed: boolean;
+    review?: PaymentReview;
+}
+
+export type ReviewOutcome = "approved" | "flagged" | "needs_follow_up";
+
+export interface PaymentReview{
+    reviewer: string;
+    at: string;
+    outcome: ReviewOutcome;
+    reason?: string;
+    note?: string;
 }
 
 export interface PaymentMeta{
@@ -25,4 +38,50 @@ export interface PaymentSummary{
 export interface PaymentResponse{
     meta: PaymentMeta;
     summary: PaymentSummary;
-}
\ No newline at end of file
+}
+
+export interface PaymentEvent{
+    id: string;
+    payment_id: string;
+    type: "created" | "status_changed" | "reviewed" | "review_reverted" | "refund" | "note";
+    actor?: string;
+    at: string;
+    from?: string;
+    to?: string;
+    outcome?: ReviewOutcome;
+    reason?: string;
+    note?: string;
+    refund_id?: string;
+    amount?: number;
+}
+
+export interface PaymentTransition{
+    from: PaymentStatus;
+    to: PaymentStatus;
+    reasons: string[];
+}
+
+export interface PaymentDetail{
+    payment: Payment;
+    timeline: PaymentEvent[];
+    transitions: PaymentTransition[];
+    review_reasons: Record<ReviewOutcome, string[]>;
+    refunds: Refund[];
+    refund_reasons: string[];
+}
+
+export type RefundStatus = "requested" | "approved" | "rejected" | "processed" | "failed";
+
+export interface Refund{
+    id: string;
+    payment_id: string;
+    amount: number;
+    status: RefundStatus;
+    reason: string;
+    note?: string;
+    requested_by: string;
+    created_at: string;
+    decided_by?: string;
+    decided_at?: string;
+    updated_at: string;
+}